@@ -3,29 +3,90 @@ package crypt
 import (
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/hkdf"
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
 	"os"
+	"strings"
 )
 
-func EncryptHandshake(plaintext string) (string, error) {
-	base64Key := os.Getenv("HANDSHAKE_SECRET")
+// SecretFromEnv возвращает ключ handshake в base64. Файл из
+// HANDSHAKE_SECRET_FILE имеет приоритет над HANDSHAKE_SECRET; пробелы и
+// переводы строк по краям содержимого файла отбрасываются.
+func SecretFromEnv() (string, error) {
+	path := os.Getenv("HANDSHAKE_SECRET_FILE")
+	if path == "" {
+		return os.Getenv("HANDSHAKE_SECRET"), nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("чтение HANDSHAKE_SECRET_FILE: %w", err)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// FallbacksFromEnv возвращает запасные ключи handshake из
+// HANDSHAKE_SECRET_FALLBACKS (через запятую). Они нужны при смене ключа:
+// сервер, ещё не получивший новый ключ, принимает один из старых.
+func FallbacksFromEnv() []string {
+	var keys []string
+	for _, k := range strings.Split(os.Getenv("HANDSHAKE_SECRET_FALLBACKS"), ",") {
+		if k = strings.TrimSpace(k); k != "" {
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
+
+// ValidateKey проверяет, что base64Key — ключ AES-256 в base64
+func ValidateKey(base64Key string) error {
+	_, err := handshakeGCM(base64Key)
+	return err
+}
+
+// Параметры шифрования с производным ключом
+const (
+	hkdfSaltSize = 32
+	hkdfInfo     = "usbmuxd-client handshake"
+)
+
+// handshakeGCM создаёт AES-GCM на ключе base64Key (32 байта в base64)
+func handshakeGCM(base64Key string) (cipher.AEAD, error) {
+	key, err := decodeKey(base64Key)
+	if err != nil {
+		return nil, err
+	}
+	return newGCM(key)
+}
+
+// decodeKey декодирует ключ AES-256 из base64
+func decodeKey(base64Key string) ([]byte, error) {
 	key, err := base64.StdEncoding.DecodeString(base64Key)
 	if err != nil {
-		return "", fmt.Errorf("не удалось декодировать ключ из base64: %w", err)
+		return nil, fmt.Errorf("не удалось декодировать ключ из base64: %w", err)
 	}
 	if len(key) != 32 {
-		return "", fmt.Errorf("ключ должен быть 32 байта")
+		return nil, fmt.Errorf("ключ должен быть 32 байта")
 	}
+	return key, nil
+}
 
+// newGCM создаёт AES-GCM на 32-байтовом ключе
+func newGCM(key []byte) (cipher.AEAD, error) {
 	block, err := aes.NewCipher(key)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
+	return cipher.NewGCM(block)
+}
 
-	aesgcm, err := cipher.NewGCM(block)
+// EncryptHandshake шифрует handshake ключом base64Key
+func EncryptHandshake(base64Key, plaintext string) (string, error) {
+	aesgcm, err := handshakeGCM(base64Key)
 	if err != nil {
 		return "", err
 	}
@@ -38,3 +99,95 @@ func EncryptHandshake(plaintext string) (string, error) {
 	ciphertext := aesgcm.Seal(nonce, nonce, []byte(plaintext), nil)
 	return base64.StdEncoding.EncodeToString(ciphertext), nil
 }
+
+// DecryptHandshake расшифровывает результат EncryptHandshake
+func DecryptHandshake(base64Key, ciphertext string) (string, error) {
+	aesgcm, err := handshakeGCM(base64Key)
+	if err != nil {
+		return "", err
+	}
+
+	data, err := base64.StdEncoding.DecodeString(ciphertext)
+	if err != nil {
+		return "", fmt.Errorf("не удалось декодировать шифротекст из base64: %w", err)
+	}
+	if len(data) < aesgcm.NonceSize() {
+		return "", errors.New("шифротекст короче nonce")
+	}
+
+	nonce, sealed := data[:aesgcm.NonceSize()], data[aesgcm.NonceSize():]
+	plaintext, err := aesgcm.Open(nil, nonce, sealed, nil)
+	if err != nil {
+		return "", fmt.Errorf("ошибка аутентификации шифротекста: %w", err)
+	}
+	return string(plaintext), nil
+}
+
+// derivedGCM создаёт AES-GCM на ключе, выведенном через HKDF-SHA256 из
+// главного ключа base64Key и соли salt
+func derivedGCM(base64Key string, salt []byte) (cipher.AEAD, error) {
+	master, err := decodeKey(base64Key)
+	if err != nil {
+		return nil, err
+	}
+	key, err := hkdf.Key(sha256.New, master, salt, hkdfInfo, 32)
+	if err != nil {
+		return nil, err
+	}
+	return newGCM(key)
+}
+
+// EncryptHandshakeHKDF шифрует handshake ключом, выведенным из base64Key
+// через HKDF-SHA256 со случайной солью: каждое сообщение шифруется своим
+// ключом, поэтому повтор nonce не раскрывает данные. Результат в base64:
+//
+//	соль (32 байта) || nonce (12 байт) || шифротекст с тегом
+func EncryptHandshakeHKDF(base64Key, plaintext string) (string, error) {
+	salt := make([]byte, hkdfSaltSize)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return "", err
+	}
+	aesgcm, err := derivedGCM(base64Key, salt)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, aesgcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+
+	out := append(salt, nonce...)
+	out = aesgcm.Seal(out, nonce, []byte(plaintext), nil)
+	return base64.StdEncoding.EncodeToString(out), nil
+}
+
+// DecryptHandshakeHKDF расшифровывает результат EncryptHandshakeHKDF
+func DecryptHandshakeHKDF(base64Key, ciphertext string) (string, error) {
+	if _, err := decodeKey(base64Key); err != nil {
+		return "", err
+	}
+	data, err := base64.StdEncoding.DecodeString(ciphertext)
+	if err != nil {
+		return "", fmt.Errorf("не удалось декодировать шифротекст из base64: %w", err)
+	}
+	if len(data) < hkdfSaltSize {
+		return "", errors.New("шифротекст короче соли")
+	}
+
+	salt, rest := data[:hkdfSaltSize], data[hkdfSaltSize:]
+	aesgcm, err := derivedGCM(base64Key, salt)
+	if err != nil {
+		return "", err
+	}
+	if len(rest) < aesgcm.NonceSize() {
+		return "", errors.New("шифротекст короче nonce")
+	}
+
+	nonce, sealed := rest[:aesgcm.NonceSize()], rest[aesgcm.NonceSize():]
+	plaintext, err := aesgcm.Open(nil, nonce, sealed, nil)
+	if err != nil {
+		return "", fmt.Errorf("ошибка аутентификации шифротекста: %w", err)
+	}
+	return string(plaintext), nil
+}
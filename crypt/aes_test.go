@@ -0,0 +1,147 @@
+package crypt
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const testPlaintext = "00008030001454190EEB802E usbmux"
+
+// newKey возвращает случайный ключ AES-256 в base64
+func newKey(t *testing.T) string {
+	t.Helper()
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	return base64.StdEncoding.EncodeToString(key)
+}
+
+func TestDecryptHandshakeRoundTrip(t *testing.T) {
+	key := newKey(t)
+	ciphertext, err := EncryptHandshake(key, testPlaintext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := DecryptHandshake(key, ciphertext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != testPlaintext {
+		t.Errorf("расшифровано %q, ожидалось %q", got, testPlaintext)
+	}
+}
+
+func TestDecryptHandshakeErrors(t *testing.T) {
+	key := newKey(t)
+	ciphertext, err := EncryptHandshake(key, testPlaintext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name, key, ciphertext string
+	}{
+		{"не base64", key, "не base64!"},
+		{"короче nonce", key, base64.StdEncoding.EncodeToString([]byte("short"))},
+		{"чужой ключ", newKey(t), ciphertext},
+		{"ключ не 32 байта", base64.StdEncoding.EncodeToString([]byte("short")), ciphertext},
+	}
+	for _, tt := range tests {
+		if _, err := DecryptHandshake(tt.key, tt.ciphertext); err == nil {
+			t.Errorf("%s: ошибки нет", tt.name)
+		}
+	}
+}
+
+func TestSecretFromFile(t *testing.T) {
+	key := newKey(t)
+	path := filepath.Join(t.TempDir(), "secret")
+	if err := os.WriteFile(path, []byte(key+"\n\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("HANDSHAKE_SECRET_FILE", path)
+	t.Setenv("HANDSHAKE_SECRET", newKey(t))
+
+	secret, err := SecretFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if secret != key {
+		t.Fatal("ключ взят не из HANDSHAKE_SECRET_FILE")
+	}
+	ciphertext, err := EncryptHandshake(secret, testPlaintext)
+	if err != nil {
+		t.Fatalf("шифрование ключом из файла: %v", err)
+	}
+	if got, err := DecryptHandshake(key, ciphertext); err != nil || got != testPlaintext {
+		t.Errorf("расшифровано %q, %v", got, err)
+	}
+}
+
+func TestSecretFromFileErrors(t *testing.T) {
+	t.Setenv("HANDSHAKE_SECRET_FILE", filepath.Join(t.TempDir(), "missing"))
+	if _, err := SecretFromEnv(); err == nil {
+		t.Error("отсутствующий файл ключа принят")
+	}
+
+	path := filepath.Join(t.TempDir(), "secret")
+	if err := os.WriteFile(path, []byte(base64.StdEncoding.EncodeToString([]byte("short"))), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("HANDSHAKE_SECRET_FILE", path)
+	secret, err := SecretFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := EncryptHandshake(secret, testPlaintext); err == nil {
+		t.Error("ключ короче 32 байт принят")
+	}
+}
+
+func TestHKDFRoundTrip(t *testing.T) {
+	key := newKey(t)
+	ciphertext, err := EncryptHandshakeHKDF(key, testPlaintext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := DecryptHandshakeHKDF(key, ciphertext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != testPlaintext {
+		t.Errorf("расшифровано %q, ожидалось %q", got, testPlaintext)
+	}
+
+	if _, err := DecryptHandshakeHKDF(newKey(t), ciphertext); err == nil {
+		t.Error("шифротекст расшифрован чужим ключом")
+	}
+	// Производный ключ не совпадает с основным
+	if _, err := DecryptHandshake(key, ciphertext); err == nil {
+		t.Error("шифротекст HKDF расшифрован основным ключом")
+	}
+}
+
+func TestHKDFDifferentSalts(t *testing.T) {
+	key := newKey(t)
+	salts := map[string]bool{}
+	for range 2 {
+		ciphertext, err := EncryptHandshakeHKDF(key, testPlaintext)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := base64.StdEncoding.DecodeString(ciphertext)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(data) < hkdfSaltSize {
+			t.Fatalf("шифротекст %d байт короче соли", len(data))
+		}
+		salts[string(data[:hkdfSaltSize])] = true
+	}
+	if len(salts) != 2 {
+		t.Error("два шифрования одного текста получили одинаковую соль")
+	}
+}
@@ -0,0 +1,29 @@
+package crypt
+
+// HandshakeCipher шифрует handshake перед отправкой серверу и расшифровывает
+// его на стороне сервера
+type HandshakeCipher interface {
+	Encrypt(plaintext string) (string, error)
+	Decrypt(ciphertext string) (string, error)
+}
+
+// AESGCM — HandshakeCipher на AES-256-GCM; формат совпадает с EncryptHandshake
+type AESGCM struct {
+	key string
+}
+
+// NewAESGCM создаёт шифр на ключе base64Key (32 байта в base64)
+func NewAESGCM(base64Key string) (*AESGCM, error) {
+	if err := ValidateKey(base64Key); err != nil {
+		return nil, err
+	}
+	return &AESGCM{key: base64Key}, nil
+}
+
+func (a *AESGCM) Encrypt(plaintext string) (string, error) {
+	return EncryptHandshake(a.key, plaintext)
+}
+
+func (a *AESGCM) Decrypt(ciphertext string) (string, error) {
+	return DecryptHandshake(a.key, ciphertext)
+}
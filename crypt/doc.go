@@ -0,0 +1,15 @@
+// Package crypt шифрует handshake клиента ключом AES-256 и расшифровывает
+// его; серверу достаточно того же пакета и того же ключа.
+//
+// Ключ — 32 байта в стандартном base64 (HANDSHAKE_SECRET). Шифротекст —
+// одна строка в стандартном base64 с дополнением, без перевода строки:
+//
+//	EncryptHandshake:     nonce (12 байт) || шифротекст || тег (16 байт)
+//	EncryptHandshakeHKDF: соль (32 байта) || nonce (12 байт) || шифротекст || тег (16 байт)
+//
+// Keyring добавляет перед base64 идентификатор ключа: "<id>:<base64>".
+//
+// В сети handshake передаётся строкой, завершённой "\n". Сервер может
+// ответить подтверждением в открытом виде или зашифровав его тем же
+// способом: клиент принимает оба варианта.
+package crypt
@@ -0,0 +1,114 @@
+package crypt
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Keyring — набор ключей handshake с идентификаторами. Шифротекст
+// предваряется идентификатором ключа: "<id>:<base64>", так что сервер
+// с несколькими ключами сразу знает, каким расшифровывать. При смене ключа
+// новый добавляется в начало набора, а старые остаются, пока ими пользуются
+// клиенты, ещё не получившие новый.
+type Keyring struct {
+	ids  []string          // в порядке объявления; первый — текущий
+	keys map[string]string // id → ключ в base64
+}
+
+// ParseKeyring разбирает набор ключей вида "id=ключ", разделённых запятыми
+// или переводами строк. Пустые строки и строки, начинающиеся с '#',
+// пропускаются. Первый ключ используется для шифрования.
+func ParseKeyring(s string) (*Keyring, error) {
+	kr := &Keyring{keys: map[string]string{}}
+	for _, line := range strings.FieldsFunc(s, func(r rune) bool { return r == ',' || r == '\n' }) {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		id, key, ok := strings.Cut(line, "=")
+		id, key = strings.TrimSpace(id), strings.TrimSpace(key)
+		if !ok || id == "" {
+			return nil, fmt.Errorf("ожидается id=ключ, получено %q", line)
+		}
+		if strings.ContainsAny(id, ": \t") {
+			return nil, fmt.Errorf("идентификатор ключа %q не может содержать ':' и пробелы", id)
+		}
+		if _, dup := kr.keys[id]; dup {
+			return nil, fmt.Errorf("ключ %q объявлен дважды", id)
+		}
+		if err := ValidateKey(key); err != nil {
+			return nil, fmt.Errorf("ключ %q: %w", id, err)
+		}
+		kr.ids = append(kr.ids, id)
+		kr.keys[id] = key
+	}
+	if len(kr.ids) == 0 {
+		return nil, errors.New("набор ключей пуст")
+	}
+	return kr, nil
+}
+
+// KeyringFromEnv загружает набор ключей из файла HANDSHAKE_KEYRING_FILE
+// или из HANDSHAKE_KEYRING; файл имеет приоритет. Если не задано ни то,
+// ни другое, возвращает nil.
+func KeyringFromEnv() (*Keyring, error) {
+	if path := os.Getenv("HANDSHAKE_KEYRING_FILE"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("чтение HANDSHAKE_KEYRING_FILE: %w", err)
+		}
+		kr, err := ParseKeyring(string(data))
+		if err != nil {
+			return nil, fmt.Errorf("HANDSHAKE_KEYRING_FILE: %w", err)
+		}
+		return kr, nil
+	}
+	raw := os.Getenv("HANDSHAKE_KEYRING")
+	if raw == "" {
+		return nil, nil
+	}
+	kr, err := ParseKeyring(raw)
+	if err != nil {
+		return nil, fmt.Errorf("HANDSHAKE_KEYRING: %w", err)
+	}
+	return kr, nil
+}
+
+// Current возвращает идентификатор ключа, которым шифруются handshake
+func (kr *Keyring) Current() string {
+	return kr.ids[0]
+}
+
+// Encrypt шифрует текущим ключом и добавляет его идентификатор
+func (kr *Keyring) Encrypt(plaintext string) (string, error) {
+	id := kr.Current()
+	ciphertext, err := EncryptHandshake(kr.keys[id], plaintext)
+	if err != nil {
+		return "", err
+	}
+	return id + ":" + ciphertext, nil
+}
+
+// Decrypt расшифровывает ключом из префикса. Шифротекст без префикса
+// (от клиентов без идентификаторов ключей) пробуется всеми ключами по очереди.
+func (kr *Keyring) Decrypt(ciphertext string) (string, error) {
+	if id, rest, ok := strings.Cut(ciphertext, ":"); ok {
+		key, known := kr.keys[id]
+		if !known {
+			return "", fmt.Errorf("неизвестный идентификатор ключа %q", id)
+		}
+		return DecryptHandshake(key, rest)
+	}
+
+	var errs []error
+	for _, id := range kr.ids {
+		plaintext, err := DecryptHandshake(kr.keys[id], ciphertext)
+		if err == nil {
+			return plaintext, nil
+		}
+		errs = append(errs, fmt.Errorf("ключ %q: %w", id, err))
+	}
+	return "", errors.Join(errs...)
+}
@@ -0,0 +1,150 @@
+package crypt
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestParseKeyring(t *testing.T) {
+	// Ключи в base64 заканчиваются '=': разделяется только первый знак
+	a, b := newKey(t), newKey(t)
+	if !strings.HasSuffix(a, "=") {
+		t.Fatalf("ключ %q без выравнивания", a)
+	}
+
+	tests := []struct {
+		name string
+		raw  string
+		ids  []string // nil — ожидается ошибка
+	}{
+		{"через запятую", "k2=" + a + ",k1=" + b, []string{"k2", "k1"}},
+		{"строки и комментарии", "# текущий\n k2 = " + a + "\n\n# прежний\nk1=" + b + "\n", []string{"k2", "k1"}},
+		{"один ключ", "k1=" + a, []string{"k1"}},
+		{"повтор идентификатора", "k1=" + a + ",k1=" + b, nil},
+		{"двоеточие в идентификаторе", "k:1=" + a, nil},
+		{"пробел в идентификаторе", "k 1=" + a, nil},
+		{"без идентификатора", "=" + a, nil},
+		{"без знака =", a, nil},
+		{"некорректный ключ", "k1=не-base64", nil},
+		{"только комментарии", "# пусто\n\n", nil},
+	}
+	for _, tt := range tests {
+		kr, err := ParseKeyring(tt.raw)
+		if tt.ids == nil {
+			if err == nil {
+				t.Errorf("%s: набор принят", tt.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !slices.Equal(kr.ids, tt.ids) {
+			t.Errorf("%s: идентификаторы %v, ожидалось %v", tt.name, kr.ids, tt.ids)
+		}
+		if kr.Current() != tt.ids[0] {
+			t.Errorf("%s: текущий ключ %q, ожидался %q", tt.name, kr.Current(), tt.ids[0])
+		}
+		if kr.keys[tt.ids[0]] != a {
+			t.Errorf("%s: ключ %q разобран как %q", tt.name, a, kr.keys[tt.ids[0]])
+		}
+	}
+}
+
+func TestKeyringRoundTrip(t *testing.T) {
+	current, old := newKey(t), newKey(t)
+	kr, err := ParseKeyring("k2=" + current + ",k1=" + old)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ciphertext, err := kr.Encrypt(testPlaintext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(ciphertext, "k2:") {
+		t.Errorf("шифротекст %q без идентификатора текущего ключа", ciphertext)
+	}
+	if got, err := kr.Decrypt(ciphertext); err != nil || got != testPlaintext {
+		t.Errorf("расшифровано %q, %v", got, err)
+	}
+
+	// Шифротекст прежнего ключа с его идентификатором
+	legacy, err := EncryptHandshake(old, testPlaintext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := kr.Decrypt("k1:" + legacy); err != nil || got != testPlaintext {
+		t.Errorf("шифротекст прежнего ключа: %q, %v", got, err)
+	}
+	// Без идентификатора пробуются все ключи по очереди
+	if got, err := kr.Decrypt(legacy); err != nil || got != testPlaintext {
+		t.Errorf("шифротекст без идентификатора: %q, %v", got, err)
+	}
+}
+
+func TestKeyringDecryptErrors(t *testing.T) {
+	key := newKey(t)
+	kr, err := ParseKeyring("k1=" + key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ciphertext, err := EncryptHandshake(key, testPlaintext)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := kr.Decrypt("k9:" + ciphertext); err == nil || !strings.Contains(err.Error(), `"k9"`) {
+		t.Errorf("неизвестный идентификатор: %v", err)
+	}
+	// Шифротекст чужого ключа не расшифровывается ни одним ключом набора
+	foreign, err := EncryptHandshake(newKey(t), testPlaintext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := kr.Decrypt(foreign); err == nil {
+		t.Error("расшифрован шифротекст чужого ключа")
+	}
+	if _, err := kr.Decrypt("k1:" + foreign); err == nil {
+		t.Error("расшифрован шифротекст чужого ключа с идентификатором k1")
+	}
+}
+
+func TestKeyringFromEnv(t *testing.T) {
+	t.Setenv("HANDSHAKE_KEYRING_FILE", "")
+	t.Setenv("HANDSHAKE_KEYRING", "")
+	if kr, err := KeyringFromEnv(); kr != nil || err != nil {
+		t.Fatalf("без переменных получено %v, %v", kr, err)
+	}
+
+	t.Setenv("HANDSHAKE_KEYRING", "env="+newKey(t))
+	kr, err := KeyringFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kr.Current() != "env" {
+		t.Errorf("текущий ключ %q, ожидался env", kr.Current())
+	}
+
+	// Файл имеет приоритет над переменной
+	path := filepath.Join(t.TempDir(), "keyring")
+	if err := os.WriteFile(path, []byte("# ключи\nfile="+newKey(t)+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("HANDSHAKE_KEYRING_FILE", path)
+	if kr, err = KeyringFromEnv(); err != nil {
+		t.Fatal(err)
+	}
+	if kr.Current() != "file" {
+		t.Errorf("текущий ключ %q, ожидался ключ из файла", kr.Current())
+	}
+
+	t.Setenv("HANDSHAKE_KEYRING_FILE", filepath.Join(t.TempDir(), "нет"))
+	if _, err := KeyringFromEnv(); err == nil {
+		t.Error("отсутствующий файл набора ключей не вызвал ошибку")
+	}
+}
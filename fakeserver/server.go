@@ -0,0 +1,153 @@
+// Package fakeserver — сервер туннелей в памяти для интеграционных тестов.
+//
+// Server реализует DialContext и подставляется вместо Dialer клиента:
+// каждое «подключение к серверу» — это net.Pipe, на другом конце которого
+// Server читает строку handshake (и предшествующий ей заголовок PROXY,
+// если он есть), запоминает её, при необходимости отвечает подтверждением
+// и передаёт соединение обработчику. Сеть и настоящий сервер не нужны.
+package fakeserver
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"usbmuxd-client/crypt"
+)
+
+// ErrClosed — сервер закрыт и новых подключений не принимает
+var ErrClosed = errors.New("сервер в памяти закрыт")
+
+// Server — сервер туннелей в памяти. Поля настраиваются до первого подключения.
+type Server struct {
+	Ack        string                                // ответ на handshake; пусто — не отвечать
+	Cipher     crypt.HandshakeCipher                 // расшифровка handshake; nil — handshake в открытом виде
+	EncryptAck bool                                  // шифровать ответ шифром Cipher
+	Handler    func(handshake string, conn net.Conn) // обработка соединения после handshake; nil — эхо
+
+	mu         sync.Mutex
+	handshakes []string
+	conns      map[net.Conn]struct{}
+	closed     bool
+	wg         sync.WaitGroup
+}
+
+// New создаёт сервер, который подтверждает handshake строкой ack
+// (пусто — без подтверждения) и возвращает данные обратно
+func New(ack string) *Server {
+	return &Server{Ack: ack}
+}
+
+// DialContext возвращает клиентский конец нового соединения с сервером.
+// network и addr не используются.
+func (s *Server) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	client, server := net.Pipe()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil, ErrClosed
+	}
+	if s.conns == nil {
+		s.conns = map[net.Conn]struct{}{}
+	}
+	s.conns[server] = struct{}{}
+	s.wg.Add(1)
+	go s.serve(server)
+	return client, nil
+}
+
+// Handshakes возвращает принятые handshake в порядке поступления,
+// уже расшифрованные, если задан Cipher
+func (s *Server) Handshakes() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.handshakes...)
+}
+
+// Close закрывает все соединения и ждёт завершения обработчиков
+func (s *Server) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+	return nil
+}
+
+// serve принимает handshake на серверном конце соединения и передаёт его обработчику
+func (s *Server) serve(conn net.Conn) {
+	defer s.wg.Done()
+	defer func() {
+		conn.Close()
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+	}()
+
+	r := bufio.NewReader(conn)
+	line, err := readLine(r)
+	if err == nil && strings.HasPrefix(line, "PROXY ") {
+		line, err = readLine(r)
+	}
+	if err != nil {
+		return
+	}
+	handshake := line
+	if s.Cipher != nil {
+		if handshake, err = s.Cipher.Decrypt(line); err != nil {
+			conn.Write([]byte("ERR " + err.Error() + "\n"))
+			return
+		}
+	}
+
+	s.mu.Lock()
+	s.handshakes = append(s.handshakes, handshake)
+	s.mu.Unlock()
+
+	if s.Ack != "" {
+		ack := s.Ack
+		if s.EncryptAck && s.Cipher != nil {
+			if ack, err = s.Cipher.Encrypt(ack); err != nil {
+				return
+			}
+		}
+		if _, err := conn.Write([]byte(ack + "\n")); err != nil {
+			return
+		}
+	}
+
+	buffered := &bufferedConn{Conn: conn, r: r}
+	if s.Handler != nil {
+		s.Handler(handshake, buffered)
+		return
+	}
+	io.Copy(conn, buffered)
+}
+
+// readLine читает строку без завершающих "\r\n"
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// bufferedConn читает сначала данные, оставшиеся в буфере после handshake
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
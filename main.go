@@ -1,12 +1,23 @@
 package main
 
 import (
+	"errors"
+	"flag"
+	"os"
+
 	"usbmuxd-client/socket"
+
+	log "github.com/sirupsen/logrus"
 )
 
 //TIP <p>To run your code, right-click the code and select <b>Run</b>.</p> <p>Alternatively, click
 // the <icon src="AllIcons.Actions.Execute"/> icon in the gutter and select the <b>Run</b> menu item from here.</p>
 
 func main() {
-	socket.Run()
+	if err := socket.RunArgs(os.Args[1:]); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return
+		}
+		log.WithError(err).Fatal("Клиент завершился с ошибкой")
+	}
 }
@@ -0,0 +1,523 @@
+package muxproto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+	"unicode/utf16"
+)
+
+// Бинарный plist (bplist00): заголовок, объекты, таблица смещений объектов
+// и 32-байтный трейлер в конце. Контейнеры ссылаются на элементы по номерам
+// в таблице смещений. Все числа — big endian.
+const (
+	bplistMagic       = "bplist00"
+	bplistTrailerSize = 32
+	bplistMaxDepth    = 256     // защита от слишком глубокой вложенности
+	bplistMaxVisits   = 1 << 20 // защита от экспоненциального раскрытия общих объектов
+)
+
+// Типы объектов — старшая половина байта-маркера
+const (
+	bpSimple = 0x0
+	bpInt    = 0x1
+	bpReal   = 0x2
+	bpDate   = 0x3
+	bpData   = 0x4
+	bpASCII  = 0x5
+	bpUTF16  = 0x6
+	bpUID    = 0x8
+	bpArray  = 0xA
+	bpDict   = 0xD
+)
+
+// bplistEpoch — начало отсчёта дат бинарного plist
+var bplistEpoch = time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// IsBinaryPlist сообщает, что data — бинарный plist
+func IsBinaryPlist(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(bplistMagic))
+}
+
+// MarshalBinaryPlist кодирует значение в бинарный plist. Поддерживаются
+// те же типы, что и в MarshalPlist.
+func MarshalBinaryPlist(v any) ([]byte, error) {
+	var w bplistWriter
+	if _, err := w.flatten(v); err != nil {
+		return nil, err
+	}
+
+	refSize := uintSize(uint64(len(w.objects)))
+	var buf bytes.Buffer
+	buf.WriteString(bplistMagic)
+	offsets := make([]uint64, len(w.objects))
+	for i, obj := range w.objects {
+		offsets[i] = uint64(buf.Len())
+		if err := w.encode(&buf, obj, refSize); err != nil {
+			return nil, err
+		}
+	}
+
+	tableOffset := uint64(buf.Len())
+	offsetSize := uintSize(tableOffset)
+	for _, off := range offsets {
+		putUint(&buf, off, offsetSize)
+	}
+
+	var trailer [bplistTrailerSize]byte
+	trailer[6] = byte(offsetSize)
+	trailer[7] = byte(refSize)
+	binary.BigEndian.PutUint64(trailer[8:], uint64(len(w.objects)))
+	binary.BigEndian.PutUint64(trailer[16:], 0) // корень — первый объект
+	binary.BigEndian.PutUint64(trailer[24:], tableOffset)
+	buf.Write(trailer[:])
+	return buf.Bytes(), nil
+}
+
+// bplistObject — значение и номера объектов его элементов
+type bplistObject struct {
+	value any
+	refs  []int // для массива — элементы; для словаря — ключи, затем значения
+}
+
+// bplistWriter раскладывает дерево значений в плоский список объектов
+type bplistWriter struct {
+	objects []bplistObject
+}
+
+// flatten добавляет v и его элементы и возвращает номер объекта v
+func (w *bplistWriter) flatten(v any) (int, error) {
+	idx := len(w.objects)
+	w.objects = append(w.objects, bplistObject{value: v})
+
+	var refs []int
+	switch v := v.(type) {
+	case map[string]any:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		refs = make([]int, 2*len(keys))
+		for i, k := range keys {
+			ref, _ := w.flatten(k)
+			refs[i] = ref
+		}
+		for i, k := range keys {
+			ref, err := w.flatten(v[k])
+			if err != nil {
+				return 0, err
+			}
+			refs[len(keys)+i] = ref
+		}
+	case []any:
+		refs = make([]int, len(v))
+		for i, item := range v {
+			ref, err := w.flatten(item)
+			if err != nil {
+				return 0, err
+			}
+			refs[i] = ref
+		}
+	case string, bool, int, int64, uint64, uint32, uint16, float64, []byte:
+	default:
+		return 0, fmt.Errorf("plist: неподдерживаемый тип %T", v)
+	}
+	w.objects[idx].refs = refs
+	return idx, nil
+}
+
+func (w *bplistWriter) encode(buf *bytes.Buffer, obj bplistObject, refSize int) error {
+	switch v := obj.value.(type) {
+	case map[string]any:
+		writeMarker(buf, bpDict, len(v))
+	case []any:
+		writeMarker(buf, bpArray, len(v))
+	case string:
+		if isASCII(v) {
+			writeMarker(buf, bpASCII, len(v))
+			buf.WriteString(v)
+			return nil
+		}
+		units := utf16.Encode([]rune(v))
+		writeMarker(buf, bpUTF16, len(units))
+		for _, u := range units {
+			binary.Write(buf, binary.BigEndian, u)
+		}
+		return nil
+	case bool:
+		if v {
+			buf.WriteByte(0x09)
+		} else {
+			buf.WriteByte(0x08)
+		}
+		return nil
+	case int:
+		writeInt(buf, int64(v))
+		return nil
+	case int64:
+		writeInt(buf, v)
+		return nil
+	case uint64:
+		writeUint(buf, v)
+		return nil
+	case uint32:
+		writeUint(buf, uint64(v))
+		return nil
+	case uint16:
+		writeUint(buf, uint64(v))
+		return nil
+	case float64:
+		buf.WriteByte(bpReal<<4 | 3)
+		binary.Write(buf, binary.BigEndian, math.Float64bits(v))
+		return nil
+	case []byte:
+		writeMarker(buf, bpData, len(v))
+		buf.Write(v)
+		return nil
+	}
+	for _, ref := range obj.refs {
+		putUint(buf, uint64(ref), refSize)
+	}
+	return nil
+}
+
+// writeMarker пишет маркер объекта с длиной count; длина от 15
+// записывается отдельным целым после маркера
+func writeMarker(buf *bytes.Buffer, typ byte, count int) {
+	if count < 0xF {
+		buf.WriteByte(typ<<4 | byte(count))
+		return
+	}
+	buf.WriteByte(typ<<4 | 0xF)
+	writeUint(buf, uint64(count))
+}
+
+// writeInt пишет целое; отрицательные занимают 8 байт
+func writeInt(buf *bytes.Buffer, v int64) {
+	if v >= 0 {
+		writeUint(buf, uint64(v))
+		return
+	}
+	buf.WriteByte(bpInt<<4 | 3)
+	putUint(buf, uint64(v), 8)
+}
+
+// writeUint пишет неотрицательное целое в 1, 2, 4 или 8 байтах; числа
+// больше MaxInt64 — в 16 байтах, так как 8-байтные целые знаковые
+func writeUint(buf *bytes.Buffer, v uint64) {
+	if v > math.MaxInt64 {
+		buf.WriteByte(bpInt<<4 | 4)
+		putUint(buf, 0, 8)
+		putUint(buf, v, 8)
+		return
+	}
+	size := uintSize(v)
+	buf.WriteByte(bpInt<<4 | byte(sizeLog2(size)))
+	putUint(buf, v, size)
+}
+
+// uintSize возвращает наименьший из размеров 1, 2, 4, 8, вмещающий v
+func uintSize(v uint64) int {
+	switch {
+	case v <= math.MaxUint8:
+		return 1
+	case v <= math.MaxUint16:
+		return 2
+	case v <= math.MaxUint32:
+		return 4
+	}
+	return 8
+}
+
+func sizeLog2(size int) int {
+	switch size {
+	case 1:
+		return 0
+	case 2:
+		return 1
+	case 4:
+		return 2
+	}
+	return 3
+}
+
+func putUint(buf *bytes.Buffer, v uint64, size int) {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], v)
+	buf.Write(b[8-size:])
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= 0x80 {
+			return false
+		}
+	}
+	return true
+}
+
+// unmarshalBinaryPlist декодирует бинарный plist в те же типы, что и
+// UnmarshalPlist; даты возвращаются строкой в формате RFC 3339, UID — uint64
+func unmarshalBinaryPlist(data []byte) (any, error) {
+	if len(data) < len(bplistMagic)+bplistTrailerSize {
+		return nil, errors.New("bplist: данные короче заголовка и трейлера")
+	}
+	trailer := data[len(data)-bplistTrailerSize:]
+	r := &bplistReader{
+		data:       data,
+		offsetSize: int(trailer[6]),
+		refSize:    int(trailer[7]),
+		numObjects: binary.BigEndian.Uint64(trailer[8:]),
+	}
+	top := binary.BigEndian.Uint64(trailer[16:])
+	tableOffset := binary.BigEndian.Uint64(trailer[24:])
+
+	if !validIntSize(r.offsetSize) || !validIntSize(r.refSize) {
+		return nil, fmt.Errorf("bplist: некорректные размеры смещения %d и ссылки %d", r.offsetSize, r.refSize)
+	}
+	tableEnd := uint64(len(data) - bplistTrailerSize)
+	if tableOffset < uint64(len(bplistMagic)) || tableOffset > tableEnd ||
+		r.numObjects > (tableEnd-tableOffset)/uint64(r.offsetSize) {
+		return nil, errors.New("bplist: таблица смещений выходит за пределы данных")
+	}
+	r.table = data[tableOffset:tableEnd]
+	r.limit = tableOffset
+	if top >= r.numObjects {
+		return nil, fmt.Errorf("bplist: корневой объект %d вне таблицы из %d", top, r.numObjects)
+	}
+	return r.object(top, 0)
+}
+
+// bplistReader читает объекты бинарного plist
+type bplistReader struct {
+	data       []byte
+	table      []byte // таблица смещений
+	limit      uint64 // объекты лежат до начала таблицы
+	offsetSize int
+	refSize    int
+	numObjects uint64
+	path       []uint64 // номера разбираемых контейнеров, для обнаружения циклов
+	visits     int      // число разобранных объектов с учётом повторов
+}
+
+func validIntSize(n int) bool {
+	return n == 1 || n == 2 || n == 4 || n == 8
+}
+
+func readUint(b []byte) uint64 {
+	var v uint64
+	for _, c := range b {
+		v = v<<8 | uint64(c)
+	}
+	return v
+}
+
+// bytesAt возвращает n байт с позиции off или ошибку, если они выходят за объекты
+func (r *bplistReader) bytesAt(off, n uint64) ([]byte, error) {
+	if off > r.limit || n > r.limit-off {
+		return nil, errors.New("bplist: объект выходит за пределы данных")
+	}
+	return r.data[off : off+n], nil
+}
+
+func (r *bplistReader) object(idx uint64, depth int) (any, error) {
+	if depth > bplistMaxDepth {
+		return nil, errors.New("bplist: слишком глубокая вложенность")
+	}
+	if r.visits++; r.visits > bplistMaxVisits {
+		return nil, errors.New("bplist: слишком много объектов")
+	}
+	if idx >= r.numObjects {
+		return nil, fmt.Errorf("bplist: ссылка %d вне таблицы из %d объектов", idx, r.numObjects)
+	}
+	pos := idx * uint64(r.offsetSize)
+	off := readUint(r.table[pos : pos+uint64(r.offsetSize)])
+	head, err := r.bytesAt(off, 1)
+	if err != nil {
+		return nil, err
+	}
+	typ, info := head[0]>>4, head[0]&0xF
+	off++
+
+	switch typ {
+	case bpSimple:
+		switch info {
+		case 0x8:
+			return false, nil
+		case 0x9:
+			return true, nil
+		}
+		return nil, fmt.Errorf("bplist: неподдерживаемый объект 0x%02x", head[0])
+	case bpInt:
+		v, _, err := r.intAt(off, info)
+		return v, err
+	case bpReal:
+		b, err := r.bytesAt(off, 1<<info)
+		if err != nil {
+			return nil, err
+		}
+		switch info {
+		case 2:
+			return float64(math.Float32frombits(uint32(readUint(b)))), nil
+		case 3:
+			return math.Float64frombits(readUint(b)), nil
+		}
+		return nil, fmt.Errorf("bplist: вещественное число из %d байт", 1<<info)
+	case bpDate:
+		b, err := r.bytesAt(off, 8)
+		if err != nil {
+			return nil, err
+		}
+		secs := math.Float64frombits(readUint(b))
+		t := bplistEpoch.Add(time.Duration(secs * float64(time.Second)))
+		return t.Format(time.RFC3339), nil
+	case bpUID:
+		b, err := r.bytesAt(off, uint64(info)+1)
+		if err != nil {
+			return nil, err
+		}
+		return readUint(b), nil
+	}
+
+	count, off, err := r.countAt(off, info)
+	if err != nil {
+		return nil, err
+	}
+	switch typ {
+	case bpData:
+		b, err := r.bytesAt(off, count)
+		if err != nil {
+			return nil, err
+		}
+		return bytes.Clone(b), nil
+	case bpASCII:
+		b, err := r.bytesAt(off, count)
+		if err != nil {
+			return nil, err
+		}
+		return string(b), nil
+	case bpUTF16:
+		if count > math.MaxUint64/2 {
+			return nil, errors.New("bplist: слишком длинная строка")
+		}
+		b, err := r.bytesAt(off, 2*count)
+		if err != nil {
+			return nil, err
+		}
+		units := make([]uint16, count)
+		for i := range units {
+			units[i] = binary.BigEndian.Uint16(b[2*i:])
+		}
+		return string(utf16.Decode(units)), nil
+	case bpArray, bpDict:
+		return r.container(idx, typ, off, count, depth)
+	}
+	return nil, fmt.Errorf("bplist: неподдерживаемый объект 0x%02x", head[0])
+}
+
+// container разбирает массив или словарь из count элементов со ссылками с позиции off
+func (r *bplistReader) container(idx uint64, typ byte, off, count uint64, depth int) (any, error) {
+	for _, p := range r.path {
+		if p == idx {
+			return nil, errors.New("bplist: контейнер ссылается сам на себя")
+		}
+	}
+	r.path = append(r.path, idx)
+	defer func() { r.path = r.path[:len(r.path)-1] }()
+
+	nrefs := count
+	if typ == bpDict {
+		nrefs = 2 * count
+	}
+	if count > r.numObjects || nrefs > r.limit/uint64(r.refSize) {
+		return nil, errors.New("bplist: слишком много элементов контейнера")
+	}
+	refs, err := r.bytesAt(off, nrefs*uint64(r.refSize))
+	if err != nil {
+		return nil, err
+	}
+	ref := func(i uint64) uint64 {
+		return readUint(refs[i*uint64(r.refSize) : (i+1)*uint64(r.refSize)])
+	}
+
+	if typ == bpArray {
+		list := make([]any, count)
+		for i := range list {
+			v, err := r.object(ref(uint64(i)), depth+1)
+			if err != nil {
+				return nil, err
+			}
+			list[i] = v
+		}
+		return list, nil
+	}
+
+	dict := make(map[string]any, count)
+	for i := uint64(0); i < count; i++ {
+		k, err := r.object(ref(i), depth+1)
+		if err != nil {
+			return nil, err
+		}
+		key, ok := k.(string)
+		if !ok {
+			return nil, fmt.Errorf("bplist: ключ словаря типа %T", k)
+		}
+		v, err := r.object(ref(count+i), depth+1)
+		if err != nil {
+			return nil, err
+		}
+		dict[key] = v
+	}
+	return dict, nil
+}
+
+// intAt читает целое размером 2^info байт с позиции off и возвращает
+// его и позицию после него. Отрицательные числа возвращаются как int64.
+func (r *bplistReader) intAt(off uint64, info byte) (any, uint64, error) {
+	if info > 4 {
+		return nil, 0, fmt.Errorf("bplist: целое из %d байт", 1<<info)
+	}
+	n := uint64(1) << info
+	b, err := r.bytesAt(off, n)
+	if err != nil {
+		return nil, 0, err
+	}
+	if n == 16 {
+		// Старшие 8 байт ненулевые только у чисел, не помещающихся в uint64
+		b = b[8:]
+	}
+	v := readUint(b)
+	if n == 8 && int64(v) < 0 {
+		return int64(v), off + n, nil
+	}
+	return v, off + n, nil
+}
+
+// countAt возвращает длину объекта: info или, если оно равно 0xF, целое
+// после маркера. Вторым значением возвращается позиция данных объекта.
+func (r *bplistReader) countAt(off uint64, info byte) (uint64, uint64, error) {
+	if info != 0xF {
+		return uint64(info), off, nil
+	}
+	head, err := r.bytesAt(off, 1)
+	if err != nil {
+		return 0, 0, err
+	}
+	if head[0]>>4 != bpInt {
+		return 0, 0, errors.New("bplist: длина объекта не является целым числом")
+	}
+	v, next, err := r.intAt(off+1, head[0]&0xF)
+	if err != nil {
+		return 0, 0, err
+	}
+	count, ok := v.(uint64)
+	if !ok {
+		return 0, 0, errors.New("bplist: отрицательная длина объекта")
+	}
+	return count, next, nil
+}
@@ -0,0 +1,197 @@
+package muxproto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// testPlist — значение со всеми поддерживаемыми типами
+func testPlist() map[string]any {
+	return map[string]any{
+		"MessageType": "Attached",
+		"DeviceID":    42,
+		"Negative":    int64(-7),
+		"MinInt":      int64(math.MinInt64),
+		"Big":         uint64(math.MaxUint64),
+		"Port":        uint16(62078),
+		"Location":    uint32(0x14100000),
+		"Ratio":       0.125,
+		"Connected":   true,
+		"Paired":      false,
+		"Data":        []byte{0, 1, 0xFE, 0xFF},
+		"Name":        "iPhone Алексея 📱",
+		"Long":        strings.Repeat("x", 300),
+		"Properties": map[string]any{
+			"SerialNumber": "00008030001454190EEB802E",
+			"Tags":         []any{"usb", uint64(1), []any{true, -1.5}},
+		},
+	}
+}
+
+// testPlistDecoded — testPlist после декодирования: целые становятся
+// uint64, отрицательные — int64
+func testPlistDecoded() map[string]any {
+	v := testPlist()
+	v["DeviceID"] = uint64(42)
+	v["Port"] = uint64(62078)
+	v["Location"] = uint64(0x14100000)
+	return v
+}
+
+func TestBinaryPlistRoundTrip(t *testing.T) {
+	data, err := MarshalBinaryPlist(testPlist())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsBinaryPlist(data) {
+		t.Fatalf("нет заголовка bplist00: %q", data[:8])
+	}
+	got, err := UnmarshalPlist(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := testPlistDecoded(); !reflect.DeepEqual(got, want) {
+		t.Errorf("декодировано\n%#v\nожидалось\n%#v", got, want)
+	}
+}
+
+func TestXMLPlistRoundTrip(t *testing.T) {
+	data, err := MarshalPlist(testPlist())
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := UnmarshalPlist(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := testPlistDecoded(); !reflect.DeepEqual(got, want) {
+		t.Errorf("декодировано\n%#v\nожидалось\n%#v", got, want)
+	}
+}
+
+func TestMarshalPlistUnsupported(t *testing.T) {
+	v := map[string]any{"Conn": struct{}{}}
+	if _, err := MarshalBinaryPlist(v); err == nil {
+		t.Error("MarshalBinaryPlist принял структуру")
+	}
+	if _, err := MarshalPlist(v); err == nil {
+		t.Error("MarshalPlist принял структуру")
+	}
+}
+
+// buildBplist собирает бинарный plist из готовых объектов с 1-байтными
+// ссылками и смещениями; корень — объект 0
+func buildBplist(objects ...[]byte) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(bplistMagic)
+	var offsets []byte
+	for _, obj := range objects {
+		offsets = append(offsets, byte(buf.Len()))
+		buf.Write(obj)
+	}
+	tableOffset := buf.Len()
+	buf.Write(offsets)
+
+	var trailer [bplistTrailerSize]byte
+	trailer[6], trailer[7] = 1, 1
+	binary.BigEndian.PutUint64(trailer[8:], uint64(len(objects)))
+	binary.BigEndian.PutUint64(trailer[24:], uint64(tableOffset))
+	buf.Write(trailer[:])
+	return buf.Bytes()
+}
+
+// nestedArrays возвращает depth вложенных друг в друга массивов
+func nestedArrays(depth int) any {
+	var v any = "дно"
+	for range depth {
+		v = []any{v}
+	}
+	return v
+}
+
+// sharedArrays возвращает plist из levels массивов, каждый из которых
+// дважды ссылается на следующий: при раскрытии 2^levels объектов
+func sharedArrays(levels int) []byte {
+	var objects [][]byte
+	for i := range levels {
+		next := byte(i + 1)
+		objects = append(objects, []byte{bpArray<<4 | 2, next, next})
+	}
+	objects = append(objects, []byte{bpInt << 4, 1})
+	return buildBplist(objects...)
+}
+
+// bplistLimitCases — бинарные plist, которые декодер обязан отклонить
+func bplistLimitCases(t testing.TB) map[string][]byte {
+	valid, err := MarshalBinaryPlist(testPlist())
+	if err != nil {
+		t.Fatal(err)
+	}
+	deep, err := MarshalBinaryPlist(nestedArrays(bplistMaxDepth + 10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return map[string][]byte{
+		"только заголовок":       []byte(bplistMagic),
+		"обрезан трейлер":        valid[:len(valid)-1],
+		"обрезаны объекты":       append([]byte(bplistMagic), valid[len(valid)-bplistTrailerSize:]...),
+		"строка за пределами":    buildBplist([]byte{bpASCII<<4 | 0xE, 'a'}),
+		"длина не целое":         buildBplist([]byte{bpData<<4 | 0xF, bpASCII << 4}),
+		"ссылка вне таблицы":     buildBplist([]byte{bpArray<<4 | 1, 5}),
+		"массив содержит себя":   buildBplist([]byte{bpArray<<4 | 1, 0}),
+		"цикл через словарь":     buildBplist([]byte{bpDict<<4 | 1, 1, 0}, []byte{bpASCII<<4 | 1, 'k'}),
+		"ключ словаря не строка": buildBplist([]byte{bpDict<<4 | 1, 1, 1}, []byte{bpInt << 4, 1}),
+		"слишком глубоко":        deep,
+		"экспоненциальный рост":  sharedArrays(24),
+	}
+}
+
+func TestUnmarshalBinaryPlistLimits(t *testing.T) {
+	for name, data := range bplistLimitCases(t) {
+		if v, err := UnmarshalPlist(data); err == nil {
+			t.Errorf("%s: декодировано %#v", name, v)
+		}
+	}
+
+	// Вложенность на пределе и общие объекты без взрывного роста допустимы
+	shallow, err := MarshalBinaryPlist(nestedArrays(bplistMaxDepth))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, data := range map[string][]byte{"вложенность на пределе": shallow, "общие объекты": sharedArrays(4)} {
+		if _, err := UnmarshalPlist(data); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+}
+
+func FuzzUnmarshalPlist(f *testing.F) {
+	for _, data := range bplistLimitCases(f) {
+		f.Add(data)
+	}
+	valid, err := MarshalBinaryPlist(testPlist())
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add(valid)
+	xmlData, err := MarshalPlist(testPlist())
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add(xmlData)
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		v, err := UnmarshalPlist(data)
+		if err != nil || !IsBinaryPlist(data) {
+			return
+		}
+		// Декодированное значение снова кодируется
+		if _, err := MarshalBinaryPlist(v); err != nil {
+			t.Errorf("декодировано %#v, но не кодируется: %v", v, err)
+		}
+	})
+}
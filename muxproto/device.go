@@ -0,0 +1,99 @@
+package muxproto
+
+import "fmt"
+
+// Device — устройство, подключённое к usbmuxd
+type Device struct {
+	UDID           string `json:"udid"`
+	DeviceID       int    `json:"deviceId"`
+	ConnectionType string `json:"connectionType"`
+	ProductID      int    `json:"productId"`
+}
+
+// ParseDevice разбирает запись устройства ({DeviceID, Properties})
+func ParseDevice(entry map[string]any) (Device, error) {
+	props, ok := entry["Properties"].(map[string]any)
+	if !ok {
+		return Device{}, fmt.Errorf("запись устройства без Properties")
+	}
+	d := Device{
+		UDID:           stringValue(props["SerialNumber"]),
+		ConnectionType: stringValue(props["ConnectionType"]),
+		ProductID:      intValue(props["ProductID"]),
+		DeviceID:       intValue(props["DeviceID"]),
+	}
+	if id, ok := entry["DeviceID"]; ok {
+		d.DeviceID = intValue(id)
+	}
+	return d, nil
+}
+
+// ParseDeviceList разбирает ответ на ListDevices
+func ParseDeviceList(payload map[string]any) ([]Device, error) {
+	list, ok := payload["DeviceList"].([]any)
+	if !ok {
+		return nil, fmt.Errorf("ответ без DeviceList")
+	}
+	devices := make([]Device, 0, len(list))
+	for i, item := range list {
+		entry, ok := item.(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("DeviceList[%d] не является словарём", i)
+		}
+		d, err := ParseDevice(entry)
+		if err != nil {
+			return nil, fmt.Errorf("DeviceList[%d]: %w", i, err)
+		}
+		devices = append(devices, d)
+	}
+	return devices, nil
+}
+
+func stringValue(v any) string {
+	s, _ := v.(string)
+	return s
+}
+
+func intValue(v any) int {
+	switch v := v.(type) {
+	case uint64:
+		return int(v)
+	case int64:
+		return int(v)
+	}
+	return 0
+}
+
+// Значения MessageType в ответах usbmuxd
+const (
+	MessageResult   = "Result"
+	MessageAttached = "Attached"
+	MessageDetached = "Detached"
+)
+
+// Коды ответа Result
+const (
+	ResultOK                = 0
+	ResultBadCommand        = 1
+	ResultBadDevice         = 2
+	ResultConnectionRefused = 3
+	ResultBadVersion        = 6
+)
+
+// ResultNumber возвращает код из ответа Result; ok = false, если это не Result
+func ResultNumber(payload map[string]any) (number int, ok bool) {
+	if stringValue(payload["MessageType"]) != MessageResult {
+		return 0, false
+	}
+	return intValue(payload["Number"]), true
+}
+
+// MessageType возвращает тип сообщения usbmuxd
+func MessageType(payload map[string]any) string {
+	return stringValue(payload["MessageType"])
+}
+
+// DeviceID возвращает идентификатор устройства из сообщения
+func DeviceID(payload map[string]any) int {
+	return intValue(payload["DeviceID"])
+}
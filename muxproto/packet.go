@@ -0,0 +1,123 @@
+package muxproto
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Константы протокола usbmuxd
+const (
+	HeaderSize       = 16
+	VersionPlist     = 1
+	MessagePlist     = 8
+	MaxPacketSize    = 4 << 20 // защита от некорректной длины
+	ProgName         = "usbmuxd-client"
+	ClientVersion    = "usbmuxd-client"
+	LibUSBMuxVersion = 3
+)
+
+// Типы сообщений старого бинарного протокола usbmuxd (версия 0)
+const (
+	MessageBinaryResult  = 1
+	MessageBinaryConnect = 2
+)
+
+// Header — заголовок пакета usbmuxd; все поля little-endian
+type Header struct {
+	Length  uint32 // длина пакета вместе с заголовком
+	Version uint32
+	Message uint32
+	Tag     uint32
+}
+
+// Packet — пакет usbmuxd с plist-содержимым
+type Packet struct {
+	Tag     uint32
+	Payload map[string]any
+}
+
+// NewRequest создаёт запрос с заданным MessageType и служебными полями клиента
+func NewRequest(messageType string, extra map[string]any) map[string]any {
+	req := map[string]any{
+		"MessageType":         messageType,
+		"ProgName":            ProgName,
+		"ClientVersionString": ClientVersion,
+		"kLibUSBMuxVersion":   LibUSBMuxVersion,
+	}
+	for k, v := range extra {
+		req[k] = v
+	}
+	return req
+}
+
+// WritePacket кодирует и отправляет plist-пакет
+func WritePacket(w io.Writer, tag uint32, payload map[string]any) error {
+	body, err := MarshalPlist(payload)
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, HeaderSize+len(body))
+	binary.LittleEndian.PutUint32(buf[0:], uint32(len(buf)))
+	binary.LittleEndian.PutUint32(buf[4:], VersionPlist)
+	binary.LittleEndian.PutUint32(buf[8:], MessagePlist)
+	binary.LittleEndian.PutUint32(buf[12:], tag)
+	copy(buf[HeaderSize:], body)
+	_, err = w.Write(buf)
+	return err
+}
+
+// Bytes кодирует заголовок
+func (h Header) Bytes() []byte {
+	buf := make([]byte, HeaderSize)
+	binary.LittleEndian.PutUint32(buf[0:], h.Length)
+	binary.LittleEndian.PutUint32(buf[4:], h.Version)
+	binary.LittleEndian.PutUint32(buf[8:], h.Message)
+	binary.LittleEndian.PutUint32(buf[12:], h.Tag)
+	return buf
+}
+
+// ReadHeader читает заголовок пакета
+func ReadHeader(r io.Reader) (Header, error) {
+	var raw [HeaderSize]byte
+	if _, err := io.ReadFull(r, raw[:]); err != nil {
+		return Header{}, err
+	}
+	h := Header{
+		Length:  binary.LittleEndian.Uint32(raw[0:]),
+		Version: binary.LittleEndian.Uint32(raw[4:]),
+		Message: binary.LittleEndian.Uint32(raw[8:]),
+		Tag:     binary.LittleEndian.Uint32(raw[12:]),
+	}
+	if h.Length < HeaderSize || h.Length > MaxPacketSize {
+		return Header{}, fmt.Errorf("некорректная длина пакета usbmuxd: %d", h.Length)
+	}
+	return h, nil
+}
+
+// ReadPacket читает пакет целиком. io.ReadFull дочитывает пакеты,
+// пришедшие несколькими TCP-сегментами.
+func ReadPacket(r io.Reader) (Packet, error) {
+	h, err := ReadHeader(r)
+	if err != nil {
+		return Packet{}, err
+	}
+	body := make([]byte, h.Length-HeaderSize)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return Packet{}, err
+	}
+	if h.Message != MessagePlist {
+		return Packet{}, fmt.Errorf("неподдерживаемый тип сообщения usbmuxd: %d", h.Message)
+	}
+
+	v, err := UnmarshalPlist(body)
+	if err != nil {
+		return Packet{}, err
+	}
+	dict, ok := v.(map[string]any)
+	if !ok {
+		return Packet{}, errors.New("корень plist не является словарём")
+	}
+	return Packet{Tag: h.Tag, Payload: dict}, nil
+}
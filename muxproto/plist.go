@@ -0,0 +1,222 @@
+package muxproto
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const plistHeader = `<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+`
+
+// MarshalPlist кодирует значение в XML plist. Поддерживаются
+// map[string]any, []any, string, bool, целые числа, float64 и []byte.
+func MarshalPlist(v any) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteString(plistHeader)
+	if err := writeValue(&buf, v); err != nil {
+		return nil, err
+	}
+	buf.WriteString("</plist>\n")
+	return buf.Bytes(), nil
+}
+
+func writeValue(buf *bytes.Buffer, v any) error {
+	switch v := v.(type) {
+	case map[string]any:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		buf.WriteString("<dict>")
+		for _, k := range keys {
+			buf.WriteString("<key>")
+			xml.EscapeText(buf, []byte(k))
+			buf.WriteString("</key>")
+			if err := writeValue(buf, v[k]); err != nil {
+				return err
+			}
+		}
+		buf.WriteString("</dict>")
+	case []any:
+		buf.WriteString("<array>")
+		for _, item := range v {
+			if err := writeValue(buf, item); err != nil {
+				return err
+			}
+		}
+		buf.WriteString("</array>")
+	case string:
+		buf.WriteString("<string>")
+		xml.EscapeText(buf, []byte(v))
+		buf.WriteString("</string>")
+	case bool:
+		if v {
+			buf.WriteString("<true/>")
+		} else {
+			buf.WriteString("<false/>")
+		}
+	case int:
+		fmt.Fprintf(buf, "<integer>%d</integer>", v)
+	case int64:
+		fmt.Fprintf(buf, "<integer>%d</integer>", v)
+	case uint64:
+		fmt.Fprintf(buf, "<integer>%d</integer>", v)
+	case uint32:
+		fmt.Fprintf(buf, "<integer>%d</integer>", v)
+	case uint16:
+		fmt.Fprintf(buf, "<integer>%d</integer>", v)
+	case float64:
+		fmt.Fprintf(buf, "<real>%s</real>", strconv.FormatFloat(v, 'g', -1, 64))
+	case []byte:
+		buf.WriteString("<data>")
+		buf.WriteString(base64.StdEncoding.EncodeToString(v))
+		buf.WriteString("</data>")
+	default:
+		return fmt.Errorf("plist: неподдерживаемый тип %T", v)
+	}
+	return nil
+}
+
+// UnmarshalPlist декодирует XML или бинарный plist. Словари возвращаются
+// как map[string]any, массивы — как []any, целые числа — как uint64
+// (отрицательные — как int64).
+func UnmarshalPlist(data []byte) (any, error) {
+	if IsBinaryPlist(data) {
+		return unmarshalBinaryPlist(data)
+	}
+	dec := xml.NewDecoder(bytes.NewReader(data))
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, fmt.Errorf("plist: %w", err)
+		}
+		if start, ok := tok.(xml.StartElement); ok {
+			if start.Name.Local == "plist" {
+				continue
+			}
+			return readValue(dec, start)
+		}
+	}
+}
+
+func readValue(dec *xml.Decoder, start xml.StartElement) (any, error) {
+	switch start.Name.Local {
+	case "dict":
+		return readDict(dec)
+	case "array":
+		return readArray(dec)
+	case "true", "false":
+		if err := dec.Skip(); err != nil {
+			return nil, err
+		}
+		return start.Name.Local == "true", nil
+	}
+
+	text, err := readText(dec)
+	if err != nil {
+		return nil, err
+	}
+	switch start.Name.Local {
+	case "string", "date":
+		return text, nil
+	case "integer":
+		text = strings.TrimSpace(text)
+		if strings.HasPrefix(text, "-") {
+			return strconv.ParseInt(text, 10, 64)
+		}
+		return strconv.ParseUint(text, 10, 64)
+	case "real":
+		return strconv.ParseFloat(strings.TrimSpace(text), 64)
+	case "data":
+		return base64.StdEncoding.DecodeString(strings.Join(strings.Fields(text), ""))
+	}
+	return nil, fmt.Errorf("plist: неизвестный элемент <%s>", start.Name.Local)
+}
+
+func readDict(dec *xml.Decoder) (map[string]any, error) {
+	dict := map[string]any{}
+	var key string
+	haveKey := false
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, fmt.Errorf("plist: %w", err)
+		}
+		switch tok := tok.(type) {
+		case xml.EndElement:
+			if haveKey {
+				return nil, fmt.Errorf("plist: ключ %q без значения", key)
+			}
+			return dict, nil
+		case xml.StartElement:
+			if tok.Name.Local == "key" {
+				if haveKey {
+					return nil, fmt.Errorf("plist: ключ %q без значения", key)
+				}
+				if key, err = readText(dec); err != nil {
+					return nil, err
+				}
+				haveKey = true
+				continue
+			}
+			if !haveKey {
+				return nil, fmt.Errorf("plist: значение <%s> без ключа", tok.Name.Local)
+			}
+			v, err := readValue(dec, tok)
+			if err != nil {
+				return nil, err
+			}
+			dict[key] = v
+			haveKey = false
+		}
+	}
+}
+
+func readArray(dec *xml.Decoder) ([]any, error) {
+	var arr []any
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, fmt.Errorf("plist: %w", err)
+		}
+		switch tok := tok.(type) {
+		case xml.EndElement:
+			return arr, nil
+		case xml.StartElement:
+			v, err := readValue(dec, tok)
+			if err != nil {
+				return nil, err
+			}
+			arr = append(arr, v)
+		}
+	}
+}
+
+// readText читает текст элемента до его закрывающего тега
+func readText(dec *xml.Decoder) (string, error) {
+	var sb strings.Builder
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			return "", io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return "", fmt.Errorf("plist: %w", err)
+		}
+		switch tok := tok.(type) {
+		case xml.CharData:
+			sb.Write(tok)
+		case xml.EndElement:
+			return sb.String(), nil
+		}
+	}
+}
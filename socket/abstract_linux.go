@@ -0,0 +1,6 @@
+//go:build linux
+
+package socket
+
+// abstractSupported — Unix-сокеты в абстрактном пространстве имён ("@имя") доступны
+const abstractSupported = true
@@ -0,0 +1,51 @@
+//go:build linux
+
+package socket
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestAbstractSocket(t *testing.T) {
+	c := newTestClient(t, Config{})
+	name := fmt.Sprintf("@usbmuxd-client-test-%d-%d", os.Getpid(), time.Now().UnixNano())
+	t.Chdir(t.TempDir())
+
+	listener, err := c.listenUnix(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tun := Tunnel{LocalAddr: name, Handshake: testUsbmuxHandshake}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		c.acceptLoop(ctx, tun, listener, "Unix-сокет", c.tunnelLimiter(tun))
+	}()
+	defer func() {
+		cancel()
+		<-done
+		c.sessions.drain(time.Second)
+	}()
+
+	conn, err := net.Dial("unix", name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	roundTrip(t, conn, "ping")
+
+	// Абстрактный сокет не оставляет файлов
+	entries, err := os.ReadDir(".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("в рабочей директории появились файлы: %v", entries)
+	}
+}
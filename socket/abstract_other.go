@@ -0,0 +1,6 @@
+//go:build !linux
+
+package socket
+
+// abstractSupported — абстрактное пространство имён Unix-сокетов есть только в Linux
+const abstractSupported = false
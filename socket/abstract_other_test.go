@@ -0,0 +1,12 @@
+//go:build !linux
+
+package socket
+
+import "testing"
+
+func TestAbstractSocketUnsupported(t *testing.T) {
+	tun := Tunnel{LocalAddr: "@usbmuxd", Handshake: testUsbmuxHandshake}
+	if _, err := tun.endpoint(); err == nil {
+		t.Fatal("абстрактный сокет принят на платформе без его поддержки")
+	}
+}
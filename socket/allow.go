@@ -0,0 +1,77 @@
+package socket
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// parseCIDRs разбирает список подсетей через запятую
+func parseCIDRs(raw string) ([]netip.Prefix, error) {
+	var list []netip.Prefix
+	for _, s := range strings.Split(raw, ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			return nil, fmt.Errorf("некорректная подсеть %q: %w", s, err)
+		}
+		list = append(list, p.Masked())
+	}
+	return list, nil
+}
+
+// allowedAddr проверяет, что адрес клиента входит в одну из подсетей.
+// Пустой список разрешает всех.
+func allowedAddr(addr net.Addr, allow []netip.Prefix) bool {
+	if len(allow) == 0 {
+		return true
+	}
+	var raw net.IP
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		raw = a.IP
+	case *net.UDPAddr:
+		raw = a.IP
+	default:
+		return false
+	}
+	ip, ok := netip.AddrFromSlice(raw)
+	if !ok {
+		return false
+	}
+	ip = ip.Unmap()
+	for _, p := range allow {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowListener закрывает сразу после Accept подключения клиентов не из allow
+type allowListener struct {
+	net.Listener
+	allow []netip.Prefix
+}
+
+func (l *allowListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if allowedAddr(conn.RemoteAddr(), l.allow) {
+			return conn, nil
+		}
+		log.WithFields(log.Fields{
+			"client":  conn.RemoteAddr(),
+			"address": l.Addr(),
+		}).Warn("Клиент не входит в разрешённые подсети, соединение закрыто")
+		conn.Close()
+	}
+}
@@ -0,0 +1,68 @@
+package socket
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+	"usbmuxd-client/fakeserver"
+)
+
+// serveAllowed принимает подключения туннеля через listenTCP, который
+// применяет Config.AllowCIDRs, и возвращает адрес слушателя
+func serveAllowed(t *testing.T, c *Client) string {
+	t.Helper()
+	listener, err := c.listenTCP(endpoint{network: "tcp", addr: "127.0.0.1:0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tun := Tunnel{LocalAddr: listener.Addr().String(), Handshake: testHandshake}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		c.acceptLoop(ctx, tun, listener, "TCP-порт", c.tunnelLimiter(tun))
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+		c.sessions.drain(time.Second)
+	})
+	return tun.LocalAddr
+}
+
+func TestAllowCIDRsRejects(t *testing.T) {
+	srv := fakeserver.New("")
+	defer srv.Close()
+	c := newTestClient(t, Config{Dialer: srv, AllowCIDRs: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}})
+	addr := serveAllowed(t, c)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); !errors.Is(err, io.EOF) {
+		t.Fatalf("подключение из запрещённой подсети не закрыто: %v", err)
+	}
+	if got := srv.Handshakes(); len(got) != 0 {
+		t.Errorf("для запрещённого клиента открыто соединение с сервером: %q", got)
+	}
+}
+
+func TestAllowCIDRsAccepts(t *testing.T) {
+	c := newTestClient(t, Config{AllowCIDRs: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8"), netip.MustParsePrefix("127.0.0.0/8")}})
+	addr := serveAllowed(t, c)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	roundTrip(t, conn, "ping")
+}
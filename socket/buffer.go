@@ -0,0 +1,36 @@
+package socket
+
+import (
+	"io"
+	"sync"
+)
+
+// defaultBufferSize — размер буфера копирования по умолчанию
+const defaultBufferSize = 32 * 1024
+
+// bufferPool — пул буферов копирования одного размера, общий для всех
+// соединений клиента
+type bufferPool struct {
+	pool sync.Pool
+}
+
+func newBufferPool(size int) *bufferPool {
+	return &bufferPool{pool: sync.Pool{New: func() any {
+		buf := make([]byte, size)
+		return &buf
+	}}}
+}
+
+func (p *bufferPool) get() *[]byte {
+	return p.pool.Get().(*[]byte)
+}
+
+func (p *bufferPool) put(buf *[]byte) {
+	p.pool.Put(buf)
+}
+
+// readerOnly и writerOnly скрывают WriterTo и ReaderFrom, чтобы
+// io.CopyBuffer всегда копировал через переданный буфер, а не выделял свой
+type readerOnly struct{ io.Reader }
+
+type writerOnly struct{ io.Writer }
@@ -0,0 +1,29 @@
+package socket
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+// Выделения памяти на копирование одного соединения: io.Copy создаёт
+// буфер на каждый вызов, пул переиспользует буферы между соединениями
+func BenchmarkCopyBuffer(b *testing.B) {
+	data := make([]byte, 64*1024)
+
+	b.Run("io.Copy", func(b *testing.B) {
+		b.ReportAllocs()
+		for b.Loop() {
+			io.Copy(writerOnly{io.Discard}, readerOnly{bytes.NewReader(data)})
+		}
+	})
+	b.Run("pool", func(b *testing.B) {
+		pool := newBufferPool(defaultBufferSize)
+		b.ReportAllocs()
+		for b.Loop() {
+			buf := pool.get()
+			io.CopyBuffer(writerOnly{io.Discard}, readerOnly{bytes.NewReader(data)}, *buf)
+			pool.put(buf)
+		}
+	})
+}
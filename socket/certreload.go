@@ -0,0 +1,80 @@
+package socket
+
+import (
+	"crypto/tls"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// certReloader отдаёт клиентский сертификат mTLS и перечитывает его с диска,
+// когда меняется время изменения файла сертификата или ключа. Проверка
+// делается при каждом TLS-рукопожатии, поэтому обновлённый сертификат
+// используется со следующего подключения без перезапуска клиента.
+type certReloader struct {
+	certPath, keyPath string
+
+	mu              sync.Mutex
+	cert            *tls.Certificate
+	certMod, keyMod time.Time
+}
+
+// newCertReloader загружает сертификат; ошибка первой загрузки возвращается сразу
+func newCertReloader(certPath, keyPath string) (*certReloader, error) {
+	r := &certReloader{certPath: certPath, keyPath: keyPath}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// reload перечитывает пару, если файлы изменились. Вызывается под mu
+// или до того, как reloader стал доступен другим горутинам.
+func (r *certReloader) reload() error {
+	certMod, err := modTime(r.certPath)
+	if err != nil {
+		return err
+	}
+	keyMod, err := modTime(r.keyPath)
+	if err != nil {
+		return err
+	}
+	if r.cert != nil && certMod.Equal(r.certMod) && keyMod.Equal(r.keyMod) {
+		return nil
+	}
+	// Неудачная пара не перечитывается, пока файлы не изменятся снова
+	r.certMod, r.keyMod = certMod, keyMod
+
+	cert, err := tls.LoadX509KeyPair(r.certPath, r.keyPath)
+	if err != nil {
+		return fmt.Errorf("загрузка клиентского сертификата %s: %w", r.certPath, err)
+	}
+	if r.cert != nil {
+		log.WithField("cert", r.certPath).Info("Клиентский сертификат обновлён")
+	}
+	r.cert = &cert
+	return nil
+}
+
+// clientCertificate — tls.Config.GetClientCertificate. Если новые файлы
+// не загружаются (например, записан только сертификат, а ключ ещё старый),
+// используется прежний сертификат.
+func (r *certReloader) clientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.reload(); err != nil {
+		log.WithError(err).Warn("Не удалось обновить клиентский сертификат, используем прежний")
+	}
+	return r.cert, nil
+}
+
+func modTime(path string) (time.Time, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("клиентский сертификат: %w", err)
+	}
+	return info.ModTime(), nil
+}
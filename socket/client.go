@@ -1,14 +1,17 @@
 package socket
 
 import (
+	"context"
 	"errors"
 	"fmt"
-	"io"
 	"net"
 	"os"
+	"os/signal"
 	"path/filepath"
-	"strings"
+	"strconv"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 	"usbmuxd-client/crypt"
 
@@ -17,246 +20,802 @@ import (
 
 // Tunnel описывает конфигурацию одного туннеля
 type Tunnel struct {
-	localAddr string // например: "127.0.0.1:7777" или "/var/run/usbmuxd"
-	handshake string // ключ для сервера: "forward" или "usbmuxd"
-}
+	LocalAddr string `json:"localAddr" yaml:"localAddr" toml:"localAddr"`                         // например: "127.0.0.1:7777" или "/var/run/usbmuxd"
+	Handshake string `json:"handshake" yaml:"handshake" toml:"handshake"`                         // ключ для сервера: "<UDID> <сервис>", например "<UDID> usbmux"
+	Network   string `json:"network,omitempty" yaml:"network,omitempty" toml:"network,omitempty"` // "unix", "tcp", "tcp4", "tcp6", "socks5", "udp"; пусто — определяется по LocalAddr
+	Dial      bool   `json:"dial,omitempty" yaml:"dial,omitempty" toml:"dial,omitempty"`          // подключаться к LocalAddr, а не слушать его
 
-// Переменные окружения
-var (
-	serverAddr   = os.Getenv("USBMUXD_HOST")
-	serverPort   = os.Getenv("USBMUXD_PORT")
-	serverSocket = os.Getenv("USBMUXD_SOCKET")
-)
+	// Сервер туннеля; пустые поля берутся из общей конфигурации
+	ServerAddr string `json:"serverAddr,omitempty" yaml:"serverAddr,omitempty" toml:"serverAddr,omitempty"` // адреса серверов через запятую, как USBMUXD_HOST
+	ServerPort string `json:"serverPort,omitempty" yaml:"serverPort,omitempty" toml:"serverPort,omitempty"` // порт по умолчанию для ServerAddr
 
-// tunnels — список туннелей, которые нужно запустить
-var tunnels = []Tunnel{
-	{localAddr: serverSocket, handshake: "00008030001454190EEB802E usbmux"},
-	{localAddr: "127.0.0.1:7777", handshake: "00008030001454190EEB802E wda"},
+	RateLimit int64 `json:"rateLimit,omitempty" yaml:"rateLimit,omitempty" toml:"rateLimit,omitempty"` // байт в секунду на направление для всех соединений туннеля; 0 — Config.TunnelRateLimit
+	MaxConns  int   `json:"maxConns,omitempty" yaml:"maxConns,omitempty" toml:"maxConns,omitempty"`    // лимит одновременных соединений туннеля; 0 — Config.MaxConns
 }
 
-func isClosedError(err error) bool {
-	if err == nil {
-		return false
+// NewTunnel создаёт туннель, проверяя локальный адрес и handshake
+func NewTunnel(localAddr, handshake string) (Tunnel, error) {
+	t := Tunnel{LocalAddr: localAddr, Handshake: handshake}
+	if _, err := t.endpoint(); err != nil {
+		return Tunnel{}, err
 	}
-	opErr, ok := err.(*net.OpError)
-	return ok && (opErr.Err.Error() == "use of closed network connection" || opErr.Err.Error() == "connection reset by peer")
+	if err := validateHandshake(handshake); err != nil {
+		return Tunnel{}, err
+	}
+	return t, nil
+}
+
+// Client — клиент туннелей со своей конфигурацией. Несколько клиентов
+// с разными настройками могут работать в одном процессе.
+type Client struct {
+	cfg          Config
+	upstreams    []upstream
+	nextUpstream atomic.Uint32 // индекс сервера, с которого начнётся следующее подключение
+	pool         *copyPool     // nil — горутина на соединение
+	buffers      *bufferPool
+	sessions     *sessionSet
+	health       healthRegistry
+	stats        statsRegistry
+	connSeq      atomic.Uint64 // счётчик для идентификаторов соединений в логах
+	held         atomic.Int64  // подключения, ждущие сервера в DialHold
+	reach        reachability
+	tunnelReach  tunnelReachability // доступность собственных серверов туннелей
+	tunnelRates  tunnelRates        // общие ограничения скорости туннелей
+	limiters     tunnelLimiters     // ограничители соединений туннелей
+	inherited    inheritedListeners // слушатели из Config.Listeners, ещё не занятые туннелями
+	mux          muxSessions
+	quic         quicConns
+	tunnels      tunnelRegistry // запущенные туннели по локальному адресу
+	drains       sync.WaitGroup // выполняющиеся вызовы Drain
+	events       *eventBus
+	eventsOnce   sync.Once
+
+	ciphers []crypt.HandshakeCipher // шифры handshake в порядке попыток; nil в списке — без шифрования
+
+	mu       sync.Mutex
+	stopCtx  context.Context // отменяется вызовом Stop
+	stop     context.CancelFunc
+	running  sync.WaitGroup
+	stopOnce sync.Once
 }
 
-func isConnectionOpen(conn net.Conn) (bool, error) {
-	if conn == nil {
-		return false, errors.New("соединение равно nil")
+// encrypted сообщает, что handshake шифруется
+func (c *Client) encrypted() bool {
+	return c.ciphers[0] != nil
+}
+
+// newConnLogger возвращает короткий идентификатор нового соединения и
+// логгер с ним; все записи о соединении делаются через этот логгер
+func (c *Client) newConnLogger() (string, *log.Entry) {
+	id := strconv.FormatUint(c.connSeq.Add(1), 36)
+	return id, log.WithField("conn", id)
+}
+
+// errClientStopped — клиент уже остановлен вызовом Stop
+var errClientStopped = errors.New("клиент остановлен")
+
+// NewClient создаёт клиента с конфигурацией cfg
+func NewClient(cfg Config) (*Client, error) {
+	cfg = cfg.withDefaults()
+	if err := cfg.Validate(); err != nil {
+		return nil, err
 	}
-	if _, err := conn.Write(nil); err != nil {
-		return false, err
+
+	c := &Client{
+		cfg:       cfg,
+		upstreams: parseUpstreams(cfg.Servers, cfg.ServerPort),
+		sessions:  newSessionSet(),
+		buffers:   newBufferPool(cfg.BufferSize),
+		events:    newEventBus(),
+		ciphers:   handshakeCiphers(cfg),
+	}
+	if len(c.upstreams) == 0 {
+		return nil, errors.New("не задан ни один сервер")
+	}
+	if cfg.CopyWorkers > 0 {
+		c.pool = newCopyPool(cfg.CopyWorkers, cfg.MaxConnsMode)
 	}
-	return true, nil
+	c.inherited.set(cfg.Listeners)
+	c.stopCtx, c.stop = context.WithCancel(context.Background())
+	c.warnIPFamily()
+	return c, nil
 }
 
-func startProxy(a, b net.Conn) {
-	log.WithFields(log.Fields{
-		"from": a.RemoteAddr(),
-		"to":   b.RemoteAddr(),
-	}).Info("Начало проксирования")
+// NewClientFromEnv создаёт клиента по переменным окружения USBMUXD_*,
+// HANDSHAKE_SECRET (или HANDSHAKE_SECRET_FILE), METRICS_ADDR и HEALTH_ADDR.
+// При активации через сокет клиент получает слушателей от systemd.
+func NewClientFromEnv() (*Client, error) {
+	cfg, err := configFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	if err := withSystemdListeners(&cfg); err != nil {
+		return nil, err
+	}
+	return NewClient(cfg)
+}
 
-	var wg sync.WaitGroup
-	wg.Add(2)
+// Клиент по умолчанию для функций пакета, создаётся из окружения при первом обращении
+var (
+	defaultOnce  sync.Once
+	defaultCl    *Client
+	defaultClErr error
+)
 
-	closeOnce := sync.OnceFunc(func() {
-		a.Close()
-		b.Close()
-	})
+// defaultClient возвращает клиента по умолчанию
+func defaultClient() (*Client, error) {
+	defaultOnce.Do(func() { defaultCl, defaultClErr = NewClientFromEnv() })
+	return defaultCl, defaultClErr
+}
 
-	go func() {
-		defer wg.Done()
-		if ok, _ := isConnectionOpen(a); !ok {
-			log.Debug("A уже закрыто, не запускаем A->B")
-			return
-		}
-		_, err := io.Copy(b, a)
-		if err != nil && !isClosedError(err) {
-			log.WithError(err).WithFields(log.Fields{
-				"source": a.RemoteAddr(),
-				"dest":   b.RemoteAddr(),
-			}).Error("Ошибка A->B")
+// connectToUpstream подключается к конкретному серверу и отправляет handshake.
+// local — принятое локальное подключение, для заголовка PROXY; может быть nil.
+// Если сервер отклонил handshake, он повторяется в новом соединении со
+// следующим запасным ключом.
+func (c *Client) connectToUpstream(ctx context.Context, logger *log.Entry, u upstream, local net.Conn, handshake string) (net.Conn, error) {
+	var lastErr error
+	for i, cipher := range c.ciphers {
+		conn, err := c.sendHandshake(ctx, logger, u, local, handshake, cipher)
+		if err == nil {
+			if i > 0 {
+				logger.WithFields(log.Fields{
+					"server": u.String(),
+					"key":    i,
+				}).Warn("Сервер принял handshake только с запасным ключом")
+			}
+			return conn, nil
 		}
-		closeOnce()
-	}()
-
-	go func() {
-		defer wg.Done()
-		if ok, _ := isConnectionOpen(b); !ok {
-			log.Debug("B уже закрыто, не запускаем B->A")
-			return
+		if !errors.Is(err, ErrHandshakeRejected) {
+			return nil, err
 		}
-		_, err := io.Copy(a, b)
-		if err != nil && !isClosedError(err) {
-			log.WithError(err).WithFields(log.Fields{
-				"source": b.RemoteAddr(),
-				"dest":   a.RemoteAddr(),
-			}).Error("Ошибка B->A")
+		lastErr = err
+		if i < len(c.ciphers)-1 {
+			logger.WithField("server", u.String()).Info("Пробуем следующий запасной ключ handshake")
 		}
-		closeOnce()
-	}()
-
-	wg.Wait()
-	log.Info("Проксирование завершено")
+	}
+	return nil, lastErr
 }
 
-func connectToServer(handshake string) (net.Conn, error) {
-	serverFullAddr := fmt.Sprintf("%s:%s", serverAddr, serverPort)
-	conn, err := net.DialTimeout("tcp", serverFullAddr, 10*time.Second)
+// sendHandshake устанавливает соединение с сервером u и отправляет
+// handshake, зашифрованный шифром cipher (nil — без шифрования). Отмена
+// ctx прерывает и подключение, и отправку handshake с ожиданием подтверждения.
+func (c *Client) sendHandshake(ctx context.Context, logger *log.Entry, u upstream, local net.Conn, handshake string, cipher crypt.HandshakeCipher) (net.Conn, error) {
+	conn, err := c.dialServer(ctx, u)
 	if err != nil {
-		log.WithError(err).WithField("server", serverFullAddr).Error("Ошибка подключения к серверу")
-		return nil, err
+		serverDialErrors.WithLabelValues(u.String()).Inc()
+		c.reach.set(u.String(), err)
+		logger.WithError(err).WithField("server", u.String()).Error("Ошибка подключения к серверу")
+		return nil, fmt.Errorf("%w: %s: %w", ErrServerUnreachable, u.String(), err)
 	}
 
+	// Закрытие соединения прерывает зависшие запись и чтение; после
+	// успешного handshake соединение больше не привязано к ctx
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
 	// Шифруем handshake
-	encryptedHandshake, err := crypt.EncryptHandshake(handshake)
+	encodedHandshake, err := encodeHandshake(handshake, cipher)
 	if err != nil {
-		log.WithError(err).Error("Не удалось зашифровать handshake")
+		handshakeErrors.WithLabelValues("encrypt").Inc()
+		logger.WithError(err).Error("Не удалось зашифровать handshake")
 		conn.Close()
 		return nil, err
 	}
 
-	// Отправляем зашифрованный handshake
-	if _, err := conn.Write([]byte(encryptedHandshake + "\n")); err != nil {
-		log.WithError(err).Error("Ошибка отправки handshake")
+	// Отправляем handshake одной строкой, перед ним — заголовок PROXY, если включён
+	var header string
+	if c.cfg.ProxyProtocol {
+		header = proxyHeader(local)
+	}
+	if err := writeHandshake(conn, []byte(header+encodedHandshake+"\n"), c.cfg.DialTimeout); err != nil {
+		handshakeErrors.WithLabelValues("write").Inc()
+		logger.WithError(err).Error("Ошибка отправки handshake")
 		conn.Close()
-		return nil, err
+		return nil, contextError(ctx, err)
+	}
+
+	// Ждём подтверждения от сервера, если оно включено
+	if c.cfg.HandshakeAck != "" {
+		if err := readAck(conn, c.cfg.HandshakeAck, c.cfg.AckTimeout, cipher); err != nil {
+			handshakeErrors.WithLabelValues(ackErrorReason(err)).Inc()
+			logger.WithError(err).WithField("server", u.String()).Error("Сервер не подтвердил handshake")
+			conn.Close()
+			return nil, contextError(ctx, err)
+		}
+	}
+	if !stop() {
+		// ctx отменён, соединение уже закрыто
+		return nil, ctx.Err()
+	}
+	c.reach.set(u.String(), nil)
+	if connLogs.allow() {
+		logger.WithFields(log.Fields{
+			"handshake": displayHandshake(handshake, c.encrypted()),
+			"server":    u.String(),
+		}).Info("connectToServer success")
 	}
-	log.WithField("handshake", handshake).Info("connectToServer success")
 	return conn, nil
 }
 
+// contextError возвращает причину отмены ctx вместо err, если ctx отменён:
+// ошибка закрытого соединения в этом случае лишь следствие отмены
+func contextError(ctx context.Context, err error) error {
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return fmt.Errorf("%w: %w", ctxErr, err)
+	}
+	return err
+}
+
 // handleUnixSocket создаёт Unix-сокет и слушает на нём
-func handleUnixSocket(t Tunnel) {
-	socketPath := t.localAddr
+func (c *Client) handleUnixSocket(ctx context.Context, t Tunnel, ep endpoint, ready func(error)) error {
+	socketPath := ep.addr
+	err := c.serveListener(ctx, t, "Unix-сокет", func() (net.Listener, error) {
+		return c.listenUnix(socketPath)
+	}, ready)
+	if err == nil && !isAbstract(socketPath) && !c.inheritedAddr(socketPath) {
+		log.WithField("socket", socketPath).Info("Unix-сокет закрыт и удалён")
+	}
+	return err
+}
 
-	// Очищаем путь от старого сокета, если он есть
-	os.Remove(socketPath)
+// staleSocketTimeout — время на проверку, отвечает ли существующий Unix-сокет
+const staleSocketTimeout = time.Second
+
+// removeStaleSocket удаляет оставшийся от прошлого запуска файл сокета.
+// Если на сокете кто-то отвечает, файл не трогается и возвращается
+// EADDRINUSE: иначе второй экземпляр молча перехватил бы адрес первого.
+func removeStaleSocket(socketPath string) error {
+	if _, err := os.Lstat(socketPath); errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if conn, err := net.DialTimeout("unix", socketPath, staleSocketTimeout); err == nil {
+		conn.Close()
+		return fmt.Errorf("сокет обслуживается другим процессом: %w", syscall.EADDRINUSE)
+	}
+	if err := os.Remove(socketPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// listenUnix создаёт Unix-сокет на месте старого и выставляет права и
+// владельца файла. Если для пути есть готовый слушатель в Config.Listeners,
+// используется он.
+// Для абстрактного сокета файловая система не затрагивается.
+func (c *Client) listenUnix(socketPath string) (net.Listener, error) {
+	if listener := c.inherited.take(socketPath); listener != nil {
+		// Файлом сокета, его правами и владельцем управляет тот, кто его создал
+		log.WithField("socket", socketPath).Info("Слушается переданный Unix-сокет")
+		return c.restrictPeers(listener), nil
+	}
+	if isAbstract(socketPath) {
+		// Абстрактный сокет исчезает вместе с последним дескриптором
+		listener, err := net.Listen("unix", socketPath)
+		if err != nil {
+			return nil, listenError(socketPath, "Unix-сокет", err)
+		}
+		log.WithField("socket", socketPath).Info("Создан и слушается абстрактный Unix-сокет")
+		return c.restrictPeers(listener), nil
+	}
+
+	// Очищаем путь от старого сокета, если его никто не обслуживает
+	if err := removeStaleSocket(socketPath); err != nil {
+		return nil, listenError(socketPath, "Unix-сокет", err)
+	}
 
 	// Создаём директорию, если её нет
-	if err := os.MkdirAll(filepath.Dir(socketPath), 0755); err != nil {
-		log.WithError(err).WithField("path", filepath.Dir(socketPath)).Fatal("Не удалось создать директорию для сокета")
+	if err := os.MkdirAll(filepath.Dir(socketPath), c.cfg.SocketDirMode); err != nil {
+		log.WithError(err).WithField("path", filepath.Dir(socketPath)).Error("Не удалось создать директорию для сокета")
+		return nil, fmt.Errorf("создание директории для сокета %s: %w", socketPath, err)
 	}
 
-	listener, err := net.Listen("unix", socketPath)
+	var listener net.Listener
+	listen := func() (err error) {
+		listener, err = net.Listen("unix", socketPath)
+		return err
+	}
+	var err error
+	if c.cfg.SocketUmask {
+		err = withUmask(c.cfg.SocketMode, listen)
+	} else {
+		err = listen()
+	}
 	if err != nil {
-		log.WithError(err).WithField("socket", socketPath).Fatal("Не удалось создать Unix-сокет")
+		return nil, listenError(socketPath, "Unix-сокет", err)
+	}
+	// Файл сокета создан этим процессом — удаляем его при закрытии слушателя
+	listener.(*net.UnixListener).SetUnlinkOnClose(true)
+
+	// Выставляем права и владельца файла сокета; ошибка не мешает работе туннеля
+	if err := os.Chmod(socketPath, c.cfg.SocketMode); err != nil {
+		log.WithError(err).WithFields(log.Fields{
+			"socket": socketPath,
+			"mode":   c.cfg.SocketMode,
+		}).Error("Не удалось изменить права Unix-сокета")
+	}
+	if c.cfg.SocketOwner != "" {
+		uid, gid, _ := parseSocketOwner(c.cfg.SocketOwner) // проверено в Validate
+		if err := os.Chown(socketPath, uid, gid); err != nil {
+			log.WithError(err).WithFields(log.Fields{
+				"socket": socketPath,
+				"owner":  c.cfg.SocketOwner,
+			}).Error("Не удалось сменить владельца Unix-сокета")
+		}
 	}
-	defer listener.Close()
 
 	log.WithField("socket", socketPath).Info("Создан и слушается Unix-сокет")
+	return c.restrictPeers(listener), nil
+}
 
-	for {
-		localConn, err := listener.Accept()
-		if err != nil {
-			log.WithError(err).Error("Ошибка принятия соединения на Unix-сокете")
-			continue
-		}
+// restrictPeers при заданных AllowUIDs или AllowGIDs пропускает на Unix-сокет
+// только процессы разрешённых пользователей и групп
+func (c *Client) restrictPeers(listener net.Listener) net.Listener {
+	if len(c.cfg.AllowUIDs) == 0 && len(c.cfg.AllowGIDs) == 0 {
+		return listener
+	}
+	return &peerAllowListener{Listener: listener, uids: c.cfg.AllowUIDs, gids: c.cfg.AllowGIDs}
+}
 
-		log.WithField("client", localConn.RemoteAddr()).Info("Новое подключение к Unix-сокету")
+// handleTCPListener создаёт TCP-слушателя и перенаправляет подключения
+func (c *Client) handleTCPListener(ctx context.Context, t Tunnel, ep endpoint, ready func(error)) error {
+	return c.serveListener(ctx, t, "TCP-порт", func() (net.Listener, error) {
+		return c.listenTCP(ep)
+	}, ready)
+}
 
-		// Подключаемся к серверу
-		serverConn, err := connectToServer(t.handshake)
-		if err != nil {
-			log.WithError(err).Error("Не удалось подключиться к серверу")
-			localConn.Close()
-			continue
+// listenTCP создаёт TCP-слушателя или берёт готового из Config.Listeners;
+// при заданных AllowCIDRs он пропускает только подключения из разрешённых сетей
+func (c *Client) listenTCP(ep endpoint) (net.Listener, error) {
+	tcpAddr := ep.addr
+
+	message := "Слушается переданный TCP-слушатель"
+	listener := c.inherited.take(tcpAddr)
+	if listener == nil {
+		// Создаём TCP-слушателя
+		var err error
+		if listener, err = net.Listen(ep.network, tcpAddr); err != nil {
+			return nil, listenError(tcpAddr, "TCP-слушатель", err)
 		}
+		message = "Создан и слушается TCP-слушатель"
+	}
+	if len(c.cfg.AllowCIDRs) > 0 {
+		listener = &allowListener{Listener: listener, allow: c.cfg.AllowCIDRs}
+	}
 
-		// Запускаем прокси
-		go startProxy(localConn, serverConn)
+	log.WithField("address", tcpAddr).Info(message)
+	return listener, nil
+}
+
+// listenError логирует ошибку создания слушателя и возвращает её с адресом.
+// Занятый адрес выделяется отдельно: обычно его держит другой процесс
+// или второй экземпляр клиента.
+func listenError(addr, kind string, err error) error {
+	if errors.Is(err, syscall.EADDRINUSE) {
+		log.WithError(err).WithField("address", addr).Error("Адрес уже занят другим процессом, туннель пропущен")
+		return fmt.Errorf("%s %s: адрес уже занят: %w", kind, addr, err)
 	}
+	log.WithError(err).WithField("address", addr).Error("Не удалось создать слушателя, туннель пропущен")
+	return fmt.Errorf("%s %s: %w", kind, addr, err)
 }
 
-// handleTCPListener создаёт TCP-слушателя и перенаправляет подключения
-func handleTCPListener(t Tunnel) {
-	tcpAddr := t.localAddr
+// acceptLoop принимает подключения на слушателе и проксирует каждое на сервер,
+// занимая для него слот limiter. При отмене ctx слушатель закрывается и цикл
+// завершается с nil. Если слушатель раз за разом возвращает неустранимые
+// ошибки, возвращается errListenerBroken, чтобы вызывающий пересоздал
+// слушателя.
+func (c *Client) acceptLoop(ctx context.Context, t Tunnel, listener net.Listener, kind string, limiter *connLimiter) error {
+	state := c.health.stateFor(t.LocalAddr)
+	state.setBound(true)
+	defer state.setBound(false)
 
-	// Создаём TCP-слушателя
-	listener, err := net.Listen("tcp", tcpAddr)
-	if err != nil {
-		log.WithError(err).WithField("address", tcpAddr).Fatal("Не удалось создать TCP-слушателя")
-	}
-	defer listener.Close()
+	stop := context.AfterFunc(ctx, func() { listener.Close() })
+	defer stop()
 
-	log.WithField("address", tcpAddr).Info("Создан и слушается TCP-слушатель")
+	var failures acceptFailures
 
 	for {
+		state.waiting()
+		if !limiter.waitSlot(ctx) {
+			log.WithField("listener", kind).Info("Слушатель остановлен")
+			return nil
+		}
+		if !c.pool.waitSlot(ctx) {
+			limiter.releaseWaited()
+			log.WithField("listener", kind).Info("Слушатель остановлен")
+			return nil
+		}
 		localConn, err := listener.Accept()
 		if err != nil {
-			log.WithError(err).Error("Ошибка принятия соединения на TCP-порту")
+			state.beat()
+			limiter.releaseWaited()
+			c.pool.releaseWaited()
+			if ctx.Err() != nil {
+				log.WithField("listener", kind).Info("Слушатель остановлен")
+				return nil
+			}
+			log.WithError(err).WithField("listener", kind).Error("Ошибка принятия соединения")
+			if err := failures.fail(ctx, err); err != nil {
+				return err
+			}
 			continue
 		}
+		failures.reset()
+		accepted := time.Now()
+		state.accepted()
+		setKeepAlive(localConn, c.cfg.KeepAlive)
 
-		log.WithField("client", localConn.RemoteAddr()).Info("Новое подключение к TCP-порту")
-
-		// Подключаемся к серверу
-		serverConn, err := connectToServer(t.handshake)
-		if err != nil {
-			log.WithError(err).Error("Не удалось подключиться к серверу")
+		if !limiter.admit() {
+			localConn.Close()
+			continue
+		}
+		if !c.pool.admit(t.LocalAddr) {
 			localConn.Close()
+			limiter.release()
 			continue
 		}
 
-		// Запускаем прокси
-		go startProxy(localConn, serverConn)
+		id, logger := c.newConnLogger()
+		logger = logger.WithField("local", t.LocalAddr)
+		if peer := peerFields(localConn); peer != nil {
+			logger = logger.WithFields(peer)
+		}
+		if connLogs.allow() {
+			logger.WithFields(log.Fields{
+				"client":   localConn.RemoteAddr(),
+				"listener": kind,
+			}).Info("Новое подключение")
+		}
+		c.events.emit(Event{Type: ConnectionOpened, Tunnel: t, ConnID: id})
+
+		// Рукопожатие SOCKS5 и подключение к серверу могут долго ждать:
+		// ведём их в отдельной горутине, чтобы цикл сразу вернулся в Accept
+		go c.serveConn(ctx, t, id, logger, localConn, accepted, limiter.release)
+	}
+}
+
+// serveConn для принятого соединения localConn проводит рукопожатие SOCKS5,
+// если туннель его требует, подключается к серверу и запускает
+// проксирование. release вызывается, когда соединение закрыто.
+func (c *Client) serveConn(ctx context.Context, t Tunnel, id string, logger *log.Entry, localConn net.Conn, accepted time.Time, release func()) {
+	// До проксирования соединение держит слот лимита и горутины пула
+	fail := func() {
+		localConn.Close()
+		c.pool.release()
+		release()
+	}
+
+	// SOCKS5-клиент сначала сообщает, куда подключаться
+	var target string
+	if t.mode() == modeSOCKS5 {
+		var err error
+		target, err = socks5Accept(localConn, c.cfg.SOCKSUser, c.cfg.SOCKSPassword)
+		if err != nil {
+			logger.WithError(err).Warn("Ошибка SOCKS5-рукопожатия")
+			fail()
+			return
+		}
+		logger = logger.WithField("target", target)
+	}
+
+	serverConn, err := c.openServerConn(ctx, logger, localConn, t)
+	if err == nil && target != "" {
+		// Цель SOCKS5 передаётся серверу строкой сразу после handshake,
+		// целиком и с тем же сроком, что и handshake
+		if err = writeHandshake(serverConn, []byte(target+"\n"), c.cfg.DialTimeout); err != nil {
+			err = fmt.Errorf("отправка цели SOCKS5: %w", err)
+			serverConn.Close()
+		}
+	}
+	if err != nil {
+		logger.WithError(err).Error("Не удалось подключиться к серверу")
+		c.events.emit(Event{Type: DialFailed, Tunnel: t, ConnID: id, Err: err})
+		if target != "" {
+			socks5Reply(localConn, socks5RepFailure)
+		}
+		fail()
+		return
+	}
+	if target != "" {
+		if err := socks5Reply(localConn, socks5RepOK); err != nil {
+			logger.WithError(err).Warn("Не удалось ответить SOCKS5-клиенту")
+			serverConn.Close()
+			fail()
+			return
+		}
 	}
+
+	// Запускаем прокси
+	c.events.emit(Event{Type: HandshakeSent, Tunnel: t, ConnID: id})
+	session := c.newProxySession(ctx, id, logger, t, localConn, serverConn)
+	session.opened = accepted
+	session.onDone = release
+	c.dispatchProxy(session)
 }
 
-func runTunnel(t Tunnel) {
+// runTunnel запускает туннель; ready вызывается, когда локальная сторона
+// готова (слушатель создан или соединение установлено) либо не удалась
+func (c *Client) runTunnel(ctx context.Context, t Tunnel, ready func(error)) error {
 	log.WithFields(log.Fields{
-		"local":     t.localAddr,
-		"handshake": t.handshake,
+		"local":     t.LocalAddr,
+		"handshake": displayHandshake(t.Handshake, c.encrypted()),
 	}).Info("Запуск туннеля")
 
-	// Если это Unix-сокет — создаём и слушаем
-	if strings.HasPrefix(t.localAddr, "/") {
-		handleUnixSocket(t)
-		return
+	ep, err := t.endpoint()
+	if err != nil {
+		return fmt.Errorf("туннель %s: %w", t.LocalAddr, err)
 	}
 
-	// Если это TCP-адрес — создаём TCP-слушателя
-	if strings.Contains(t.localAddr, ":") {
-		handleTCPListener(t)
-		return
+	if c.cfg.Mux && t.mode() != modeDial {
+		// Соединение с сервером устанавливается заранее, как только туннель готов
+		ready = c.keepMuxWhenReady(ctx, t, ready)
+	}
+
+	switch t.mode() {
+	case modeUnix:
+		// Unix-сокет — создаём и слушаем
+		return c.handleUnixSocket(ctx, t, ep, ready)
+	case modeTCPListen, modeSOCKS5:
+		// TCP-адрес — создаём TCP-слушателя; для SOCKS5 он же ведёт рукопожатие
+		return c.handleTCPListener(ctx, t, ep, ready)
+	case modeUDP:
+		// UDP-адрес — пересылаем датаграммы
+		return c.handleUDPListener(ctx, t, ep, ready)
 	}
 
-	// Иначе — обычное TCP-подключение
-	serverConn, err := connectToServer(t.handshake)
+	// Иначе — подключаемся к локальному ресурсу
+	id, logger := c.newConnLogger()
+	logger = logger.WithField("local", t.LocalAddr)
+	c.events.emit(Event{Type: ConnectionOpened, Tunnel: t, ConnID: id})
+	serverConn, err := c.openServerConn(ctx, logger, nil, t)
 	if err != nil {
-		log.WithError(err).Error("Не удалось подключиться к серверу")
-		return
+		logger.WithError(err).Error("Не удалось подключиться к серверу")
+		c.events.emit(Event{Type: DialFailed, Tunnel: t, ConnID: id, Err: err})
+		return fmt.Errorf("туннель %s: %w", t.LocalAddr, err)
 	}
 
-	localConn, err := net.Dial("tcp", t.localAddr)
+	localConn, err := c.dialLocal(ctx, logger, ep)
 	if err != nil {
-		log.WithError(err).WithField("local", t.localAddr).Error("Ошибка подключения к локальному ресурсу")
+		logger.WithError(err).Error("Ошибка подключения к локальному ресурсу")
 		serverConn.Close()
-		return
+		return fmt.Errorf("туннель %s: %w", t.LocalAddr, err)
+	}
+	setKeepAlive(localConn, c.cfg.KeepAlive)
+	ready(nil)
+
+	c.events.emit(Event{Type: HandshakeSent, Tunnel: t, ConnID: id})
+	startProxy(c.newProxySession(ctx, id, logger, t, localConn, serverConn))
+	return nil
+}
+
+// Run настраивает логирование, запускает все туннели из списка
+// и останавливает их по SIGINT/SIGTERM. Для встраивания в другой сервис
+// без переменных окружения используйте Manager.
+func Run() error {
+	if err := ConfigureLogging(); err != nil {
+		return err
+	}
+	return runUntilSignal(RunContext)
+}
+
+// RunArgs работает как Run, но дополнительно принимает флаги командной
+// строки args (см. ParseFlags)
+func RunArgs(args []string) error {
+	if err := ConfigureLogging(); err != nil {
+		return err
+	}
+	c, err := ParseFlags(args)
+	if err != nil {
+		return err
+	}
+	return runUntilSignal(c.Run)
+}
+
+// runUntilSignal вызывает run с контекстом, который отменяется по SIGINT или SIGTERM.
+// Повторный сигнал во время остановки завершает процесс, не дожидаясь
+// активных соединений; оставшиеся Unix-сокеты удаляются при следующем запуске.
+func runUntilSignal(run func(context.Context) error) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case sig := <-sigs:
+			log.WithField("signal", sig).Info("Получен сигнал, останавливаем клиент")
+			cancel()
+		case <-done:
+			return
+		}
+		select {
+		case sig := <-sigs:
+			log.WithField("signal", sig).Warn("Повторный сигнал, завершаем работу без ожидания соединений")
+			os.Exit(1)
+		case <-done:
+		}
+	}()
+
+	return run(ctx)
+}
+
+// RunContext запускает клиента по умолчанию (настроенного из окружения)
+// и работает до отмены ctx
+func RunContext(ctx context.Context) error {
+	c, err := defaultClient()
+	if err != nil {
+		return err
 	}
+	return c.Run(ctx)
+}
+
+// RunTunnels запускает переданные туннели клиента по умолчанию и работает
+// до отмены ctx
+func RunTunnels(ctx context.Context, tunnels []Tunnel) error {
+	c, err := defaultClient()
+	if err != nil {
+		return err
+	}
+	return c.runTunnels(ctx, tunnels, nil)
+}
 
-	startProxy(localConn, serverConn)
+// Run запускает туннели клиента и работает до отмены ctx или вызова Stop.
+// Туннель, который не удалось запустить, пропускается, остальные продолжают
+// работу. После остановки слушатели закрываются, активным соединениям даётся
+// ShutdownGrace на завершение, после чего они закрываются принудительно.
+// Возвращает ошибки настройки или объединённые ошибки туннелей, если
+// не удалось запустить ни один из них.
+func (c *Client) Run(ctx context.Context) error {
+	return c.runTunnels(ctx, c.cfg.Tunnels, nil)
 }
 
-// Run запускает все туннели из списка
-func Run() {
-	if serverAddr == "" || serverPort == "" {
-		log.Fatal("Переменные окружения USBMUXD_HOST и USBMUXD_PORT должны быть установлены")
+// Stop останавливает клиента и ждёт завершения Run.
+// Остановленный клиент нельзя запустить повторно.
+func (c *Client) Stop() {
+	c.mu.Lock()
+	c.stop()
+	c.mu.Unlock()
+
+	c.running.Wait()
+	c.stopOnce.Do(func() {
+		if c.pool != nil {
+			c.pool.close()
+		}
+	})
+}
+
+// runTunnels запускает tunnels и работает до отмены ctx или вызова Stop.
+// Если задан started, он вызывается с числом работающих туннелей, когда все
+// они сообщили о готовности, а runTunnels не завершается вместе с последним
+// туннелем: новые можно добавить через AddTunnel.
+func (c *Client) runTunnels(ctx context.Context, tunnels []Tunnel, started func(running int)) error {
+	if err := validateTunnels(tunnels); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	if c.stopCtx.Err() != nil {
+		c.mu.Unlock()
+		return errClientStopped
 	}
-	log.WithField("host:port", serverAddr+":"+serverPort).Info("Запуск клиента")
+	c.running.Add(1)
+	c.mu.Unlock()
+	defer c.running.Done()
+
+	// Вспомогательные серверы останавливаются вместе с туннелями
+	ctx, cancel := context.WithCancel(ctx)
+	stopRun := context.AfterFunc(c.stopCtx, cancel)
+	defer stopRun()
+	var services sync.WaitGroup
+	defer services.Wait()
+	defer cancel()
+
+	if c.cfg.WatchdogTimeout > 0 {
+		go c.health.watch(ctx, c.cfg.WatchdogTimeout)
+	}
+	if c.cfg.MetricsAddr != "" {
+		services.Add(1)
+		go func() {
+			defer services.Done()
+			serveMetrics(ctx, c.cfg.MetricsAddr)
+		}()
+	}
+	if c.cfg.HealthAddr != "" {
+		services.Add(2)
+		go func() {
+			defer services.Done()
+			c.watchReachability(ctx, c.cfg.HealthInterval)
+		}()
+		go func() {
+			defer services.Done()
+			c.serveHealth(ctx, c.cfg.HealthAddr)
+		}()
+	}
+	log.WithField("servers", c.upstreams).Info("Запуск клиента")
 
-	var wg sync.WaitGroup
+	var wg, readyWg sync.WaitGroup
+	summaries := make([]tunnelSummary, len(tunnels))
+	errs := make([]error, len(tunnels))
 
-	for _, tunnel := range tunnels {
+	for i, tunnel := range tunnels {
 		wg.Add(1)
-		go func(t Tunnel) {
-			defer wg.Done()
-			runTunnel(t)
-		}(tunnel)
+		readyWg.Add(1)
+		summaries[i] = newTunnelSummary(tunnel, c.encrypted(), c.upstreamsFor(tunnel))
+
+		var once sync.Once
+		ready := func(err error) {
+			once.Do(func() {
+				summaries[i].err = err
+				readyWg.Done()
+			})
+		}
+
+		finished := func(err error) {
+			errs[i] = err
+			if err != nil {
+				ready(err)
+			}
+			ready(errTunnelStopped)
+			wg.Done()
+		}
+		if err := c.startTunnel(ctx, tunnel, ready, finished); err != nil {
+			finished(err)
+		}
 	}
 
-	wg.Wait()
+	go func() {
+		readyWg.Wait()
+		logStartupSummary(summaries)
+		c.inherited.warnUnclaimed()
+		if started != nil {
+			running := 0
+			for _, s := range summaries {
+				if s.err == nil {
+					running++
+				}
+			}
+			started(running)
+		}
+	}()
+
+	tunnelsDone := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(tunnelsDone)
+	}()
+
+	finish := tunnelsDone
+	if started != nil {
+		finish = nil
+	}
+	select {
+	case <-finish:
+	case <-ctx.Done():
+		log.Info("Остановка клиента")
+	}
+
+	// Туннели, остановленные Drain, дожидаются его: он сам ограничивает ожидание соединений
+	c.drains.Wait()
+	c.sessions.drain(c.cfg.ShutdownGrace)
+	c.mux.closeAll()
+	c.quic.closeAll()
+	<-tunnelsDone
 	log.Info("Все туннели завершили работу")
+
+	failed := 0
+	for _, err := range errs {
+		if err != nil {
+			failed++
+		}
+	}
+	if failed == len(tunnels) {
+		return errors.Join(errs...)
+	}
+	if failed > 0 {
+		log.WithError(errors.Join(errs...)).WithField("failed", failed).Warn("Часть туннелей не работала")
+	}
+	return nil
 }
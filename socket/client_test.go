@@ -0,0 +1,118 @@
+package socket
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+	"usbmuxd-client/fakeserver"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// Handshake туннелей в тестах
+const (
+	testHandshake       = "00008030001454190EEB802E wda"
+	testUsbmuxHandshake = "00008030001454190EEB802E usbmux"
+)
+
+// newTestClient создаёт клиента с конфигурацией cfg. Если сервер не задан,
+// подставляется адрес-заглушка, а без Dialer — эхо-сервер в памяти.
+// Клиент останавливается в конце теста.
+func newTestClient(t testing.TB, cfg Config) *Client {
+	t.Helper()
+	if len(cfg.Servers) == 0 {
+		cfg.Servers = []string{"fake:1"}
+	}
+	if cfg.Dialer == nil {
+		srv := fakeserver.New(cfg.HandshakeAck)
+		t.Cleanup(func() { srv.Close() })
+		cfg.Dialer = srv
+	}
+	c, err := NewClient(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(c.Stop)
+	return c
+}
+
+// serveTCP принимает подключения туннеля tun на свободном порту 127.0.0.1
+// и возвращает его адрес. В конце теста приём останавливается, а
+// оставшиеся соединения закрываются.
+func serveTCP(t testing.TB, c *Client, tun Tunnel) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tun.LocalAddr = listener.Addr().String()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		c.acceptLoop(ctx, tun, listener, "TCP-порт", c.tunnelLimiter(tun))
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+		c.sessions.drain(time.Second)
+	})
+	return tun.LocalAddr
+}
+
+// roundTrip отправляет msg в conn и ждёт тех же байт в ответ
+func roundTrip(t testing.TB, conn net.Conn, msg string) {
+	t.Helper()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	defer conn.SetDeadline(time.Time{})
+	if _, err := conn.Write([]byte(msg)); err != nil {
+		t.Fatalf("запись: %v", err)
+	}
+	got := make([]byte, len(msg))
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatalf("чтение ответа: %v", err)
+	}
+	if string(got) != msg {
+		t.Fatalf("получено %q, ожидалось %q", got, msg)
+	}
+}
+
+// counterValue возвращает текущее значение счётчика Prometheus
+func counterValue(t testing.TB, c prometheus.Counter) float64 {
+	t.Helper()
+	var m dto.Metric
+	if err := c.Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetCounter().GetValue()
+}
+
+// gaugeValue возвращает текущее значение датчика Prometheus
+func gaugeValue(t testing.TB, g prometheus.Gauge) float64 {
+	t.Helper()
+	var m dto.Metric
+	if err := g.Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetGauge().GetValue()
+}
+
+// waitEvent ждёт первого события типа typ
+func waitEvent(t testing.TB, events <-chan Event, typ EventType) Event {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case ev := <-events:
+			if ev.Type == typ {
+				return ev
+			}
+		case <-timeout:
+			t.Fatalf("не дождались события %s", typ)
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package socket
+
+import (
+	"compress/flate"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// compressCloseTimeout — сколько ждать отправки завершающего блока при закрытии
+const compressCloseTimeout = time.Second
+
+// compressedConn сжимает данные, отправляемые серверу, и распаковывает
+// полученные от него (deflate, USBMUXD_COMPRESS=1). Сервер должен делать то же.
+// Каждая запись завершается Flush: сжатый поток не копит данные, и
+// интерактивный обмен не задерживается.
+type compressedConn struct {
+	net.Conn
+	r io.ReadCloser
+
+	mu sync.Mutex // heartbeat и копирование могут писать одновременно
+	w  *flate.Writer
+}
+
+func newCompressedConn(conn net.Conn) *compressedConn {
+	w, _ := flate.NewWriter(conn, flate.BestSpeed) // ошибка только для неверного уровня
+	return &compressedConn{Conn: conn, r: flate.NewReader(conn), w: w}
+}
+
+func (c *compressedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (c *compressedConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n, err := c.w.Write(p)
+	if err != nil {
+		return n, err
+	}
+	return n, c.w.Flush()
+}
+
+// Close отправляет завершающий блок, чтобы собеседник получил чистый конец
+// потока, и закрывает соединение
+func (c *compressedConn) Close() error {
+	c.Conn.SetWriteDeadline(time.Now().Add(compressCloseTimeout))
+	c.mu.Lock()
+	c.w.Close()
+	c.mu.Unlock()
+	return c.Conn.Close()
+}
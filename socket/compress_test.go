@@ -0,0 +1,61 @@
+package socket
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+	"usbmuxd-client/fakeserver"
+)
+
+// countingConn считает байты, прочитанные из соединения
+type countingConn struct {
+	net.Conn
+	read *atomic.Int64
+}
+
+func (c countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.read.Add(int64(n))
+	return n, err
+}
+
+func TestCompressRoundTrip(t *testing.T) {
+	// Сервер распаковывает полученное и отправляет обратно сжатым
+	srv := fakeserver.New("")
+	var wire atomic.Int64
+	srv.Handler = func(handshake string, conn net.Conn) {
+		cc := newCompressedConn(countingConn{Conn: conn, read: &wire})
+		defer cc.Close()
+		io.Copy(cc, cc)
+	}
+	defer srv.Close()
+
+	c := newTestClient(t, Config{Dialer: srv, Compress: true})
+	addr := serveTCP(t, c, Tunnel{Handshake: testHandshake})
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// Короткое сообщение доходит без закрытия потока: каждая запись сбрасывается
+	roundTrip(t, conn, "ping")
+
+	payload := bytes.Repeat([]byte("<key>DeviceID</key><integer>3</integer>"), 4096)
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	go conn.Write(payload)
+	got := make([]byte, len(payload))
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, payload) {
+		t.Fatal("данные искажены при сжатии")
+	}
+	if n := wire.Load(); n >= int64(len(payload)) {
+		t.Errorf("по сети передано %d байт из %d: данные не сжаты", n, len(payload))
+	}
+}
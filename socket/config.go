@@ -0,0 +1,666 @@
+package socket
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"usbmuxd-client/crypt"
+	"usbmuxd-client/fakeserver"
+
+	"github.com/BurntSushi/toml"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+)
+
+// Значения по умолчанию
+const (
+	defaultShutdownGrace = 10 * time.Second // время на завершение активных соединений при остановке
+	defaultDialTimeout   = 10 * time.Second // таймаут подключения к серверу
+	defaultAckTimeout    = 5 * time.Second  // таймаут ожидания подтверждения handshake
+	defaultDialRounds    = 3                // число раундов перебора серверов
+	defaultSocketMode    = 0600             // права файла Unix-сокета
+	defaultSocketDirMode = 0755             // права директории Unix-сокета
+	defaultMaxHeld       = 256              // подключений, одновременно ждущих сервера в DialHold
+)
+
+// Config — настройки клиента. Нулевые Dialer, LocalDialer, DialTimeout, AckTimeout,
+// DialRounds, MaxHeld, LocalDialInterval, MaxConnsMode, BufferSize, SocketMode,
+// SocketDirMode, HealthInterval и HeartbeatTimeout заменяются значениями по умолчанию;
+// остальные поля используются как есть (0 отключает соответствующую функцию).
+type Config struct {
+	Servers    []string // серверы: "host", "host:port", "[::1]:port", "ws[s]://host[:port]/path" или "quic://host:port"
+	ServerPort string   // порт для серверов без собственного порта
+	Tunnels    []Tunnel
+
+	HandshakeSecret    string                // ключ шифрования handshake в base64; пусто — без шифрования
+	HandshakeFallbacks []string              // запасные ключи: пробуются по очереди, если сервер отклонил handshake (нужен HandshakeAck)
+	HandshakeCipher    crypt.HandshakeCipher // шифр handshake вместо AES-GCM на HandshakeSecret; nil — по HandshakeSecret
+	HandshakeAck       string                // ожидаемое подтверждение handshake; пусто — не ждать
+	AckTimeout         time.Duration         // таймаут ожидания подтверждения
+
+	Dialer        Dialer        // подключения к серверу; nil — net.Dialer
+	LocalDialer   *net.Dialer   // подключения dial-туннелей к локальным ресурсам, всегда напрямую; nil — net.Dialer
+	Proxy         string        // прокси для подключений к серверу: socks5://[user:pass@]host:port, http:// или https://; используется, если Dialer не задан
+	DialTimeout   time.Duration // таймаут подключения к одному серверу
+	DialRounds    int           // число раундов перебора серверов
+	DialHold      time.Duration // сколько подключение ждёт доступного сервера, повторяя раунды сверх DialRounds; 0 — только DialRounds
+	MaxHeld       int           // сколько подключений одновременно ждут сервера в DialHold; остальные закрываются после DialRounds
+	IPFamily      string        // prefer-ipv4, prefer-ipv6, ipv4-only, ipv6-only; пусто — Happy Eyeballs. Полностью действует только с net.Dialer: иному Dialer *-only передаётся сетью tcp4/tcp6, prefer-* не передаётся; к quic:// не применяется
+	TLS           *tls.Config   // TLS к серверу; nil — без TLS
+	KeepAlive     time.Duration // период TCP keepalive; 0 — отключён
+	Mux           bool          // передавать подключения потоками одного соединения (нужен совместимый сервер)
+	ProxyProtocol bool          // отправлять серверу заголовок PROXY protocol v1 с адресом TCP-клиента
+	Compress      bool          // сжимать данные между клиентом и сервером (нужен совместимый сервер)
+	SOCKSUser     string        // логин SOCKS5-туннелей; пусто — без аутентификации
+	SOCKSPassword string        // пароль SOCKS5-туннелей
+	Reconnect     bool          // переподключать туннели к usbmuxd при обрыве соединения с сервером (только для протоколов без состояния)
+
+	LocalDialRetries  int           // повторы подключения dial-туннеля к локальному ресурсу; 0 — одна попытка
+	LocalDialInterval time.Duration // пауза перед первым повтором, дальше удваивается (не более 5с)
+
+	HeartbeatInterval time.Duration // период проверки живости usbmuxd; 0 — отключена
+	HeartbeatTimeout  time.Duration // время ожидания ответа на проверку
+
+	FirstByteTimeout time.Duration // время от handshake до первого байта
+	IdleTimeout      time.Duration // время без данных в обе стороны
+	RWTimeout        time.Duration // срок одной операции чтения или записи при копировании; 0 — без срока
+	SlowConnWarn     time.Duration // предупреждать о соединениях длиннее порога при закрытии; 0 — не предупреждать
+	RateLimit        int64         // байт в секунду на направление соединения
+	TunnelRateLimit  int64         // байт в секунду на направление, общие для всех соединений туннеля; Tunnel.RateLimit переопределяет
+
+	Listeners map[string]net.Listener // готовые слушатели по локальному адресу туннеля (например, от systemd); туннель без своего слушателя создаёт его сам
+
+	AllowCIDRs   []netip.Prefix // подсети клиентов TCP- и UDP-слушателей; пусто — все
+	AllowUIDs    []int          // пользователи процессов, которым разрешён Unix-сокет (только Linux); пусто вместе с AllowGIDs — все
+	AllowGIDs    []int          // группы (основные или дополнительные) процессов, которым разрешён Unix-сокет
+	MaxConns     int            // лимит одновременных соединений туннеля; Tunnel.MaxConns переопределяет
+	MaxConnsMode string         // limitReject или limitBlock
+	CopyWorkers  int            // горутины копирования, по две на соединение; без свободных действует MaxConnsMode; 0 — свои горутины у каждого соединения
+	BufferSize   int            // размер буфера копирования в байтах
+
+	SocketMode    os.FileMode // права файла Unix-сокета
+	SocketDirMode os.FileMode // права директории Unix-сокета
+	SocketOwner   string      // владелец файла Unix-сокета "пользователь[:группа]"; пусто — не менять (сменить может только root)
+	SocketUmask   bool        // создавать Unix-сокет сразу с правами SocketMode через umask, без промежутка до chmod
+
+	ShutdownGrace   time.Duration // время на завершение соединений при остановке
+	WatchdogTimeout time.Duration // порог зависания цикла приёма соединений, не меньше 100мс
+	MetricsAddr     string        // адрес сервера /metrics; пусто — не запускать
+	HealthAddr      string        // адрес сервера /healthz; пусто — не запускать
+	HealthInterval  time.Duration // период фоновой проверки доступности сервера
+}
+
+// withDefaults возвращает копию конфигурации с заполненными значениями по умолчанию
+func (cfg Config) withDefaults() Config {
+	if cfg.Dialer == nil && cfg.Proxy != "" {
+		// Ошибка разбора адреса прокси сообщается Validate
+		if d, err := newProxyDialer(cfg.Proxy); err == nil && d != nil {
+			cfg.Dialer = d
+		}
+	}
+	if cfg.Dialer == nil {
+		cfg.Dialer = &net.Dialer{}
+	}
+	if cfg.LocalDialer == nil {
+		cfg.LocalDialer = &net.Dialer{}
+	}
+	if cfg.DialTimeout == 0 {
+		cfg.DialTimeout = defaultDialTimeout
+	}
+	if cfg.AckTimeout == 0 {
+		cfg.AckTimeout = defaultAckTimeout
+	}
+	if cfg.DialRounds == 0 {
+		cfg.DialRounds = defaultDialRounds
+	}
+	if cfg.MaxHeld == 0 {
+		cfg.MaxHeld = defaultMaxHeld
+	}
+	if cfg.LocalDialInterval == 0 {
+		cfg.LocalDialInterval = retryInitialDelay
+	}
+	if cfg.MaxConnsMode == "" {
+		cfg.MaxConnsMode = limitReject
+	}
+	if cfg.BufferSize == 0 {
+		cfg.BufferSize = defaultBufferSize
+	}
+	if cfg.SocketMode == 0 {
+		cfg.SocketMode = defaultSocketMode
+	}
+	if cfg.SocketDirMode == 0 {
+		cfg.SocketDirMode = defaultSocketDirMode
+	}
+	if cfg.HealthInterval == 0 {
+		cfg.HealthInterval = defaultHealthInterval
+	}
+	if cfg.HeartbeatTimeout == 0 {
+		cfg.HeartbeatTimeout = defaultHeartbeatTimeout
+	}
+	return cfg
+}
+
+// Validate проверяет конфигурацию и возвращает все найденные ошибки разом
+func (cfg Config) Validate() error {
+	cfg = cfg.withDefaults()
+	var errs []error
+	if len(cfg.Servers) == 0 {
+		errs = append(errs, errors.New("не задан ни один сервер"))
+	}
+	if cfg.ServerPort != "" && !validPort(cfg.ServerPort) {
+		errs = append(errs, fmt.Errorf("порт сервера должен быть числом от 1 до 65535, получено %q", cfg.ServerPort))
+	}
+	for _, s := range cfg.Servers {
+		if strings.Contains(s, "://") {
+			if _, err := parseURLUpstream(s); err != nil {
+				errs = append(errs, fmt.Errorf("сервер %q: %w", s, err))
+			}
+			continue
+		}
+		_, port, err := net.SplitHostPort(s)
+		switch {
+		case err != nil && cfg.ServerPort == "":
+			errs = append(errs, fmt.Errorf("у сервера %q нет порта, и порт по умолчанию не задан", s))
+		case err == nil && !validPort(port):
+			errs = append(errs, fmt.Errorf("сервер %q: порт должен быть числом от 1 до 65535", s))
+		}
+	}
+	if !validIPFamily(cfg.IPFamily) {
+		errs = append(errs, fmt.Errorf("семейство адресов должно быть одним из: prefer-ipv4, prefer-ipv6, ipv4-only, ipv6-only, получено %q", cfg.IPFamily))
+	}
+	if _, err := newProxyDialer(cfg.Proxy); err != nil {
+		errs = append(errs, err)
+	}
+	if cfg.DialRounds < 0 {
+		errs = append(errs, fmt.Errorf("число раундов подключения должно быть положительным, получено %d", cfg.DialRounds))
+	}
+	if cfg.LocalDialRetries < 0 || cfg.LocalDialInterval < 0 {
+		errs = append(errs, fmt.Errorf("повторы подключения к локальному ресурсу не могут быть отрицательными, получено %d и %s", cfg.LocalDialRetries, cfg.LocalDialInterval))
+	}
+	if cfg.ProxyProtocol && cfg.Mux {
+		errs = append(errs, errors.New("заголовок PROXY несовместим с мультиплексированием: в одном соединении с сервером идут подключения разных клиентов"))
+	}
+	if cfg.SOCKSPassword != "" && cfg.SOCKSUser == "" {
+		errs = append(errs, errors.New("пароль SOCKS5 задан без логина"))
+	}
+	if len(cfg.SOCKSUser) > 255 || len(cfg.SOCKSPassword) > 255 {
+		errs = append(errs, errors.New("логин и пароль SOCKS5 не длиннее 255 байт"))
+	}
+	if cfg.CopyWorkers != 0 && cfg.CopyWorkers < 2 {
+		errs = append(errs, fmt.Errorf("размер пула копирования должен быть не меньше 2, получено %d", cfg.CopyWorkers))
+	}
+	if cfg.DialTimeout < 0 || cfg.AckTimeout < 0 || cfg.KeepAlive < 0 || cfg.FirstByteTimeout < 0 ||
+		cfg.IdleTimeout < 0 || cfg.RWTimeout < 0 || cfg.DialHold < 0 || cfg.SlowConnWarn < 0 || cfg.ShutdownGrace < 0 || cfg.WatchdogTimeout < 0 || cfg.HealthInterval < 0 ||
+		cfg.HeartbeatInterval < 0 || cfg.HeartbeatTimeout < 0 {
+		errs = append(errs, errors.New("таймауты не могут быть отрицательными"))
+	}
+	if cfg.WatchdogTimeout > 0 && cfg.WatchdogTimeout < minWatchdogTimeout {
+		errs = append(errs, fmt.Errorf("порог зависания должен быть не меньше %s, получено %s", minWatchdogTimeout, cfg.WatchdogTimeout))
+	}
+	if cfg.RateLimit < 0 || cfg.TunnelRateLimit < 0 || cfg.MaxConns < 0 || cfg.MaxHeld < 0 || cfg.BufferSize < 0 {
+		errs = append(errs, errors.New("лимиты не могут быть отрицательными"))
+	}
+	if err := validLimitMode(cfg.MaxConnsMode); err != nil {
+		errs = append(errs, err)
+	}
+	if cfg.HandshakeSecret != "" {
+		if err := crypt.ValidateKey(cfg.HandshakeSecret); err != nil {
+			errs = append(errs, fmt.Errorf("ключ handshake: %w", err))
+		}
+	}
+	if cfg.HandshakeCipher != nil && cfg.HandshakeSecret != "" {
+		errs = append(errs, errors.New("заданы и шифр handshake (HandshakeCipher или HANDSHAKE_KEYRING), и ключ HandshakeSecret: используйте что-то одно"))
+	}
+	if len(cfg.HandshakeFallbacks) > 0 && cfg.HandshakeSecret == "" {
+		errs = append(errs, errors.New("запасные ключи handshake заданы без основного"))
+	}
+	if len(cfg.HandshakeFallbacks) > 0 && cfg.HandshakeAck == "" {
+		errs = append(errs, errors.New("запасные ключи handshake заданы без HandshakeAck (USBMUXD_HANDSHAKE_ACK): без подтверждения отказ сервера не распознать"))
+	}
+	for i, key := range cfg.HandshakeFallbacks {
+		if err := crypt.ValidateKey(key); err != nil {
+			errs = append(errs, fmt.Errorf("запасной ключ handshake %d: %w", i, err))
+		}
+	}
+	if (len(cfg.AllowUIDs) > 0 || len(cfg.AllowGIDs) > 0) && !peerCredSupported {
+		errs = append(errs, errors.New("ограничение Unix-сокета по пользователям и группам поддерживается только в Linux"))
+	}
+	if _, _, err := parseSocketOwner(cfg.SocketOwner); err != nil {
+		errs = append(errs, err)
+	}
+	if cfg.SocketMode > 0777 || cfg.SocketDirMode > 0777 {
+		errs = append(errs, fmt.Errorf("права Unix-сокета должны быть не больше 0777, получено %o и %o", cfg.SocketMode, cfg.SocketDirMode))
+	}
+	if err := validateTunnels(cfg.Tunnels); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// validPort сообщает, что port — номер TCP-порта
+func validPort(port string) bool {
+	n, err := strconv.Atoi(port)
+	return err == nil && n >= 1 && n <= 65535
+}
+
+// ValidateConfig разбирает и проверяет настройки из переменных окружения,
+// не открывая слушателей и соединений. Возвращает все найденные ошибки разом.
+func ValidateConfig() error {
+	cfg, err := configFromEnv()
+	if err != nil {
+		return err
+	}
+	return cfg.Validate()
+}
+
+// envOr возвращает значение переменной окружения или def, если она пуста
+func envOr(name, def string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return def
+}
+
+// parseDuration разбирает длительность из переменной окружения name.
+// Пустое значение оставляет *dst без изменений; positive запрещает 0.
+func parseDuration(name string, dst *time.Duration, positive bool) error {
+	raw := os.Getenv(name)
+	if raw == "" {
+		return nil
+	}
+	d, err := time.ParseDuration(raw)
+	if positive && (err != nil || d <= 0) {
+		return fmt.Errorf("%s должно быть положительной длительностью, получено %q", name, raw)
+	}
+	if err != nil || d < 0 {
+		return fmt.Errorf("%s должно быть неотрицательной длительностью, получено %q", name, raw)
+	}
+	*dst = d
+	return nil
+}
+
+// parseMode разбирает восьмеричные права из переменной окружения name
+func parseMode(name, example string, dst *os.FileMode) error {
+	raw := os.Getenv(name)
+	if raw == "" {
+		return nil
+	}
+	mode, err := strconv.ParseUint(raw, 8, 32)
+	if err != nil || mode > 0777 {
+		return fmt.Errorf("%s должно быть восьмеричными правами, например %s, получено %q", name, example, raw)
+	}
+	*dst = os.FileMode(mode)
+	return nil
+}
+
+// configFromEnv собирает конфигурацию из переменных окружения.
+// Ошибки разбора собираются все, а не только первая.
+func configFromEnv() (Config, error) {
+	cfg, errs := envConfig()
+	if len(cfg.Servers) == 0 || cfg.ServerPort == "" {
+		errs = append([]error{errors.New("переменные окружения USBMUXD_HOST и USBMUXD_PORT должны быть установлены")}, errs...)
+	}
+	if err := errors.Join(errs...); err != nil {
+		return Config{}, err
+	}
+	return cfg, nil
+}
+
+// envConfig разбирает переменные окружения, не требуя адреса сервера:
+// он может быть задан и флагами. Возвращает все ошибки разбора.
+func envConfig() (Config, []error) {
+	var errs []error
+	serverAddr := os.Getenv("USBMUXD_HOST")
+	serverPort := os.Getenv("USBMUXD_PORT")
+
+	cfg := Config{
+		ServerPort:       serverPort,
+		HandshakeAck:     os.Getenv("USBMUXD_HANDSHAKE_ACK"),
+		AckTimeout:       defaultAckTimeout,
+		DialTimeout:      defaultDialTimeout,
+		DialRounds:       defaultDialRounds,
+		MaxHeld:          defaultMaxHeld,
+		IPFamily:         os.Getenv("USBMUXD_IP_FAMILY"),
+		KeepAlive:        defaultKeepAlive,
+		MaxConnsMode:     envOr("USBMUXD_MAX_CONNS_MODE", limitReject),
+		BufferSize:       defaultBufferSize,
+		SocketMode:       defaultSocketMode,
+		SocketDirMode:    defaultSocketDirMode,
+		ShutdownGrace:    defaultShutdownGrace,
+		SocketOwner:      os.Getenv("USBMUXD_SOCKET_OWNER"),
+		SocketUmask:      os.Getenv("USBMUXD_SOCKET_UMASK") == "1",
+		MetricsAddr:      os.Getenv("METRICS_ADDR"),
+		HealthAddr:       os.Getenv("HEALTH_ADDR"),
+		Mux:              os.Getenv("USBMUXD_MUX") == "1",
+		Reconnect:        os.Getenv("USBMUXD_RECONNECT") == "1",
+		ProxyProtocol:    os.Getenv("USBMUXD_PROXY_PROTOCOL") == "1",
+		Compress:         os.Getenv("USBMUXD_COMPRESS") == "1",
+		SOCKSUser:        os.Getenv("USBMUXD_SOCKS5_USER"),
+		SOCKSPassword:    os.Getenv("USBMUXD_SOCKS5_PASSWORD"),
+		HealthInterval:   defaultHealthInterval,
+		HeartbeatTimeout: defaultHeartbeatTimeout,
+	}
+	for _, h := range strings.Split(serverAddr, ",") {
+		if h = strings.TrimSpace(h); h != "" {
+			cfg.Servers = append(cfg.Servers, h)
+		}
+	}
+	if serverAddr != "" && len(cfg.Servers) == 0 {
+		errs = append(errs, errors.New("USBMUXD_HOST не содержит ни одного сервера"))
+	}
+	if serverPort != "" && !validPort(serverPort) {
+		errs = append(errs, fmt.Errorf("USBMUXD_PORT должно быть числом от 1 до 65535, получено %q", serverPort))
+	}
+	if !validIPFamily(cfg.IPFamily) {
+		errs = append(errs, fmt.Errorf("USBMUXD_IP_FAMILY должно быть одним из: prefer-ipv4, prefer-ipv6, ipv4-only, ipv6-only, получено %q", cfg.IPFamily))
+	}
+	if raw := os.Getenv("USBMUXD_ALLOW_CIDRS"); raw != "" {
+		if list, err := parseCIDRs(raw); err != nil {
+			errs = append(errs, fmt.Errorf("USBMUXD_ALLOW_CIDRS: %w", err))
+		} else {
+			cfg.AllowCIDRs = list
+		}
+	}
+	if raw := os.Getenv("USBMUXD_ALLOW_UIDS"); raw != "" {
+		if ids, err := parseIDs(raw, lookupUID); err != nil {
+			errs = append(errs, fmt.Errorf("USBMUXD_ALLOW_UIDS: %w", err))
+		} else {
+			cfg.AllowUIDs = ids
+		}
+	}
+	if raw := os.Getenv("USBMUXD_ALLOW_GIDS"); raw != "" {
+		if ids, err := parseIDs(raw, lookupGID); err != nil {
+			errs = append(errs, fmt.Errorf("USBMUXD_ALLOW_GIDS: %w", err))
+		} else {
+			cfg.AllowGIDs = ids
+		}
+	}
+	if raw := os.Getenv("USBMUXD_COPY_WORKERS"); raw != "" {
+		if n, err := strconv.Atoi(raw); err != nil || n < 2 {
+			errs = append(errs, fmt.Errorf("USBMUXD_COPY_WORKERS должно быть целым числом не меньше 2, получено %q", raw))
+		} else {
+			cfg.CopyWorkers = n
+		}
+	}
+	if raw := os.Getenv("USBMUXD_DIAL_ROUNDS"); raw != "" {
+		if n, err := strconv.Atoi(raw); err != nil || n < 1 {
+			errs = append(errs, fmt.Errorf("USBMUXD_DIAL_ROUNDS должно быть положительным целым числом, получено %q", raw))
+		} else {
+			cfg.DialRounds = n
+		}
+	}
+	if raw := os.Getenv("USBMUXD_MAX_HELD"); raw != "" {
+		if n, err := strconv.Atoi(raw); err != nil || n < 1 {
+			errs = append(errs, fmt.Errorf("USBMUXD_MAX_HELD должно быть положительным целым числом, получено %q", raw))
+		} else {
+			cfg.MaxHeld = n
+		}
+	}
+	if raw := os.Getenv("USBMUXD_LOCAL_DIAL_RETRIES"); raw != "" {
+		if n, err := strconv.Atoi(raw); err != nil || n < 0 {
+			errs = append(errs, fmt.Errorf("USBMUXD_LOCAL_DIAL_RETRIES должно быть неотрицательным целым числом, получено %q", raw))
+		} else {
+			cfg.LocalDialRetries = n
+		}
+	}
+	if raw := os.Getenv("USBMUXD_MAX_CONNS"); raw != "" {
+		if n, err := strconv.Atoi(raw); err != nil || n < 0 {
+			errs = append(errs, fmt.Errorf("USBMUXD_MAX_CONNS должно быть неотрицательным целым числом, получено %q", raw))
+		} else {
+			cfg.MaxConns = n
+		}
+	}
+	if err := validLimitMode(cfg.MaxConnsMode); err != nil {
+		errs = append(errs, err)
+	}
+	if raw := os.Getenv("USBMUXD_BUFFER_SIZE"); raw != "" {
+		if n, err := strconv.Atoi(raw); err != nil || n < 1 {
+			errs = append(errs, fmt.Errorf("USBMUXD_BUFFER_SIZE должно быть положительным числом байт, получено %q", raw))
+		} else {
+			cfg.BufferSize = n
+		}
+	}
+	if raw := os.Getenv("USBMUXD_RATE_LIMIT"); raw != "" {
+		if n, err := strconv.ParseInt(raw, 10, 64); err != nil || n < 0 {
+			errs = append(errs, fmt.Errorf("USBMUXD_RATE_LIMIT должно быть неотрицательным числом байт в секунду, получено %q", raw))
+		} else {
+			cfg.RateLimit = n
+		}
+	}
+	if raw := os.Getenv("USBMUXD_TUNNEL_RATE_LIMIT"); raw != "" {
+		if n, err := strconv.ParseInt(raw, 10, 64); err != nil || n < 0 {
+			errs = append(errs, fmt.Errorf("USBMUXD_TUNNEL_RATE_LIMIT должно быть неотрицательным числом байт в секунду, получено %q", raw))
+		} else {
+			cfg.TunnelRateLimit = n
+		}
+	}
+
+	durations := []struct {
+		name     string
+		dst      *time.Duration
+		positive bool
+	}{
+		{"USBMUXD_WATCHDOG_TIMEOUT", &cfg.WatchdogTimeout, true},
+		{"USBMUXD_FIRST_BYTE_TIMEOUT", &cfg.FirstByteTimeout, true},
+		{"USBMUXD_SHUTDOWN_GRACE", &cfg.ShutdownGrace, false},
+		{"USBMUXD_DIAL_TIMEOUT", &cfg.DialTimeout, true},
+		{"USBMUXD_DIAL_HOLD", &cfg.DialHold, false},
+		{"USBMUXD_LOCAL_DIAL_INTERVAL", &cfg.LocalDialInterval, true},
+		{"USBMUXD_ACK_TIMEOUT", &cfg.AckTimeout, true},
+		{"USBMUXD_IDLE_TIMEOUT", &cfg.IdleTimeout, false},
+		{"USBMUXD_RW_TIMEOUT", &cfg.RWTimeout, false},
+		{"USBMUXD_SLOW_CONN_WARN", &cfg.SlowConnWarn, false},
+		{"USBMUXD_KEEPALIVE", &cfg.KeepAlive, false},
+		{"USBMUXD_HEALTH_INTERVAL", &cfg.HealthInterval, true},
+		{"USBMUXD_HEARTBEAT_INTERVAL", &cfg.HeartbeatInterval, false},
+		{"USBMUXD_HEARTBEAT_TIMEOUT", &cfg.HeartbeatTimeout, true},
+	}
+	for _, d := range durations {
+		if err := parseDuration(d.name, d.dst, d.positive); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if err := parseMode("USBMUXD_SOCKET_MODE", "0660", &cfg.SocketMode); err != nil {
+		errs = append(errs, err)
+	}
+	if err := parseMode("USBMUXD_SOCKET_DIR_MODE", "0755", &cfg.SocketDirMode); err != nil {
+		errs = append(errs, err)
+	}
+
+	if secret, err := crypt.SecretFromEnv(); err != nil {
+		errs = append(errs, err)
+	} else if secret != "" {
+		if err := crypt.ValidateKey(secret); err != nil {
+			errs = append(errs, fmt.Errorf("HANDSHAKE_SECRET: %w", err))
+		}
+		cfg.HandshakeSecret = secret
+	}
+	if kr, err := crypt.KeyringFromEnv(); err != nil {
+		errs = append(errs, err)
+	} else if kr != nil {
+		cfg.HandshakeCipher = kr
+	}
+	cfg.HandshakeFallbacks = crypt.FallbacksFromEnv()
+	for i, key := range cfg.HandshakeFallbacks {
+		if err := crypt.ValidateKey(key); err != nil {
+			errs = append(errs, fmt.Errorf("HANDSHAKE_SECRET_FALLBACKS, ключ %d: %w", i, err))
+		}
+	}
+
+	if tlsCfg, err := loadTLSConfig(); err != nil {
+		errs = append(errs, err)
+	} else {
+		cfg.TLS = tlsCfg
+	}
+	if d, err := proxyFromEnv(); err != nil {
+		errs = append(errs, err)
+	} else if d != nil {
+		cfg.Dialer = d
+	}
+	base := cfg.Dialer
+	if base == nil {
+		base = &net.Dialer{}
+	}
+	if d, err := sshJumpFromEnv(base); err != nil {
+		errs = append(errs, err)
+	} else if d != nil {
+		cfg.Dialer = d
+	}
+	if os.Getenv("USBMUXD_INMEMORY") == "1" {
+		inMemoryConfig(&cfg, &errs)
+	}
+
+	if tunnels, err := loadTunnels(); err != nil {
+		errs = append(errs, err)
+	} else {
+		cfg.Tunnels = tunnels
+	}
+	return cfg, errs
+}
+
+// inMemoryConfig подключает клиента к серверу в памяти вместо настоящего
+// (USBMUXD_INMEMORY=1). Сервер подтверждает handshake строкой HandshakeAck,
+// расшифровывает его ключом HandshakeSecret или шифром HandshakeCipher и
+// возвращает данные обратно. Адрес сервера в этом режиме не нужен.
+func inMemoryConfig(cfg *Config, errs *[]error) {
+	srv := fakeserver.New(cfg.HandshakeAck)
+	if cfg.HandshakeSecret != "" {
+		cipher, err := crypt.NewAESGCM(cfg.HandshakeSecret)
+		if err != nil {
+			return
+		}
+		srv.Cipher = cipher
+	}
+	if cfg.HandshakeCipher != nil {
+		srv.Cipher = cfg.HandshakeCipher
+	}
+	if cfg.TLS != nil {
+		*errs = append(*errs, errors.New("USBMUXD_INMEMORY несовместим с TLS"))
+	}
+	cfg.Dialer = srv
+	if len(cfg.Servers) == 0 {
+		cfg.Servers = []string{"inmemory"}
+	}
+	if cfg.ServerPort == "" {
+		cfg.ServerPort = "1"
+	}
+	log.Warn("Включён режим сервера в памяти: подключения к настоящему серверу не выполняются")
+}
+
+// defaultTunnels — туннели по умолчанию, если USBMUXD_CONFIG не задан.
+// Путь Unix-сокета usbmuxd берётся из USBMUXD_SOCKET_ADDRESS (или устаревшей
+// USBMUXD_SOCKET); если он не задан, туннель к usbmuxd пропускается.
+func defaultTunnels() []Tunnel {
+	var list []Tunnel
+	if socketPath := envOr("USBMUXD_SOCKET_ADDRESS", os.Getenv("USBMUXD_SOCKET")); socketPath != "" {
+		list = append(list, Tunnel{LocalAddr: socketPath, Handshake: "00008030001454190EEB802E usbmux"})
+	} else {
+		log.Warn("USBMUXD_SOCKET_ADDRESS не задан, туннель к usbmuxd пропущен")
+	}
+	return append(list, Tunnel{LocalAddr: "127.0.0.1:7777", Handshake: "00008030001454190EEB802E wda"})
+}
+
+// loadTunnels возвращает список туннелей из файла USBMUXD_CONFIG
+// или туннели по умолчанию
+func loadTunnels() ([]Tunnel, error) {
+	configPath := os.Getenv("USBMUXD_CONFIG")
+	if configPath == "" {
+		return defaultTunnels(), nil
+	}
+	return loadTunnelsFile(configPath)
+}
+
+// tunnelsDocument — корень YAML- и TOML-конфигурации: в TOML нет массива
+// верхнего уровня, поэтому туннели лежат в ключе tunnels
+type tunnelsDocument struct {
+	Tunnels []Tunnel `yaml:"tunnels" toml:"tunnels"`
+}
+
+// loadTunnelsFile читает туннели из файла. Формат определяется по расширению:
+// .yaml и .yml — YAML, .toml — TOML, остальные — JSON-массив туннелей.
+// Неизвестный ключ — ошибка: опечатка в имени поля не должна молча
+// оставлять туннель с настройками по умолчанию.
+func loadTunnelsFile(configPath string) ([]Tunnel, error) {
+	data, err := os.ReadFile(configPath)
+	if err != nil {
+		return nil, fmt.Errorf("чтение конфигурации %s: %w", configPath, err)
+	}
+	list, err := decodeTunnels(data, strings.ToLower(filepath.Ext(configPath)))
+	if err != nil {
+		return nil, fmt.Errorf("разбор конфигурации %s: %w", configPath, err)
+	}
+	if err := validateTunnels(list); err != nil {
+		return nil, fmt.Errorf("конфигурация %s: %w", configPath, err)
+	}
+	return list, nil
+}
+
+// decodeTunnels разбирает туннели в формате, заданном расширением файла ext
+func decodeTunnels(data []byte, ext string) ([]Tunnel, error) {
+	switch ext {
+	case ".yaml", ".yml":
+		var doc tunnelsDocument
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		dec.KnownFields(true)
+		if err := dec.Decode(&doc); err != nil && !errors.Is(err, io.EOF) {
+			return nil, err
+		}
+		return doc.Tunnels, nil
+	case ".toml":
+		var doc tunnelsDocument
+		md, err := toml.Decode(string(data), &doc)
+		if err != nil {
+			return nil, err
+		}
+		if undecoded := md.Undecoded(); len(undecoded) > 0 {
+			return nil, fmt.Errorf("неизвестные ключи: %v", undecoded)
+		}
+		return doc.Tunnels, nil
+	}
+	var list []Tunnel
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&list); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// validateTunnels проверяет каждый туннель и возвращает все найденные ошибки с индексами
+func validateTunnels(list []Tunnel) error {
+	var errs []error
+	for i, t := range list {
+		if _, err := t.endpoint(); err != nil {
+			errs = append(errs, fmt.Errorf("туннель %d: %w", i, err))
+		}
+		if err := validateHandshake(t.Handshake); err != nil {
+			errs = append(errs, fmt.Errorf("туннель %d: %w", i, err))
+		}
+		if t.Dial && (t.Network == networkSOCKS5 || t.Network == networkUDP) {
+			errs = append(errs, fmt.Errorf("туннель %d: %s-туннель не может работать в режиме dial", i, t.Network))
+		}
+		if t.ServerPort != "" && !validPort(t.ServerPort) {
+			errs = append(errs, fmt.Errorf("туннель %d: порт сервера должен быть числом от 1 до 65535, получено %q", i, t.ServerPort))
+		}
+		if t.MaxConns < 0 {
+			errs = append(errs, fmt.Errorf("туннель %d: лимит соединений не может быть отрицательным, получено %d", i, t.MaxConns))
+		}
+		if t.RateLimit < 0 {
+			errs = append(errs, fmt.Errorf("туннель %d: ограничение скорости не может быть отрицательным, получено %d", i, t.RateLimit))
+		}
+		if t.ServerAddr != "" && len(parseUpstreams(strings.Split(t.ServerAddr, ","), "")) == 0 {
+			errs = append(errs, fmt.Errorf("туннель %d: serverAddr не содержит ни одного сервера", i))
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,164 @@
+package socket
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestDefaultTunnelsWithoutSocketAddress(t *testing.T) {
+	t.Setenv("USBMUXD_CONFIG", "")
+	t.Setenv("USBMUXD_SOCKET_ADDRESS", "")
+	t.Setenv("USBMUXD_SOCKET", "")
+	t.Chdir(t.TempDir())
+
+	tunnels, err := loadTunnels()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tun := range tunnels {
+		if handshakeService(tun.Handshake) == serviceUsbmux {
+			t.Errorf("туннель к usbmuxd не пропущен: %+v", tun)
+		}
+	}
+	if len(tunnels) != 1 {
+		t.Fatalf("получено %d туннелей, ожидался только туннель к WDA", len(tunnels))
+	}
+	if err := validateTunnels(tunnels); err != nil {
+		t.Fatal(err)
+	}
+
+	// Туннель с пустым адресом отклоняется до создания сокета
+	c := newTestClient(t, Config{})
+	if err := c.runTunnels(context.Background(), []Tunnel{{Handshake: testUsbmuxHandshake}}, nil); err == nil {
+		t.Error("туннель с пустым адресом принят")
+	}
+	entries, err := os.ReadDir(".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("в рабочей директории появились файлы: %v", entries)
+	}
+}
+
+// testTunnelsFile — один и тот же набор туннелей во всех форматах файла
+var testTunnelsFile = map[string]string{
+	".json": `[
+  {"localAddr": "127.0.0.1:7777", "handshake": "00008030001454190EEB802E wda", "network": "tcp",
+   "serverAddr": "relay-a,relay-b", "serverPort": "27015", "rateLimit": 1048576, "maxConns": 8},
+  {"localAddr": "/var/run/usbmuxd", "handshake": "00008030001454190EEB802E usbmux"},
+  {"localAddr": "127.0.0.1:8100", "handshake": "00008030001454190EEB802E wda", "dial": true}
+]`,
+	".yaml": `tunnels:
+  - localAddr: 127.0.0.1:7777
+    handshake: 00008030001454190EEB802E wda
+    network: tcp
+    serverAddr: relay-a,relay-b
+    serverPort: "27015"
+    rateLimit: 1048576
+    maxConns: 8
+  - localAddr: /var/run/usbmuxd
+    handshake: 00008030001454190EEB802E usbmux
+  - localAddr: 127.0.0.1:8100
+    handshake: 00008030001454190EEB802E wda
+    dial: true
+`,
+	".toml": `[[tunnels]]
+localAddr = "127.0.0.1:7777"
+handshake = "00008030001454190EEB802E wda"
+network = "tcp"
+serverAddr = "relay-a,relay-b"
+serverPort = "27015"
+rateLimit = 1048576
+maxConns = 8
+
+[[tunnels]]
+localAddr = "/var/run/usbmuxd"
+handshake = "00008030001454190EEB802E usbmux"
+
+[[tunnels]]
+localAddr = "127.0.0.1:8100"
+handshake = "00008030001454190EEB802E wda"
+dial = true
+`,
+}
+
+// wantTunnelsFile — туннели из testTunnelsFile
+var wantTunnelsFile = []Tunnel{
+	{LocalAddr: "127.0.0.1:7777", Handshake: testHandshake, Network: "tcp", ServerAddr: "relay-a,relay-b", ServerPort: "27015", RateLimit: 1 << 20, MaxConns: 8},
+	{LocalAddr: "/var/run/usbmuxd", Handshake: testUsbmuxHandshake},
+	{LocalAddr: "127.0.0.1:8100", Handshake: testHandshake, Dial: true},
+}
+
+// writeConfig записывает content во временный файл name и возвращает путь
+func writeConfig(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadTunnelsFileFormats(t *testing.T) {
+	// Формат определяется по расширению без учёта регистра;
+	// неизвестное расширение — JSON
+	files := map[string]string{
+		"tunnels.json": testTunnelsFile[".json"],
+		"tunnels.conf": testTunnelsFile[".json"],
+		"tunnels.yaml": testTunnelsFile[".yaml"],
+		"tunnels.YML":  testTunnelsFile[".yaml"],
+		"tunnels.toml": testTunnelsFile[".toml"],
+	}
+	for name, content := range files {
+		list, err := loadTunnelsFile(writeConfig(t, name, content))
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if !reflect.DeepEqual(list, wantTunnelsFile) {
+			t.Errorf("%s: разобрано\n%+v\nожидалось\n%+v", name, list, wantTunnelsFile)
+		}
+	}
+}
+
+func TestLoadTunnelsFileUnknownKey(t *testing.T) {
+	// Опечатка в maxConns не должна молча снимать лимит
+	files := map[string]string{
+		"tunnels.json": `[{"localAddr": "127.0.0.1:7777", "handshake": "00008030001454190EEB802E wda", "maxConn": 8}]`,
+		"tunnels.yaml": "tunnels:\n  - localAddr: 127.0.0.1:7777\n    handshake: 00008030001454190EEB802E wda\n    maxConn: 8\n",
+		"tunnels.toml": "[[tunnels]]\nlocalAddr = \"127.0.0.1:7777\"\nhandshake = \"00008030001454190EEB802E wda\"\nmaxConn = 8\n",
+		"root.yaml":    "tunnel:\n  - localAddr: 127.0.0.1:7777\n",
+		"root.toml":    "[[tunnel]]\nlocalAddr = \"127.0.0.1:7777\"\n",
+	}
+	for name, content := range files {
+		if list, err := loadTunnelsFile(writeConfig(t, name, content)); err == nil {
+			t.Errorf("%s: неизвестный ключ пропущен, разобрано %+v", name, list)
+		}
+	}
+}
+
+func TestConfigFlag(t *testing.T) {
+	t.Setenv("USBMUXD_HOST", "127.0.0.1")
+	t.Setenv("USBMUXD_PORT", "27015")
+	t.Setenv("USBMUXD_CONFIG", "")
+
+	for ext, content := range testTunnelsFile {
+		c, err := ParseFlags([]string{"-config", writeConfig(t, "tunnels"+ext, content)})
+		if err != nil {
+			t.Errorf("%s: %v", ext, err)
+			continue
+		}
+		t.Cleanup(c.Stop)
+		if !reflect.DeepEqual(c.cfg.Tunnels, wantTunnelsFile) {
+			t.Errorf("%s: туннели\n%+v\nожидалось\n%+v", ext, c.cfg.Tunnels, wantTunnelsFile)
+		}
+	}
+
+	if _, err := ParseFlags([]string{"-config", writeConfig(t, "tunnels.yaml", "tunnels:\n  - lokalAddr: /tmp/x\n")}); err == nil {
+		t.Error("файл с неизвестным ключом принят")
+	}
+}
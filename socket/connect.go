@@ -0,0 +1,85 @@
+package socket
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"usbmuxd-client/muxproto"
+)
+
+// ConnectError — usbmuxd отказал в подключении к порту устройства
+type ConnectError struct {
+	DeviceID int
+	Port     uint16
+	Number   int // код ответа Result
+}
+
+func (e *ConnectError) Error() string {
+	return fmt.Sprintf("usbmuxd отказал в подключении к порту %d устройства %d: %s", e.Port, e.DeviceID, resultName(e.Number))
+}
+
+// resultName возвращает название кода ответа usbmuxd
+func resultName(number int) string {
+	switch number {
+	case muxproto.ResultBadCommand:
+		return "BadCommand"
+	case muxproto.ResultBadDevice:
+		return "BadDevice"
+	case muxproto.ResultConnectionRefused:
+		return "ConnectionRefused"
+	case muxproto.ResultBadVersion:
+		return "BadVersion"
+	}
+	return fmt.Sprintf("код %d", number)
+}
+
+// Connect подключается к TCP-порту устройства через клиента по умолчанию
+func Connect(ctx context.Context, deviceID int, port uint16) (net.Conn, error) {
+	c, err := defaultClient()
+	if err != nil {
+		return nil, err
+	}
+	return c.Connect(ctx, deviceID, port)
+}
+
+// Connect открывает через удалённый usbmuxd соединение с TCP-портом
+// устройства deviceID. После успешного ответа usbmuxd соединение передаёт
+// данные сервиса устройства как есть. Отказ usbmuxd возвращается как
+// *ConnectError. ctx ограничивает только установку соединения.
+func (c *Client) Connect(ctx context.Context, deviceID int, port uint16) (net.Conn, error) {
+	conn, stop, err := c.dialUsbmux(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// usbmuxd ожидает номер порта в сетевом порядке байт
+	req := muxproto.NewRequest("Connect", map[string]any{
+		"DeviceID":   deviceID,
+		"PortNumber": int(port>>8 | port<<8),
+	})
+	if err := muxproto.WritePacket(conn, 1, req); err != nil {
+		stop()
+		conn.Close()
+		return nil, contextError(ctx, fmt.Errorf("отправка Connect: %w", err))
+	}
+	pkt, err := muxproto.ReadPacket(conn)
+	if !stop() {
+		// ctx отменён во время ожидания ответа: соединение уже с истёкшим сроком
+		conn.Close()
+		return nil, ctx.Err()
+	}
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("чтение ответа Connect: %w", err)
+	}
+	number, ok := muxproto.ResultNumber(pkt.Payload)
+	if !ok {
+		conn.Close()
+		return nil, fmt.Errorf("неожиданный ответ на Connect: %v", pkt.Payload)
+	}
+	if number != muxproto.ResultOK {
+		conn.Close()
+		return nil, &ConnectError{DeviceID: deviceID, Port: port, Number: number}
+	}
+	return conn, nil
+}
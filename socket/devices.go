@@ -0,0 +1,98 @@
+package socket
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+	"usbmuxd-client/muxproto"
+)
+
+// Device — устройство, подключённое к удалённому usbmuxd
+type Device = muxproto.Device
+
+// serviceUsbmux — сервис handshake, открывающий канал к usbmuxd
+const serviceUsbmux = "usbmux"
+
+// usbmuxTunnel возвращает первый туннель клиента к usbmuxd
+func (c *Client) usbmuxTunnel() (Tunnel, error) {
+	for _, t := range c.cfg.Tunnels {
+		if handshakeService(t.Handshake) == serviceUsbmux {
+			return t, nil
+		}
+	}
+	return Tunnel{}, errors.New("не настроен ни один туннель к usbmuxd")
+}
+
+// dialUsbmux открывает через сервер канал к удалённому usbmuxd.
+// Отмена ctx прерывает операции ввода-вывода на возвращённом соединении
+// до вызова stop.
+func (c *Client) dialUsbmux(ctx context.Context) (conn net.Conn, stop func() bool, err error) {
+	t, err := c.usbmuxTunnel()
+	if err != nil {
+		return nil, nil, err
+	}
+	_, logger := c.newConnLogger()
+	conn, err = c.openServerConn(ctx, logger, nil, t)
+	if err != nil {
+		return nil, nil, err
+	}
+	stop = context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	return conn, stop, nil
+}
+
+// ListDevices запрашивает у удалённого usbmuxd список подключённых устройств
+// через клиента по умолчанию
+func ListDevices(ctx context.Context) ([]Device, error) {
+	c, err := defaultClient()
+	if err != nil {
+		return nil, err
+	}
+	return c.ListDevices(ctx)
+}
+
+// ListDevices запрашивает у удалённого usbmuxd список подключённых устройств
+func (c *Client) ListDevices(ctx context.Context) ([]Device, error) {
+	conn, stop, err := c.dialUsbmux(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	defer stop()
+
+	if err := muxproto.WritePacket(conn, 1, muxproto.NewRequest("ListDevices", nil)); err != nil {
+		return nil, contextError(ctx, fmt.Errorf("отправка ListDevices: %w", err))
+	}
+	pkt, err := muxproto.ReadPacket(conn)
+	if err != nil {
+		return nil, contextError(ctx, fmt.Errorf("чтение ответа ListDevices: %w", err))
+	}
+	if number, ok := muxproto.ResultNumber(pkt.Payload); ok {
+		// Вместо списка usbmuxd отвечает Result, если не понял запрос (например, BadVersion)
+		return nil, fmt.Errorf("usbmuxd отклонил ListDevices: %s", resultName(number))
+	}
+	return muxproto.ParseDeviceList(pkt.Payload)
+}
+
+// FindDevice возвращает подключённое устройство с UDID udid. Если устройство
+// подключено несколькими способами (USB и сеть), предпочитается USB.
+func (c *Client) FindDevice(ctx context.Context, udid string) (Device, error) {
+	devices, err := c.ListDevices(ctx)
+	if err != nil {
+		return Device{}, err
+	}
+	var found *Device
+	for i, d := range devices {
+		if d.UDID != udid {
+			continue
+		}
+		if found == nil || d.ConnectionType == "USB" {
+			found = &devices[i]
+		}
+	}
+	if found == nil {
+		return Device{}, fmt.Errorf("устройство %s не подключено", udid)
+	}
+	return *found, nil
+}
@@ -0,0 +1,85 @@
+package socket
+
+import (
+	"context"
+	"net"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"usbmuxd-client/fakeserver"
+	"usbmuxd-client/muxproto"
+)
+
+// usbmuxServer возвращает сервер, который на запрос к usbmuxd отвечает
+// одним пакетом с содержимым body и запоминает тип полученного запроса
+func usbmuxServer(t *testing.T, body []byte) (*fakeserver.Server, <-chan string) {
+	t.Helper()
+	requests := make(chan string, 1)
+	srv := fakeserver.New("")
+	srv.Handler = func(handshake string, conn net.Conn) {
+		pkt, err := muxproto.ReadPacket(conn)
+		if err != nil {
+			t.Errorf("чтение запроса: %v", err)
+			return
+		}
+		requests <- muxproto.MessageType(pkt.Payload)
+		h := muxproto.Header{
+			Length:  uint32(muxproto.HeaderSize + len(body)),
+			Version: muxproto.VersionPlist,
+			Message: muxproto.MessagePlist,
+			Tag:     pkt.Tag,
+		}
+		conn.Write(append(h.Bytes(), body...))
+	}
+	t.Cleanup(func() { srv.Close() })
+	return srv, requests
+}
+
+func TestListDevices(t *testing.T) {
+	fixture, err := os.ReadFile("testdata/listdevices.plist")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv, requests := usbmuxServer(t, fixture)
+	c := newTestClient(t, Config{Dialer: srv, Tunnels: []Tunnel{{LocalAddr: "/tmp/usbmuxd", Handshake: testUsbmuxHandshake}}})
+
+	devices, err := c.ListDevices(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := <-requests; got != "ListDevices" {
+		t.Errorf("отправлен запрос %q, ожидался ListDevices", got)
+	}
+	if got := srv.Handshakes(); len(got) != 1 || got[0] != testUsbmuxHandshake {
+		t.Errorf("handshake %q, ожидался %q", got, testUsbmuxHandshake)
+	}
+	want := []Device{
+		{UDID: "00008030001454190EEB802E", DeviceID: 3, ConnectionType: "USB", ProductID: 4776},
+		{UDID: "00008110000A1C2E0C38801E", DeviceID: 7, ConnectionType: "Network"},
+	}
+	if !reflect.DeepEqual(devices, want) {
+		t.Errorf("получено %+v, ожидалось %+v", devices, want)
+	}
+}
+
+func TestListDevicesRejected(t *testing.T) {
+	body, err := muxproto.MarshalPlist(map[string]any{"MessageType": muxproto.MessageResult, "Number": muxproto.ResultBadVersion})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv, _ := usbmuxServer(t, body)
+	c := newTestClient(t, Config{Dialer: srv, Tunnels: []Tunnel{{LocalAddr: "/tmp/usbmuxd", Handshake: testUsbmuxHandshake}}})
+
+	_, err = c.ListDevices(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "BadVersion") {
+		t.Fatalf("ошибка %v, ожидался отказ BadVersion", err)
+	}
+}
+
+func TestListDevicesNoUsbmuxTunnel(t *testing.T) {
+	c := newTestClient(t, Config{Tunnels: []Tunnel{{LocalAddr: "127.0.0.1:8100", Handshake: testHandshake}}})
+	if _, err := c.ListDevices(context.Background()); err == nil {
+		t.Fatal("ListDevices без туннеля к usbmuxd завершился без ошибки")
+	}
+}
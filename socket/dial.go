@@ -0,0 +1,190 @@
+package socket
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"slices"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Допустимые значения USBMUXD_IP_FAMILY
+const (
+	familyPreferIPv4 = "prefer-ipv4"
+	familyPreferIPv6 = "prefer-ipv6"
+	familyIPv4Only   = "ipv4-only"
+	familyIPv6Only   = "ipv6-only"
+)
+
+// Dialer устанавливает соединения клиента с сервером. По умолчанию
+// используется net.Dialer; в тестах можно подставить, например,
+// реализацию на net.Pipe.
+type Dialer interface {
+	DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// validIPFamily сообщает, является ли значение допустимым предпочтением семейства адресов
+func validIPFamily(family string) bool {
+	switch family {
+	case "", familyPreferIPv4, familyPreferIPv6, familyIPv4Only, familyIPv6Only:
+		return true
+	}
+	return false
+}
+
+// familyNetwork возвращает сеть для Dialer, который сам разрешает имена:
+// строгое ограничение семейства выражается сетью, предпочтение — нет
+func familyNetwork(family string) string {
+	switch family {
+	case familyIPv4Only:
+		return "tcp4"
+	case familyIPv6Only:
+		return "tcp6"
+	}
+	return "tcp"
+}
+
+// orderByFamily фильтрует и упорядочивает адреса согласно предпочтению
+func orderByFamily(addrs []net.IPAddr, family string) []net.IP {
+	var v4, v6 []net.IP
+	for _, a := range addrs {
+		if a.IP.To4() != nil {
+			v4 = append(v4, a.IP)
+		} else {
+			v6 = append(v6, a.IP)
+		}
+	}
+	switch family {
+	case familyIPv4Only:
+		return v4
+	case familyIPv6Only:
+		return v6
+	case familyPreferIPv6:
+		return append(v6, v4...)
+	default:
+		return append(v4, v6...)
+	}
+}
+
+// warnIPFamily при запуске предупреждает, что IPFamily применяется не
+// полностью: Dialer, отличный от net.Dialer (прокси, SSH-узел, сервер в
+// памяти), сам разрешает имя сервера, поэтому prefer-* для него не действует,
+// а *-only передаётся лишь сетью tcp4 или tcp6. К серверам quic:// семейство
+// не применяется вовсе.
+func (c *Client) warnIPFamily() {
+	family := c.cfg.IPFamily
+	if family == "" {
+		return
+	}
+	if _, direct := c.cfg.Dialer.(*net.Dialer); !direct {
+		message := "Предпочтение семейства адресов не применяется: Dialer сам разрешает имя сервера"
+		if family == familyIPv4Only || family == familyIPv6Only {
+			message = "Семейство адресов передаётся Dialer только сетью tcp4 или tcp6 и может им не учитываться"
+		}
+		log.WithFields(log.Fields{
+			"ip_family": family,
+			"dialer":    fmt.Sprintf("%T", c.cfg.Dialer),
+		}).Warn(message)
+	}
+
+	upstreams := slices.Clone(c.upstreams)
+	for _, t := range c.cfg.Tunnels {
+		upstreams = append(upstreams, c.upstreamsFor(t)...)
+	}
+	warned := map[string]bool{}
+	for _, u := range upstreams {
+		if u.scheme == schemeQUIC && !warned[u.String()] {
+			warned[u.String()] = true
+			log.WithFields(log.Fields{
+				"ip_family": family,
+				"server":    u,
+			}).Warn("К серверу quic:// семейство адресов не применяется")
+		}
+	}
+}
+
+// dialServer устанавливает соединение с сервером и, если включён TLS,
+// выполняет TLS-рукопожатие; handshake отправляется уже после него.
+// К серверам ws:// и wss:// подключение идёт через WebSocket, к quic:// —
+// потоком QUIC-соединения.
+func (c *Client) dialServer(ctx context.Context, u upstream) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.cfg.DialTimeout)
+	defer cancel()
+
+	if u.scheme == schemeQUIC {
+		return c.dialQUIC(ctx, u)
+	}
+	conn, err := dialTCP(ctx, c.cfg.Dialer, u.host, u.port, c.cfg.IPFamily)
+	if err != nil {
+		return nil, err
+	}
+	setKeepAlive(conn, c.cfg.KeepAlive)
+	if u.scheme != "" {
+		return c.dialWebSocket(ctx, conn, u)
+	}
+	if c.cfg.TLS == nil {
+		return conn, nil
+	}
+	return wrapTLS(ctx, conn, c.cfg.TLS, u.host)
+}
+
+// dialTCP устанавливает TCP-соединение с сервером. Без предпочтения
+// семейства используется стандартный Happy Eyeballs; иначе адреса
+// разрешаются вручную и перебираются в заданном порядке. Имя разрешается
+// здесь только для прямого net.Dialer: прокси, SSH-узел и сервер в памяти
+// разрешают его сами, им передаётся лишь сеть tcp4 или tcp6 для *-only.
+func dialTCP(ctx context.Context, dialer Dialer, host, port, family string) (net.Conn, error) {
+	if family == "" {
+		return dialer.DialContext(ctx, "tcp", net.JoinHostPort(host, port))
+	}
+	if _, direct := dialer.(*net.Dialer); !direct {
+		return dialer.DialContext(ctx, familyNetwork(family), net.JoinHostPort(host, port))
+	}
+
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	ips := orderByFamily(addrs, family)
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("у %s нет адресов, подходящих под %s (найдено: %v)", host, family, addrs)
+	}
+
+	var lastErr error
+	for _, ip := range ips {
+		network := "tcp6"
+		if ip.To4() != nil {
+			network = "tcp4"
+		}
+		conn, err := dialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+// dialLocal подключается к локальному ресурсу dial-туннеля. Если ресурс ещё
+// не готов, делается до LocalDialRetries повторов: пауза начинается с
+// LocalDialInterval и удваивается, но не превышает 5с. Отмена ctx прерывает
+// ожидание. Подключение идёт через LocalDialer, а не через Dialer сервера:
+// прокси, SSH-узел и сервер в памяти относятся только к стороне сервера.
+func (c *Client) dialLocal(ctx context.Context, logger *log.Entry, ep endpoint) (net.Conn, error) {
+	delay := c.cfg.LocalDialInterval
+	for attempt := 0; ; attempt++ {
+		conn, err := c.cfg.LocalDialer.DialContext(ctx, ep.network, ep.addr)
+		if err == nil || attempt >= c.cfg.LocalDialRetries {
+			return conn, err
+		}
+		logger.WithError(err).WithFields(log.Fields{
+			"attempt": attempt + 1,
+			"delay":   delay,
+		}).Warn("Локальный ресурс недоступен, повторяем")
+		if !sleepContext(ctx, delay) {
+			return nil, ctx.Err()
+		}
+		delay = min(delay*2, retryMaxDelay)
+	}
+}
@@ -0,0 +1,149 @@
+package socket
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// blackholeDialer имитирует недоступный хост: подключение не завершается,
+// пока не истечёт или не будет отменён ctx
+type blackholeDialer struct{}
+
+func (blackholeDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestDialTimeout(t *testing.T) {
+	const timeout = 150 * time.Millisecond
+	c := newTestClient(t, Config{Dialer: blackholeDialer{}, DialTimeout: timeout, DialRounds: 1})
+
+	_, logger := c.newConnLogger()
+	start := time.Now()
+	_, err := c.connectToServer(context.Background(), logger, nil, Tunnel{Handshake: testHandshake})
+	elapsed := time.Since(start)
+	if !errors.Is(err, ErrServerUnreachable) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("ошибка %v, ожидалась недоступность сервера по таймауту", err)
+	}
+	if elapsed < timeout || elapsed > timeout+time.Second {
+		t.Errorf("подключение прервано через %s, ожидалось около %s", elapsed, timeout)
+	}
+}
+
+func TestDialTimeoutFromEnv(t *testing.T) {
+	t.Setenv("USBMUXD_HOST", "127.0.0.1")
+	t.Setenv("USBMUXD_PORT", "27015")
+
+	t.Setenv("USBMUXD_DIAL_TIMEOUT", "250ms")
+	cfg, err := configFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.DialTimeout != 250*time.Millisecond {
+		t.Errorf("DialTimeout = %s, ожидалось 250ms", cfg.DialTimeout)
+	}
+
+	for _, raw := range []string{"0", "-1s", "быстро"} {
+		t.Setenv("USBMUXD_DIAL_TIMEOUT", raw)
+		if _, err := configFromEnv(); err == nil {
+			t.Errorf("USBMUXD_DIAL_TIMEOUT=%q принят", raw)
+		}
+	}
+}
+
+// cancelAfter вызывает connectToServer с контекстом, отменяемым через d,
+// и возвращает время до возврата и ошибку
+func cancelAfter(t *testing.T, c *Client, d time.Duration) (time.Duration, error) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(d, cancel)
+	_, logger := c.newConnLogger()
+	start := time.Now()
+	conn, err := c.connectToServer(ctx, logger, nil, Tunnel{Handshake: testHandshake})
+	if err == nil {
+		conn.Close()
+	}
+	return time.Since(start), err
+}
+
+func TestConnectCancelDuringDial(t *testing.T) {
+	c := newTestClient(t, Config{Dialer: blackholeDialer{}, DialTimeout: time.Minute})
+	elapsed, err := cancelAfter(t, c, 100*time.Millisecond)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("ошибка %v, ожидалась отмена контекста", err)
+	}
+	if elapsed > time.Second {
+		t.Errorf("отмена прервала подключение только через %s", elapsed)
+	}
+}
+
+func TestConnectCancelAwaitingAck(t *testing.T) {
+	// Слушатель не вызывает Accept: соединение устанавливается ядром,
+	// но подтверждение handshake не приходит никогда
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	c := newTestClient(t, Config{Servers: []string{listener.Addr().String()}, Dialer: &net.Dialer{}, HandshakeAck: "OK", DialTimeout: time.Minute})
+	elapsed, err := cancelAfter(t, c, 100*time.Millisecond)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("ошибка %v, ожидалась отмена контекста", err)
+	}
+	if elapsed > time.Second {
+		t.Errorf("отмена прервала ожидание подтверждения только через %s", elapsed)
+	}
+}
+
+func TestDialLocalRetry(t *testing.T) {
+	c := newTestClient(t, Config{LocalDialRetries: 5, LocalDialInterval: 50 * time.Millisecond})
+	addr := freeAddr(t)
+
+	// Локальный ресурс начинает слушать только после первой неудачной попытки
+	listening := make(chan net.Listener, 1)
+	time.AfterFunc(120*time.Millisecond, func() {
+		listener, err := net.Listen("tcp", addr)
+		if err != nil {
+			t.Error(err)
+			listener = nil
+		}
+		listening <- listener
+	})
+
+	_, logger := c.newConnLogger()
+	conn, err := c.dialLocal(context.Background(), logger, endpoint{network: "tcp", addr: addr})
+	if listener := <-listening; listener != nil {
+		defer listener.Close()
+	}
+	if err != nil {
+		t.Fatalf("подключение к запоздавшему ресурсу: %v", err)
+	}
+	conn.Close()
+}
+
+func TestDialLocalRetriesExhausted(t *testing.T) {
+	const retries, interval = 2, 20 * time.Millisecond
+	c := newTestClient(t, Config{LocalDialRetries: retries, LocalDialInterval: interval})
+
+	_, logger := c.newConnLogger()
+	start := time.Now()
+	_, err := c.dialLocal(context.Background(), logger, endpoint{network: "tcp", addr: freeAddr(t)})
+	if err == nil {
+		t.Fatal("подключение к несуществующему ресурсу удалось")
+	}
+	// Паузы 20мс и 40мс между тремя попытками
+	if elapsed := time.Since(start); elapsed < 3*interval {
+		t.Errorf("попытки закончились через %s, повторы не выполнены", elapsed)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	c = newTestClient(t, Config{LocalDialRetries: 100, LocalDialInterval: time.Minute})
+	if _, err := c.dialLocal(ctx, logger, endpoint{network: "tcp", addr: freeAddr(t)}); !errors.Is(err, context.Canceled) {
+		t.Errorf("после отмены контекста получено %v", err)
+	}
+}
@@ -0,0 +1,111 @@
+package socket
+
+import (
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// EventType — вид события жизненного цикла соединения
+type EventType int
+
+const (
+	ConnectionOpened EventType = iota + 1 // принято локальное подключение или начат dial-туннель
+	HandshakeSent                         // соединение с сервером установлено, handshake отправлен
+	ConnectionClosed                      // проксирование завершено
+	DialFailed                            // не удалось подключиться к серверу
+)
+
+func (t EventType) String() string {
+	switch t {
+	case ConnectionOpened:
+		return "ConnectionOpened"
+	case HandshakeSent:
+		return "HandshakeSent"
+	case ConnectionClosed:
+		return "ConnectionClosed"
+	case DialFailed:
+		return "DialFailed"
+	}
+	return "Unknown"
+}
+
+// Event — событие соединения. BytesIn, BytesOut, Duration, ErrIn и ErrOut
+// заполнены только у ConnectionClosed. Err у DialFailed — ошибка
+// подключения, у ConnectionClosed — ошибки обоих направлений вместе
+// (nil, если соединение закрылось чисто). У соединения, закрытого без
+// данных после handshake, Err, ErrIn и ErrOut — ErrNoData.
+type Event struct {
+	Type     EventType
+	Time     time.Time
+	Tunnel   Tunnel
+	ConnID   string // тот же идентификатор, что в поле conn логов
+	BytesIn  int64
+	BytesOut int64
+	Duration time.Duration
+	Err      error
+	ErrIn    error // ошибка направления от сервера к клиенту
+	ErrOut   error // ошибка направления от клиента к серверу
+}
+
+// eventBuffer — число событий, ожидающих обработчика; сверх него события отбрасываются
+const eventBuffer = 256
+
+// eventBus доставляет события обработчику в отдельной горутине,
+// чтобы медленный обработчик не задерживал проксирование
+type eventBus struct {
+	handler atomic.Pointer[func(Event)]
+	ch      chan Event
+	dropped atomic.Int64
+}
+
+func newEventBus() *eventBus {
+	return &eventBus{ch: make(chan Event, eventBuffer)}
+}
+
+// run вызывает обработчик для каждого события до закрытия done
+func (b *eventBus) run(done <-chan struct{}) {
+	for {
+		select {
+		case ev := <-b.ch:
+			if fn := b.handler.Load(); fn != nil {
+				(*fn)(ev)
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+// emit передаёт событие без ожидания; без обработчика ничего не делает
+func (b *eventBus) emit(ev Event) {
+	if b.handler.Load() == nil {
+		return
+	}
+	ev.Time = time.Now()
+	select {
+	case b.ch <- ev:
+	default:
+		if b.dropped.Add(1) == 1 {
+			log.Warn("Обработчик событий не успевает, события отбрасываются")
+		}
+	}
+}
+
+// OnEvent задаёт обработчик событий соединений; nil отключает доставку.
+// Обработчик вызывается последовательно в отдельной горутине. Если он не
+// успевает, события сверх буфера отбрасываются (см. DroppedEvents).
+func (c *Client) OnEvent(fn func(Event)) {
+	if fn == nil {
+		c.events.handler.Store(nil)
+		return
+	}
+	c.events.handler.Store(&fn)
+	c.eventsOnce.Do(func() { go c.events.run(c.stopCtx.Done()) })
+}
+
+// DroppedEvents возвращает число событий, отброшенных из-за медленного обработчика
+func (c *Client) DroppedEvents() int64 {
+	return c.events.dropped.Load()
+}
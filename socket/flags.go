@@ -0,0 +1,115 @@
+package socket
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// tunnelFlags — значения повторяемого флага -tunnel
+type tunnelFlags []Tunnel
+
+func (f *tunnelFlags) String() string {
+	parts := make([]string, len(*f))
+	for i, t := range *f {
+		parts[i] = "local=" + t.LocalAddr + ",handshake=" + t.Handshake
+	}
+	return strings.Join(parts, " ")
+}
+
+// Set разбирает значение вида local=<адрес>,handshake=<UDID сервис>[,network=<сеть>][,dial=true][,rate=<байт/с>][,maxconns=<число>]
+func (f *tunnelFlags) Set(value string) error {
+	var t Tunnel
+	for _, part := range strings.Split(value, ",") {
+		key, val, ok := strings.Cut(part, "=")
+		if !ok {
+			return fmt.Errorf("ожидается ключ=значение, получено %q", part)
+		}
+		switch strings.TrimSpace(key) {
+		case "local":
+			t.LocalAddr = val
+		case "handshake":
+			t.Handshake = val
+		case "network":
+			t.Network = val
+		case "dial":
+			dial, err := strconv.ParseBool(val)
+			if err != nil {
+				return fmt.Errorf("dial должно быть true или false, получено %q", val)
+			}
+			t.Dial = dial
+		case "rate":
+			rate, err := strconv.ParseInt(val, 10, 64)
+			if err != nil || rate < 0 {
+				return fmt.Errorf("rate должно быть неотрицательным числом байт в секунду, получено %q", val)
+			}
+			t.RateLimit = rate
+		case "maxconns":
+			n, err := strconv.Atoi(val)
+			if err != nil || n < 0 {
+				return fmt.Errorf("maxconns должно быть неотрицательным числом, получено %q", val)
+			}
+			t.MaxConns = n
+		default:
+			return fmt.Errorf("неизвестный параметр туннеля %q", key)
+		}
+	}
+	if t.LocalAddr == "" || t.Handshake == "" {
+		return errors.New("туннелю нужны local и handshake")
+	}
+	*f = append(*f, t)
+	return nil
+}
+
+// ParseFlags создаёт клиента по переменным окружения и флагам командной
+// строки args (без имени программы). Флаги переопределяют окружение;
+// если задан хотя бы один -tunnel, туннели из окружения и файла -config
+// не используются. При активации через сокет клиент получает слушателей
+// от systemd.
+func ParseFlags(args []string) (*Client, error) {
+	cfg, errs := envConfig()
+
+	fs := flag.NewFlagSet("usbmuxd-client", flag.ContinueOnError)
+	host := fs.String("host", strings.Join(cfg.Servers, ","), "адреса серверов через запятую (USBMUXD_HOST)")
+	fs.StringVar(&cfg.ServerPort, "port", cfg.ServerPort, "порт сервера (USBMUXD_PORT)")
+	fs.DurationVar(&cfg.DialTimeout, "dial-timeout", cfg.DialTimeout, "таймаут подключения к серверу (USBMUXD_DIAL_TIMEOUT)")
+	configPath := fs.String("config", os.Getenv("USBMUXD_CONFIG"), "файл туннелей: JSON, YAML (.yaml, .yml) или TOML (.toml) (USBMUXD_CONFIG)")
+	var tunnels tunnelFlags
+	fs.Var(&tunnels, "tunnel", "туннель local=<адрес>,handshake=<UDID сервис>[,network=<сеть>][,dial=true][,rate=<байт/с>][,maxconns=<число>]; можно повторять")
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if fs.NArg() > 0 {
+		return nil, fmt.Errorf("лишние аргументы: %s", strings.Join(fs.Args(), " "))
+	}
+
+	cfg.Servers = nil
+	for _, h := range strings.Split(*host, ",") {
+		if h = strings.TrimSpace(h); h != "" {
+			cfg.Servers = append(cfg.Servers, h)
+		}
+	}
+	if len(cfg.Servers) == 0 || cfg.ServerPort == "" {
+		errs = append([]error{errors.New("адрес сервера не задан: укажите -host и -port или USBMUXD_HOST и USBMUXD_PORT")}, errs...)
+	}
+	if *configPath != os.Getenv("USBMUXD_CONFIG") && *configPath != "" {
+		if list, err := loadTunnelsFile(*configPath); err != nil {
+			errs = append(errs, err)
+		} else {
+			cfg.Tunnels = list
+		}
+	}
+	if len(tunnels) > 0 {
+		cfg.Tunnels = tunnels
+	}
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+	if err := withSystemdListeners(&cfg); err != nil {
+		return nil, err
+	}
+	return NewClient(cfg)
+}
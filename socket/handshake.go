@@ -0,0 +1,167 @@
+package socket
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+	"usbmuxd-client/crypt"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// handshakeServices — сервисы, которые понимает сервер.
+// Handshake имеет вид "<UDID> <сервис>".
+var handshakeServices = []string{"usbmux", "wda"}
+
+// validateHandshake проверяет, что handshake указывает известный сервис
+func validateHandshake(handshake string) error {
+	fields := strings.Fields(handshake)
+	if len(fields) != 2 {
+		return fmt.Errorf("handshake %q должен иметь вид \"<UDID> <сервис>\"", handshake)
+	}
+	if !slices.Contains(handshakeServices, fields[1]) {
+		return fmt.Errorf("неизвестный сервис %q в handshake, допустимые: %s", fields[1], strings.Join(handshakeServices, ", "))
+	}
+	return nil
+}
+
+// handshakeService возвращает сервис из handshake или пустую строку
+func handshakeService(handshake string) string {
+	if fields := strings.Fields(handshake); len(fields) == 2 {
+		return fields[1]
+	}
+	return ""
+}
+
+// plaintextWarning предупреждает о нешифрованном handshake один раз за процесс
+var plaintextWarning sync.Once
+
+// encodeHandshake готовит handshake к отправке: шифрует его, если задан
+// шифр, иначе отправляет как есть с предупреждением в лог. Handshake
+// передаётся одной строкой, поэтому результат шифра не должен содержать
+// перевода строки: AES-GCM отдаёт base64(nonce||шифротекст).
+func encodeHandshake(handshake string, cipher crypt.HandshakeCipher) (string, error) {
+	if cipher == nil {
+		plaintextWarning.Do(func() {
+			log.Warn("HANDSHAKE_SECRET не задан, handshake отправляется в открытом виде")
+		})
+		return handshake, nil
+	}
+	encoded, err := cipher.Encrypt(handshake)
+	if err != nil {
+		return "", err
+	}
+	if strings.ContainsAny(encoded, "\r\n") {
+		return "", errors.New("зашифрованный handshake содержит перевод строки и не помещается в одну строку")
+	}
+	return encoded, nil
+}
+
+// handshakeCiphers возвращает шифры handshake в порядке попыток:
+// HandshakeCipher, если задан, иначе AES-GCM на основном и запасных ключах.
+// Без шифрования — один nil.
+func handshakeCiphers(cfg Config) []crypt.HandshakeCipher {
+	if cfg.HandshakeCipher != nil {
+		return []crypt.HandshakeCipher{cfg.HandshakeCipher}
+	}
+	if cfg.HandshakeSecret == "" {
+		return []crypt.HandshakeCipher{nil}
+	}
+	var ciphers []crypt.HandshakeCipher
+	for _, key := range append([]string{cfg.HandshakeSecret}, cfg.HandshakeFallbacks...) {
+		// Ключи уже проверены Validate
+		cipher, _ := crypt.NewAESGCM(key)
+		ciphers = append(ciphers, cipher)
+	}
+	return ciphers
+}
+
+// Причины неудачного подключения к серверу; проверяются через errors.Is
+var (
+	ErrServerUnreachable = errors.New("сервер недоступен")                      // не удалось установить соединение
+	ErrHandshakeRejected = errors.New("сервер отклонил handshake")              // сервер ответил отказом
+	ErrHandshakeTimeout  = errors.New("сервер не подтвердил handshake вовремя") // подтверждение не пришло за AckTimeout
+)
+
+// writeHandshake отправляет строку handshake целиком: повторяет запись,
+// пока не уйдут все байты, и ограничивает её сроком timeout, чтобы
+// зависший сервер не держал подключение бесконечно
+func writeHandshake(conn net.Conn, data []byte, timeout time.Duration) error {
+	if err := conn.SetWriteDeadline(time.Now().Add(timeout)); err != nil {
+		return err
+	}
+	defer conn.SetWriteDeadline(time.Time{})
+	return writeFull(conn, data)
+}
+
+// writeFull пишет data целиком, даже если Writer принимает данные частями
+func writeFull(w io.Writer, data []byte) error {
+	for len(data) > 0 {
+		n, err := w.Write(data)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return io.ErrShortWrite
+		}
+		data = data[n:]
+	}
+	return nil
+}
+
+// maxAckLength — наибольшая длина строки подтверждения вместе с переводом строки
+const maxAckLength = 256
+
+// readAck читает строку подтверждения handshake. Ответ, совпадающий с
+// want в открытом виде или после расшифровки шифром cipher (если он задан),
+// означает успех; любой другой (например, "ERR ...") — отказ.
+// Чтение идёт побайтно, чтобы не захватить данные, следующие за строкой.
+// Строка длиннее maxAckLength без перевода строки тоже считается отказом:
+// сломанный сервер не может заставить клиента читать бесконечно. Закрытие
+// соединения до подтверждения — тоже отказ: так сервер обычно отвечает на
+// handshake, который не смог разобрать.
+func readAck(conn net.Conn, want string, timeout time.Duration, cipher crypt.HandshakeCipher) error {
+	if err := conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return err
+	}
+	defer conn.SetReadDeadline(time.Time{})
+
+	r := io.LimitReader(conn, maxAckLength)
+	var line []byte
+	b := make([]byte, 1)
+	for {
+		if _, err := io.ReadFull(r, b); err != nil {
+			if len(line) == maxAckLength {
+				return fmt.Errorf("%w: ответ длиннее %d байт без перевода строки", ErrHandshakeRejected, maxAckLength)
+			}
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				return fmt.Errorf("%w: %w", ErrHandshakeTimeout, err)
+			}
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || isClosedError(err) {
+				return fmt.Errorf("%w: соединение закрыто до подтверждения: %w", ErrHandshakeRejected, err)
+			}
+			return fmt.Errorf("чтение подтверждения handshake: %w", err)
+		}
+		if b[0] == '\n' {
+			break
+		}
+		line = append(line, b[0])
+	}
+
+	reply := strings.TrimSuffix(string(line), "\r")
+	if reply == want {
+		return nil
+	}
+	if cipher != nil {
+		if plain, err := cipher.Decrypt(reply); err == nil && plain == want {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %q", ErrHandshakeRejected, reply)
+}
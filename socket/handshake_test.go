@@ -0,0 +1,431 @@
+package socket
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+	"usbmuxd-client/crypt"
+	"usbmuxd-client/fakeserver"
+)
+
+// pipeDialer вместо подключения к серверу отдаёт клиенту конец net.Pipe,
+// а серверный конец передаёт в канал conns
+type pipeDialer struct {
+	conns chan net.Conn
+}
+
+func newPipeDialer() *pipeDialer {
+	return &pipeDialer{conns: make(chan net.Conn, 16)}
+}
+
+func (d *pipeDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	client, server := net.Pipe()
+	d.conns <- server
+	return client, nil
+}
+
+// readLine читает строку handshake на серверном конце с ограничением по времени
+func readLine(t *testing.T, conn net.Conn) string {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		t.Fatalf("чтение handshake: %v", err)
+	}
+	return strings.TrimSuffix(line, "\n")
+}
+
+// newSecret возвращает случайный ключ handshake в base64
+func newSecret(t *testing.T) string {
+	t.Helper()
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	return base64.StdEncoding.EncodeToString(key)
+}
+
+// connectAsync вызывает connectToServer в отдельной горутине: net.Pipe
+// синхронен, и запись handshake ждёт чтения на серверном конце
+func connectAsync(c *Client, tun Tunnel) <-chan error {
+	errc := make(chan error, 1)
+	go func() {
+		_, logger := c.newConnLogger()
+		conn, err := c.connectToServer(context.Background(), logger, nil, tun)
+		if err == nil {
+			conn.Close()
+		}
+		errc <- err
+	}()
+	return errc
+}
+
+func TestHandshakeEncrypted(t *testing.T) {
+	secret := newSecret(t)
+	dialer := newPipeDialer()
+	c := newTestClient(t, Config{Dialer: dialer, HandshakeSecret: secret})
+
+	errc := connectAsync(c, Tunnel{Handshake: testHandshake})
+	server := <-dialer.conns
+	defer server.Close()
+	line := readLine(t, server)
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+
+	if line == testHandshake {
+		t.Fatal("handshake отправлен в открытом виде")
+	}
+	got, err := crypt.DecryptHandshake(secret, line)
+	if err != nil {
+		t.Fatalf("расшифровка отправленного handshake: %v", err)
+	}
+	if got != testHandshake {
+		t.Errorf("расшифровано %q, ожидалось %q", got, testHandshake)
+	}
+}
+
+func TestHandshakePlaintextFallback(t *testing.T) {
+	dialer := newPipeDialer()
+	c := newTestClient(t, Config{Dialer: dialer})
+
+	errc := connectAsync(c, Tunnel{Handshake: testHandshake})
+	server := <-dialer.conns
+	defer server.Close()
+	line := readLine(t, server)
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	if line != testHandshake {
+		t.Errorf("отправлено %q, ожидался handshake в открытом виде %q", line, testHandshake)
+	}
+}
+
+func TestNewTunnelRejectsUnknownService(t *testing.T) {
+	for _, handshake := range []string{"00008030001454190EEB802E foward", "00008030001454190EEB802E", ""} {
+		_, err := NewTunnel("127.0.0.1:7777", handshake)
+		if err == nil {
+			t.Errorf("NewTunnel принял handshake %q", handshake)
+			continue
+		}
+		if handshake == "00008030001454190EEB802E foward" && !strings.Contains(err.Error(), strings.Join(handshakeServices, ", ")) {
+			t.Errorf("ошибка %q не перечисляет допустимые сервисы", err)
+		}
+	}
+	if _, err := NewTunnel("127.0.0.1:7777", testHandshake); err != nil {
+		t.Errorf("NewTunnel отклонил %q: %v", testHandshake, err)
+	}
+}
+
+func TestConnectRejectsUnknownService(t *testing.T) {
+	srv := fakeserver.New("")
+	defer srv.Close()
+	c := newTestClient(t, Config{Dialer: srv})
+
+	// Туннель в обход NewTunnel: handshake проверяется ещё раз перед отправкой
+	_, logger := c.newConnLogger()
+	if _, err := c.connectToServer(context.Background(), logger, nil, Tunnel{Handshake: "00008030001454190EEB802E foward"}); err == nil {
+		t.Fatal("connectToServer отправил неизвестный сервис")
+	}
+	if got := srv.Handshakes(); len(got) != 0 {
+		t.Errorf("сервер получил handshake %q", got)
+	}
+}
+
+// failingDialer отказывает в каждом подключении
+type failingDialer struct{}
+
+func (failingDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return nil, &net.OpError{Op: "dial", Net: network, Err: syscall.ECONNREFUSED}
+}
+
+func TestConnectErrors(t *testing.T) {
+	closing := fakeserver.New("")
+	closing.Handler = func(handshake string, conn net.Conn) {}
+	tests := []struct {
+		name   string
+		dialer Dialer
+		want   []error
+	}{
+		{"сервер недоступен", failingDialer{}, []error{ErrServerUnreachable, syscall.ECONNREFUSED}},
+		{"отказ", fakeserver.New("ERR unknown device"), []error{ErrHandshakeRejected}},
+		{"нет подтверждения", fakeserver.New(""), []error{ErrHandshakeTimeout, os.ErrDeadlineExceeded}},
+		{"закрыто до подтверждения", closing, []error{ErrHandshakeRejected, io.EOF}},
+	}
+	for _, tt := range tests {
+		if srv, ok := tt.dialer.(*fakeserver.Server); ok {
+			defer srv.Close()
+		}
+		c := newTestClient(t, Config{Dialer: tt.dialer, HandshakeAck: "OK", AckTimeout: 100 * time.Millisecond, DialRounds: 1})
+		_, logger := c.newConnLogger()
+		conn, err := c.connectToServer(context.Background(), logger, nil, Tunnel{Handshake: testHandshake})
+		if err == nil {
+			conn.Close()
+			t.Errorf("%s: подключение удалось", tt.name)
+			continue
+		}
+		for _, want := range tt.want {
+			if !errors.Is(err, want) {
+				t.Errorf("%s: ошибка %v не соответствует %v", tt.name, err, want)
+			}
+		}
+	}
+}
+
+// streamingServer возвращает сервер, который вместо подтверждения
+// отправляет байты 'x' по одному с паузой pause, пока соединение открыто.
+// Счётчик — сколько байт принял клиент.
+func streamingServer(t *testing.T, pause time.Duration) (*fakeserver.Server, *atomic.Int64) {
+	t.Helper()
+	sent := new(atomic.Int64)
+	srv := fakeserver.New("")
+	srv.Handler = func(handshake string, conn net.Conn) {
+		for {
+			if _, err := conn.Write([]byte("x")); err != nil {
+				return
+			}
+			sent.Add(1)
+			time.Sleep(pause)
+		}
+	}
+	t.Cleanup(func() { srv.Close() })
+	return srv, sent
+}
+
+func TestAckLengthLimit(t *testing.T) {
+	srv, sent := streamingServer(t, 0)
+	c := newTestClient(t, Config{Dialer: srv, HandshakeAck: "OK", DialRounds: 1})
+
+	_, logger := c.newConnLogger()
+	start := time.Now()
+	_, err := c.connectToServer(context.Background(), logger, nil, Tunnel{Handshake: testHandshake})
+	if !errors.Is(err, ErrHandshakeRejected) {
+		t.Fatalf("ошибка %v, ожидался отказ", err)
+	}
+	if got := sent.Load(); got > maxAckLength {
+		t.Errorf("клиент прочитал %d байт, ограничение %d", got, maxAckLength)
+	}
+	if elapsed := time.Since(start); elapsed > defaultAckTimeout {
+		t.Errorf("клиент читал ответ %s, дольше AckTimeout", elapsed)
+	}
+}
+
+func TestAckDeadline(t *testing.T) {
+	const timeout = 200 * time.Millisecond
+	srv, sent := streamingServer(t, 20*time.Millisecond)
+	c := newTestClient(t, Config{Dialer: srv, HandshakeAck: "OK", AckTimeout: timeout, DialRounds: 1})
+
+	_, logger := c.newConnLogger()
+	start := time.Now()
+	_, err := c.connectToServer(context.Background(), logger, nil, Tunnel{Handshake: testHandshake})
+	if !errors.Is(err, ErrHandshakeTimeout) {
+		t.Fatalf("ошибка %v, ожидался таймаут подтверждения", err)
+	}
+	if elapsed := time.Since(start); elapsed < timeout || elapsed > timeout+time.Second {
+		t.Errorf("ожидание прервано через %s, ожидалось около %s", elapsed, timeout)
+	}
+	if got := sent.Load(); got == 0 || got >= maxAckLength {
+		t.Errorf("до таймаута прочитано %d байт", got)
+	}
+}
+
+// oneByteConn принимает за одну запись не больше одного байта
+type oneByteConn struct {
+	net.Conn
+	writes *atomic.Int32
+}
+
+func (c oneByteConn) Write(p []byte) (int, error) {
+	c.writes.Add(1)
+	return c.Conn.Write(p[:min(len(p), 1)])
+}
+
+// oneByteDialer отдаёт соединения dialer, обёрнутые в oneByteConn
+type oneByteDialer struct {
+	dialer Dialer
+	writes *atomic.Int32
+}
+
+func (d oneByteDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	conn, err := d.dialer.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return oneByteConn{Conn: conn, writes: d.writes}, nil
+}
+
+func TestHandshakeShortWrites(t *testing.T) {
+	secret := newSecret(t)
+	cipher, err := crypt.NewAESGCM(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := fakeserver.New("OK")
+	srv.Cipher = cipher
+	defer srv.Close()
+	writes := new(atomic.Int32)
+	c := newTestClient(t, Config{Dialer: oneByteDialer{dialer: srv, writes: writes}, HandshakeSecret: secret, HandshakeAck: "OK", DialRounds: 1})
+
+	_, logger := c.newConnLogger()
+	conn, err := c.connectToServer(context.Background(), logger, nil, Tunnel{Handshake: testHandshake})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if got := srv.Handshakes(); len(got) != 1 || got[0] != testHandshake {
+		t.Errorf("сервер получил %q, ожидался %q", got, testHandshake)
+	}
+	// Зашифрованный handshake длиннее открытого, и каждый байт ушёл отдельной записью
+	if got := writes.Load(); got <= int32(len(testHandshake)) {
+		t.Errorf("handshake отправлен за %d записей", got)
+	}
+}
+
+// zeroWriter ничего не принимает и не возвращает ошибки
+type zeroWriter struct{}
+
+func (zeroWriter) Write(p []byte) (int, error) { return 0, nil }
+
+func TestWriteFullNoProgress(t *testing.T) {
+	if err := writeFull(zeroWriter{}, []byte(testHandshake)); !errors.Is(err, io.ErrShortWrite) {
+		t.Errorf("writeFull вернул %v, ожидался io.ErrShortWrite", err)
+	}
+}
+
+// newlineCipher возвращает шифротекст с переводом строки внутри
+type newlineCipher struct{ sep string }
+
+func (c newlineCipher) Encrypt(plaintext string) (string, error) {
+	return "AAAA" + c.sep + "BBBB", nil
+}
+
+func (c newlineCipher) Decrypt(ciphertext string) (string, error) {
+	return "", errors.New("не поддерживается")
+}
+
+func TestHandshakeNewlineCiphertext(t *testing.T) {
+	for _, sep := range []string{"\r\n", "\n", "\r"} {
+		srv := fakeserver.New("OK")
+		defer srv.Close()
+		c := newTestClient(t, Config{Dialer: srv, HandshakeCipher: newlineCipher{sep}, HandshakeAck: "OK", DialRounds: 1})
+
+		// Вторая строка шифротекста ушла бы серверу как данные туннеля
+		_, logger := c.newConnLogger()
+		if _, err := c.connectToServer(context.Background(), logger, nil, Tunnel{Handshake: testHandshake}); err == nil {
+			t.Errorf("%q: отправлен шифротекст с переводом строки", sep)
+		}
+		if got := srv.Handshakes(); len(got) != 0 {
+			t.Errorf("%q: сервер получил %q", sep, got)
+		}
+	}
+}
+
+func TestEncryptedAck(t *testing.T) {
+	secret := newSecret(t)
+	cipher, err := crypt.NewAESGCM(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := fakeserver.New("OK")
+	srv.Cipher = cipher
+	srv.EncryptAck = true
+	defer srv.Close()
+	c := newTestClient(t, Config{Dialer: srv, HandshakeSecret: secret, HandshakeAck: "OK", DialRounds: 1})
+
+	_, logger := c.newConnLogger()
+	conn, err := c.connectToServer(context.Background(), logger, nil, Tunnel{Handshake: testHandshake})
+	if err != nil {
+		t.Fatalf("зашифрованное подтверждение не принято: %v", err)
+	}
+	roundTrip(t, conn, "ping")
+	conn.Close()
+
+	// Подтверждение, зашифрованное чужим ключом, — отказ
+	foreign, err := crypt.EncryptHandshake(newSecret(t), "OK")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	go server.Write([]byte(foreign + "\n"))
+	if err := readAck(client, "OK", time.Second, cipher); !errors.Is(err, ErrHandshakeRejected) {
+		t.Errorf("подтверждение чужим ключом: %v, ожидался отказ", err)
+	}
+}
+
+// countingDialer считает подключения через dialer
+type countingDialer struct {
+	dialer Dialer
+	dials  *atomic.Int32
+}
+
+func (d countingDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	d.dials.Add(1)
+	return d.dialer.DialContext(ctx, network, addr)
+}
+
+func TestHandshakeFallbackKey(t *testing.T) {
+	current, previous := newSecret(t), newSecret(t)
+	// Сервер ещё не получил новый ключ и знает только прежний
+	cipher, err := crypt.NewAESGCM(previous)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := fakeserver.New("OK")
+	srv.Cipher = cipher
+	defer srv.Close()
+
+	dials := new(atomic.Int32)
+	rejected := counterValue(t, handshakeErrors.WithLabelValues("rejected"))
+	c := newTestClient(t, Config{
+		Dialer:             countingDialer{dialer: srv, dials: dials},
+		HandshakeSecret:    current,
+		HandshakeFallbacks: []string{previous},
+		HandshakeAck:       "OK",
+		DialRounds:         1,
+	})
+
+	_, logger := c.newConnLogger()
+	conn, err := c.connectToServer(context.Background(), logger, nil, Tunnel{Handshake: testHandshake})
+	if err != nil {
+		t.Fatalf("handshake с запасным ключом: %v", err)
+	}
+	roundTrip(t, conn, "ping")
+	conn.Close()
+	if got := dials.Load(); got != 2 {
+		t.Errorf("сделано %d подключений, ожидалось 2: основным и запасным ключом", got)
+	}
+	if got := srv.Handshakes(); len(got) != 1 || got[0] != testHandshake {
+		t.Errorf("сервер получил %q, ожидался %q", got, testHandshake)
+	}
+	if got := counterValue(t, handshakeErrors.WithLabelValues("rejected")); got != rejected+1 {
+		t.Errorf("usbmuxd_handshake_errors_total{reason=rejected} = %v, ожидалось %v", got, rejected+1)
+	}
+
+	// Ни один ключ не подходит: после последнего запасного возвращается отказ
+	dials.Store(0)
+	c = newTestClient(t, Config{
+		Dialer:             countingDialer{dialer: srv, dials: dials},
+		HandshakeSecret:    current,
+		HandshakeFallbacks: []string{newSecret(t)},
+		HandshakeAck:       "OK",
+		DialRounds:         1,
+	})
+	if _, err := c.connectToServer(context.Background(), logger, nil, Tunnel{Handshake: testHandshake}); !errors.Is(err, ErrHandshakeRejected) {
+		t.Errorf("ошибка %v, ожидался отказ", err)
+	}
+	if got := dials.Load(); got != 2 {
+		t.Errorf("сделано %d подключений, ожидалось 2", got)
+	}
+}
@@ -0,0 +1,244 @@
+package socket
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// defaultHealthInterval — период фоновой проверки доступности сервера
+const defaultHealthInterval = 15 * time.Second
+
+// reachability — кешированные результаты последних проверок доступности
+// серверов по адресу сервера. Обновляется фоновой проверкой и каждым
+// подключением к серверу; собственные серверы туннелей хранятся рядом с
+// общими и не перекрывают их результаты.
+type reachability struct {
+	mu sync.Mutex
+	m  map[string]reachResult
+}
+
+// reachResult — результат последней проверки одного сервера
+type reachResult struct {
+	checked time.Time
+	err     error
+}
+
+func (r *reachability) set(server string, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.m == nil {
+		r.m = map[string]reachResult{}
+	}
+	r.m[server] = reachResult{checked: time.Now(), err: err}
+}
+
+// get возвращает результат для набора серверов, из которых достаточно
+// одного: время последней успешной проверки, а если успешных нет — время
+// последней проверки и ошибки всех проверенных серверов
+func (r *reachability) get(upstreams []upstream) (time.Time, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var (
+		lastOK, lastCheck time.Time
+		errs              []error
+	)
+	for _, u := range upstreams {
+		res, ok := r.m[u.String()]
+		if !ok {
+			continue
+		}
+		if res.err == nil {
+			if res.checked.After(lastOK) {
+				lastOK = res.checked
+			}
+			continue
+		}
+		if res.checked.After(lastCheck) {
+			lastCheck = res.checked
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", u, res.err))
+	}
+	if !lastOK.IsZero() {
+		return lastOK, nil
+	}
+	return lastCheck, errors.Join(errs...)
+}
+
+// tunnelReachability — результаты проверки серверов туннелей, у которых
+// задан собственный ServerAddr или ServerPort, по локальному адресу туннеля
+type tunnelReachability struct {
+	mu sync.Mutex
+	m  map[string]tunnelServerHealth
+}
+
+// replace заменяет все результаты: туннели, удалённые с прошлой проверки, пропадают
+func (r *tunnelReachability) replace(m map[string]tunnelServerHealth) {
+	r.mu.Lock()
+	r.m = m
+	r.mu.Unlock()
+}
+
+// list возвращает результаты, отсортированные по локальному адресу
+func (r *tunnelReachability) list() []tunnelServerHealth {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	list := make([]tunnelServerHealth, 0, len(r.m))
+	for _, h := range r.m {
+		list = append(list, h)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].LocalAddr < list[j].LocalAddr })
+	return list
+}
+
+// tunnelServerHealth — доступность собственных серверов одного туннеля
+type tunnelServerHealth struct {
+	LocalAddr string    `json:"localAddr"`
+	Servers   []string  `json:"servers"`
+	Reachable bool      `json:"reachable"`
+	LastCheck time.Time `json:"lastCheck"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// healthReport — тело ответа /healthz
+type healthReport struct {
+	Status            string               `json:"status"`
+	ServerReachable   bool                 `json:"serverReachable"`
+	LastCheck         time.Time            `json:"lastCheck"`
+	Error             string               `json:"error,omitempty"`
+	ActiveConnections int                  `json:"activeConnections"`
+	Tunnels           []TunnelHealth       `json:"tunnels"`
+	TunnelServers     []tunnelServerHealth `json:"tunnelServers,omitempty"`
+}
+
+// checkServers проверяет, что хотя бы один из серверов upstreams принимает
+// подключения. Handshake не отправляется: достаточно установить соединение.
+func (c *Client) checkServers(ctx context.Context, upstreams []upstream) error {
+	var errs []error
+	for _, u := range upstreams {
+		conn, err := c.dialServer(ctx, u)
+		c.reach.set(u.String(), err)
+		if err == nil {
+			conn.Close()
+			return nil
+		}
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// watchReachability проверяет доступность сервера сразу и затем каждые interval
+func (c *Client) watchReachability(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		err := c.checkServers(ctx, c.upstreams)
+		if err != nil {
+			log.WithError(err).Debug("Сервер недоступен")
+		}
+		c.checkTunnelServers(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// checkTunnelServers проверяет собственные серверы запущенных туннелей.
+// Туннели с одинаковыми серверами проверяются одним подключением.
+func (c *Client) checkTunnelServers(ctx context.Context) {
+	results := map[string]tunnelServerHealth{}
+	checked := map[string]bool{}
+	for _, at := range c.tunnels.list() {
+		t := at.tunnel
+		if t.ServerAddr == "" && t.ServerPort == "" {
+			continue
+		}
+		upstreams := c.upstreamsFor(t)
+		servers := make([]string, len(upstreams))
+		for i, u := range upstreams {
+			servers[i] = u.String()
+		}
+		key := strings.Join(servers, ",")
+		if !checked[key] {
+			checked[key] = true
+			if err := c.checkServers(ctx, upstreams); err != nil {
+				log.WithError(err).WithField("local", t.LocalAddr).Debug("Серверы туннеля недоступны")
+			}
+		}
+
+		lastCheck, err := c.reach.get(upstreams)
+		h := tunnelServerHealth{LocalAddr: t.LocalAddr, Servers: servers, Reachable: err == nil, LastCheck: lastCheck}
+		if err != nil {
+			h.Error = err.Error()
+		}
+		results[t.LocalAddr] = h
+	}
+	c.tunnelReach.replace(results)
+}
+
+// healthReport собирает состояние клиента. Клиент здоров, если хотя бы один
+// слушатель работает, ни один цикл приёма не завис, а последняя проверка
+// сервера не старше двух интервалов и прошла успешно. Собственные серверы
+// туннелей показываются в отчёте, но на общий статус не влияют.
+func (c *Client) healthReport() (healthReport, bool) {
+	checked, err := c.reach.get(c.upstreams)
+	reachable := !checked.IsZero() && err == nil && time.Since(checked) < 2*c.cfg.HealthInterval
+
+	tunnels := c.Health()
+	bound, stalled := false, false
+	for _, t := range tunnels {
+		bound = bound || t.Bound
+		stalled = stalled || t.Stalled
+	}
+
+	report := healthReport{
+		Status:            "ok",
+		ServerReachable:   reachable,
+		LastCheck:         checked,
+		ActiveConnections: c.sessions.count(),
+		Tunnels:           tunnels,
+		TunnelServers:     c.tunnelReach.list(),
+	}
+	if err != nil {
+		report.Error = err.Error()
+	}
+	healthy := bound && reachable && !stalled
+	if !healthy {
+		report.Status = "unavailable"
+	}
+	return report, healthy
+}
+
+// serveHealth отдаёт /healthz на addr до отмены ctx
+func (c *Client) serveHealth(ctx context.Context, addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		report, healthy := c.healthReport()
+		w.Header().Set("Content-Type", "application/json")
+		if !healthy {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(report)
+	})
+	srv := &http.Server{Addr: addr, Handler: mux}
+
+	stop := context.AfterFunc(ctx, func() { srv.Shutdown(context.Background()) })
+	defer stop()
+
+	log.WithField("address", addr).Info("Запущен сервер проверки состояния")
+	if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.WithError(err).WithField("address", addr).Error("Ошибка сервера проверки состояния")
+	}
+}
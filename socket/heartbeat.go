@@ -0,0 +1,262 @@
+package socket
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"time"
+	"usbmuxd-client/muxproto"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// defaultHeartbeatTimeout — время ожидания ответа на проверку живости
+const defaultHeartbeatTimeout = 10 * time.Second
+
+// heartbeatTag — старший бит тега отличает пакеты проверки живости
+// от запросов локального клиента
+const heartbeatTag = 1 << 31
+
+// heartbeat проверяет живость соединения с удалённым usbmuxd. Пока соединение
+// работает в режиме пакетов, клиент периодически отправляет серверу ReadBUID
+// со своим тегом и вырезает ответ из потока к локальному клиенту. Если ответа
+// нет дольше timeout, сессия закрывается. После успешного Connect соединение
+// становится туннелем к порту устройства, и пакеты больше не разбираются.
+type heartbeat struct {
+	s        *proxySession
+	server   net.Conn
+	interval time.Duration
+	timeout  time.Duration
+
+	mu          sync.Mutex // также сериализует запись пакетов на сервер
+	stopped     bool
+	connecting  bool   // отправлен Connect, ждём ответа; проверки не отправляются
+	connectTag  uint32 // тег запроса Connect
+	outstanding uint32 // тег ожидаемого ответа на проверку; 0 — нет
+	seq         uint32
+
+	connectResult chan bool     // результат Connect от B->A к A->B
+	done          chan struct{} // закрывается при завершении сессии
+	doneOnce      sync.Once
+}
+
+func newHeartbeat(s *proxySession) *heartbeat {
+	hb := &heartbeat{
+		s:             s,
+		server:        s.b,
+		interval:      s.client.cfg.HeartbeatInterval,
+		timeout:       s.client.cfg.HeartbeatTimeout,
+		connectResult: make(chan bool, 1),
+		done:          make(chan struct{}),
+	}
+	go hb.loop()
+	return hb
+}
+
+// stop прекращает проверки
+func (hb *heartbeat) stop() {
+	hb.mu.Lock()
+	hb.stopped = true
+	hb.mu.Unlock()
+	hb.doneOnce.Do(func() { close(hb.done) })
+}
+
+func (hb *heartbeat) loop() {
+	ticker := time.NewTicker(hb.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-hb.done:
+			return
+		case <-ticker.C:
+		}
+		if !hb.ping() {
+			return
+		}
+	}
+}
+
+// ping отправляет проверку, если соединение в режиме пакетов и предыдущая
+// проверка получила ответ. Возвращает false, когда проверки больше не нужны.
+func (hb *heartbeat) ping() bool {
+	hb.mu.Lock()
+	defer hb.mu.Unlock()
+	if hb.stopped {
+		return false
+	}
+	if hb.connecting || hb.outstanding != 0 {
+		return true
+	}
+
+	hb.seq++
+	tag := heartbeatTag | hb.seq
+	if err := muxproto.WritePacket(hb.server, tag, muxproto.NewRequest("ReadBUID", nil)); err != nil {
+		hb.s.logger.WithError(err).Debug("Не удалось отправить проверку живости usbmuxd")
+		return false
+	}
+	hb.outstanding = tag
+	time.AfterFunc(hb.timeout, func() { hb.expire(tag) })
+	return true
+}
+
+// expire закрывает сессию, если ответ на проверку tag так и не пришёл
+func (hb *heartbeat) expire(tag uint32) {
+	hb.mu.Lock()
+	dead := !hb.stopped && hb.outstanding == tag
+	hb.mu.Unlock()
+	if !dead {
+		return
+	}
+	hb.s.logger.WithFields(log.Fields{
+		"server":  hb.server.RemoteAddr(),
+		"timeout": hb.timeout,
+	}).Warn("usbmuxd не ответил на проверку живости, закрываем соединение")
+	hb.s.closeOnce()
+}
+
+// readRawPacket читает пакет usbmuxd, не разбирая его содержимое
+func readRawPacket(r io.Reader) (muxproto.Header, []byte, error) {
+	h, err := muxproto.ReadHeader(r)
+	if err != nil {
+		return h, nil, err
+	}
+	body := make([]byte, h.Length-muxproto.HeaderSize)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return h, nil, err
+	}
+	return h, body, nil
+}
+
+// isConnect сообщает, является ли пакет запросом Connect
+func isConnect(h muxproto.Header, body []byte) bool {
+	switch h.Message {
+	case muxproto.MessageBinaryConnect:
+		return true
+	case muxproto.MessagePlist:
+		v, err := muxproto.UnmarshalPlist(body)
+		if err != nil {
+			return false
+		}
+		dict, ok := v.(map[string]any)
+		return ok && muxproto.MessageType(dict) == "Connect"
+	}
+	return false
+}
+
+// resultOK сообщает, что ответ на Connect означает успех
+func resultOK(h muxproto.Header, body []byte) bool {
+	switch h.Message {
+	case muxproto.MessageBinaryResult:
+		return len(body) >= 4 && binary.LittleEndian.Uint32(body) == 0
+	case muxproto.MessagePlist:
+		v, err := muxproto.UnmarshalPlist(body)
+		if err != nil {
+			return false
+		}
+		dict, ok := v.(map[string]any)
+		if !ok {
+			return false
+		}
+		number, ok := muxproto.ResultNumber(dict)
+		return ok && number == 0
+	}
+	return false
+}
+
+// writePacket отправляет заголовок и тело одной записью
+func writePacket(w io.Writer, h muxproto.Header, body []byte) (int64, error) {
+	n, err := w.Write(append(h.Bytes(), body...))
+	return int64(n), err
+}
+
+// copyToServer пересылает пакеты локального клиента на сервер. После
+// успешного Connect копирует оставшиеся данные как есть.
+func (hb *heartbeat) copyToServer(dst io.Writer, src io.Reader, buf []byte) (int64, error) {
+	var total int64
+	for {
+		h, body, err := readRawPacket(src)
+		if err != nil {
+			if err == io.EOF {
+				err = nil
+			}
+			return total, err
+		}
+
+		connect := isConnect(h, body)
+		hb.mu.Lock()
+		if connect {
+			hb.connecting = true
+			hb.connectTag = h.Tag
+		}
+		n, err := writePacket(dst, h, body)
+		hb.mu.Unlock()
+		total += n
+		if err != nil {
+			return total, err
+		}
+		if !connect {
+			continue
+		}
+
+		select {
+		case ok := <-hb.connectResult:
+			if !ok {
+				continue
+			}
+		case <-hb.done:
+			return total, nil
+		}
+		n, err = io.CopyBuffer(writerOnly{dst}, readerOnly{src}, buf)
+		return total + n, err
+	}
+}
+
+// copyToClient пересылает пакеты сервера локальному клиенту, вырезая ответы
+// на проверки живости. После ответа на Connect сообщает результат
+// copyToServer и при успехе копирует оставшиеся данные как есть.
+func (hb *heartbeat) copyToClient(dst io.Writer, src io.Reader, buf []byte) (int64, error) {
+	defer hb.stop()
+
+	var total int64
+	for {
+		h, body, err := readRawPacket(src)
+		if err != nil {
+			if err == io.EOF {
+				err = nil
+			}
+			return total, err
+		}
+
+		hb.mu.Lock()
+		if h.Tag&heartbeatTag != 0 {
+			if h.Tag == hb.outstanding {
+				hb.outstanding = 0
+			}
+			hb.mu.Unlock()
+			continue
+		}
+		connect := hb.connecting && h.Tag == hb.connectTag
+		ok := connect && resultOK(h, body)
+		if connect {
+			hb.connecting = false
+			hb.stopped = ok
+		}
+		hb.mu.Unlock()
+
+		n, err := writePacket(dst, h, body)
+		total += n
+		if err != nil {
+			return total, err
+		}
+		if !connect {
+			continue
+		}
+
+		hb.connectResult <- ok
+		if ok {
+			n, err = io.CopyBuffer(writerOnly{dst}, readerOnly{src}, buf)
+			return total + n, err
+		}
+	}
+}
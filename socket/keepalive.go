@@ -0,0 +1,30 @@
+package socket
+
+import (
+	"net"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// defaultKeepAlive — период TCP keepalive по умолчанию
+const defaultKeepAlive = 30 * time.Second
+
+// setKeepAlive настраивает TCP keepalive с периодом keepAlivePeriod;
+// 0 отключает keepalive. Применяется только к TCP: для Unix-сокетов
+// и других транспортов ничего не делает.
+func setKeepAlive(conn net.Conn, keepAlivePeriod time.Duration) {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return
+	}
+	if err := tcpConn.SetKeepAlive(keepAlivePeriod > 0); err != nil {
+		log.WithError(err).Debug("Не удалось настроить TCP keepalive")
+		return
+	}
+	if keepAlivePeriod > 0 {
+		if err := tcpConn.SetKeepAlivePeriod(keepAlivePeriod); err != nil {
+			log.WithError(err).Debug("Не удалось задать период TCP keepalive")
+		}
+	}
+}
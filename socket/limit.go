@@ -0,0 +1,144 @@
+package socket
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Поведение при достижении лимита соединений (USBMUXD_MAX_CONNS_MODE)
+const (
+	limitReject = "reject" // закрыть новое соединение сразу
+	limitBlock  = "block"  // не принимать новые соединения, пока не освободится слот
+)
+
+// connLimiter ограничивает число одновременных соединений туннеля.
+// Нулевой лимит означает отсутствие ограничения.
+type connLimiter struct {
+	slots     chan struct{}
+	mode      string
+	localAddr string
+}
+
+// newConnLimiter создаёт ограничитель; при max <= 0 возвращает nil
+func newConnLimiter(localAddr string, max int, mode string) *connLimiter {
+	if max <= 0 {
+		return nil
+	}
+	return &connLimiter{slots: make(chan struct{}, max), mode: mode, localAddr: localAddr}
+}
+
+// tunnelLimiter возвращает ограничитель соединений туннеля t: лимит туннеля
+// или общий Config.MaxConns. Ограничитель один на всё время работы туннеля,
+// в том числе при пересоздании слушателя.
+func (c *Client) tunnelLimiter(t Tunnel) *connLimiter {
+	return c.limiters.get(t.LocalAddr, cmp.Or(t.MaxConns, c.cfg.MaxConns), c.cfg.MaxConnsMode)
+}
+
+// tunnelLimiters — ограничители соединений туннелей по локальному адресу
+type tunnelLimiters struct {
+	mu sync.Mutex
+	m  map[string]*connLimiter
+}
+
+// get возвращает ограничитель туннеля addr. Соединения удалённого туннеля
+// продолжают работать и занимать слоты, поэтому туннель, заново добавленный
+// на тот же адрес, получает прежний ограничитель. Если лимит изменился,
+// ограничитель создаётся заново.
+func (r *tunnelLimiters) get(addr string, max int, mode string) *connLimiter {
+	if max <= 0 {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if l := r.m[addr]; l != nil && cap(l.slots) == max && l.mode == mode {
+		return l
+	}
+	if r.m == nil {
+		r.m = map[string]*connLimiter{}
+	}
+	l := newConnLimiter(addr, max, mode)
+	r.m[addr] = l
+	return l
+}
+
+// validLimitMode проверяет значение USBMUXD_MAX_CONNS_MODE
+func validLimitMode(mode string) error {
+	if mode != limitReject && mode != limitBlock {
+		return fmt.Errorf("USBMUXD_MAX_CONNS_MODE должно быть %q или %q, получено %q", limitReject, limitBlock, mode)
+	}
+	return nil
+}
+
+// waitSlot в режиме block ждёт свободного слота до приёма соединения.
+// Возвращает false, если ctx отменён.
+func (l *connLimiter) waitSlot(ctx context.Context) bool {
+	if l == nil || l.mode != limitBlock {
+		return true
+	}
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	default:
+	}
+
+	log.WithFields(log.Fields{
+		"local": l.localAddr,
+		"limit": cap(l.slots),
+	}).Warn("Достигнут лимит соединений, ожидаем освобождения слота")
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// admit в режиме reject занимает слот для принятого соединения.
+// Возвращает false, если слотов нет и соединение нужно отклонить.
+func (l *connLimiter) admit() bool {
+	if l == nil || l.mode != limitReject {
+		return true
+	}
+	if l.tryAcquire() {
+		return true
+	}
+	log.WithFields(log.Fields{
+		"local": l.localAddr,
+		"limit": cap(l.slots),
+	}).Warn("Достигнут лимит соединений, соединение отклонено")
+	return false
+}
+
+// tryAcquire занимает слот без ожидания в любом режиме. Отказ учитывается
+// в usbmuxd_conn_limit_rejected_total.
+func (l *connLimiter) tryAcquire() bool {
+	if l == nil {
+		return true
+	}
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	default:
+		connLimitRejected.WithLabelValues(l.localAddr).Inc()
+		return false
+	}
+}
+
+// releaseWaited возвращает слот, занятый waitSlot, если соединение так и не было принято
+func (l *connLimiter) releaseWaited() {
+	if l != nil && l.mode == limitBlock {
+		l.release()
+	}
+}
+
+// release освобождает слот
+func (l *connLimiter) release() {
+	if l == nil {
+		return
+	}
+	<-l.slots
+}
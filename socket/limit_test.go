@@ -0,0 +1,123 @@
+package socket
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// dialTunnel подключается к туннелю и проверяет, что он проксирует данные
+func dialTunnel(t *testing.T, addr string) net.Conn {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	roundTrip(t, conn, "ping")
+	return conn
+}
+
+// waitActive ждёт, пока число активных соединений туннеля станет n
+func waitActive(t *testing.T, c *Client, addr string, n int64) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		var active int64
+		if tc := c.stats.lookup(addr); tc != nil {
+			active = tc.active.Load()
+		}
+		if active == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("активных соединений %d, ожидалось %d", active, n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestMaxConnsReject(t *testing.T) {
+	c := newTestClient(t, Config{MaxConns: 2, MaxConnsMode: limitReject})
+	addr := serveTCP(t, c, Tunnel{Handshake: testHandshake})
+
+	first := dialTunnel(t, addr)
+	dialTunnel(t, addr)
+
+	// Третье соединение сверх лимита закрывается сразу после Accept
+	extra, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer extra.Close()
+	extra.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := extra.Read(make([]byte, 1)); !errors.Is(err, io.EOF) {
+		t.Fatalf("соединение сверх лимита не закрыто: %v", err)
+	}
+	if got := counterValue(t, connLimitRejected.WithLabelValues(addr)); got != 1 {
+		t.Errorf("usbmuxd_conn_limit_rejected_total = %v, ожидалось 1", got)
+	}
+
+	// Закрытое соединение освобождает слот
+	first.Close()
+	waitActive(t, c, addr, 1)
+	dialTunnel(t, addr)
+}
+
+func TestMaxConnsBlock(t *testing.T) {
+	c := newTestClient(t, Config{MaxConns: 1, MaxConnsMode: limitBlock})
+	addr := serveTCP(t, c, Tunnel{Handshake: testHandshake})
+
+	first := dialTunnel(t, addr)
+
+	// Второе соединение ждёт в очереди слушателя, пока занят слот
+	waiting, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer waiting.Close()
+	if _, err := waiting.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	waiting.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if n, err := waiting.Read(make([]byte, 4)); err == nil {
+		t.Fatalf("соединение сверх лимита обслужено (%d байт)", n)
+	}
+
+	first.Close()
+	waiting.SetReadDeadline(time.Now().Add(5 * time.Second))
+	got := make([]byte, 4)
+	if _, err := io.ReadFull(waiting, got); err != nil || string(got) != "ping" {
+		t.Fatalf("после освобождения слота получено %q, %v", got, err)
+	}
+	if got := counterValue(t, connLimitRejected.WithLabelValues(addr)); got != 0 {
+		t.Errorf("usbmuxd_conn_limit_rejected_total = %v, в режиме block ожидалось 0", got)
+	}
+}
+
+func TestCopyPoolReject(t *testing.T) {
+	// Пул на одно соединение: по горутине на каждое направление
+	c := newTestClient(t, Config{CopyWorkers: 2, MaxConnsMode: limitReject})
+	addr := serveTCP(t, c, Tunnel{Handshake: testHandshake})
+
+	dialTunnel(t, addr)
+	extra, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer extra.Close()
+	extra.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := extra.Read(make([]byte, 1)); !errors.Is(err, io.EOF) {
+		t.Fatalf("соединение сверх пула не закрыто: %v", err)
+	}
+
+	// Отказ из-за пула считается отдельно от отказов по MaxConns
+	if got := counterValue(t, copyPoolRejected.WithLabelValues(addr)); got != 1 {
+		t.Errorf("usbmuxd_copy_pool_rejected_total = %v, ожидалось 1", got)
+	}
+	if got := counterValue(t, connLimitRejected.WithLabelValues(addr)); got != 0 {
+		t.Errorf("usbmuxd_conn_limit_rejected_total = %v, ожидалось 0", got)
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !unix
+
+package socket
+
+import "syscall"
+
+// peekOpen на платформах без MSG_PEEK считает соединение открытым
+func peekOpen(syscall.RawConn) (bool, error) {
+	return true, nil
+}
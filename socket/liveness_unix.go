@@ -0,0 +1,35 @@
+//go:build unix
+
+package socket
+
+import (
+	"errors"
+	"syscall"
+)
+
+// peekOpen заглядывает в буфер сокета, не извлекая данные
+func peekOpen(raw syscall.RawConn) (bool, error) {
+	var (
+		n       int
+		peekErr error
+		buf     [1]byte
+	)
+	err := raw.Control(func(fd uintptr) {
+		n, _, peekErr = syscall.Recvfrom(int(fd), buf[:], syscall.MSG_PEEK|syscall.MSG_DONTWAIT)
+	})
+	if err != nil {
+		return false, err
+	}
+
+	switch {
+	case errors.Is(peekErr, syscall.EAGAIN), errors.Is(peekErr, syscall.EWOULDBLOCK):
+		// Данных нет, но соединение живо
+		return true, nil
+	case peekErr != nil:
+		return false, peekErr
+	case n == 0:
+		// Собеседник закрыл соединение (EOF)
+		return false, nil
+	}
+	return true, nil
+}
@@ -0,0 +1,48 @@
+package socket
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ConfigureLogging настраивает глобальный логгер по USBMUXD_LOG_LEVEL
+// (debug, info, warn, error) и USBMUXD_LOG_FORMAT (text, json).
+// Пустые значения оставляют настройки logrus без изменений.
+// USBMUXD_LOG_SAMPLE ограничивает число Info-сообщений о подключениях
+// в секунду; лишние пропускаются со сводкой раз в секунду.
+func ConfigureLogging() error {
+	if raw := os.Getenv("USBMUXD_LOG_LEVEL"); raw != "" {
+		switch raw {
+		case "debug", "info", "warn", "error":
+		default:
+			return fmt.Errorf("USBMUXD_LOG_LEVEL должно быть одним из: debug, info, warn, error, получено %q", raw)
+		}
+		level, err := log.ParseLevel(raw)
+		if err != nil {
+			return err
+		}
+		log.SetLevel(level)
+	}
+
+	switch raw := os.Getenv("USBMUXD_LOG_FORMAT"); raw {
+	case "":
+	case "text":
+		log.SetFormatter(&log.TextFormatter{})
+	case "json":
+		log.SetFormatter(&log.JSONFormatter{})
+	default:
+		return fmt.Errorf("USBMUXD_LOG_FORMAT должно быть text или json, получено %q", raw)
+	}
+
+	if raw := os.Getenv("USBMUXD_LOG_SAMPLE"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 0 {
+			return fmt.Errorf("USBMUXD_LOG_SAMPLE должно быть неотрицательным числом, получено %q", raw)
+		}
+		connLogs.setLimit(n)
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+package socket
+
+import (
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// connLogs ограничивает частые Info-сообщения о подключениях:
+// новое подключение, успешный handshake, начало и конец проксирования.
+// Ошибки и предупреждения не ограничиваются.
+var connLogs logSampler
+
+// logSampler пропускает не больше limit сообщений в секунду; о пропущенных
+// в конце секунды выводится одна сводка
+type logSampler struct {
+	mu         sync.Mutex
+	limit      int // 0 — без ограничения
+	window     time.Time
+	count      int
+	suppressed int
+}
+
+// setLimit задаёт число сообщений в секунду; 0 снимает ограничение
+func (s *logSampler) setLimit(n int) {
+	s.mu.Lock()
+	s.limit = n
+	s.mu.Unlock()
+}
+
+// allow сообщает, можно ли вывести очередное сообщение
+func (s *logSampler) allow() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.limit <= 0 {
+		return true
+	}
+
+	now := time.Now()
+	if now.Sub(s.window) >= time.Second {
+		s.window = now
+		s.count = 0
+	}
+	if s.count < s.limit {
+		s.count++
+		return true
+	}
+	if s.suppressed == 0 {
+		// Первое пропущенное сообщение в окне — сводка по его окончании
+		time.AfterFunc(time.Second-now.Sub(s.window), s.flush)
+	}
+	s.suppressed++
+	return false
+}
+
+// flush выводит сводку пропущенных сообщений
+func (s *logSampler) flush() {
+	s.mu.Lock()
+	n := s.suppressed
+	s.suppressed = 0
+	s.mu.Unlock()
+
+	if n > 0 {
+		log.WithField("suppressed", n).Info("Сообщения о подключениях пропущены из-за USBMUXD_LOG_SAMPLE")
+	}
+}
@@ -0,0 +1,107 @@
+package socket
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// errManagerStarted — Start вызван повторно
+var errManagerStarted = errors.New("менеджер уже запущен")
+
+// Manager — клиент для встраивания в другой сервис: Start запускает туннели
+// в фоне и возвращает управление, Stop останавливает их и возвращает
+// результат работы. Туннели можно добавлять и удалять на ходу.
+type Manager struct {
+	client *Client
+
+	mu   sync.Mutex
+	ctx  context.Context
+	done chan struct{} // закрывается после завершения работы; nil — не запущен
+	err  error
+}
+
+// NewManager создаёт менеджер с настройками cfg; ошибки конфигурации
+// возвращаются сразу
+func NewManager(cfg Config) (*Manager, error) {
+	c, err := NewClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &Manager{client: c}, nil
+}
+
+// Client возвращает клиента менеджера: через него доступны статистика,
+// состояние туннелей и события
+func (m *Manager) Client() *Client {
+	return m.client
+}
+
+// Start запускает туннели из конфигурации и ждёт, пока каждый из них будет
+// готов или не удастся. Если не запустился ни один, менеджер останавливается
+// и ошибки туннелей возвращаются. Менеджер работает до отмены ctx или Stop,
+// даже если все туннели завершились.
+func (m *Manager) Start(ctx context.Context) error {
+	m.mu.Lock()
+	if m.done != nil {
+		m.mu.Unlock()
+		return errManagerStarted
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	m.ctx, m.done = ctx, done
+	m.mu.Unlock()
+
+	tunnels := m.client.cfg.Tunnels
+	started := make(chan int, 1)
+	go func() {
+		defer close(done)
+		defer cancel()
+		m.err = m.client.runTunnels(ctx, tunnels, func(running int) { started <- running })
+	}()
+
+	select {
+	case running := <-started:
+		if running == 0 && len(tunnels) > 0 {
+			cancel()
+			<-done
+			return m.err
+		}
+		return nil
+	case <-done:
+		return m.err
+	}
+}
+
+// Stop останавливает все туннели, ждёт завершения соединений (не дольше
+// ShutdownGrace) и возвращает ошибку работы менеджера. Остановленный
+// менеджер нельзя запустить повторно.
+func (m *Manager) Stop() error {
+	m.client.Stop()
+
+	m.mu.Lock()
+	done := m.done
+	m.mu.Unlock()
+	if done == nil {
+		return nil
+	}
+	<-done
+	return m.err
+}
+
+// AddTunnel запускает туннель t и ждёт, пока локальная сторона будет готова.
+// Туннель работает до RemoveTunnel, Stop или отмены контекста Start.
+func (m *Manager) AddTunnel(t Tunnel) error {
+	m.mu.Lock()
+	ctx := m.ctx
+	m.mu.Unlock()
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return m.client.AddTunnel(ctx, t)
+}
+
+// RemoveTunnel останавливает туннель с локальным адресом localAddr
+func (m *Manager) RemoveTunnel(localAddr string) error {
+	return m.client.RemoveTunnel(localAddr)
+}
@@ -0,0 +1,108 @@
+package socket
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"usbmuxd-client/fakeserver"
+)
+
+// newTestManager создаёт менеджер с туннелями tunnels и эхо-сервером в памяти
+func newTestManager(t *testing.T, tunnels ...Tunnel) *Manager {
+	t.Helper()
+	srv := fakeserver.New("")
+	t.Cleanup(func() { srv.Close() })
+	m, err := NewManager(Config{Servers: []string{"fake:1"}, Dialer: srv, Tunnels: tunnels})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { m.Stop() })
+	return m
+}
+
+// checkReleased проверяет, что адрес остановленного туннеля снова можно занять
+func checkReleased(t *testing.T, addr string) {
+	t.Helper()
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatalf("адрес %s не освобождён: %v", addr, err)
+	}
+	listener.Close()
+}
+
+func TestManagerStartStop(t *testing.T) {
+	first, second := freeAddr(t), freeAddr(t)
+	m := newTestManager(t,
+		Tunnel{LocalAddr: first, Handshake: testHandshake},
+		Tunnel{LocalAddr: second, Handshake: testUsbmuxHandshake},
+	)
+
+	if err := m.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	// Start возвращает управление, когда туннели уже слушают
+	for _, addr := range []string{first, second} {
+		dialTunnel(t, addr).Close()
+	}
+	if err := m.Start(context.Background()); !errors.Is(err, errManagerStarted) {
+		t.Errorf("повторный Start: %v", err)
+	}
+
+	if err := m.Stop(); err != nil {
+		t.Fatalf("Stop: %v", err)
+	}
+	for _, addr := range []string{first, second} {
+		checkReleased(t, addr)
+	}
+}
+
+func TestManagerStartAllFailed(t *testing.T) {
+	m := newTestManager(t, Tunnel{LocalAddr: busyAddr(t), Handshake: testHandshake})
+	if err := m.Start(context.Background()); err == nil {
+		t.Fatal("Start успешен, хотя ни один туннель не запустился")
+	}
+}
+
+func TestManagerLiveTunnels(t *testing.T) {
+	initial, added := freeAddr(t), freeAddr(t)
+	m := newTestManager(t, Tunnel{LocalAddr: initial, Handshake: testHandshake})
+	if err := m.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.AddTunnel(Tunnel{LocalAddr: added, Handshake: testHandshake}); err != nil {
+		t.Fatal(err)
+	}
+	dialTunnel(t, added).Close()
+	if err := m.AddTunnel(Tunnel{LocalAddr: initial, Handshake: testUsbmuxHandshake}); err == nil {
+		t.Error("добавлен второй туннель на занятый адрес")
+	}
+	if err := m.AddTunnel(Tunnel{LocalAddr: freeAddr(t), Handshake: "00008030001454190EEB802E foward"}); err == nil {
+		t.Error("добавлен туннель с неизвестным сервисом")
+	}
+
+	// Удаление туннеля из конфигурации и добавленного на ходу
+	for _, addr := range []string{initial, added} {
+		if err := m.RemoveTunnel(addr); err != nil {
+			t.Fatal(err)
+		}
+		checkReleased(t, addr)
+	}
+	if err := m.RemoveTunnel(initial); err == nil {
+		t.Error("туннель удалён дважды")
+	}
+
+	// Менеджер работает без туннелей, пока его не остановят
+	if err := m.AddTunnel(Tunnel{LocalAddr: initial, Handshake: testHandshake}); err != nil {
+		t.Fatalf("туннель не добавлен заново: %v", err)
+	}
+	dialTunnel(t, initial).Close()
+	if err := m.Stop(); err != nil {
+		t.Fatalf("Stop: %v", err)
+	}
+	checkReleased(t, initial)
+	if err := m.AddTunnel(Tunnel{LocalAddr: added, Handshake: testHandshake}); err == nil {
+		t.Error("туннель добавлен в остановленный менеджер")
+	}
+}
@@ -0,0 +1,93 @@
+package socket
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	log "github.com/sirupsen/logrus"
+)
+
+// Метрики Prometheus
+var (
+	activeConnections = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "usbmuxd_active_connections",
+		Help: "Число активных проксируемых соединений",
+	}, []string{"tunnel"})
+
+	connectionsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "usbmuxd_connections_total",
+		Help: "Общее число проксированных соединений",
+	}, []string{"tunnel"})
+
+	bytesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "usbmuxd_bytes_total",
+		Help: "Число переданных байт (direction: in — от сервера, out — к серверу)",
+	}, []string{"tunnel", "direction"})
+
+	connectionDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "usbmuxd_connection_duration_seconds",
+		Help:    "Длительность проксированных соединений от принятия до закрытия",
+		Buckets: prometheus.ExponentialBuckets(0.01, 4, 10), // от 10мс до ~45мин
+	}, []string{"tunnel"})
+
+	serverDialErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "usbmuxd_server_dial_errors_total",
+		Help: "Число ошибок подключения к серверу",
+	}, []string{"server"})
+
+	connLimitRejected = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "usbmuxd_conn_limit_rejected_total",
+		Help: "Число соединений, отклонённых из-за лимита соединений туннеля",
+	}, []string{"tunnel"})
+
+	copyPoolRejected = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "usbmuxd_copy_pool_rejected_total",
+		Help: "Число соединений, отклонённых из-за нехватки свободных горутин пула копирования",
+	}, []string{"tunnel"})
+
+	idleClosed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "usbmuxd_idle_closed_total",
+		Help: "Число соединений, закрытых после IdleTimeout без данных",
+	}, []string{"tunnel"})
+
+	noDataClosed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "usbmuxd_no_data_closed_total",
+		Help: "Число соединений, закрытых без данных после handshake (FirstByteTimeout)",
+	}, []string{"tunnel"})
+
+	handshakeErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "usbmuxd_handshake_errors_total",
+		Help: "Число ошибок handshake (reason: encrypt, write, rejected, timeout, read)",
+	}, []string{"reason"})
+)
+
+// ackErrorReason возвращает метку reason для ошибки ожидания подтверждения
+func ackErrorReason(err error) string {
+	switch {
+	case errors.Is(err, ErrHandshakeRejected):
+		return "rejected"
+	case errors.Is(err, ErrHandshakeTimeout):
+		return "timeout"
+	default:
+		return "read"
+	}
+}
+
+// serveMetrics отдаёт /metrics на addr до отмены ctx
+func serveMetrics(ctx context.Context, addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	srv := &http.Server{Addr: addr, Handler: mux}
+
+	stop := context.AfterFunc(ctx, func() { srv.Shutdown(context.Background()) })
+	defer stop()
+
+	log.WithField("address", addr).Info("Запущен сервер метрик")
+	if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.WithError(err).WithField("address", addr).Error("Ошибка сервера метрик")
+	}
+}
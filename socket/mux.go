@@ -0,0 +1,182 @@
+package socket
+
+import (
+	"context"
+	"net"
+	"sync"
+	"usbmuxd-client/tunnelmux"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// muxSessions — мультиплексированные соединения с сервером (USBMUXD_MUX=1),
+// по одному на handshake и сервер. Каждое локальное подключение получает в
+// нём отдельный поток; формат кадров описан в пакете tunnelmux. mu защищает
+// только карту: соединения устанавливаются под блокировкой своего ключа, так
+// что недоступный сервер одного туннеля не задерживает остальные.
+type muxSessions struct {
+	mu      sync.Mutex
+	entries map[string]*muxEntry
+}
+
+// muxEntry — соединение одного ключа muxKey
+type muxEntry struct {
+	dialing chan struct{} // занят, пока соединение устанавливается
+	mu      sync.Mutex
+	session *tunnelmux.Session
+}
+
+// entry возвращает запись для ключа key, создавая её при необходимости
+func (m *muxSessions) entry(key string) *muxEntry {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.entries == nil {
+		m.entries = map[string]*muxEntry{}
+	}
+	e, ok := m.entries[key]
+	if !ok {
+		e = &muxEntry{dialing: make(chan struct{}, 1)}
+		m.entries[key] = e
+	}
+	return e
+}
+
+// current возвращает последнее установленное соединение записи или nil
+func (e *muxEntry) current() *tunnelmux.Session {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.session
+}
+
+func (e *muxEntry) set(s *tunnelmux.Session) {
+	e.mu.Lock()
+	e.session = s
+	e.mu.Unlock()
+}
+
+// openServerConn открывает соединение с сервером туннеля t для одного
+// локального подключения local (nil, если его нет): отдельное TCP-соединение
+// или поток мультиплексированного
+func (c *Client) openServerConn(ctx context.Context, logger *log.Entry, local net.Conn, t Tunnel) (net.Conn, error) {
+	if !c.cfg.Mux {
+		return c.connectToServer(ctx, logger, local, t)
+	}
+	return c.openStream(ctx, logger, t)
+}
+
+// openStream открывает поток в соединении для handshake и сервера туннеля t,
+// устанавливая соединение заново, если его нет или оно оборвалось
+func (c *Client) openStream(ctx context.Context, logger *log.Entry, t Tunnel) (net.Conn, error) {
+	if s := c.mux.entry(muxKey(t)).current(); s != nil {
+		if st, err := s.Open(); err == nil {
+			return st, nil
+		}
+		logger.WithError(s.Err()).Info("Мультиплексированное соединение оборвалось, переподключаемся")
+	}
+	s, err := c.muxSession(ctx, logger, t)
+	if err != nil {
+		return nil, err
+	}
+	return s.Open()
+}
+
+// keepMux держит мультиплексированное соединение туннеля t открытым до
+// отмены ctx: устанавливает его сразу после запуска туннеля и восстанавливает
+// после обрыва, чтобы первое подключение не ждало подключения и handshake
+func (c *Client) keepMux(ctx context.Context, t Tunnel) {
+	_, logger := c.newConnLogger()
+	logger = logger.WithField("local", t.LocalAddr)
+	delay := retryInitialDelay
+	for {
+		s, err := c.muxSession(ctx, logger, t)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			logger.WithError(err).Debug("Не удалось заранее установить мультиплексированное соединение")
+			if !sleepContext(ctx, jitter(delay)) {
+				return
+			}
+			delay = min(delay*2, retryMaxDelay)
+			continue
+		}
+		delay = retryInitialDelay
+
+		select {
+		case <-s.Done():
+		case <-ctx.Done():
+			return
+		}
+		if !sleepContext(ctx, jitter(retryInitialDelay)) {
+			return
+		}
+	}
+}
+
+// keepMuxWhenReady возвращает ready, который после успешного запуска
+// туннеля t запускает keepMux
+func (c *Client) keepMuxWhenReady(ctx context.Context, t Tunnel, ready func(error)) func(error) {
+	var once sync.Once
+	return func(err error) {
+		if err == nil {
+			once.Do(func() { go c.keepMux(ctx, t) })
+		}
+		ready(err)
+	}
+}
+
+// muxSession возвращает работающее соединение туннеля t, устанавливая его
+// при необходимости. Одновременно соединение для ключа устанавливает только
+// один вызов, остальные ждут его результата или отмены своего ctx.
+func (c *Client) muxSession(ctx context.Context, logger *log.Entry, t Tunnel) (*tunnelmux.Session, error) {
+	e := c.mux.entry(muxKey(t))
+	if s := e.current(); s != nil && s.Err() == nil {
+		return s, nil
+	}
+
+	select {
+	case e.dialing <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	defer func() { <-e.dialing }()
+
+	// Пока ждали, соединение мог установить другой вызов
+	if s := e.current(); s != nil && s.Err() == nil {
+		return s, nil
+	}
+	return c.dialMux(ctx, logger, t, e)
+}
+
+// dialMux устанавливает соединение для туннеля t и запоминает его в e.
+// Вызывается, пока занят e.dialing.
+func (c *Client) dialMux(ctx context.Context, logger *log.Entry, t Tunnel, e *muxEntry) (*tunnelmux.Session, error) {
+	conn, err := c.connectToServer(ctx, logger, nil, t)
+	if err != nil {
+		return nil, err
+	}
+	s := tunnelmux.Client(conn)
+	e.set(s)
+	logger.WithFields(log.Fields{
+		"handshake": displayHandshake(t.Handshake, c.encrypted()),
+		"server":    conn.RemoteAddr(),
+	}).Info("Установлено мультиплексированное соединение")
+	return s, nil
+}
+
+// muxKey — ключ соединения: туннели с одинаковыми handshake и сервером делят его
+func muxKey(t Tunnel) string {
+	return t.Handshake + "@" + t.ServerAddr + ":" + t.ServerPort
+}
+
+// closeAll закрывает все мультиплексированные соединения
+func (m *muxSessions) closeAll() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for key, e := range m.entries {
+		if s := e.current(); s != nil {
+			s.Close()
+		}
+		delete(m.entries, key)
+	}
+}
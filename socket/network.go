@@ -0,0 +1,155 @@
+package socket
+
+import (
+	"fmt"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Поддерживаемые значения Tunnel.Network
+const (
+	networkUnix = "unix"
+	networkTCP  = "tcp"
+	networkTCP4 = "tcp4"
+	networkTCP6 = "tcp6"
+	// SOCKS5-прокси на TCP-адресе: цель каждого подключения выбирает клиент
+	networkSOCKS5 = "socks5"
+	// UDP-адрес: датаграммы каждого клиента идут на сервер отдельным соединением
+	networkUDP = "udp"
+)
+
+// Режимы работы туннеля
+const (
+	modeUnix      = "unix"
+	modeTCPListen = "tcp-listen"
+	modeDial      = "dial"
+	modeSOCKS5    = "socks5"
+	modeUDP       = "udp"
+)
+
+// endpoint — разобранный локальный адрес туннеля
+type endpoint struct {
+	network string
+	addr    string
+}
+
+// endpoint определяет транспорт и адрес туннеля. Если Network не задан,
+// он выводится из LocalAddr: абсолютный путь или "@имя" (абстрактный сокет
+// Linux) — Unix-сокет, "host:port" (в том числе "[::1]:7777") — TCP,
+// голый порт "7777" — TCP на 127.0.0.1.
+func (t Tunnel) endpoint() (endpoint, error) {
+	if t.LocalAddr == "" {
+		return endpoint{}, fmt.Errorf("пустой локальный адрес: укажите путь Unix-сокета или TCP-адрес")
+	}
+
+	network := t.Network
+	if network == "" {
+		network = inferNetwork(t.LocalAddr)
+		if network == "" {
+			return endpoint{}, fmt.Errorf("не удалось определить тип адреса %q, укажите network", t.LocalAddr)
+		}
+	}
+
+	switch network {
+	case networkUnix:
+		if isAbstract(t.LocalAddr) && !abstractSupported {
+			return endpoint{}, fmt.Errorf("абстрактный Unix-сокет %q поддерживается только в Linux", t.LocalAddr)
+		}
+		return endpoint{network: network, addr: t.LocalAddr}, nil
+	case networkTCP, networkTCP4, networkTCP6:
+		addr, err := normalizeTCPAddr(t.LocalAddr, network)
+		if err != nil {
+			return endpoint{}, err
+		}
+		return endpoint{network: network, addr: addr}, nil
+	case networkSOCKS5:
+		addr, err := normalizeTCPAddr(t.LocalAddr, networkTCP)
+		if err != nil {
+			return endpoint{}, err
+		}
+		return endpoint{network: networkTCP, addr: addr}, nil
+	case networkUDP:
+		addr, err := normalizeTCPAddr(t.LocalAddr, networkTCP)
+		if err != nil {
+			return endpoint{}, err
+		}
+		return endpoint{network: networkUDP, addr: addr}, nil
+	}
+	return endpoint{}, fmt.Errorf("неподдерживаемый network %q, допустимые: unix, tcp, tcp4, tcp6, socks5, udp", network)
+}
+
+// mode возвращает режим работы туннеля
+func (t Tunnel) mode() string {
+	ep, err := t.endpoint()
+	switch {
+	case err != nil:
+		return "invalid"
+	case t.Dial:
+		return modeDial
+	case ep.network == networkUnix:
+		return modeUnix
+	case t.Network == networkSOCKS5:
+		return modeSOCKS5
+	case ep.network == networkUDP:
+		return modeUDP
+	default:
+		return modeTCPListen
+	}
+}
+
+// inferNetwork выводит транспорт из адреса или возвращает пустую строку
+func inferNetwork(addr string) string {
+	if isPort(addr) {
+		return networkTCP
+	}
+	if host, port, err := net.SplitHostPort(addr); err == nil && isPort(port) && !strings.ContainsAny(host, `/\`) {
+		return networkTCP
+	}
+	if strings.HasPrefix(addr, "/") || filepath.IsAbs(addr) || isAbstract(addr) {
+		return networkUnix
+	}
+	return ""
+}
+
+// normalizeTCPAddr проверяет TCP-адрес и соответствие семейства IP-литерала
+func normalizeTCPAddr(addr, network string) (string, error) {
+	if isPort(addr) {
+		host := "127.0.0.1"
+		if network == networkTCP6 {
+			host = "::1"
+		}
+		return net.JoinHostPort(host, addr), nil
+	}
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", fmt.Errorf("некорректный TCP-адрес %q: %w", addr, err)
+	}
+	if !isPort(port) {
+		return "", fmt.Errorf("некорректный порт в адресе %q", addr)
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		if network == networkTCP4 && ip.To4() == nil {
+			return "", fmt.Errorf("адрес %q не IPv4, а network = tcp4", addr)
+		}
+		if network == networkTCP6 && ip.To4() != nil {
+			return "", fmt.Errorf("адрес %q не IPv6, а network = tcp6", addr)
+		}
+	}
+	return addr, nil
+}
+
+// isPort сообщает, является ли строка номером порта
+func isPort(s string) bool {
+	n, err := strconv.Atoi(s)
+	return err == nil && n >= 0 && n <= 65535
+}
+
+// isAbstract сообщает, что адрес — имя в абстрактном пространстве Unix-сокетов.
+// Такой сокет не связан с файлом: удалять, создавать директорию и выставлять
+// права не нужно.
+func isAbstract(addr string) bool {
+	return len(addr) > 1 && addr[0] == '@'
+}
@@ -0,0 +1,66 @@
+package socket
+
+import "testing"
+
+func TestTunnelEndpoint(t *testing.T) {
+	tests := []struct {
+		addr, network         string
+		wantNetwork, wantAddr string
+		wantMode              string
+	}{
+		{"[::1]:7777", "", "tcp", "[::1]:7777", modeTCPListen},
+		{"127.0.0.1:7777", "", "tcp", "127.0.0.1:7777", modeTCPListen},
+		{"localhost:7777", "", "tcp", "localhost:7777", modeTCPListen},
+		{"relay.example.com:7777", "", "tcp", "relay.example.com:7777", modeTCPListen},
+		{"7777", "", "tcp", "127.0.0.1:7777", modeTCPListen},
+		{"7777", "tcp6", "tcp6", "[::1]:7777", modeTCPListen},
+		{"[::1]:7777", "tcp6", "tcp6", "[::1]:7777", modeTCPListen},
+		{"/var/run/usbmuxd", "", "unix", "/var/run/usbmuxd", modeUnix},
+		{"/tmp/a:b", "", "unix", "/tmp/a:b", modeUnix},
+		{"relative/socket", "unix", "unix", "relative/socket", modeUnix},
+		{"127.0.0.1:1080", "socks5", "tcp", "127.0.0.1:1080", modeSOCKS5},
+		{"127.0.0.1:5353", "udp", "udp", "127.0.0.1:5353", modeUDP},
+	}
+	for _, tt := range tests {
+		tun := Tunnel{LocalAddr: tt.addr, Network: tt.network, Handshake: testHandshake}
+		ep, err := tun.endpoint()
+		if err != nil {
+			t.Errorf("%q (%q): %v", tt.addr, tt.network, err)
+			continue
+		}
+		if ep.network != tt.wantNetwork || ep.addr != tt.wantAddr {
+			t.Errorf("%q (%q): получено %s %s, ожидалось %s %s", tt.addr, tt.network, ep.network, ep.addr, tt.wantNetwork, tt.wantAddr)
+		}
+		if mode := tun.mode(); mode != tt.wantMode {
+			t.Errorf("%q (%q): режим %s, ожидался %s", tt.addr, tt.network, mode, tt.wantMode)
+		}
+	}
+}
+
+func TestTunnelEndpointInvalid(t *testing.T) {
+	tests := []struct {
+		addr, network string
+	}{
+		{"", ""},
+		{"relative/socket", ""},
+		{"127.0.0.1:7777", "tcp6"},
+		{"[::1]:7777", "tcp4"},
+		{"127.0.0.1:port", "tcp"},
+		{"127.0.0.1:7777", "sctp"},
+	}
+	for _, tt := range tests {
+		tun := Tunnel{LocalAddr: tt.addr, Network: tt.network}
+		if ep, err := tun.endpoint(); err == nil {
+			t.Errorf("%q (%q): принят как %s %s", tt.addr, tt.network, ep.network, ep.addr)
+		}
+	}
+}
+
+func TestTunnelDialModeValidation(t *testing.T) {
+	for _, network := range []string{networkSOCKS5, networkUDP} {
+		tun := Tunnel{LocalAddr: "127.0.0.1:7777", Network: network, Handshake: testHandshake, Dial: true}
+		if err := validateTunnels([]Tunnel{tun}); err == nil {
+			t.Errorf("%s-туннель в режиме dial принят", network)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package socket
+
+import (
+	"fmt"
+	"net"
+	"os/user"
+	"slices"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// peerCred — процесс на другом конце Unix-сокета
+type peerCred struct {
+	PID, UID, GID int
+}
+
+// fields возвращает поля лога с учётными данными процесса
+func (p peerCred) fields() log.Fields {
+	return log.Fields{"pid": p.PID, "uid": p.UID, "gid": p.GID}
+}
+
+// peerFields возвращает поля лога с учётными данными процесса,
+// подключившегося к Unix-сокету, или nil, если их нельзя получить
+func peerFields(conn net.Conn) log.Fields {
+	uc, ok := conn.(*net.UnixConn)
+	if !ok {
+		return nil
+	}
+	cred, err := getPeerCred(uc)
+	if err != nil {
+		return nil
+	}
+	return cred.fields()
+}
+
+// parseIDs разбирает список пользователей или групп через запятую: числа
+// или имена, которые разрешаются через lookup
+func parseIDs(raw string, lookup func(string) (string, error)) ([]int, error) {
+	var ids []int
+	for _, s := range strings.Split(raw, ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		id, err := lookupID(s, lookup)
+		if err != nil {
+			return nil, fmt.Errorf("%q: %w", s, err)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+func lookupUID(name string) (string, error) {
+	u, err := user.Lookup(name)
+	if err != nil {
+		return "", err
+	}
+	return u.Uid, nil
+}
+
+func lookupGID(name string) (string, error) {
+	g, err := user.LookupGroup(name)
+	if err != nil {
+		return "", err
+	}
+	return g.Gid, nil
+}
+
+// allowedPeer проверяет, что процесс запущен пользователем из uids или
+// входит в группу из gids (основную или дополнительную). Пустые списки
+// разрешают всех.
+func allowedPeer(cred peerCred, uids, gids []int) bool {
+	if len(uids) == 0 && len(gids) == 0 {
+		return true
+	}
+	if slices.Contains(uids, cred.UID) || slices.Contains(gids, cred.GID) {
+		return true
+	}
+	if len(gids) == 0 {
+		return false
+	}
+	u, err := user.LookupId(strconv.Itoa(cred.UID))
+	if err != nil {
+		return false
+	}
+	groups, err := u.GroupIds()
+	if err != nil {
+		return false
+	}
+	for _, g := range groups {
+		if gid, err := strconv.Atoi(g); err == nil && slices.Contains(gids, gid) {
+			return true
+		}
+	}
+	return false
+}
+
+// peerAllowListener закрывает сразу после Accept подключения процессов,
+// не входящих в разрешённых пользователей и группы. Если учётные данные
+// процесса получить не удалось, подключение тоже закрывается.
+type peerAllowListener struct {
+	net.Listener
+	uids, gids []int
+}
+
+func (l *peerAllowListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		uc, _ := conn.(*net.UnixConn)
+		if uc == nil {
+			return conn, nil
+		}
+		cred, err := getPeerCred(uc)
+		if err == nil && allowedPeer(cred, l.uids, l.gids) {
+			return conn, nil
+		}
+		entry := log.WithField("address", l.Addr())
+		if err != nil {
+			entry = entry.WithError(err)
+		} else {
+			entry = entry.WithFields(cred.fields())
+		}
+		entry.Warn("Процесс не входит в разрешённых пользователей и группы, соединение закрыто")
+		conn.Close()
+	}
+}
@@ -0,0 +1,30 @@
+//go:build linux
+
+package socket
+
+import (
+	"net"
+	"syscall"
+)
+
+// peerCredSupported — учётные данные собеседника по Unix-сокету доступны (SO_PEERCRED)
+const peerCredSupported = true
+
+// getPeerCred возвращает учётные данные процесса на другом конце соединения
+func getPeerCred(conn *net.UnixConn) (peerCred, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return peerCred{}, err
+	}
+	var ucred *syscall.Ucred
+	var credErr error
+	if err := raw.Control(func(fd uintptr) {
+		ucred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	}); err != nil {
+		return peerCred{}, err
+	}
+	if credErr != nil {
+		return peerCred{}, credErr
+	}
+	return peerCred{PID: int(ucred.Pid), UID: int(ucred.Uid), GID: int(ucred.Gid)}, nil
+}
@@ -0,0 +1,71 @@
+//go:build linux
+
+package socket
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// dialPeerAllowed подключается к Unix-сокету за peerAllowListener
+// и сообщает, принято ли соединение
+func dialPeerAllowed(t *testing.T, uids, gids []int) bool {
+	t.Helper()
+	socketPath := filepath.Join(t.TempDir(), "usbmuxd")
+	inner, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener := &peerAllowListener{Listener: inner, uids: uids, gids: gids}
+	defer listener.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		if conn, err := listener.Accept(); err == nil {
+			accepted <- conn
+		}
+	}()
+
+	conn, err := net.Dial("unix", socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	select {
+	case server := <-accepted:
+		server.Close()
+		return true
+	case <-time.After(time.Second):
+	}
+	// Отклонённое соединение закрыто слушателем
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); !errors.Is(err, io.EOF) {
+		t.Fatalf("отклонённое соединение не закрыто: %v", err)
+	}
+	return false
+}
+
+func TestPeerAllowListener(t *testing.T) {
+	uid, gid := os.Getuid(), os.Getgid()
+	if !dialPeerAllowed(t, []int{uid}, nil) {
+		t.Error("процесс текущего пользователя не пропущен")
+	}
+	if !dialPeerAllowed(t, nil, []int{gid}) {
+		t.Error("процесс текущей группы не пропущен")
+	}
+	if dialPeerAllowed(t, []int{uid + 1}, nil) {
+		t.Error("пропущен процесс чужого пользователя")
+	}
+}
+
+func TestAllowPeersValidate(t *testing.T) {
+	cfg := Config{Servers: []string{"fake:1"}, AllowUIDs: []int{os.Getuid()}}
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("ограничение по пользователям отклонено: %v", err)
+	}
+}
@@ -0,0 +1,16 @@
+//go:build !linux
+
+package socket
+
+import (
+	"errors"
+	"net"
+)
+
+// peerCredSupported — SO_PEERCRED есть только в Linux
+const peerCredSupported = false
+
+// getPeerCred на платформах без SO_PEERCRED всегда возвращает ошибку
+func getPeerCred(*net.UnixConn) (peerCred, error) {
+	return peerCred{}, errors.New("учётные данные собеседника по Unix-сокету не поддерживаются на этой платформе")
+}
@@ -0,0 +1,16 @@
+//go:build !linux
+
+package socket
+
+import "testing"
+
+func TestAllowPeersUnsupported(t *testing.T) {
+	for _, cfg := range []Config{
+		{Servers: []string{"fake:1"}, AllowUIDs: []int{0}},
+		{Servers: []string{"fake:1"}, AllowGIDs: []int{0}},
+	} {
+		if err := cfg.Validate(); err == nil {
+			t.Errorf("ограничение Unix-сокета принято без SO_PEERCRED: %+v", cfg)
+		}
+	}
+}
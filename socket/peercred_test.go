@@ -0,0 +1,83 @@
+package socket
+
+import (
+	"errors"
+	"os/user"
+	"slices"
+	"strconv"
+	"testing"
+)
+
+func TestParseIDs(t *testing.T) {
+	names := map[string]string{"usbmux": "140", "plugdev": "46", "broken": "не число"}
+	lookup := func(name string) (string, error) {
+		if id, ok := names[name]; ok {
+			return id, nil
+		}
+		return "", errors.New("не найден")
+	}
+
+	ids, err := parseIDs(" 0, usbmux ,,plugdev,1000", lookup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []int{0, 140, 46, 1000}; !slices.Equal(ids, want) {
+		t.Errorf("разобрано %v, ожидалось %v", ids, want)
+	}
+	for _, raw := range []string{"0,nobody-here", "broken", "-1"} {
+		if ids, err := parseIDs(raw, lookup); err == nil {
+			t.Errorf("%q разобрано как %v", raw, ids)
+		}
+	}
+}
+
+func TestAllowedPeer(t *testing.T) {
+	// Заведомо несуществующие пользователь и группа
+	const unknown = 1 << 30
+	cred := peerCred{PID: 1, UID: 1000, GID: 1000}
+	tests := []struct {
+		name       string
+		uids, gids []int
+		want       bool
+	}{
+		{"без ограничений", nil, nil, true},
+		{"пользователь", []int{0, 1000}, nil, true},
+		{"основная группа", nil, []int{1000}, true},
+		{"чужой пользователь", []int{0}, nil, false},
+		{"чужие пользователь и группа", []int{0}, []int{unknown}, false},
+	}
+	for _, tt := range tests {
+		if got := allowedPeer(cred, tt.uids, tt.gids); got != tt.want {
+			t.Errorf("%s: allowedPeer = %v, ожидалось %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestAllowedPeerSupplementaryGroup(t *testing.T) {
+	u, err := user.Current()
+	if err != nil {
+		t.Skip(err)
+	}
+	groups, err := u.GroupIds()
+	if err != nil || len(groups) == 0 {
+		t.Skipf("группы пользователя недоступны: %v", err)
+	}
+	gid, err := strconv.Atoi(groups[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	uid, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Основная группа процесса не разрешена: доступ даёт членство
+	// пользователя в группе из списка
+	cred := peerCred{UID: uid, GID: 1 << 30}
+	if !allowedPeer(cred, nil, []int{gid}) {
+		t.Errorf("процесс пользователя из группы %d не пропущен", gid)
+	}
+	if allowedPeer(cred, nil, []int{1<<30 + 1}) {
+		t.Error("пропущен процесс пользователя не из разрешённых групп")
+	}
+}
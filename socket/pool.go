@@ -0,0 +1,143 @@
+package socket
+
+import (
+	"context"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// copyPool — ограниченный пул постоянных горутин копирования. Каждое
+// направление соединения — отдельное задание в очереди пула, поэтому
+// соединение не держит собственных горутин. При приёме соединения за ним
+// резервируются две свободные горутины: задания в очереди не ждут, и
+// половина соединения не простаивает, пока не закроются другие. Когда
+// свободных горутин нет, новое соединение отклоняется или не принимается
+// до их освобождения — как при лимите соединений (USBMUXD_MAX_CONNS_MODE),
+// так что число горутин не растёт с нагрузкой.
+type copyPool struct {
+	jobs chan func()
+	mode string
+
+	mu   sync.Mutex
+	free int           // горутины, не зарезервированные за соединениями
+	wake chan struct{} // сигнал ждущему в режиме block, что горутины освободились
+}
+
+// newCopyPool запускает пул из workers горутин; mode — limitReject или limitBlock
+func newCopyPool(workers int, mode string) *copyPool {
+	p := &copyPool{
+		jobs: make(chan func(), workers),
+		mode: mode,
+		free: workers,
+		wake: make(chan struct{}, 1),
+	}
+	for range workers {
+		go p.worker()
+	}
+	log.WithField("workers", workers).Info("Запущен пул горутин копирования")
+	return p
+}
+
+// worker выполняет задания копирования до закрытия пула
+func (p *copyPool) worker() {
+	for job := range p.jobs {
+		job()
+	}
+}
+
+// reserve резервирует горутины для обоих направлений соединения
+func (p *copyPool) reserve() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.free < 2 {
+		return false
+	}
+	p.free -= 2
+	if p.free >= 2 {
+		p.signal() // свободных хватит и следующему ждущему
+	}
+	return true
+}
+
+// put возвращает n горутин в число свободных
+func (p *copyPool) put(n int) {
+	p.mu.Lock()
+	p.free += n
+	p.signal()
+	p.mu.Unlock()
+}
+
+func (p *copyPool) signal() {
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+// waitSlot в режиме block до приёма соединения ждёт, пока для него
+// освободятся горутины. Возвращает false, если ctx отменён.
+func (p *copyPool) waitSlot(ctx context.Context) bool {
+	if p == nil || p.mode != limitBlock {
+		return true
+	}
+	if p.reserve() {
+		return true
+	}
+	log.Warn("Все горутины пула копирования заняты, ожидаем освобождения")
+	for {
+		select {
+		case <-p.wake:
+			if p.reserve() {
+				return true
+			}
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+// admit в режиме reject резервирует горутины для принятого соединения.
+// Возвращает false, если свободных нет и соединение нужно отклонить.
+func (p *copyPool) admit(localAddr string) bool {
+	if p == nil || p.mode != limitReject {
+		return true
+	}
+	if p.reserve() {
+		return true
+	}
+	copyPoolRejected.WithLabelValues(localAddr).Inc()
+	log.WithField("local", localAddr).Warn("Все горутины пула копирования заняты, соединение отклонено")
+	return false
+}
+
+// releaseWaited возвращает горутины, зарезервированные waitSlot, если
+// соединение так и не было принято
+func (p *copyPool) releaseWaited() {
+	if p != nil && p.mode == limitBlock {
+		p.put(2)
+	}
+}
+
+// release возвращает горутины соединения, которое закрылось, не дойдя до
+// проксирования
+func (p *copyPool) release() {
+	if p != nil {
+		p.put(2)
+	}
+}
+
+// submit ставит задание копирования в очередь. Горутина для него
+// зарезервирована при приёме соединения, поэтому submit не блокируется;
+// по завершении задания она снова свободна.
+func (p *copyPool) submit(job func()) {
+	p.jobs <- func() {
+		job()
+		p.put(1)
+	}
+}
+
+// close останавливает горутины пула. Вызывается, когда новых сессий уже не будет.
+func (p *copyPool) close() {
+	close(p.jobs)
+}
@@ -0,0 +1,71 @@
+package socket
+
+import (
+	"context"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// benchmarkProxy на каждой итерации открывает conns соединений разом,
+// передаёт по каждому payload байт на эхо-сервер и обратно и закрывает их.
+// workers > 0 включает пул копирования, 0 — горутины на соединение.
+func benchmarkProxy(b *testing.B, workers, conns, payload int) {
+	level := log.GetLevel()
+	log.SetLevel(log.ErrorLevel)
+	b.Cleanup(func() { log.SetLevel(level) })
+
+	c := newTestClient(b, Config{CopyWorkers: workers, MaxConnsMode: limitBlock})
+	tun := Tunnel{LocalAddr: "127.0.0.1:7777", Handshake: testHandshake}
+	msg := make([]byte, payload)
+	ctx := context.Background()
+
+	b.ReportAllocs()
+	for b.Loop() {
+		var wg sync.WaitGroup
+		for range conns {
+			wg.Add(1)
+			go func() {
+				local, a := net.Pipe()
+				server, echo := net.Pipe()
+				go func() {
+					io.Copy(echo, echo)
+					echo.Close()
+				}()
+
+				if !c.pool.waitSlot(ctx) {
+					b.Error("пул копирования закрыт")
+					wg.Done()
+					return
+				}
+				id, logger := c.newConnLogger()
+				s := c.newProxySession(ctx, id, logger, tun, a, server)
+				s.onDone = wg.Done
+				c.dispatchProxy(s)
+
+				go local.Write(msg)
+				io.CopyN(io.Discard, local, int64(payload))
+				local.Close()
+			}()
+		}
+		wg.Wait()
+	}
+}
+
+// Сравнение пула копирования с горутинами на соединение при большом числе
+// одновременных соединений
+func BenchmarkProxy(b *testing.B) {
+	const conns, payload = 1000, 4 * 1024
+	b.Run("goroutines", func(b *testing.B) {
+		benchmarkProxy(b, 0, conns, payload)
+	})
+	for _, workers := range []int{64, 512} {
+		b.Run("pool-"+strconv.Itoa(workers), func(b *testing.B) {
+			benchmarkProxy(b, workers, conns, payload)
+		})
+	}
+}
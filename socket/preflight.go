@@ -0,0 +1,81 @@
+package socket
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Preflight проверяет конфигурацию, не обслуживая трафик: для каждого
+// туннеля создаёт и сразу закрывает слушателя (для dial-туннеля —
+// подключается к локальному ресурсу) и один раз подключается к серверу
+// с полным handshake и ожиданием подтверждения. Ошибки всех туннелей
+// возвращаются вместе; после возврата открытых сокетов и соединений нет.
+func (c *Client) Preflight(ctx context.Context) error {
+	var errs []error
+	for _, t := range c.cfg.Tunnels {
+		if err := c.preflightTunnel(ctx, t); err != nil {
+			errs = append(errs, fmt.Errorf("туннель %s: %w", t.LocalAddr, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// preflightTunnel проверяет локальную сторону и сервер одного туннеля
+func (c *Client) preflightTunnel(ctx context.Context, t Tunnel) error {
+	ep, err := t.endpoint()
+	if err != nil {
+		return err
+	}
+	if err := c.preflightLocal(ctx, t, ep); err != nil {
+		return err
+	}
+
+	_, logger := c.newConnLogger()
+	logger = logger.WithField("local", t.LocalAddr)
+	conn, err := c.connectToServer(ctx, logger, nil, t)
+	if err != nil {
+		return fmt.Errorf("сервер: %w", err)
+	}
+	conn.Close()
+	log.WithField("local", t.LocalAddr).Info("Проверка туннеля пройдена")
+	return nil
+}
+
+// preflightLocal создаёт и закрывает слушателя туннеля или подключается
+// к локальному ресурсу dial-туннеля
+func (c *Client) preflightLocal(ctx context.Context, t Tunnel, ep endpoint) error {
+	var (
+		listener net.Listener
+		err      error
+	)
+	if c.inherited.has(ep.addr) {
+		// Переданный слушатель уже создан, а закрыть его значит потерять
+		return nil
+	}
+	switch t.mode() {
+	case modeDial:
+		conn, err := c.cfg.LocalDialer.DialContext(ctx, ep.network, ep.addr)
+		if err != nil {
+			return fmt.Errorf("локальный ресурс: %w", err)
+		}
+		return conn.Close()
+	case modeUnix:
+		listener, err = c.listenUnix(ep.addr)
+	case modeUDP:
+		pc, err := net.ListenPacket(ep.network, ep.addr)
+		if err != nil {
+			return listenError(ep.addr, "UDP-порт", err)
+		}
+		return pc.Close()
+	default:
+		listener, err = c.listenTCP(ep)
+	}
+	if err != nil {
+		return err
+	}
+	return listener.Close()
+}
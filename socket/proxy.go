@@ -0,0 +1,535 @@
+package socket
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ErrNoData — после handshake за отведённое время не передано ни одного байта
+var ErrNoData = errors.New("нет данных после handshake")
+
+// isClosedError сообщает, что ошибка означает закрытое соединение, а не сбой.
+// Потоки мультиплексирования и net.Pipe возвращают net.ErrClosed и
+// io.ErrClosedPipe без обёртки *net.OpError.
+func isClosedError(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, net.ErrClosed) || errors.Is(err, io.ErrClosedPipe) {
+		return true
+	}
+	opErr, ok := err.(*net.OpError)
+	return ok && (opErr.Err.Error() == "use of closed network connection" || opErr.Err.Error() == "connection reset by peer")
+}
+
+// isConnectionOpen проверяет, что собеседник не закрыл соединение.
+// Для TCP и Unix-сокетов делается неблокирующий recv с MSG_PEEK: данные
+// не извлекаются из буфера, EOF или RST означают закрытое соединение.
+// Для соединений без доступа к дескриптору (TLS, net.Pipe) проверка
+// невозможна, и соединение считается открытым — тогда закрытие обнаружит io.Copy.
+func isConnectionOpen(conn net.Conn) (bool, error) {
+	if conn == nil {
+		return false, errors.New("соединение равно nil")
+	}
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return true, nil
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return false, err
+	}
+	return peekOpen(raw)
+}
+
+// proxySession — состояние одного проксируемого соединения.
+// a — локальная сторона, b — сервер.
+type proxySession struct {
+	client    *Client
+	id        string // идентификатор соединения в логах и событиях
+	logger    *log.Entry
+	tunnel    Tunnel
+	opened    time.Time // момент принятия подключения, для длительности соединения
+	a, b      net.Conn  // b заменяется при переподключении, читать через server()
+	bMu       sync.Mutex
+	closing   bool // сессия закрывается, переподключаться нельзя; защищено bMu
+	closeOnce func()
+	closed    chan struct{}   // закрывается вызовом closeOnce
+	ctx       context.Context // контекст туннеля; отменяется и при закрытии сессии
+	onDone    func()          // вызывается после завершения сессии, может быть nil
+	heartbeat *heartbeat      // проверка живости usbmuxd, может быть nil
+	redial    redialState
+	gotData   atomic.Bool
+	noData    atomic.Bool  // сессия закрыта по ErrNoData
+	lastData  atomic.Int64 // время последней передачи данных, UnixNano
+
+	pending           atomic.Int32 // направления, которые ещё копируются
+	bytesIn, bytesOut int64        // итоги направлений, читать после pending == 0
+	errIn, errOut     error
+	cleanups          []func() // действия, отменяемые по завершении сессии
+}
+
+// newProxySession создаёт сессию для пары соединений туннеля t. Отмена ctx
+// прерывает переподключения сессии к серверу, но не закрывает её.
+func (c *Client) newProxySession(ctx context.Context, id string, logger *log.Entry, t Tunnel, a, b net.Conn) *proxySession {
+	if c.cfg.Compress {
+		b = newCompressedConn(b)
+	}
+	s := &proxySession{
+		client: c,
+		id:     id,
+		logger: logger,
+		tunnel: t,
+		opened: time.Now(),
+		a:      a,
+		b:      b,
+		closed: make(chan struct{}),
+	}
+	var cancel context.CancelFunc
+	s.ctx, cancel = context.WithCancel(ctx)
+	s.closeOnce = sync.OnceFunc(func() {
+		cancel()
+		close(s.closed)
+		s.bMu.Lock()
+		s.closing = true
+		b := s.b
+		s.bMu.Unlock()
+		a.Close()
+		b.Close()
+	})
+	return s
+}
+
+// server возвращает текущее соединение с сервером
+func (s *proxySession) server() net.Conn {
+	s.bMu.Lock()
+	defer s.bMu.Unlock()
+	return s.b
+}
+
+// sessionSet — активные сессии клиента, для ожидания и принудительного
+// закрытия при остановке
+type sessionSet struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+	m    map[*proxySession]struct{}
+}
+
+func newSessionSet() *sessionSet {
+	set := &sessionSet{m: map[*proxySession]struct{}{}}
+	set.cond = sync.NewCond(&set.mu)
+	return set
+}
+
+func (set *sessionSet) track(s *proxySession) {
+	set.mu.Lock()
+	set.m[s] = struct{}{}
+	set.mu.Unlock()
+}
+
+func (set *sessionSet) untrack(s *proxySession) {
+	set.mu.Lock()
+	delete(set.m, s)
+	set.cond.Broadcast()
+	set.mu.Unlock()
+}
+
+// count возвращает число активных сессий
+func (set *sessionSet) count() int {
+	set.mu.Lock()
+	defer set.mu.Unlock()
+	return len(set.m)
+}
+
+// drain ждёт завершения активных сессий не дольше grace,
+// затем закрывает оставшиеся и дожидается их завершения
+func (set *sessionSet) drain(grace time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), grace)
+	defer cancel()
+	set.drainContext(ctx)
+}
+
+// drainContext ждёт завершения всех сессий до отмены ctx, после чего
+// закрывает оставшиеся. Возвращает false, если пришлось закрывать.
+func (set *sessionSet) drainContext(ctx context.Context) bool {
+	done := make(chan struct{})
+	go func() {
+		set.mu.Lock()
+		for len(set.m) > 0 {
+			set.cond.Wait()
+		}
+		set.mu.Unlock()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-ctx.Done():
+	}
+
+	set.mu.Lock()
+	if len(set.m) > 0 {
+		log.WithField("count", len(set.m)).Warn("Принудительно закрываем активные соединения")
+	}
+	for s := range set.m {
+		s.closeOnce()
+	}
+	set.mu.Unlock()
+	<-done
+	return false
+}
+
+// startProxy проксирует данные сессии, запуская каждое направление в
+// отдельной горутине, и ждёт завершения сессии
+func startProxy(s *proxySession) {
+	done := make(chan struct{})
+	onDone := s.onDone
+	s.onDone = func() {
+		if onDone != nil {
+			onDone()
+		}
+		close(done)
+	}
+	s.run(func(f func()) { go f() })
+	<-done
+}
+
+// dispatchProxy запускает проксирование сессии и сразу возвращается:
+// направления копируются горутинами пула, если он включён, иначе —
+// двумя горутинами на соединение. Горутины пула для сессии должны быть
+// зарезервированы при приёме соединения (copyPool.admit или waitSlot).
+func (c *Client) dispatchProxy(s *proxySession) {
+	if c.pool != nil {
+		s.run(c.pool.submit)
+		return
+	}
+	s.run(func(f func()) { go f() })
+}
+
+// finish закрывает соединения сессии и сообщает о её завершении
+func (s *proxySession) finish() {
+	s.closeOnce()
+	if s.onDone != nil {
+		s.onDone()
+	}
+}
+
+// run запускает копирование данных в обе стороны до закрытия одной из
+// них: каждое направление — отдельное задание для spawn. Итоги соединения
+// подводит направление, завершившееся последним.
+func (s *proxySession) run(spawn func(func())) {
+	s.start()
+	s.pending.Store(2)
+	if s.reconnects() {
+		spawn(func() {
+			s.bytesIn, s.errIn = s.copyFromServer()
+			s.halfDone()
+		})
+		spawn(func() {
+			s.bytesOut, s.errOut = s.copyToServer()
+			s.halfDone()
+		})
+		return
+	}
+	spawn(func() {
+		s.bytesIn, s.errIn = s.copyHalf(s.a, s.b, "B->A")
+		s.halfDone()
+	})
+	spawn(func() {
+		s.bytesOut, s.errOut = s.copyHalf(s.b, s.a, "A->B")
+		s.halfDone()
+	})
+}
+
+// start готовит сессию к копированию: запускает наблюдение за данными и
+// учёт активных соединений. Обратные действия выполняет complete.
+func (s *proxySession) start() {
+	cfg := &s.client.cfg
+	a, b := s.a, s.b
+	if connLogs.allow() {
+		s.logger.WithFields(log.Fields{
+			"from": a.RemoteAddr(),
+			"to":   b.RemoteAddr(),
+		}).Info("Начало проксирования")
+	}
+
+	// Соединение, по которому после handshake так и не пошли данные, закрываем
+	if cfg.FirstByteTimeout > 0 {
+		timer := time.AfterFunc(cfg.FirstByteTimeout, func() {
+			if s.gotData.Load() {
+				return
+			}
+			s.noData.Store(true)
+			noDataClosed.WithLabelValues(s.tunnel.LocalAddr).Inc()
+			s.client.stats.countersFor(s.tunnel.LocalAddr).noData.Add(1)
+			s.logger.WithError(ErrNoData).WithFields(log.Fields{
+				"from":    a.RemoteAddr(),
+				"to":      b.RemoteAddr(),
+				"timeout": cfg.FirstByteTimeout,
+			}).Warn("Закрываем соединение без данных")
+			s.closeOnce()
+		})
+		s.cleanups = append(s.cleanups, func() { timer.Stop() })
+	}
+
+	// Соединение, по которому давно не было данных ни в одну сторону, закрываем
+	if cfg.IdleTimeout > 0 {
+		s.lastData.Store(time.Now().UnixNano())
+		s.cleanups = append(s.cleanups, s.watchIdle())
+	}
+
+	// Для туннелей к usbmuxd периодически проверяем, что сервер отвечает
+	if cfg.HeartbeatInterval > 0 && handshakeService(s.tunnel.Handshake) == serviceUsbmux {
+		s.heartbeat = newHeartbeat(s)
+		s.cleanups = append(s.cleanups, s.heartbeat.stop)
+	}
+
+	s.client.sessions.track(s)
+	s.cleanups = append(s.cleanups, func() { s.client.sessions.untrack(s) })
+
+	active := activeConnections.WithLabelValues(s.tunnel.LocalAddr)
+	active.Inc()
+	counters := s.client.stats.countersFor(s.tunnel.LocalAddr)
+	counters.active.Add(1)
+	s.cleanups = append(s.cleanups, func() {
+		active.Dec()
+		counters.active.Add(-1)
+	})
+}
+
+// halfDone отмечает завершение одного направления; после второго
+// подводятся итоги сессии
+func (s *proxySession) halfDone() {
+	if s.pending.Add(-1) == 0 {
+		s.complete()
+	}
+}
+
+// complete учитывает завершённое соединение в статистике, метриках, логах
+// и событиях, отменяет действия start и завершает сессию
+func (s *proxySession) complete() {
+	defer s.finish()
+	defer func() {
+		for i := len(s.cleanups) - 1; i >= 0; i-- {
+			s.cleanups[i]()
+		}
+	}()
+
+	bytesIn, bytesOut, errIn, errOut := s.bytesIn, s.bytesOut, s.errIn, s.errOut
+	closeErr := errors.Join(errOut, errIn)
+	if s.noData.Load() {
+		// Ни одно направление не передало данных: закрытие по таймеру —
+		// причина для обоих
+		errIn, errOut, closeErr = ErrNoData, ErrNoData, ErrNoData
+	}
+	s.client.stats.record(s.tunnel.LocalAddr, bytesIn, bytesOut)
+	connectionsTotal.WithLabelValues(s.tunnel.LocalAddr).Inc()
+	bytesTotal.WithLabelValues(s.tunnel.LocalAddr, "in").Add(float64(bytesIn))
+	bytesTotal.WithLabelValues(s.tunnel.LocalAddr, "out").Add(float64(bytesOut))
+	duration := time.Since(s.opened)
+	connectionDuration.WithLabelValues(s.tunnel.LocalAddr).Observe(duration.Seconds())
+	if limit := s.client.cfg.SlowConnWarn; limit > 0 && duration > limit {
+		s.logger.WithFields(log.Fields{
+			"duration":  duration,
+			"threshold": limit,
+			"bytes_in":  bytesIn,
+			"bytes_out": bytesOut,
+		}).Warn("Соединение длилось дольше порога")
+	}
+	if errIn != nil || errOut != nil {
+		s.logger.WithFields(log.Fields{
+			"bytes_in":  bytesIn,
+			"bytes_out": bytesOut,
+			"error_in":  errIn,
+			"error_out": errOut,
+		}).Warn("Проксирование завершено с ошибкой")
+	} else if connLogs.allow() {
+		s.logger.WithFields(log.Fields{
+			"bytes_in":  bytesIn,
+			"bytes_out": bytesOut,
+		}).Info("Проксирование завершено")
+	}
+	s.client.events.emit(Event{
+		Type:     ConnectionClosed,
+		Tunnel:   s.tunnel,
+		ConnID:   s.id,
+		BytesIn:  bytesIn,
+		BytesOut: bytesOut,
+		Duration: duration,
+		Err:      closeErr,
+		ErrIn:    errIn,
+		ErrOut:   errOut,
+	})
+}
+
+// copyHalf копирует данные из src в dst, закрывает обе стороны по
+// завершении и возвращает число скопированных байт и ошибку, если
+// направление завершилось не чистым закрытием
+func (s *proxySession) copyHalf(dst, src net.Conn, direction string) (int64, error) {
+	if ok, _ := isConnectionOpen(src); !ok {
+		s.logger.WithField("direction", direction).Debug("Источник уже закрыт, не запускаем копирование")
+		return 0, nil
+	}
+
+	r, w := s.wrapReader(src), s.wrapWriter(dst)
+	buf := s.client.buffers.get()
+	var n int64
+	var err error
+	switch {
+	case s.heartbeat != nil && dst == s.b:
+		n, err = s.heartbeat.copyToServer(w, r, *buf)
+	case s.heartbeat != nil:
+		n, err = s.heartbeat.copyToClient(w, r, *buf)
+	default:
+		n, err = io.CopyBuffer(writerOnly{w}, readerOnly{r}, *buf)
+	}
+	s.client.buffers.put(buf)
+	err = s.logCopyError(err, dst, src, direction)
+	s.closeOnce()
+	return n, err
+}
+
+// wrapReader добавляет к чтению из src учёт активности, ограничение
+// скорости соединения и туннеля и срок операции в соответствии с конфигурацией
+func (s *proxySession) wrapReader(src net.Conn) io.Reader {
+	cfg := &s.client.cfg
+	var r io.Reader = src
+	if cfg.FirstByteTimeout > 0 || cfg.IdleTimeout > 0 {
+		r = &activityReader{r: src, s: s}
+	}
+	if cfg.RateLimit > 0 {
+		r = &limitedReader{r: r, bucket: newTokenBucket(cfg.RateLimit), done: s.closed}
+	}
+	if rate := cmp.Or(s.tunnel.RateLimit, cfg.TunnelRateLimit); rate > 0 {
+		buckets := s.client.tunnelRates.get(s.tunnel.LocalAddr, rate)
+		bucket := buckets.toClient
+		if src == s.a {
+			bucket = buckets.toServer
+		}
+		r = &limitedReader{r: r, bucket: bucket, done: s.closed}
+	}
+	if cfg.RWTimeout > 0 {
+		r = &deadlineReader{r: r, conn: src, timeout: cfg.RWTimeout}
+	}
+	return r
+}
+
+// wrapWriter добавляет к записи в dst срок операции, если он задан
+func (s *proxySession) wrapWriter(dst net.Conn) io.Writer {
+	if timeout := s.client.cfg.RWTimeout; timeout > 0 {
+		return &deadlineWriter{conn: dst, timeout: timeout}
+	}
+	return dst
+}
+
+// logCopyError логирует ошибку копирования и возвращает её; закрытие
+// соединения ошибкой не считается, и для него возвращается nil
+func (s *proxySession) logCopyError(err error, dst, src net.Conn, direction string) error {
+	if err == nil || errors.Is(err, io.EOF) || isClosedError(err) {
+		return nil
+	}
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		s.logger.WithError(err).WithFields(log.Fields{
+			"source":  src.RemoteAddr(),
+			"dest":    dst.RemoteAddr(),
+			"timeout": s.client.cfg.RWTimeout,
+		}).Warn("Истёк срок операции " + direction + ", закрываем соединение")
+	} else {
+		s.logger.WithError(err).WithFields(log.Fields{
+			"source": src.RemoteAddr(),
+			"dest":   dst.RemoteAddr(),
+		}).Error("Ошибка " + direction)
+	}
+	return err
+}
+
+// watchIdle закрывает сессию, если данные не передавались дольше IdleTimeout.
+// Возвращает функцию остановки наблюдения.
+func (s *proxySession) watchIdle() (stop func()) {
+	idleTimeout := s.client.cfg.IdleTimeout
+	var (
+		mu      sync.Mutex
+		timer   *time.Timer
+		stopped bool
+	)
+	var check func()
+	check = func() {
+		idle := time.Since(time.Unix(0, s.lastData.Load()))
+		if idle >= idleTimeout {
+			idleClosed.WithLabelValues(s.tunnel.LocalAddr).Inc()
+			s.logger.WithFields(log.Fields{
+				"from":     s.a.RemoteAddr(),
+				"to":       s.server().RemoteAddr(),
+				"timeout":  idleTimeout,
+				"duration": time.Since(s.opened),
+			}).Info("Закрываем неактивное соединение")
+			s.closeOnce()
+			return
+		}
+		mu.Lock()
+		if !stopped {
+			timer = time.AfterFunc(idleTimeout-idle, check)
+		}
+		mu.Unlock()
+	}
+
+	mu.Lock()
+	timer = time.AfterFunc(idleTimeout, check)
+	mu.Unlock()
+
+	return func() {
+		mu.Lock()
+		stopped = true
+		timer.Stop()
+		mu.Unlock()
+	}
+}
+
+// activityReader отмечает в сессии факт и время передачи данных
+type activityReader struct {
+	r io.Reader
+	s *proxySession
+}
+
+func (a *activityReader) Read(p []byte) (int, error) {
+	n, err := a.r.Read(p)
+	if n > 0 {
+		a.s.gotData.Store(true)
+		a.s.lastData.Store(time.Now().UnixNano())
+	}
+	return n, err
+}
+
+// deadlineReader перед каждым чтением продлевает срок чтения conn на timeout
+type deadlineReader struct {
+	r       io.Reader
+	conn    net.Conn
+	timeout time.Duration
+}
+
+func (d *deadlineReader) Read(p []byte) (int, error) {
+	d.conn.SetReadDeadline(time.Now().Add(d.timeout))
+	return d.r.Read(p)
+}
+
+// deadlineWriter перед каждой записью продлевает срок записи conn на timeout
+type deadlineWriter struct {
+	conn    net.Conn
+	timeout time.Duration
+}
+
+func (d *deadlineWriter) Write(p []byte) (int, error) {
+	d.conn.SetWriteDeadline(time.Now().Add(d.timeout))
+	return d.conn.Write(p)
+}
@@ -0,0 +1,273 @@
+package socket
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+	"usbmuxd-client/fakeserver"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	log "github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+)
+
+func TestFirstByteTimeout(t *testing.T) {
+	c := newTestClient(t, Config{FirstByteTimeout: 100 * time.Millisecond})
+	events := make(chan Event, 8)
+	c.OnEvent(func(ev Event) { events <- ev })
+	addr := serveTCP(t, c, Tunnel{Handshake: testHandshake})
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// Клиент молчит: соединение должно закрыться по таймеру
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); !errors.Is(err, io.EOF) {
+		t.Fatalf("чтение вернуло %v, ожидалось закрытие соединения", err)
+	}
+
+	if ev := waitEvent(t, events, ConnectionClosed); !errors.Is(ev.Err, ErrNoData) {
+		t.Errorf("причина закрытия %v, ожидалась ErrNoData", ev.Err)
+	}
+	if got := counterValue(t, noDataClosed.WithLabelValues(addr)); got != 1 {
+		t.Errorf("usbmuxd_no_data_closed_total = %v, ожидалось 1", got)
+	}
+	if stats := c.Stats(); len(stats) != 1 || stats[0].NoDataClosed != 1 {
+		t.Errorf("Stats() = %+v, ожидалось одно соединение, закрытое по ErrNoData", stats)
+	}
+}
+
+func TestFirstByteTimeoutWithData(t *testing.T) {
+	c := newTestClient(t, Config{FirstByteTimeout: 100 * time.Millisecond})
+	addr := serveTCP(t, c, Tunnel{Handshake: testHandshake})
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	roundTrip(t, conn, "ping")
+
+	// После первых данных таймер не действует
+	time.Sleep(300 * time.Millisecond)
+	roundTrip(t, conn, "pong")
+	if got := counterValue(t, noDataClosed.WithLabelValues(addr)); got != 0 {
+		t.Errorf("usbmuxd_no_data_closed_total = %v, ожидалось 0", got)
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	const timeout = 200 * time.Millisecond
+	c := newTestClient(t, Config{IdleTimeout: timeout})
+	addr := serveTCP(t, c, Tunnel{Handshake: testHandshake})
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// Пока данные идут, соединение живёт дольше IdleTimeout
+	roundTrip(t, conn, "ping")
+	for range 3 {
+		time.Sleep(timeout / 2)
+		roundTrip(t, conn, "ping")
+	}
+
+	// Без данных соединение закрывается после IdleTimeout; таймер
+	// отсчитывается от последнего обмена
+	start := time.Now()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); !errors.Is(err, io.EOF) {
+		t.Fatalf("чтение вернуло %v, ожидалось закрытие соединения", err)
+	}
+	if elapsed := time.Since(start); elapsed < timeout/2 {
+		t.Errorf("соединение закрыто через %s, раньше IdleTimeout", elapsed)
+	}
+	if got := counterValue(t, idleClosed.WithLabelValues(addr)); got != 1 {
+		t.Errorf("usbmuxd_idle_closed_total = %v, ожидалось 1", got)
+	}
+}
+
+func TestRWTimeout(t *testing.T) {
+	const timeout = 200 * time.Millisecond
+	// Сервер принимает соединение, но ничего из него не читает
+	srv := fakeserver.New("")
+	release := make(chan struct{})
+	srv.Handler = func(handshake string, conn net.Conn) { <-release }
+	defer func() {
+		close(release)
+		srv.Close()
+	}()
+
+	c := newTestClient(t, Config{Dialer: srv, RWTimeout: timeout})
+	events := make(chan Event, 8)
+	c.OnEvent(func(ev Event) { events <- ev })
+	addr := serveTCP(t, c, Tunnel{Handshake: testHandshake})
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	start := time.Now()
+	go conn.Write(make([]byte, 64*1024))
+
+	ev := waitEvent(t, events, ConnectionClosed)
+	if !errors.Is(ev.Err, os.ErrDeadlineExceeded) {
+		t.Errorf("причина закрытия %v, ожидался истёкший срок записи", ev.Err)
+	}
+	if elapsed := time.Since(start); elapsed < timeout {
+		t.Errorf("соединение закрыто через %s, раньше RWTimeout", elapsed)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil || errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("чтение вернуло %v, ожидалось закрытие соединения", err)
+	}
+}
+
+// captureLogs перехватывает записи стандартного логгера до конца теста
+func captureLogs(t *testing.T) *logtest.Hook {
+	t.Helper()
+	hook := new(logtest.Hook)
+	old := log.StandardLogger().ReplaceHooks(log.LevelHooks{})
+	log.AddHook(hook)
+	t.Cleanup(func() { log.StandardLogger().ReplaceHooks(old) })
+	return hook
+}
+
+// slowWarnings возвращает предупреждения о долгих соединениях
+func slowWarnings(hook *logtest.Hook) []*log.Entry {
+	var found []*log.Entry
+	for _, e := range hook.AllEntries() {
+		if e.Level == log.WarnLevel && e.Message == "Соединение длилось дольше порога" {
+			found = append(found, e)
+		}
+	}
+	return found
+}
+
+func TestSlowConnWarn(t *testing.T) {
+	const threshold = 100 * time.Millisecond
+	hook := captureLogs(t)
+	c := newTestClient(t, Config{SlowConnWarn: threshold})
+	events := make(chan Event, 8)
+	c.OnEvent(func(ev Event) { events <- ev })
+	addr := serveTCP(t, c, Tunnel{Handshake: testHandshake})
+
+	histogram := connectionDuration.WithLabelValues(addr).(prometheus.Histogram)
+	var before dto.Metric
+	if err := histogram.Write(&before); err != nil {
+		t.Fatal(err)
+	}
+
+	// Короткое соединение не вызывает предупреждения
+	fast, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roundTrip(t, fast, "ping")
+	fast.Close()
+	waitEvent(t, events, ConnectionClosed)
+	if got := slowWarnings(hook); len(got) != 0 {
+		t.Fatalf("предупреждение о коротком соединении: %v", got[0].Data)
+	}
+
+	slow, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roundTrip(t, slow, "ping")
+	time.Sleep(threshold + 50*time.Millisecond)
+	slow.Close()
+	waitEvent(t, events, ConnectionClosed)
+
+	warnings := slowWarnings(hook)
+	if len(warnings) != 1 {
+		t.Fatalf("предупреждений о долгом соединении %d, ожидалось 1", len(warnings))
+	}
+	if d, _ := warnings[0].Data["duration"].(time.Duration); d < threshold {
+		t.Errorf("в предупреждении длительность %s, меньше порога", d)
+	}
+	var after dto.Metric
+	if err := histogram.Write(&after); err != nil {
+		t.Fatal(err)
+	}
+	if got := after.GetHistogram().GetSampleCount() - before.GetHistogram().GetSampleCount(); got != 2 {
+		t.Errorf("в гистограмму длительности записано %d соединений, ожидалось 2", got)
+	}
+}
+
+// errWriteRejected — ошибка, которую failingConn возвращает на запись
+var errWriteRejected = errors.New("запись отклонена")
+
+// failingConn отклоняет запись данных, содержащих "boom"
+type failingConn struct {
+	net.Conn
+}
+
+func (c failingConn) Write(p []byte) (int, error) {
+	if bytes.Contains(p, []byte("boom")) {
+		return 0, errWriteRejected
+	}
+	return c.Conn.Write(p)
+}
+
+// failingWriteDialer отдаёт соединения dialer, обёрнутые в failingConn
+type failingWriteDialer struct {
+	dialer Dialer
+}
+
+func (d failingWriteDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	conn, err := d.dialer.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return failingConn{conn}, nil
+}
+
+func TestCopyErrorReported(t *testing.T) {
+	srv := fakeserver.New("")
+	defer srv.Close()
+	c := newTestClient(t, Config{Dialer: failingWriteDialer{srv}})
+	events := make(chan Event, 8)
+	c.OnEvent(func(ev Event) { events <- ev })
+	addr := serveTCP(t, c, Tunnel{Handshake: testHandshake})
+
+	// Чистое закрытие ошибкой не считается
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roundTrip(t, conn, "ping")
+	conn.Close()
+	if ev := waitEvent(t, events, ConnectionClosed); ev.Err != nil || ev.ErrIn != nil || ev.ErrOut != nil {
+		t.Errorf("чистое закрытие сообщено с ошибкой: %v (in %v, out %v)", ev.Err, ev.ErrIn, ev.ErrOut)
+	}
+
+	// Ошибка записи на сервер сообщается как ошибка направления к серверу
+	conn, err = net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("boom")); err != nil {
+		t.Fatal(err)
+	}
+	ev := waitEvent(t, events, ConnectionClosed)
+	if !errors.Is(ev.Err, errWriteRejected) || !errors.Is(ev.ErrOut, errWriteRejected) {
+		t.Errorf("ошибка записи не сообщена: %v (out %v)", ev.Err, ev.ErrOut)
+	}
+	if ev.ErrIn != nil {
+		t.Errorf("направление от сервера завершено с ошибкой %v, ожидалось чистое закрытие", ev.ErrIn)
+	}
+}
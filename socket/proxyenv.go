@@ -0,0 +1,179 @@
+package socket
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// proxyFromEnv возвращает Dialer, ведущий подключения к серверу через
+// прокси из USBMUXD_PROXY, а если она не задана — из ALL_PROXY или
+// HTTPS_PROXY (в любом регистре). USBMUXD_PROXY=direct отключает прокси
+// из окружения. Без прокси возвращается nil.
+func proxyFromEnv() (Dialer, error) {
+	return newProxyDialer(firstEnv("USBMUXD_PROXY", "ALL_PROXY", "all_proxy", "HTTPS_PROXY", "https_proxy"))
+}
+
+// newProxyDialer возвращает Dialer, ведущий подключения через прокси raw.
+// Схема URL выбирает протокол: socks5 и socks5h — SOCKS5 (логин и пароль
+// берутся из URL), http — HTTP CONNECT, https — HTTP CONNECT поверх TLS
+// к прокси. Через прокси идут только подключения к серверам: локальные
+// ресурсы dial-туннелей подключаются через Config.LocalDialer. Серверы из
+// NO_PROXY и на адресах loopback подключаются напрямую. Для пустого raw и
+// "direct" возвращается nil.
+func newProxyDialer(raw string) (Dialer, error) {
+	if raw == "" || raw == "direct" {
+		return nil, nil
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("некорректный адрес прокси %q: %w", raw, err)
+	}
+
+	var d proxy.Dialer
+	switch u.Scheme {
+	case "http", "https":
+		d = newHTTPConnectDialer(u)
+	case "socks5", "socks5h":
+		if d, err = proxy.FromURL(u, proxy.Direct); err != nil {
+			return nil, fmt.Errorf("прокси %q: %w", u.Redacted(), err)
+		}
+	default:
+		return nil, fmt.Errorf("неподдерживаемая схема прокси %q, допустимые: http, https, socks5, socks5h", u.Scheme)
+	}
+
+	perHost := proxy.NewPerHost(d, proxy.Direct)
+	perHost.AddFromString("localhost,127.0.0.0/8,::1")
+	addNoProxy(perHost, firstEnv("NO_PROXY", "no_proxy"))
+	return perHost, nil
+}
+
+// addNoProxy добавляет в p исключения из NO_PROXY: адреса, подсети и
+// домены. Домен, как в curl и net/http, покрывает и свои поддомены;
+// ведущие "." и "*." допускаются.
+func addNoProxy(p *proxy.PerHost, raw string) {
+	for _, entry := range strings.Split(raw, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if _, _, err := net.ParseCIDR(entry); err == nil || net.ParseIP(entry) != nil {
+			p.AddFromString(entry)
+			continue
+		}
+		p.AddZone(strings.TrimPrefix(entry, "*"))
+	}
+}
+
+// firstEnv возвращает первое непустое значение переменных окружения
+func firstEnv(names ...string) string {
+	for _, name := range names {
+		if v := os.Getenv(name); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// httpConnectDialer подключается через HTTP-прокси методом CONNECT
+type httpConnectDialer struct {
+	proxyAddr string
+	auth      *url.Userinfo // nil — без Proxy-Authorization
+	tls       *tls.Config   // nil — соединение с прокси без TLS
+}
+
+// newHTTPConnectDialer создаёт Dialer для прокси u со схемой http или https.
+// Без порта используется 80 или 443.
+func newHTTPConnectDialer(u *url.URL) *httpConnectDialer {
+	d := &httpConnectDialer{proxyAddr: u.Host, auth: u.User}
+	port := "80"
+	if u.Scheme == "https" {
+		port = "443"
+		d.tls = &tls.Config{ServerName: u.Hostname(), MinVersion: tls.VersionTLS12}
+	}
+	if u.Port() == "" {
+		d.proxyAddr = net.JoinHostPort(u.Hostname(), port)
+	}
+	return d
+}
+
+func (d *httpConnectDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+// DialContext открывает туннель к addr; отмена ctx прерывает и подключение
+// к прокси, и ожидание его ответа. Семейство адресов из network к прокси
+// не относится, а CONNECT передать его не может: адрес разрешает прокси.
+func (d *httpConnectDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	conn, err := proxy.Direct.DialContext(ctx, "tcp", d.proxyAddr)
+	if err != nil {
+		return nil, fmt.Errorf("подключение к прокси %s: %w", d.proxyAddr, err)
+	}
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	defer stop()
+	if d.tls != nil {
+		tlsConn := tls.Client(conn, d.tls)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("TLS-рукопожатие с прокси %s: %w", d.proxyAddr, err)
+		}
+		conn = tlsConn
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: http.Header{},
+	}
+	if d.auth != nil {
+		password, _ := d.auth.Password()
+		token := base64.StdEncoding.EncodeToString([]byte(d.auth.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+token)
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("запрос CONNECT к прокси %s: %w", d.proxyAddr, err)
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("ответ прокси %s: %w", d.proxyAddr, err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("прокси %s отказал в CONNECT %s: %s", d.proxyAddr, addr, resp.Status)
+	}
+	if !stop() {
+		conn.Close()
+		return nil, ctx.Err()
+	}
+	if br.Buffered() > 0 {
+		// Прокси прислал данные сервера вместе с ответом — не теряем их
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+// bufferedConn отдаёт сначала прочитанные в буфер данные, затем данные соединения
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
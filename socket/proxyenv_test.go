@@ -0,0 +1,93 @@
+package socket
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+)
+
+// socksProxy запускает SOCKS5-прокси, который соединяет каждого клиента
+// с upstream независимо от запрошенной цели. Цели передаются в targets.
+func socksProxy(t *testing.T, upstream string) (string, <-chan string) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	targets := make(chan string, 4)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				target, err := socks5Accept(conn, "", "")
+				if err != nil {
+					return
+				}
+				targets <- target
+				remote, err := net.Dial("tcp", upstream)
+				if err != nil {
+					socks5Reply(conn, socks5RepFailure)
+					return
+				}
+				defer remote.Close()
+				if socks5Reply(conn, socks5RepOK) != nil {
+					return
+				}
+				go io.Copy(remote, conn)
+				io.Copy(conn, remote)
+			}()
+		}
+	}()
+	return listener.Addr().String(), targets
+}
+
+func TestProxyFromEnvSOCKS5(t *testing.T) {
+	upstream, attempts := refusingServer(t, 0)
+	proxyAddr, targets := socksProxy(t, upstream)
+
+	t.Setenv("USBMUXD_PROXY", "")
+	t.Setenv("ALL_PROXY", "socks5://"+proxyAddr)
+	t.Setenv("NO_PROXY", "")
+	dialer, err := proxyFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Сервер доступен только через прокси: имя relay.test не разрешается
+	c := newTestClient(t, Config{Servers: []string{"relay.test:27015"}, Dialer: dialer, HandshakeAck: "OK", DialRounds: 1})
+	_, logger := c.newConnLogger()
+	conn, err := c.connectToServer(context.Background(), logger, nil, Tunnel{Handshake: testHandshake})
+	if err != nil {
+		t.Fatalf("подключение через SOCKS5-прокси: %v", err)
+	}
+	defer conn.Close()
+	roundTrip(t, conn, "ping")
+
+	if got := <-targets; got != "relay.test:27015" {
+		t.Errorf("прокси получил цель %q, ожидался relay.test:27015", got)
+	}
+	if got := attempts.Load(); got != 1 {
+		t.Errorf("сервер получил %d подключений, ожидалось 1", got)
+	}
+}
+
+func TestProxyFromEnvDirect(t *testing.T) {
+	for _, env := range []map[string]string{
+		{"USBMUXD_PROXY": "", "ALL_PROXY": "", "all_proxy": "", "HTTPS_PROXY": "", "https_proxy": ""},
+		{"USBMUXD_PROXY": "direct", "ALL_PROXY": "socks5://127.0.0.1:1080"},
+	} {
+		for k, v := range env {
+			t.Setenv(k, v)
+		}
+		if dialer, err := proxyFromEnv(); err != nil || dialer != nil {
+			t.Errorf("%v: получен %v, %v, ожидалось прямое подключение", env, dialer, err)
+		}
+	}
+}
@@ -0,0 +1,29 @@
+package socket
+
+import (
+	"fmt"
+	"net"
+)
+
+// proxyHeader возвращает заголовок PROXY protocol v1 для локального
+// подключения local: адрес клиента и адрес, на котором оно принято.
+// Для Unix-сокетов и соединений без локального клиента возвращает "".
+func proxyHeader(local net.Conn) string {
+	if local == nil {
+		return ""
+	}
+	src, ok1 := local.RemoteAddr().(*net.TCPAddr)
+	dst, ok2 := local.LocalAddr().(*net.TCPAddr)
+	if !ok1 || !ok2 {
+		return ""
+	}
+	src4, dst4 := src.IP.To4(), dst.IP.To4()
+	switch {
+	case src4 != nil && dst4 != nil:
+		return fmt.Sprintf("PROXY TCP4 %s %s %d %d\r\n", src4, dst4, src.Port, dst.Port)
+	case src4 == nil && dst4 == nil:
+		return fmt.Sprintf("PROXY TCP6 %s %s %d %d\r\n", src.IP, dst.IP, src.Port, dst.Port)
+	}
+	// Адреса разных семейств в одном заголовке не допускаются
+	return "PROXY UNKNOWN\r\n"
+}
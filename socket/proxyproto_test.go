@@ -0,0 +1,75 @@
+package socket
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+// addrConn — соединение с заданными адресами для проверки заголовка PROXY
+type addrConn struct {
+	net.Conn
+	local, remote net.Addr
+}
+
+func (c addrConn) LocalAddr() net.Addr  { return c.local }
+func (c addrConn) RemoteAddr() net.Addr { return c.remote }
+
+func tcpAddr(s string) *net.TCPAddr {
+	return net.TCPAddrFromAddrPort(netip.MustParseAddrPort(s))
+}
+
+func TestProxyHeader(t *testing.T) {
+	tests := []struct {
+		remote, local net.Addr
+		want          string
+	}{
+		{tcpAddr("192.0.2.10:51234"), tcpAddr("127.0.0.1:7777"), "PROXY TCP4 192.0.2.10 127.0.0.1 51234 7777\r\n"},
+		{tcpAddr("[2001:db8::10]:51234"), tcpAddr("[::1]:7777"), "PROXY TCP6 2001:db8::10 ::1 51234 7777\r\n"},
+		{tcpAddr("192.0.2.10:51234"), tcpAddr("[::1]:7777"), "PROXY UNKNOWN\r\n"},
+		{&net.UnixAddr{Name: "@", Net: "unix"}, &net.UnixAddr{Name: "/var/run/usbmuxd", Net: "unix"}, ""},
+	}
+	for _, tt := range tests {
+		if got := proxyHeader(addrConn{local: tt.local, remote: tt.remote}); got != tt.want {
+			t.Errorf("%s -> %s: заголовок %q, ожидался %q", tt.remote, tt.local, got, tt.want)
+		}
+	}
+}
+
+func TestProxyHeaderSent(t *testing.T) {
+	dialer := newPipeDialer()
+	c := newTestClient(t, Config{Dialer: dialer, ProxyProtocol: true})
+	local := addrConn{local: tcpAddr("127.0.0.1:7777"), remote: tcpAddr("192.0.2.10:51234")}
+
+	errc := make(chan error, 1)
+	go func() {
+		_, logger := c.newConnLogger()
+		conn, err := c.connectToServer(context.Background(), logger, local, Tunnel{Handshake: testHandshake})
+		if err == nil {
+			conn.Close()
+		}
+		errc <- err
+	}()
+	server := <-dialer.conns
+	defer server.Close()
+
+	// Заголовок PROXY — первые байты соединения, до handshake
+	server.SetReadDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(server)
+	header, err := r.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "PROXY TCP4 192.0.2.10 127.0.0.1 51234 7777\r\n"; header != want {
+		t.Errorf("заголовок %q, ожидался %q", header, want)
+	}
+	if line, err := r.ReadString('\n'); err != nil || line != testHandshake+"\n" {
+		t.Errorf("после заголовка получено %q, %v, ожидался handshake", line, err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+}
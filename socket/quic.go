@@ -0,0 +1,170 @@
+package socket
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// quicALPN — протокол прикладного уровня, который клиент объявляет серверу QUIC
+const quicALPN = "usbmuxd-tunnel"
+
+// quicKeepAlive — период служебных пакетов, не дающих NAT и серверу
+// закрыть простаивающее QUIC-соединение
+const quicKeepAlive = 15 * time.Second
+
+// quicConns — QUIC-соединения с серверами quic://, по одному на сервер.
+// Каждое подключение к серверу — отдельный поток в соединении: handshake
+// отправляется в поток, как в обычное TCP-соединение. Как и у muxSessions,
+// mu защищает только карту: соединение устанавливается под блокировкой
+// своего сервера, так что недоступный сервер не задерживает остальные.
+type quicConns struct {
+	mu      sync.Mutex
+	entries map[string]*quicEntry
+}
+
+// quicEntry — соединение с одним сервером quic://
+type quicEntry struct {
+	dialing chan struct{} // занят, пока соединение устанавливается
+	mu      sync.Mutex
+	conn    *quic.Conn
+}
+
+// entry возвращает запись для сервера key, создавая её при необходимости
+func (q *quicConns) entry(key string) *quicEntry {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.entries == nil {
+		q.entries = map[string]*quicEntry{}
+	}
+	e, ok := q.entries[key]
+	if !ok {
+		e = &quicEntry{dialing: make(chan struct{}, 1)}
+		q.entries[key] = e
+	}
+	return e
+}
+
+// current возвращает установленное соединение записи, если оно не оборвалось
+func (e *quicEntry) current() *quic.Conn {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.conn != nil && e.conn.Context().Err() != nil {
+		e.conn = nil
+	}
+	return e.conn
+}
+
+func (e *quicEntry) set(conn *quic.Conn) {
+	e.mu.Lock()
+	e.conn = conn
+	e.mu.Unlock()
+}
+
+// drop закрывает соединение conn и забывает его, если запись всё ещё хранит его
+func (e *quicEntry) drop(conn *quic.Conn) {
+	conn.CloseWithError(0, "")
+	e.mu.Lock()
+	if e.conn == conn {
+		e.conn = nil
+	}
+	e.mu.Unlock()
+}
+
+// dialQUIC открывает поток в QUIC-соединении с сервером u, устанавливая
+// соединение заново, если его нет или оно оборвалось. UDP-сокет создаётся
+// напрямую: Config.Dialer и IPFamily для QUIC не применяются. TLS
+// настраивается как USBMUXD_TLS_*, без них сертификат проверяется по
+// системным корневым сертификатам.
+func (c *Client) dialQUIC(ctx context.Context, u upstream) (net.Conn, error) {
+	e := c.quic.entry(u.String())
+	if conn := e.current(); conn != nil {
+		st, err := conn.OpenStreamSync(ctx)
+		if err == nil {
+			return quicStream{st, conn}, nil
+		}
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		e.drop(conn)
+	}
+	conn, err := c.quicConn(ctx, u, e)
+	if err != nil {
+		return nil, err
+	}
+	st, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		// Отмена ctx не повод рвать соединение, которым пользуются другие
+		if ctx.Err() == nil {
+			e.drop(conn)
+		}
+		return nil, err
+	}
+	return quicStream{st, conn}, nil
+}
+
+// quicConn возвращает соединение записи e, устанавливая его при
+// необходимости. Одновременно соединение с сервером устанавливает только
+// один вызов, остальные ждут его результата или отмены своего ctx.
+func (c *Client) quicConn(ctx context.Context, u upstream, e *quicEntry) (*quic.Conn, error) {
+	select {
+	case e.dialing <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	defer func() { <-e.dialing }()
+
+	// Пока ждали, соединение мог установить другой вызов
+	if conn := e.current(); conn != nil {
+		return conn, nil
+	}
+
+	tlsCfg := &tls.Config{MinVersion: tls.VersionTLS13}
+	if c.cfg.TLS != nil {
+		tlsCfg = c.cfg.TLS.Clone()
+	}
+	if tlsCfg.ServerName == "" {
+		tlsCfg.ServerName = u.host
+	}
+	if len(tlsCfg.NextProtos) == 0 {
+		tlsCfg.NextProtos = []string{quicALPN}
+	}
+	conn, err := quic.DialAddr(ctx, net.JoinHostPort(u.host, u.port), tlsCfg, &quic.Config{KeepAlivePeriod: quicKeepAlive})
+	if err != nil {
+		return nil, err
+	}
+	e.set(conn)
+	return conn, nil
+}
+
+// closeAll закрывает все QUIC-соединения
+func (q *quicConns) closeAll() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for key, e := range q.entries {
+		if conn := e.current(); conn != nil {
+			conn.CloseWithError(0, "")
+		}
+		delete(q.entries, key)
+	}
+}
+
+// quicStream — поток QUIC в виде net.Conn
+type quicStream struct {
+	*quic.Stream
+	conn *quic.Conn
+}
+
+func (s quicStream) LocalAddr() net.Addr  { return s.conn.LocalAddr() }
+func (s quicStream) RemoteAddr() net.Addr { return s.conn.RemoteAddr() }
+
+// Close закрывает поток в обе стороны: Close самого quic.Stream
+// закрывает только запись
+func (s quicStream) Close() error {
+	s.Stream.CancelRead(0)
+	return s.Stream.Close()
+}
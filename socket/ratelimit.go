@@ -0,0 +1,101 @@
+package socket
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// tokenBucket — ведро токенов: один токен — один байт. Ёмкость ведра
+// равна секундному объёму, поэтому кратковременные всплески сглаживаются.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(bytesPerSec int64) *tokenBucket {
+	return &tokenBucket{
+		rate:   float64(bytesPerSec),
+		burst:  float64(bytesPerSec),
+		tokens: float64(bytesPerSec),
+		last:   time.Now(),
+	}
+}
+
+// take списывает n токенов и возвращает, сколько нужно подождать,
+// чтобы баланс не ушёл в минус
+func (b *tokenBucket) take(n int) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// maxChunk — наибольший объём одного чтения
+func (b *tokenBucket) maxChunk() int {
+	return max(1, int(b.burst))
+}
+
+// limitedReader ограничивает скорость чтения из r. Ожидание прерывается
+// закрытием done: ведро туннеля делят все его соединения, и долг в нём
+// может измеряться секундами, которые закрытой сессии ждать незачем.
+type limitedReader struct {
+	r      io.Reader
+	bucket *tokenBucket
+	done   <-chan struct{} // закрывается вместе с сессией; nil — ждать всегда
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if len(p) > l.bucket.maxChunk() {
+		p = p[:l.bucket.maxChunk()]
+	}
+	n, err := l.r.Read(p)
+	if wait := l.bucket.take(n); wait > 0 {
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-l.done:
+			timer.Stop()
+		}
+	}
+	return n, err
+}
+
+// tunnelBuckets — вёдра туннеля, общие для всех его соединений
+type tunnelBuckets struct {
+	rate     int64
+	toServer *tokenBucket // данные от локальных клиентов к серверу
+	toClient *tokenBucket // данные от сервера к локальным клиентам
+}
+
+// tunnelRates — ограничения скорости туннелей по локальному адресу
+type tunnelRates struct {
+	mu sync.Mutex
+	m  map[string]*tunnelBuckets
+}
+
+// get возвращает вёдра туннеля addr. Если туннель перезапущен с другим
+// ограничением, вёдра создаются заново.
+func (r *tunnelRates) get(addr string, rate int64) *tunnelBuckets {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if b := r.m[addr]; b != nil && b.rate == rate {
+		return b
+	}
+	if r.m == nil {
+		r.m = map[string]*tunnelBuckets{}
+	}
+	b := &tunnelBuckets{rate: rate, toServer: newTokenBucket(rate), toClient: newTokenBucket(rate)}
+	r.m[addr] = b
+	return b
+}
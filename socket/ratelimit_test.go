@@ -0,0 +1,58 @@
+package socket
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRateLimit(t *testing.T) {
+	const (
+		rate    = 64 << 10
+		payload = 2 * rate
+	)
+	c := newTestClient(t, Config{RateLimit: rate})
+	addr := serveTCP(t, c, Tunnel{Handshake: testHandshake})
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	data := bytes.Repeat([]byte("x"), payload)
+	start := time.Now()
+	go conn.Write(data)
+	got := make([]byte, payload)
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatal(err)
+	}
+	elapsed := time.Since(start)
+
+	if !bytes.Equal(got, data) {
+		t.Fatal("данные искажены")
+	}
+	// Первую секунду покрывает запас ведра, остальное идёт со скоростью rate
+	if want := time.Duration(payload-rate) * time.Second / rate; elapsed < want {
+		t.Errorf("%d байт прошли за %s, ожидалось не быстрее %s", payload, elapsed, want)
+	}
+}
+
+func TestLimitedReaderDone(t *testing.T) {
+	bucket := newTokenBucket(1)
+	done := make(chan struct{})
+	r := &limitedReader{r: bytes.NewReader(make([]byte, 1<<10)), bucket: bucket, done: done}
+	r.Read(make([]byte, 1))
+
+	// Долг в ведре — минута; закрытие done прерывает ожидание
+	bucket.take(60)
+	close(done)
+	start := time.Now()
+	r.Read(make([]byte, 1))
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("чтение после закрытия сессии ждало %s", elapsed)
+	}
+}
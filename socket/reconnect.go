@@ -0,0 +1,176 @@
+package socket
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sync"
+)
+
+// maxRedials — сколько раз подряд переподключаться к серверу, если новое
+// соединение обрывается, не передав ни байта
+const maxRedials = 3
+
+// redialState — состояние переподключений сессии
+type redialState struct {
+	mu    sync.Mutex
+	fails int // переподключений подряд без данных от сервера
+}
+
+// reconnects сообщает, переподключается ли сессия к серверу при обрыве.
+// Только для туннелей к usbmuxd с USBMUXD_RECONNECT и без проверки живости:
+// heartbeat разбирает поток пакетов одного соединения.
+//
+// Переподключение безопасно лишь для протоколов без состояния на сервере:
+// новое соединение получает тот же handshake, но ничего не знает о запросах,
+// отправленных по старому. Данные, которые не удалось записать в оборванное
+// соединение, и ответы, не дошедшие из него, теряются.
+func (s *proxySession) reconnects() bool {
+	return s.client.cfg.Reconnect && s.heartbeat == nil &&
+		handshakeService(s.tunnel.Handshake) == serviceUsbmux
+}
+
+// copyFromServer копирует данные от сервера к клиенту, переподключаясь
+// к серверу, если соединение с ним оборвалось
+func (s *proxySession) copyFromServer() (int64, error) {
+	buf := s.client.buffers.get()
+	defer s.client.buffers.put(buf)
+	defer s.closeOnce()
+
+	var total int64
+	for {
+		srv := s.server()
+		n, readErr, writeErr := copyChunks(s.wrapWriter(s.a), s.wrapReader(srv), *buf)
+		total += n
+		if writeErr != nil || s.isClosing() {
+			return total, s.logCopyError(writeErr, s.a, srv, "B->A")
+		}
+		if n > 0 {
+			s.redial.mu.Lock()
+			s.redial.fails = 0
+			s.redial.mu.Unlock()
+		}
+		if readErr == nil {
+			readErr = io.EOF
+		}
+		if !s.reconnect(srv, readErr) {
+			return total, s.redialError(readErr)
+		}
+	}
+}
+
+// copyToServer копирует данные от клиента к серверу, переподключаясь
+// к серверу, если запись в него не удалась
+func (s *proxySession) copyToServer() (int64, error) {
+	buf := s.client.buffers.get()
+	defer s.client.buffers.put(buf)
+	defer s.closeOnce()
+
+	var total int64
+	w := &currentServerWriter{s: s}
+	for {
+		n, readErr, writeErr := copyChunks(w, s.wrapReader(s.a), *buf)
+		total += n
+		if writeErr == nil || s.isClosing() {
+			return total, s.logCopyError(readErr, s.server(), s.a, "A->B")
+		}
+		if !s.reconnect(w.last, writeErr) {
+			return total, s.redialError(writeErr)
+		}
+	}
+}
+
+// currentServerWriter пишет в текущее соединение с сервером: данные,
+// прочитанные до переподключения, уходят уже в новое соединение
+type currentServerWriter struct {
+	s    *proxySession
+	last net.Conn // соединение, в которое была последняя запись
+}
+
+func (w *currentServerWriter) Write(p []byte) (int, error) {
+	w.last = w.s.server()
+	return w.s.wrapWriter(w.last).Write(p)
+}
+
+// reconnect заменяет оборванное соединение old новым с тем же handshake.
+// Если другое направление уже переподключилось, сразу возвращает true.
+// Подключение прерывается остановкой туннеля или клиента и закрытием сессии.
+func (s *proxySession) reconnect(old net.Conn, cause error) bool {
+	s.redial.mu.Lock()
+	defer s.redial.mu.Unlock()
+
+	if s.isClosing() {
+		return false
+	}
+	if s.server() != old {
+		return true
+	}
+	if s.redial.fails >= maxRedials {
+		s.logger.WithField("attempts", s.redial.fails).Error("Сервер обрывает соединение сразу после переподключения, закрываем сессию")
+		return false
+	}
+	s.redial.fails++
+
+	s.logger.WithError(cause).Warn("Соединение с сервером оборвалось, переподключаемся")
+	conn, err := s.client.openServerConn(s.ctx, s.logger, s.a, s.tunnel)
+	if err != nil {
+		s.logger.WithError(err).Error("Не удалось переподключиться к серверу")
+		return false
+	}
+
+	if s.client.cfg.Compress {
+		conn = newCompressedConn(conn)
+	}
+
+	s.bMu.Lock()
+	if s.closing {
+		s.bMu.Unlock()
+		conn.Close()
+		return false
+	}
+	s.b = conn
+	s.bMu.Unlock()
+	old.Close()
+
+	s.logger.WithField("server", conn.RemoteAddr()).Info("Соединение с сервером восстановлено")
+	return true
+}
+
+// redialError возвращает ошибку направления, которое не смогло
+// переподключиться; если сессию уже закрывают, ошибки нет
+func (s *proxySession) redialError(cause error) error {
+	if s.isClosing() {
+		return nil
+	}
+	return fmt.Errorf("не удалось восстановить соединение с сервером: %w", cause)
+}
+
+func (s *proxySession) isClosing() bool {
+	s.bMu.Lock()
+	defer s.bMu.Unlock()
+	return s.closing
+}
+
+// copyChunks копирует src в dst до ошибки или конца данных и разделяет
+// ошибки чтения и записи. Конец данных ошибкой не считается.
+func copyChunks(dst io.Writer, src io.Reader, buf []byte) (n int64, readErr, writeErr error) {
+	for {
+		nr, err := src.Read(buf)
+		if nr > 0 {
+			nw, err := dst.Write(buf[:nr])
+			n += int64(nw)
+			if err == nil && nw < nr {
+				err = io.ErrShortWrite
+			}
+			if err != nil {
+				return n, nil, err
+			}
+		}
+		if err == io.EOF {
+			return n, nil, nil
+		}
+		if err != nil {
+			return n, err, nil
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package socket
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+	"usbmuxd-client/fakeserver"
+)
+
+// serverConn возвращает текущее соединение с сервером единственной сессии клиента
+func serverConn(t *testing.T, c *Client) net.Conn {
+	t.Helper()
+	c.sessions.mu.Lock()
+	defer c.sessions.mu.Unlock()
+	if len(c.sessions.m) != 1 {
+		t.Fatalf("активных сессий %d, ожидалась одна", len(c.sessions.m))
+	}
+	for s := range c.sessions.m {
+		return s.server()
+	}
+	return nil
+}
+
+func TestReconnectMidStream(t *testing.T) {
+	// Первое соединение обрывается по сигналу kill после первого ответа,
+	// следующие возвращают данные обратно
+	srv := fakeserver.New("")
+	kill := make(chan struct{})
+	stop := sync.OnceFunc(func() { close(kill) })
+	var conns atomic.Int32
+	srv.Handler = func(handshake string, conn net.Conn) {
+		if conns.Add(1) == 1 {
+			buf := make([]byte, 4)
+			if _, err := io.ReadFull(conn, buf); err == nil {
+				conn.Write(buf)
+			}
+			<-kill
+			return
+		}
+		io.Copy(conn, conn)
+	}
+	defer srv.Close()
+	defer stop()
+
+	c := newTestClient(t, Config{Dialer: srv, Reconnect: true})
+	addr := serveTCP(t, c, Tunnel{Handshake: testUsbmuxHandshake})
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	roundTrip(t, conn, "ping")
+	first := serverConn(t, c)
+	stop()
+
+	// Локальный клиент остаётся подключённым, а данные идут в новое соединение
+	deadline := time.Now().Add(5 * time.Second)
+	for serverConn(t, c) == first {
+		if time.Now().After(deadline) {
+			t.Fatal("соединение с сервером не восстановлено")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	roundTrip(t, conn, "pong")
+	if got := len(srv.Handshakes()); got != 2 {
+		t.Errorf("сервер принял %d подключений, ожидалось 2", got)
+	}
+	for _, h := range srv.Handshakes() {
+		if h != testUsbmuxHandshake {
+			t.Errorf("при переподключении отправлен handshake %q", h)
+		}
+	}
+}
+
+func TestReconnectGivesUp(t *testing.T) {
+	// Сервер обрывает каждое соединение сразу после handshake
+	srv := fakeserver.New("")
+	srv.Handler = func(handshake string, conn net.Conn) {}
+	defer srv.Close()
+
+	c := newTestClient(t, Config{Dialer: srv, Reconnect: true})
+	addr := serveTCP(t, c, Tunnel{Handshake: testUsbmuxHandshake})
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); !errors.Is(err, io.EOF) {
+		t.Fatalf("чтение вернуло %v, ожидалось закрытие соединения", err)
+	}
+	if got := len(srv.Handshakes()); got != 1+maxRedials {
+		t.Errorf("сервер принял %d подключений, ожидалось %d", got, 1+maxRedials)
+	}
+}
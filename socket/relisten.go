@@ -0,0 +1,136 @@
+package socket
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Паузы после ошибок Accept и при пересоздании слушателя
+const (
+	acceptRetryMin   = 5 * time.Millisecond
+	acceptRetryMax   = time.Second
+	acceptFailLimit  = 5 // подряд неустранимых ошибок, после которых слушатель пересоздаётся
+	relistenMinDelay = 100 * time.Millisecond
+	relistenMaxDelay = 30 * time.Second
+)
+
+// errListenerBroken — слушатель раз за разом возвращает неустранимые ошибки
+var errListenerBroken = errors.New("слушатель перестал принимать подключения")
+
+// temporaryAcceptError сообщает, что ошибка Accept относится к одному
+// подключению или к временной нехватке ресурсов, а не к самому слушателю
+func temporaryAcceptError(err error) bool {
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		return true
+	}
+	for _, errno := range []syscall.Errno{syscall.ECONNABORTED, syscall.ECONNRESET, syscall.EMFILE, syscall.ENFILE, syscall.ENOBUFS, syscall.ENOMEM, syscall.EINTR} {
+		if errors.Is(err, errno) {
+			return true
+		}
+	}
+	return false
+}
+
+// acceptFailures считает ошибки Accept подряд и выдерживает паузу между ними
+type acceptFailures struct {
+	delay  time.Duration
+	broken int
+}
+
+// fail выдерживает паузу после ошибки и возвращает errListenerBroken, если
+// неустранимых ошибок подряд стало слишком много. Пауза растёт от 5мс до 1с
+// и прерывается отменой ctx.
+func (f *acceptFailures) fail(ctx context.Context, err error) error {
+	if temporaryAcceptError(err) {
+		f.broken = 0
+	} else if f.broken++; f.broken >= acceptFailLimit {
+		return fmt.Errorf("%w: %d ошибок подряд: %w", errListenerBroken, f.broken, err)
+	}
+	f.delay = min(max(f.delay*2, acceptRetryMin), acceptRetryMax)
+	sleepContext(ctx, f.delay)
+	return nil
+}
+
+// reset вызывается после успешного Accept
+func (f *acceptFailures) reset() {
+	*f = acceptFailures{}
+}
+
+// serveListener принимает подключения на слушателе от listen. Если слушатель
+// сломался, он закрывается и создаётся заново с паузой от 100мс до 30с;
+// попытки продолжаются до отмены ctx. Сломанный слушатель из
+// Config.Listeners не пересоздаётся: туннель завершается с ошибкой.
+// Ошибка первого создания возвращается без повторов, ready вызывается
+// только после него.
+func (c *Client) serveListener(ctx context.Context, t Tunnel, kind string, listen func() (net.Listener, error), ready func(error)) error {
+	ep, err := t.endpoint()
+	if err != nil {
+		return err
+	}
+	inherited := c.inheritedAddr(ep.addr)
+	listener, err := listen()
+	if err != nil {
+		return err
+	}
+	ready(nil)
+
+	// Соединения, принятые прежним слушателем, продолжают занимать слоты
+	limiter := c.tunnelLimiter(t)
+	delay := relistenMinDelay
+	for {
+		started := time.Now()
+		err := c.acceptLoop(ctx, t, listener, kind, limiter)
+		listener.Close()
+		if err == nil {
+			return nil
+		}
+		if inherited {
+			log.WithError(err).WithFields(log.Fields{
+				"listener": kind,
+				"address":  t.LocalAddr,
+			}).Error("Переданный слушатель сломан, пересоздать его нельзя: туннель остановлен")
+			return fmt.Errorf("туннель %s: переданный слушатель: %w", t.LocalAddr, err)
+		}
+		if time.Since(started) > relistenMaxDelay {
+			delay = relistenMinDelay
+		}
+
+		for {
+			log.WithError(err).WithFields(log.Fields{
+				"listener": kind,
+				"address":  t.LocalAddr,
+				"delay":    delay,
+			}).Warn("Слушатель сломан, пересоздаём")
+			if !sleepContext(ctx, delay) {
+				return nil
+			}
+			delay = min(delay*2, relistenMaxDelay)
+			if listener, err = listen(); err == nil {
+				break
+			}
+		}
+		log.WithFields(log.Fields{
+			"listener": kind,
+			"address":  t.LocalAddr,
+		}).Info("Слушатель пересоздан")
+	}
+}
+
+// sleepContext ждёт d и возвращает false, если ctx отменён раньше
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
@@ -0,0 +1,186 @@
+package socket
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// brokenListener на каждый Accept возвращает err
+type brokenListener struct {
+	err     error
+	accepts atomic.Int32
+	closed  chan struct{}
+}
+
+func newBrokenListener(err error) *brokenListener {
+	return &brokenListener{err: err, closed: make(chan struct{})}
+}
+
+func (l *brokenListener) Accept() (net.Conn, error) {
+	l.accepts.Add(1)
+	select {
+	case <-l.closed:
+		return nil, net.ErrClosed
+	default:
+		return nil, l.err
+	}
+}
+
+func (l *brokenListener) Close() error {
+	select {
+	case <-l.closed:
+	default:
+		close(l.closed)
+	}
+	return nil
+}
+
+func (l *brokenListener) Addr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
+}
+
+func TestAcceptLoopBrokenListener(t *testing.T) {
+	c := newTestClient(t, Config{})
+	listener := newBrokenListener(errors.New("слушатель сломан"))
+
+	done := make(chan error, 1)
+	go func() {
+		done <- c.acceptLoop(context.Background(), Tunnel{LocalAddr: "127.0.0.1:7777", Handshake: testHandshake}, listener, "TCP-порт", nil)
+	}()
+	select {
+	case err := <-done:
+		if !errors.Is(err, errListenerBroken) {
+			t.Fatalf("acceptLoop вернул %v, ожидался errListenerBroken", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("acceptLoop крутится на сломанном слушателе")
+	}
+	if got := listener.accepts.Load(); got != acceptFailLimit {
+		t.Errorf("сделано %d попыток Accept, ожидалось %d", got, acceptFailLimit)
+	}
+}
+
+func TestAcceptLoopTemporaryErrors(t *testing.T) {
+	c := newTestClient(t, Config{})
+	listener := newBrokenListener(syscall.EMFILE)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	err := c.acceptLoop(ctx, Tunnel{LocalAddr: "127.0.0.1:7777", Handshake: testHandshake}, listener, "TCP-порт", nil)
+	if err != nil {
+		t.Fatalf("временные ошибки сочтены поломкой слушателя: %v", err)
+	}
+	// Паузы 5, 10, 20, 40, 80мс: за 200мс не больше нескольких попыток
+	if got := listener.accepts.Load(); got > 10 {
+		t.Errorf("за 200мс сделано %d попыток Accept, пауза между ошибками не работает", got)
+	}
+}
+
+func TestServeListenerRelisten(t *testing.T) {
+	c := newTestClient(t, Config{})
+	broken := newBrokenListener(errors.New("слушатель сломан"))
+	var listens atomic.Int32
+	addr := make(chan string, 1)
+	listen := func() (net.Listener, error) {
+		if listens.Add(1) == 1 {
+			return broken, nil
+		}
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err == nil {
+			addr <- listener.Addr().String()
+		}
+		return listener, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- c.serveListener(ctx, Tunnel{LocalAddr: "127.0.0.1:7777", Handshake: testHandshake}, "TCP-порт", listen, func(error) {})
+	}()
+
+	select {
+	case a := <-addr:
+		conn, err := net.Dial("tcp", a)
+		if err != nil {
+			t.Fatal(err)
+		}
+		roundTrip(t, conn, "ping")
+		conn.Close()
+	case <-time.After(5 * time.Second):
+		t.Fatal("сломанный слушатель не пересоздан")
+	}
+	if got := broken.accepts.Load(); got != acceptFailLimit {
+		t.Errorf("на сломанном слушателе сделано %d попыток Accept, ожидалось %d", got, acceptFailLimit)
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Errorf("serveListener после остановки: %v", err)
+	}
+	c.sessions.drain(time.Second)
+	if got := listens.Load(); got != 2 {
+		t.Errorf("слушатель создан %d раз, ожидалось 2", got)
+	}
+}
+
+func TestServeListenerRelistenKeepsLimit(t *testing.T) {
+	c := newTestClient(t, Config{MaxConns: 1, MaxConnsMode: limitReject})
+	tun := Tunnel{LocalAddr: "127.0.0.1:7778", Handshake: testHandshake}
+	listeners := make(chan net.Listener, 2)
+	listen := func() (net.Listener, error) {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err == nil {
+			listeners <- listener
+		}
+		return listener, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- c.serveListener(ctx, tun, "TCP-порт", listen, func(error) {})
+	}()
+	defer func() {
+		cancel()
+		<-done
+		c.sessions.drain(time.Second)
+	}()
+
+	// Единственный слот занят соединением, принятым первым слушателем
+	first := <-listeners
+	held := dialTunnel(t, first.Addr().String())
+
+	// Закрытый слушатель сломан: serveListener создаёт новый
+	first.Close()
+	var second net.Listener
+	select {
+	case second = <-listeners:
+	case <-time.After(5 * time.Second):
+		t.Fatal("сломанный слушатель не пересоздан")
+	}
+
+	rejected := counterValue(t, connLimitRejected.WithLabelValues(tun.LocalAddr))
+	extra, err := net.Dial("tcp", second.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer extra.Close()
+	extra.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := extra.Read(make([]byte, 1)); !errors.Is(err, io.EOF) {
+		t.Fatalf("после пересоздания слушателя принято соединение сверх лимита: %v", err)
+	}
+	if got := counterValue(t, connLimitRejected.WithLabelValues(tun.LocalAddr)); got != rejected+1 {
+		t.Errorf("usbmuxd_conn_limit_rejected_total = %v, ожидалось %v", got, rejected+1)
+	}
+
+	// Слот прежнего соединения освобождается и для нового слушателя
+	held.Close()
+	waitActive(t, c, tun.LocalAddr, 0)
+	dialTunnel(t, second.Addr().String())
+}
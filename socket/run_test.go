@@ -0,0 +1,91 @@
+package socket
+
+import (
+	"context"
+	"errors"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// freeAddr возвращает свободный TCP-адрес на 127.0.0.1
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	return listener.Addr().String()
+}
+
+// busyAddr занимает TCP-адрес до конца теста и возвращает его
+func busyAddr(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	return listener.Addr().String()
+}
+
+// dialRetry подключается к addr, пока туннель не начнёт слушать
+func dialRetry(t *testing.T, addr string) net.Conn {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			t.Cleanup(func() { conn.Close() })
+			return conn
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("туннель %s не запустился: %v", addr, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRunSkipsBusyAddress(t *testing.T) {
+	busy, free := busyAddr(t), freeAddr(t)
+	c := newTestClient(t, Config{Tunnels: []Tunnel{
+		{LocalAddr: busy, Handshake: testHandshake},
+		{LocalAddr: free, Handshake: testHandshake},
+	}})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error, 1)
+	go func() { errc <- c.Run(ctx) }()
+
+	roundTrip(t, dialRetry(t, free), "ping")
+	select {
+	case err := <-errc:
+		t.Fatalf("Run завершился, хотя один туннель работает: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	cancel()
+	if err := <-errc; err != nil {
+		t.Errorf("Run после остановки: %v", err)
+	}
+}
+
+func TestRunAllTunnelsFailed(t *testing.T) {
+	c := newTestClient(t, Config{Tunnels: []Tunnel{
+		{LocalAddr: busyAddr(t), Handshake: testHandshake},
+		{LocalAddr: busyAddr(t), Handshake: testHandshake},
+	}})
+
+	errc := make(chan error, 1)
+	go func() { errc <- c.Run(context.Background()) }()
+	select {
+	case err := <-errc:
+		if !errors.Is(err, syscall.EADDRINUSE) {
+			t.Errorf("ошибка %v, ожидался занятый адрес", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run не завершился, хотя ни один туннель не запустился")
+	}
+}
@@ -0,0 +1,44 @@
+package socket
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// parseSocketOwner разбирает владельца Unix-сокета вида "пользователь[:группа]"
+// или ":группа"; пользователь и группа задаются именем или числом. Не
+// заданная часть возвращается как -1 и при смене владельца не меняется.
+func parseSocketOwner(owner string) (uid, gid int, err error) {
+	uid, gid = -1, -1
+	if owner == "" {
+		return uid, gid, nil
+	}
+	userPart, groupPart, _ := strings.Cut(owner, ":")
+	if userPart != "" {
+		if uid, err = lookupID(userPart, lookupUID); err != nil {
+			return -1, -1, fmt.Errorf("владелец Unix-сокета %q: %w", owner, err)
+		}
+	}
+	if groupPart != "" {
+		if gid, err = lookupID(groupPart, lookupGID); err != nil {
+			return -1, -1, fmt.Errorf("группа Unix-сокета %q: %w", owner, err)
+		}
+	}
+	if uid == -1 && gid == -1 {
+		return -1, -1, fmt.Errorf("владелец Unix-сокета должен иметь вид пользователь[:группа], получено %q", owner)
+	}
+	return uid, gid, nil
+}
+
+// lookupID возвращает числовой идентификатор: само число или результат lookup по имени
+func lookupID(s string, lookup func(string) (string, error)) (int, error) {
+	if id, err := strconv.Atoi(s); err == nil && id >= 0 {
+		return id, nil
+	}
+	raw, err := lookup(s)
+	if err != nil {
+		return -1, err
+	}
+	return strconv.Atoi(raw)
+}
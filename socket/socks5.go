@@ -0,0 +1,157 @@
+package socket
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// socks5Timeout — время на SOCKS5-рукопожатие с локальным клиентом
+const socks5Timeout = 10 * time.Second
+
+// Значения протокола SOCKS5 (RFC 1928, RFC 1929)
+const (
+	socks5Version      = 5
+	socks5AuthNone     = 0x00
+	socks5AuthPassword = 0x02
+	socks5AuthNoMethod = 0xff
+	socks5CmdConnect   = 0x01
+	socks5AtypIPv4     = 0x01
+	socks5AtypDomain   = 0x03
+	socks5AtypIPv6     = 0x04
+
+	socks5RepOK             = 0x00
+	socks5RepFailure        = 0x01
+	socks5RepCmdUnsupported = 0x07
+	socks5RepAtypUnknown    = 0x08
+)
+
+// socks5Accept проводит SOCKS5-рукопожатие с локальным клиентом и возвращает
+// запрошенную цель "host:port". Поддерживается только CONNECT. Если user
+// задан, клиент обязан пройти аутентификацию по логину и паролю.
+// Ответ на CONNECT отправляет вызывающий через socks5Reply.
+func socks5Accept(conn net.Conn, user, password string) (string, error) {
+	conn.SetDeadline(time.Now().Add(socks5Timeout))
+	defer conn.SetDeadline(time.Time{})
+
+	// Приветствие: версия и список методов аутентификации
+	head := make([]byte, 2)
+	if _, err := io.ReadFull(conn, head); err != nil {
+		return "", fmt.Errorf("чтение приветствия SOCKS5: %w", err)
+	}
+	if head[0] != socks5Version {
+		return "", fmt.Errorf("неподдерживаемая версия SOCKS %d", head[0])
+	}
+	methods := make([]byte, head[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return "", fmt.Errorf("чтение методов SOCKS5: %w", err)
+	}
+
+	want := byte(socks5AuthNone)
+	if user != "" {
+		want = socks5AuthPassword
+	}
+	offered := false
+	for _, m := range methods {
+		offered = offered || m == want
+	}
+	if !offered {
+		conn.Write([]byte{socks5Version, socks5AuthNoMethod})
+		return "", errors.New("клиент SOCKS5 не предложил подходящий метод аутентификации")
+	}
+	if _, err := conn.Write([]byte{socks5Version, want}); err != nil {
+		return "", err
+	}
+	if want == socks5AuthPassword {
+		if err := socks5Login(conn, user, password); err != nil {
+			return "", err
+		}
+	}
+
+	// Запрос: версия, команда, резерв, тип адреса
+	req := make([]byte, 4)
+	if _, err := io.ReadFull(conn, req); err != nil {
+		return "", fmt.Errorf("чтение запроса SOCKS5: %w", err)
+	}
+	if req[1] != socks5CmdConnect {
+		socks5Reply(conn, socks5RepCmdUnsupported)
+		return "", fmt.Errorf("неподдерживаемая команда SOCKS5 %d, поддерживается только CONNECT", req[1])
+	}
+
+	var host string
+	switch req[3] {
+	case socks5AtypIPv4, socks5AtypIPv6:
+		ip := make([]byte, net.IPv4len)
+		if req[3] == socks5AtypIPv6 {
+			ip = make([]byte, net.IPv6len)
+		}
+		if _, err := io.ReadFull(conn, ip); err != nil {
+			return "", fmt.Errorf("чтение адреса SOCKS5: %w", err)
+		}
+		host = net.IP(ip).String()
+	case socks5AtypDomain:
+		n := make([]byte, 1)
+		if _, err := io.ReadFull(conn, n); err != nil {
+			return "", fmt.Errorf("чтение адреса SOCKS5: %w", err)
+		}
+		name := make([]byte, n[0])
+		if _, err := io.ReadFull(conn, name); err != nil {
+			return "", fmt.Errorf("чтение адреса SOCKS5: %w", err)
+		}
+		host = string(name)
+	default:
+		socks5Reply(conn, socks5RepAtypUnknown)
+		return "", fmt.Errorf("неизвестный тип адреса SOCKS5 %d", req[3])
+	}
+
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(conn, port); err != nil {
+		return "", fmt.Errorf("чтение порта SOCKS5: %w", err)
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(port[0])<<8|int(port[1]))), nil
+}
+
+// socks5Login проверяет логин и пароль клиента (RFC 1929)
+func socks5Login(conn net.Conn, user, password string) error {
+	readField := func() ([]byte, error) {
+		n := make([]byte, 1)
+		if _, err := io.ReadFull(conn, n); err != nil {
+			return nil, err
+		}
+		field := make([]byte, n[0])
+		_, err := io.ReadFull(conn, field)
+		return field, err
+	}
+
+	ver := make([]byte, 1)
+	if _, err := io.ReadFull(conn, ver); err != nil {
+		return fmt.Errorf("чтение аутентификации SOCKS5: %w", err)
+	}
+	gotUser, err := readField()
+	if err != nil {
+		return fmt.Errorf("чтение аутентификации SOCKS5: %w", err)
+	}
+	gotPassword, err := readField()
+	if err != nil {
+		return fmt.Errorf("чтение аутентификации SOCKS5: %w", err)
+	}
+
+	userOK := subtle.ConstantTimeCompare(gotUser, []byte(user)) == 1
+	passwordOK := subtle.ConstantTimeCompare(gotPassword, []byte(password)) == 1
+	if !userOK || !passwordOK {
+		conn.Write([]byte{1, 1})
+		return errors.New("неверный логин или пароль SOCKS5")
+	}
+	_, err = conn.Write([]byte{1, 0})
+	return err
+}
+
+// socks5Reply отвечает на запрос CONNECT; адрес привязки не сообщается
+func socks5Reply(conn net.Conn, rep byte) error {
+	_, err := conn.Write([]byte{socks5Version, rep, 0, socks5AtypIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
@@ -0,0 +1,95 @@
+package socket
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"usbmuxd-client/fakeserver"
+
+	"golang.org/x/net/proxy"
+)
+
+// socksServer возвращает сервер, который читает цель после handshake,
+// передаёт её в targets и возвращает данные обратно
+func socksServer(t *testing.T) (*fakeserver.Server, <-chan string) {
+	t.Helper()
+	targets := make(chan string, 4)
+	srv := fakeserver.New("")
+	srv.Handler = func(handshake string, conn net.Conn) {
+		r := bufio.NewReader(conn)
+		target, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		targets <- strings.TrimSuffix(target, "\n")
+		buf := make([]byte, 32*1024)
+		for {
+			n, err := r.Read(buf)
+			if n > 0 {
+				conn.Write(buf[:n])
+			}
+			if err != nil {
+				return
+			}
+		}
+	}
+	t.Cleanup(func() { srv.Close() })
+	return srv, targets
+}
+
+func TestSOCKS5Connect(t *testing.T) {
+	srv, targets := socksServer(t)
+	c := newTestClient(t, Config{Dialer: srv})
+	addr := serveTCP(t, c, Tunnel{Network: networkSOCKS5, Handshake: testHandshake})
+
+	dialer, err := proxy.SOCKS5("tcp", addr, nil, proxy.Direct)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, target := range []string{"device.local:8100", "10.0.0.2:62078", "[fe80::1]:22"} {
+		conn, err := dialer.Dial("tcp", target)
+		if err != nil {
+			t.Fatalf("CONNECT %s: %v", target, err)
+		}
+		roundTrip(t, conn, "ping")
+		conn.Close()
+		if got := <-targets; got != target {
+			t.Errorf("серверу передана цель %q, ожидалась %q", got, target)
+		}
+	}
+}
+
+func TestSOCKS5Auth(t *testing.T) {
+	srv, targets := socksServer(t)
+	c := newTestClient(t, Config{Dialer: srv, SOCKSUser: "tester", SOCKSPassword: "secret"})
+	addr := serveTCP(t, c, Tunnel{Network: networkSOCKS5, Handshake: testHandshake})
+
+	dialer, err := proxy.SOCKS5("tcp", addr, &proxy.Auth{User: "tester", Password: "secret"}, proxy.Direct)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := dialer.Dial("tcp", "device.local:8100")
+	if err != nil {
+		t.Fatalf("CONNECT с верным паролем: %v", err)
+	}
+	roundTrip(t, conn, "ping")
+	conn.Close()
+	if got := <-targets; got != "device.local:8100" {
+		t.Errorf("серверу передана цель %q", got)
+	}
+
+	for _, auth := range []*proxy.Auth{nil, {User: "tester", Password: "wrong"}} {
+		dialer, err := proxy.SOCKS5("tcp", addr, auth, proxy.Direct)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if conn, err := dialer.Dial("tcp", "device.local:8100"); err == nil {
+			conn.Close()
+			t.Errorf("подключение с %+v принято", auth)
+		}
+	}
+	if got := len(srv.Handshakes()); got != 1 {
+		t.Errorf("сервер получил %d подключений, ожидалось 1", got)
+	}
+}
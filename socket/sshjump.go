@@ -0,0 +1,201 @@
+package socket
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// sshJumpFromEnv возвращает Dialer, ведущий подключения к серверу через
+// SSH-узел из USBMUXD_SSH_JUMP ("ssh://user@bastion[:port]"). Аутентификация —
+// ключом из USBMUXD_SSH_KEY (с паролем USBMUXD_SSH_KEY_PASSPHRASE) и/или
+// через ssh-agent по SSH_AUTH_SOCK. Ключ узла проверяется по
+// USBMUXD_SSH_KNOWN_HOSTS (по умолчанию ~/.ssh/known_hosts); USBMUXD_SSH_INSECURE=1
+// отключает проверку. Сам узел подключается через base. Через узел идут
+// только подключения к серверам, в том числе к адресам loopback — это
+// loopback узла; локальные ресурсы dial-туннелей подключаются напрямую
+// (Config.LocalDialer). Без USBMUXD_SSH_JUMP возвращается nil.
+func sshJumpFromEnv(base Dialer) (Dialer, error) {
+	raw := os.Getenv("USBMUXD_SSH_JUMP")
+	if raw == "" {
+		return nil, nil
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("некорректный адрес USBMUXD_SSH_JUMP %q: %w", raw, err)
+	}
+	if u.Scheme != "ssh" || u.Hostname() == "" || u.User.Username() == "" {
+		return nil, fmt.Errorf("USBMUXD_SSH_JUMP должен иметь вид ssh://user@host[:port], получено %q", raw)
+	}
+	port := u.Port()
+	if port == "" {
+		port = "22"
+	}
+
+	auth, err := sshAuthFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	hostKey, err := sshHostKeyFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	return &sshDialer{
+		addr: net.JoinHostPort(u.Hostname(), port),
+		base: base,
+		config: &ssh.ClientConfig{
+			User:            u.User.Username(),
+			Auth:            auth,
+			HostKeyCallback: hostKey,
+		},
+	}, nil
+}
+
+// sshAuthFromEnv собирает способы аутентификации: ключ из файла, затем ssh-agent
+func sshAuthFromEnv() ([]ssh.AuthMethod, error) {
+	var auth []ssh.AuthMethod
+	if path := os.Getenv("USBMUXD_SSH_KEY"); path != "" {
+		pemBytes, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("USBMUXD_SSH_KEY: %w", err)
+		}
+		var signer ssh.Signer
+		if passphrase := os.Getenv("USBMUXD_SSH_KEY_PASSPHRASE"); passphrase != "" {
+			signer, err = ssh.ParsePrivateKeyWithPassphrase(pemBytes, []byte(passphrase))
+		} else {
+			signer, err = ssh.ParsePrivateKey(pemBytes)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("USBMUXD_SSH_KEY %s: %w", path, err)
+		}
+		auth = append(auth, ssh.PublicKeys(signer))
+	}
+	if sock := os.Getenv("SSH_AUTH_SOCK"); sock != "" {
+		// Агент подключается при каждой аутентификации: он может быть
+		// перезапущен, пока клиент работает
+		auth = append(auth, ssh.PublicKeysCallback(func() ([]ssh.Signer, error) {
+			conn, err := net.Dial("unix", sock)
+			if err != nil {
+				return nil, fmt.Errorf("подключение к ssh-agent: %w", err)
+			}
+			defer conn.Close()
+			return agent.NewClient(conn).Signers()
+		}))
+	}
+	if len(auth) == 0 {
+		return nil, errors.New("для USBMUXD_SSH_JUMP нужен USBMUXD_SSH_KEY или запущенный ssh-agent (SSH_AUTH_SOCK)")
+	}
+	return auth, nil
+}
+
+// sshHostKeyFromEnv возвращает проверку ключа SSH-узла
+func sshHostKeyFromEnv() (ssh.HostKeyCallback, error) {
+	if os.Getenv("USBMUXD_SSH_INSECURE") == "1" {
+		log.Warn("Проверка ключа SSH-узла отключена (USBMUXD_SSH_INSECURE=1): соединение уязвимо для подмены узла")
+		return ssh.InsecureIgnoreHostKey(), nil
+	}
+	path := os.Getenv("USBMUXD_SSH_KNOWN_HOSTS")
+	if path == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, fmt.Errorf("не задан USBMUXD_SSH_KNOWN_HOSTS и не найден домашний каталог: %w", err)
+		}
+		path = filepath.Join(home, ".ssh", "known_hosts")
+	}
+	callback, err := knownhosts.New(path)
+	if err != nil {
+		return nil, fmt.Errorf("USBMUXD_SSH_KNOWN_HOSTS: %w", err)
+	}
+	return callback, nil
+}
+
+// sshDialer открывает соединения через одно SSH-подключение к узлу,
+// устанавливая его заново, если оно оборвалось
+type sshDialer struct {
+	addr   string
+	base   Dialer
+	config *ssh.ClientConfig
+
+	mu     sync.Mutex
+	client *ssh.Client
+}
+
+func (d *sshDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+// DialContext открывает канал к addr. Если канал не открылся в уже
+// установленном подключении, подключение к узлу делается заново один раз.
+func (d *sshDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	client, reused, err := d.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := client.DialContext(ctx, network, addr)
+	if err == nil || !reused || ctx.Err() != nil {
+		return conn, err
+	}
+
+	d.drop(client)
+	if client, _, err = d.connect(ctx); err != nil {
+		return nil, err
+	}
+	return client.DialContext(ctx, network, addr)
+}
+
+// connect возвращает SSH-подключение к узлу; reused — оно было установлено раньше
+func (d *sshDialer) connect(ctx context.Context) (client *ssh.Client, reused bool, err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.client != nil {
+		return d.client, true, nil
+	}
+
+	conn, err := d.base.DialContext(ctx, "tcp", d.addr)
+	if err != nil {
+		return nil, false, fmt.Errorf("подключение к SSH-узлу %s: %w", d.addr, err)
+	}
+	// ssh.NewClientConn не принимает контекст: срок переносится на соединение
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	sshConn, chans, reqs, err := ssh.NewClientConn(conn, d.addr, d.config)
+	stop()
+	if err != nil {
+		conn.Close()
+		return nil, false, fmt.Errorf("SSH-рукопожатие с %s: %w", d.addr, err)
+	}
+	conn.SetDeadline(time.Time{})
+
+	client = ssh.NewClient(sshConn, chans, reqs)
+	d.client = client
+	go func() {
+		err := client.Wait()
+		log.WithError(err).WithField("address", d.addr).Debug("SSH-подключение к узлу закрыто")
+		d.drop(client)
+	}()
+	log.WithField("address", d.addr).Info("Установлено SSH-подключение к узлу")
+	return client, false, nil
+}
+
+// drop закрывает подключение client и забывает его, если оно ещё текущее
+func (d *sshDialer) drop(client *ssh.Client) {
+	d.mu.Lock()
+	if d.client == client {
+		d.client = nil
+	}
+	d.mu.Unlock()
+	client.Close()
+}
@@ -0,0 +1,91 @@
+package socket
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// TunnelStats — накопленная статистика туннеля.
+// BytesOut — от локального клиента к серверу, BytesIn — от сервера к клиенту.
+type TunnelStats struct {
+	LocalAddr    string `json:"localAddr"`
+	Connections  int64  `json:"connections"`
+	BytesIn      int64  `json:"bytesIn"`
+	BytesOut     int64  `json:"bytesOut"`
+	NoDataClosed int64  `json:"noDataClosed"` // закрыты по ErrNoData
+}
+
+// tunnelCounters — атомарные счётчики одного туннеля
+type tunnelCounters struct {
+	connections atomic.Int64 // завершённые соединения
+	active      atomic.Int64 // соединения, которые проксируются сейчас
+	bytesIn     atomic.Int64
+	bytesOut    atomic.Int64
+	noData      atomic.Int64 // соединения, закрытые по ErrNoData
+}
+
+// statsRegistry — счётчики туннелей клиента по локальному адресу
+type statsRegistry struct {
+	mu       sync.Mutex
+	counters map[string]*tunnelCounters
+}
+
+// countersFor возвращает счётчики туннеля по его локальному адресу
+func (r *statsRegistry) countersFor(localAddr string) *tunnelCounters {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.counters == nil {
+		r.counters = map[string]*tunnelCounters{}
+	}
+	c, ok := r.counters[localAddr]
+	if !ok {
+		c = &tunnelCounters{}
+		r.counters[localAddr] = c
+	}
+	return c
+}
+
+// lookup возвращает счётчики туннеля или nil, если соединений ещё не было
+func (r *statsRegistry) lookup(localAddr string) *tunnelCounters {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.counters[localAddr]
+}
+
+// record учитывает завершённое соединение туннеля
+func (r *statsRegistry) record(localAddr string, bytesIn, bytesOut int64) {
+	c := r.countersFor(localAddr)
+	c.connections.Add(1)
+	c.bytesIn.Add(bytesIn)
+	c.bytesOut.Add(bytesOut)
+}
+
+// Stats возвращает статистику клиента по всем туннелям, отсортированную по адресу
+func (c *Client) Stats() []TunnelStats {
+	r := &c.stats
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	result := make([]TunnelStats, 0, len(r.counters))
+	for addr, tc := range r.counters {
+		result = append(result, TunnelStats{
+			LocalAddr:    addr,
+			Connections:  tc.connections.Load(),
+			BytesIn:      tc.bytesIn.Load(),
+			BytesOut:     tc.bytesOut.Load(),
+			NoDataClosed: tc.noData.Load(),
+		})
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].LocalAddr < result[j].LocalAddr })
+	return result
+}
+
+// Stats возвращает статистику клиента по умолчанию
+func Stats() []TunnelStats {
+	c, err := defaultClient()
+	if err != nil {
+		return nil
+	}
+	return c.Stats()
+}
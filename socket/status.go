@@ -0,0 +1,61 @@
+package socket
+
+import "sort"
+
+// Состояния туннеля в TunnelStatus
+const (
+	TunnelUp   = "up"
+	TunnelDown = "down"
+)
+
+// TunnelStatus — текущее состояние туннеля. BytesIn и BytesOut учитывают
+// завершённые соединения.
+type TunnelStatus struct {
+	LocalAddr         string `json:"localAddr"`
+	Handshake         string `json:"handshake"` // при шифровании handshake — его хеш
+	State             string `json:"state"`     // TunnelUp или TunnelDown
+	ActiveConnections int64  `json:"activeConnections"`
+	BytesIn           int64  `json:"bytesIn"`
+	BytesOut          int64  `json:"bytesOut"`
+}
+
+// Status возвращает состояние туннелей из конфигурации и добавленных
+// AddTunnel, отсортированное по адресу
+func (c *Client) Status() []TunnelStatus {
+	tunnels := map[string]Tunnel{}
+	for _, t := range c.cfg.Tunnels {
+		tunnels[t.LocalAddr] = t
+	}
+	running := map[string]bool{}
+	for _, at := range c.tunnels.list() {
+		tunnels[at.tunnel.LocalAddr] = at.tunnel
+		running[at.tunnel.LocalAddr] = true
+	}
+
+	result := make([]TunnelStatus, 0, len(tunnels))
+	for addr, t := range tunnels {
+		// Слушатель работает, если привязан; dial-туннель — пока он запущен
+		up := running[addr]
+		if t.mode() != modeDial {
+			up = c.health.bound(addr)
+		}
+		state := TunnelDown
+		if up {
+			state = TunnelUp
+		}
+
+		status := TunnelStatus{
+			LocalAddr: addr,
+			Handshake: displayHandshake(t.Handshake, c.encrypted()),
+			State:     state,
+		}
+		if tc := c.stats.lookup(addr); tc != nil {
+			status.ActiveConnections = tc.active.Load()
+			status.BytesIn = tc.bytesIn.Load()
+			status.BytesOut = tc.bytesOut.Load()
+		}
+		result = append(result, status)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].LocalAddr < result[j].LocalAddr })
+	return result
+}
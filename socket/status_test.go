@@ -0,0 +1,51 @@
+package socket
+
+import (
+	"context"
+	"testing"
+)
+
+func TestStatus(t *testing.T) {
+	up, down := freeAddr(t), busyAddr(t)
+	c := newTestClient(t, Config{Tunnels: []Tunnel{
+		{LocalAddr: up, Handshake: testHandshake},
+		{LocalAddr: down, Handshake: testUsbmuxHandshake},
+	}})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go c.Run(ctx)
+
+	first := dialRetry(t, up)
+	roundTrip(t, first, "ping")
+	second := dialRetry(t, up)
+	roundTrip(t, second, "ping")
+	waitActive(t, c, up, 2)
+
+	status := statusOf(t, c, up)
+	if status.State != TunnelUp || status.ActiveConnections != 2 {
+		t.Errorf("%s: %+v, ожидалось два активных соединения на работающем туннеле", up, status)
+	}
+	if status := statusOf(t, c, down); status.State != TunnelDown || status.ActiveConnections != 0 {
+		t.Errorf("%s: %+v, ожидался неработающий туннель без соединений", down, status)
+	}
+
+	// Байты учитываются после завершения соединения
+	first.Close()
+	waitActive(t, c, up, 1)
+	status = statusOf(t, c, up)
+	if status.ActiveConnections != 1 || status.BytesIn != 4 || status.BytesOut != 4 {
+		t.Errorf("%s: %+v, ожидалось одно активное соединение и по 4 байта в каждую сторону", up, status)
+	}
+}
+
+// statusOf возвращает состояние туннеля addr из Status
+func statusOf(t *testing.T, c *Client, addr string) TunnelStatus {
+	t.Helper()
+	for _, s := range c.Status() {
+		if s.LocalAddr == addr {
+			return s
+		}
+	}
+	t.Fatalf("туннеля %s нет в Status", addr)
+	return TunnelStatus{}
+}
@@ -0,0 +1,78 @@
+package socket
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// errTunnelStopped — туннель завершился, не сообщив о готовности
+var errTunnelStopped = errors.New("туннель завершился до готовности")
+
+// tunnelSummary — итог запуска одного туннеля для стартовой сводки
+type tunnelSummary struct {
+	local     string
+	mode      string
+	handshake string
+	upstreams []upstream
+	err       error
+}
+
+func newTunnelSummary(t Tunnel, encrypted bool, upstreams []upstream) tunnelSummary {
+	return tunnelSummary{
+		local:     t.LocalAddr,
+		mode:      t.mode(),
+		handshake: displayHandshake(t.Handshake, encrypted),
+		upstreams: upstreams,
+	}
+}
+
+// status возвращает состояние запуска в виде строки
+func (s tunnelSummary) status() string {
+	if s.err != nil {
+		return "failed: " + s.err.Error()
+	}
+	return "ok"
+}
+
+// displayHandshake возвращает handshake для логов. Если включено
+// шифрование handshake (encrypted), значение считается секретным
+// и заменяется хешем.
+func displayHandshake(handshake string, encrypted bool) string {
+	if !encrypted {
+		return handshake
+	}
+	sum := sha256.Sum256([]byte(handshake))
+	return "sha256:" + hex.EncodeToString(sum[:4])
+}
+
+// logStartupSummary выводит сводку по всем туннелям одной строкой (Info)
+// и по строке на туннель (Debug). Вызывается последним шагом запуска, когда
+// каждый туннель сообщил о готовности или ошибке.
+func logStartupSummary(summaries []tunnelSummary) {
+	lines := make([]string, 0, len(summaries))
+	failed := 0
+	for _, s := range summaries {
+		if s.err != nil {
+			failed++
+		}
+		lines = append(lines, fmt.Sprintf("%s %s (%s) -> %v: %s", s.mode, s.local, s.handshake, s.upstreams, s.status()))
+
+		log.WithFields(log.Fields{
+			"local":     s.local,
+			"mode":      s.mode,
+			"handshake": s.handshake,
+			"upstream":  s.upstreams,
+			"status":    s.status(),
+		}).Debug("Туннель")
+	}
+
+	log.WithFields(log.Fields{
+		"tunnels": lines,
+		"total":   len(summaries),
+		"failed":  failed,
+	}).Info("Клиент готов")
+}
@@ -0,0 +1,199 @@
+package socket
+
+import (
+	"fmt"
+	"maps"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// sdListenFDsStart — первый дескриптор, передаваемый systemd (SD_LISTEN_FDS_START)
+const sdListenFDsStart = 3
+
+// Слушатели от systemd разбираются один раз за процесс: дескрипторы
+// передаются процессу один раз, а LISTEN_* после разбора удаляются
+var (
+	systemdOnce sync.Once
+	systemdLns  map[string]net.Listener
+	systemdErr  error
+)
+
+// systemdListeners возвращает слушателей, переданных systemd при активации
+// через сокет (LISTEN_PID, LISTEN_FDS, LISTEN_FDNAMES), по локальному адресу
+// туннеля. Каждый слушатель доступен по своему адресу (путь Unix-сокета или
+// "host:port") и, если в unit-файле задан FileDescriptorName, по этому имени.
+// Переменные разбираются при первом вызове и удаляются, чтобы их не
+// унаследовали дочерние процессы; дальше возвращается тот же результат.
+// Без активации возвращается nil.
+func systemdListeners() (map[string]net.Listener, error) {
+	systemdOnce.Do(func() {
+		systemdLns, systemdErr = parseSystemdListeners()
+	})
+	return maps.Clone(systemdLns), systemdErr
+}
+
+// parseSystemdListeners создаёт слушателей из дескрипторов от systemd.
+// Если один из дескрипторов не подошёл, уже созданные слушатели закрываются.
+func parseSystemdListeners() (map[string]net.Listener, error) {
+	pid, fds := os.Getenv("LISTEN_PID"), os.Getenv("LISTEN_FDS")
+	names := os.Getenv("LISTEN_FDNAMES")
+	if pid == "" || fds == "" {
+		return nil, nil
+	}
+	if pid != strconv.Itoa(os.Getpid()) {
+		// Переменные предназначены другому процессу
+		return nil, nil
+	}
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	n, err := strconv.Atoi(fds)
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("LISTEN_FDS должно быть неотрицательным числом, получено %q", fds)
+	}
+	var fdNames []string
+	if names != "" {
+		fdNames = strings.Split(names, ":")
+	}
+
+	listeners := map[string]net.Listener{}
+	for i := range n {
+		fd := sdListenFDsStart + i
+		name := ""
+		if i < len(fdNames) {
+			name = fdNames[i]
+		}
+		f := os.NewFile(uintptr(fd), name)
+		listener, err := net.FileListener(f)
+		f.Close() // FileListener дублирует дескриптор
+		if err != nil {
+			for _, l := range listeners {
+				l.Close() // для слушателя с именем повторный Close безвреден
+			}
+			return nil, fmt.Errorf("дескриптор %d от systemd (%q) не является слушающим сокетом: %w", fd, name, err)
+		}
+		listeners[listener.Addr().String()] = listener
+		if name != "" && name != "unknown" {
+			listeners[name] = listener
+		}
+		log.WithFields(log.Fields{
+			"fd":      fd,
+			"name":    name,
+			"address": listener.Addr(),
+		}).Info("Получен слушатель от systemd")
+	}
+	return listeners, nil
+}
+
+// withSystemdListeners подставляет в cfg слушателей от systemd, если
+// Config.Listeners не задан явно
+func withSystemdListeners(cfg *Config) error {
+	if cfg.Listeners != nil {
+		return nil
+	}
+	listeners, err := systemdListeners()
+	cfg.Listeners = listeners
+	return err
+}
+
+// inheritedAddr сообщает, что слушатель для addr передан в Config.Listeners.
+// Такой слушатель нельзя пересоздать: адрес может быть доступен только
+// тому, кто его передал (например, привилегированный порт у systemd).
+func (c *Client) inheritedAddr(addr string) bool {
+	key := listenerKey(addr)
+	for k, listener := range c.cfg.Listeners {
+		if listener != nil && listenerKey(k) == key {
+			return true
+		}
+	}
+	return false
+}
+
+// listenerKey приводит адрес к виду, по которому туннель находит переданного
+// слушателя. Для TCP-адресов пустой хост, 0.0.0.0 и :: равнозначны: туннель
+// ":27015" должен найти слушателя systemd "[::]:27015" или "0.0.0.0:27015".
+// IP-литералы записываются канонически; пути и имена не меняются.
+func listenerKey(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || !isPort(port) {
+		return addr
+	}
+	if host == "" {
+		return ":" + port
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return addr
+	}
+	if ip.IsUnspecified() {
+		return ":" + port
+	}
+	return net.JoinHostPort(ip.String(), port)
+}
+
+// inheritedListeners — готовые слушатели (Config.Listeners), которые туннели
+// забирают вместо того, чтобы создавать свои. Ключи приведены listenerKey.
+type inheritedListeners struct {
+	mu sync.Mutex
+	m  map[string]net.Listener
+}
+
+// set запоминает слушателей listeners по приведённым адресам
+func (l *inheritedListeners) set(listeners map[string]net.Listener) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.m = make(map[string]net.Listener, len(listeners))
+	for addr, listener := range listeners {
+		if listener != nil {
+			l.m[listenerKey(addr)] = listener
+		}
+	}
+}
+
+// has сообщает, есть ли слушатель для адреса addr
+func (l *inheritedListeners) has(addr string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.m[listenerKey(addr)] != nil
+}
+
+// take возвращает слушателя для адреса addr и забывает его под всеми ключами
+func (l *inheritedListeners) take(addr string) net.Listener {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	listener := l.m[listenerKey(addr)]
+	if listener == nil {
+		return nil
+	}
+	for key, other := range l.m {
+		if other == listener {
+			delete(l.m, key)
+		}
+	}
+	return listener
+}
+
+// warnUnclaimed предупреждает о переданных слушателях, которые не забрал ни
+// один туннель: скорее всего, адрес в unit-файле не совпадает с адресом
+// туннеля. Слушатели не закрываются — их ещё может забрать AddTunnel.
+func (l *inheritedListeners) warnUnclaimed() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	keys := map[net.Listener][]string{}
+	for key, listener := range l.m {
+		keys[listener] = append(keys[listener], key)
+	}
+	for listener, names := range keys {
+		slices.Sort(names)
+		log.WithFields(log.Fields{
+			"address": listener.Addr(),
+			"keys":    names,
+		}).Warn("Переданный слушатель не занят ни одним туннелем")
+	}
+}
@@ -0,0 +1,103 @@
+package socket
+
+import (
+	"net"
+	"slices"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func TestListenerKey(t *testing.T) {
+	tests := []struct {
+		addr, want string
+	}{
+		{":27015", ":27015"},
+		{"0.0.0.0:27015", ":27015"},
+		{"[::]:27015", ":27015"},
+		{"127.0.0.1:7777", "127.0.0.1:7777"},
+		{"[0:0:0:0:0:0:0:1]:7777", "[::1]:7777"},
+		{"localhost:7777", "localhost:7777"},
+		{"/var/run/usbmuxd", "/var/run/usbmuxd"},
+		{"@usbmuxd", "@usbmuxd"},
+		{"usbmuxd.socket", "usbmuxd.socket"},
+	}
+	for _, tt := range tests {
+		if got := listenerKey(tt.addr); got != tt.want {
+			t.Errorf("listenerKey(%q) = %q, ожидалось %q", tt.addr, got, tt.want)
+		}
+	}
+}
+
+func TestInheritedListenersWildcard(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	// systemd сообщает адрес слушателя на всех интерфейсах как "[::]:порт"
+	var l inheritedListeners
+	l.set(map[string]net.Listener{"[::]:27015": listener, "usbmuxd": listener})
+
+	if !l.has("0.0.0.0:27015") {
+		t.Error("слушатель [::]:27015 не найден по адресу 0.0.0.0:27015")
+	}
+	if got := l.take(":27015"); got != listener {
+		t.Fatalf("take(\":27015\") = %v, ожидался переданный слушатель", got)
+	}
+	if l.has("usbmuxd") {
+		t.Error("забранный слушатель остался доступен по имени")
+	}
+}
+
+func TestInheritedAddrWildcard(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	c := &Client{cfg: Config{Listeners: map[string]net.Listener{"0.0.0.0:27015": listener}}}
+	if !c.inheritedAddr(":27015") {
+		t.Error("адрес :27015 не распознан как переданный")
+	}
+	if c.inheritedAddr("127.0.0.1:27015") {
+		t.Error("адрес 127.0.0.1:27015 ошибочно распознан как переданный")
+	}
+}
+
+func TestInheritedListenersWarnUnclaimed(t *testing.T) {
+	hook := captureLogs(t)
+	claimed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer claimed.Close()
+	unclaimed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unclaimed.Close()
+
+	var l inheritedListeners
+	l.set(map[string]net.Listener{"[::]:27015": claimed, "[::]:27016": unclaimed, "usbmuxd-wda": unclaimed})
+	l.take("0.0.0.0:27015")
+	l.warnUnclaimed()
+
+	var warnings []*log.Entry
+	for _, e := range hook.AllEntries() {
+		if e.Message == "Переданный слушатель не занят ни одним туннелем" {
+			warnings = append(warnings, e)
+		}
+	}
+	if len(warnings) != 1 {
+		t.Fatalf("предупреждений %d, ожидалось одно — о незанятом слушателе", len(warnings))
+	}
+	if got := warnings[0].Data["address"]; got != unclaimed.Addr() {
+		t.Errorf("предупреждение о %v, ожидалось о %v", got, unclaimed.Addr())
+	}
+	if keys, _ := warnings[0].Data["keys"].([]string); !slices.Equal(keys, []string{":27016", "usbmuxd-wda"}) {
+		t.Errorf("в предупреждении ключи %q", keys)
+	}
+}
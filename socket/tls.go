@@ -0,0 +1,103 @@
+package socket
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// loadTLSConfig собирает tls.Config из USBMUXD_TLS_* или возвращает nil,
+// если TLS выключен. USBMUXD_TLS_CA — PEM-файлы корневых сертификатов
+// через запятую; если не задан, используются системные.
+func loadTLSConfig() (*tls.Config, error) {
+	if os.Getenv("USBMUXD_TLS") != "1" {
+		return nil, nil
+	}
+
+	cfg := &tls.Config{
+		ServerName:         os.Getenv("USBMUXD_TLS_SERVER_NAME"),
+		InsecureSkipVerify: os.Getenv("USBMUXD_TLS_INSECURE") == "1",
+		MinVersion:         tls.VersionTLS12,
+	}
+	if raw := os.Getenv("USBMUXD_TLS_CA"); raw != "" {
+		pool, err := loadCAPool(strings.Split(raw, ","))
+		if err != nil {
+			return nil, fmt.Errorf("USBMUXD_TLS_CA: %w", err)
+		}
+		cfg.RootCAs = pool
+	}
+	if cfg.InsecureSkipVerify {
+		log.Warn("Проверка сертификата сервера отключена (USBMUXD_TLS_INSECURE): соединение не защищено от подмены сервера")
+	}
+
+	// Клиентский сертификат для серверов, требующих mTLS: файлы
+	// перечитываются при изменении, PEM из окружения загружается один раз
+	certPath, keyPath := os.Getenv("USBMUXD_TLS_CERT"), os.Getenv("USBMUXD_TLS_KEY")
+	certPEM, keyPEM := os.Getenv("USBMUXD_TLS_CERT_PEM"), os.Getenv("USBMUXD_TLS_KEY_PEM")
+	switch {
+	case (certPath != "" || keyPath != "") && (certPEM != "" || keyPEM != ""):
+		return nil, errors.New("клиентский сертификат задаётся либо файлами USBMUXD_TLS_CERT и USBMUXD_TLS_KEY, либо USBMUXD_TLS_CERT_PEM и USBMUXD_TLS_KEY_PEM")
+	case certPEM != "" || keyPEM != "":
+		if certPEM == "" || keyPEM == "" {
+			return nil, errors.New("USBMUXD_TLS_CERT_PEM и USBMUXD_TLS_KEY_PEM задаются только вместе")
+		}
+		cert, err := tls.X509KeyPair([]byte(certPEM), []byte(keyPEM))
+		if err != nil {
+			return nil, fmt.Errorf("загрузка клиентского сертификата из USBMUXD_TLS_CERT_PEM: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	case certPath == "" && keyPath == "":
+	case certPath == "" || keyPath == "":
+		return nil, errors.New("USBMUXD_TLS_CERT и USBMUXD_TLS_KEY задаются только вместе")
+	default:
+		reloader, err := newCertReloader(certPath, keyPath)
+		if err != nil {
+			return nil, err
+		}
+		cfg.GetClientCertificate = reloader.clientCertificate
+	}
+	return cfg, nil
+}
+
+// loadCAPool собирает пул корневых сертификатов из PEM-файлов paths;
+// каждый файл должен содержать хотя бы один сертификат
+func loadCAPool(paths []string) (*x509.CertPool, error) {
+	pool := x509.NewCertPool()
+	for _, path := range paths {
+		path = strings.TrimSpace(path)
+		if path == "" {
+			continue
+		}
+		pem, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("чтение %s: %w", path, err)
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%s не содержит PEM-сертификатов", path)
+		}
+	}
+	return pool, nil
+}
+
+// wrapTLS выполняет TLS-рукопожатие поверх установленного соединения.
+// Если имя сервера не задано явно, используется host.
+func wrapTLS(ctx context.Context, conn net.Conn, cfg *tls.Config, host string) (net.Conn, error) {
+	if cfg.ServerName == "" {
+		cfg = cfg.Clone()
+		cfg.ServerName = host
+	}
+
+	tlsConn := tls.Client(conn, cfg)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("TLS-рукопожатие с %s: %w", host, err)
+	}
+	return tlsConn, nil
+}
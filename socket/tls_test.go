@@ -0,0 +1,211 @@
+package socket
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCA — удостоверяющий центр для сертификатов тестов
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "usbmuxd-client test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue выпускает сертификат для 127.0.0.1 с назначением usage
+// и возвращает его и ключ в PEM
+func (ca *testCA) issue(t *testing.T, serial int64, usage x509.ExtKeyUsage) (certPEM, keyPEM []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+// writeFile записывает data во временный файл name и возвращает путь
+func writeFile(t *testing.T, dir, name string, data []byte) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// mtlsServer запускает TLS-сервер, который требует клиентский сертификат,
+// подписанный ca, подтверждает handshake строкой "OK" и возвращает данные обратно
+func mtlsServer(t *testing.T, ca *testCA) string {
+	t.Helper()
+	certPEM, keyPEM := ca.issue(t, 2, x509.ExtKeyUsageServerAuth)
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				if _, err := r.ReadString('\n'); err != nil {
+					return
+				}
+				conn.Write([]byte("OK\n"))
+				io.Copy(conn, r)
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+// tlsEnv задаёт окружение TLS с корневым сертификатом ca
+func tlsEnv(t *testing.T, dir string, ca *testCA) {
+	t.Helper()
+	t.Setenv("USBMUXD_TLS", "1")
+	t.Setenv("USBMUXD_TLS_CA", writeFile(t, dir, "ca.pem", ca.pem))
+	t.Setenv("USBMUXD_TLS_CERT", "")
+	t.Setenv("USBMUXD_TLS_KEY", "")
+}
+
+func TestMutualTLS(t *testing.T) {
+	ca := newTestCA(t)
+	addr := mtlsServer(t, ca)
+	dir := t.TempDir()
+	certPEM, keyPEM := ca.issue(t, 3, x509.ExtKeyUsageClientAuth)
+
+	tlsEnv(t, dir, ca)
+	t.Setenv("USBMUXD_TLS_CERT", writeFile(t, dir, "client.pem", certPEM))
+	t.Setenv("USBMUXD_TLS_KEY", writeFile(t, dir, "client-key.pem", keyPEM))
+	tlsCfg, err := loadTLSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := newTestClient(t, Config{Servers: []string{addr}, Dialer: &net.Dialer{}, TLS: tlsCfg, HandshakeAck: "OK", DialRounds: 1})
+	_, logger := c.newConnLogger()
+	conn, err := c.connectToServer(context.Background(), logger, nil, Tunnel{Handshake: testHandshake})
+	if err != nil {
+		t.Fatalf("подключение с клиентским сертификатом: %v", err)
+	}
+	defer conn.Close()
+	roundTrip(t, conn, "ping")
+}
+
+func TestMutualTLSWithoutCertificate(t *testing.T) {
+	ca := newTestCA(t)
+	addr := mtlsServer(t, ca)
+
+	tlsEnv(t, t.TempDir(), ca)
+	tlsCfg, err := loadTLSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := newTestClient(t, Config{Servers: []string{addr}, Dialer: &net.Dialer{}, TLS: tlsCfg, HandshakeAck: "OK", DialRounds: 1})
+	_, logger := c.newConnLogger()
+	conn, err := c.connectToServer(context.Background(), logger, nil, Tunnel{Handshake: testHandshake})
+	if err == nil {
+		conn.Close()
+		t.Fatal("сервер принял подключение без клиентского сертификата")
+	}
+}
+
+func TestTLSCertificatePairRequired(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t)
+	certPEM, keyPEM := ca.issue(t, 3, x509.ExtKeyUsageClientAuth)
+	certPath := writeFile(t, dir, "client.pem", certPEM)
+	keyPath := writeFile(t, dir, "client-key.pem", keyPEM)
+	garbage := writeFile(t, dir, "garbage.pem", []byte("не PEM"))
+
+	tests := []struct {
+		name, cert, key string
+	}{
+		{"только сертификат", certPath, ""},
+		{"только ключ", "", keyPath},
+		{"сертификат не разбирается", garbage, keyPath},
+		{"ключ не разбирается", certPath, garbage},
+	}
+	for _, tt := range tests {
+		tlsEnv(t, dir, ca)
+		t.Setenv("USBMUXD_TLS_CERT", tt.cert)
+		t.Setenv("USBMUXD_TLS_KEY", tt.key)
+		if _, err := loadTLSConfig(); err == nil {
+			t.Errorf("%s: конфигурация принята", tt.name)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package socket
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// activeTunnel — запущенный туннель в реестре клиента
+type activeTunnel struct {
+	tunnel Tunnel
+	cancel context.CancelFunc
+	done   chan struct{} // закрывается после завершения runTunnel
+}
+
+// tunnelRegistry — запущенные туннели по локальному адресу
+type tunnelRegistry struct {
+	mu sync.Mutex
+	m  map[string]*activeTunnel
+}
+
+// add регистрирует туннель; false — адрес уже занят другим туннелем
+func (r *tunnelRegistry) add(addr string, at *activeTunnel) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, exists := r.m[addr]; exists {
+		return false
+	}
+	if r.m == nil {
+		r.m = map[string]*activeTunnel{}
+	}
+	r.m[addr] = at
+	return true
+}
+
+// remove удаляет туннель, если он всё ещё зарегистрирован под addr
+func (r *tunnelRegistry) remove(addr string, at *activeTunnel) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.m[addr] == at {
+		delete(r.m, addr)
+	}
+}
+
+// list возвращает все зарегистрированные туннели
+func (r *tunnelRegistry) list() []*activeTunnel {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	list := make([]*activeTunnel, 0, len(r.m))
+	for _, at := range r.m {
+		list = append(list, at)
+	}
+	return list
+}
+
+func (r *tunnelRegistry) get(addr string) *activeTunnel {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.m[addr]
+}
+
+// startTunnel регистрирует туннель и запускает его в отдельной горутине
+// до отмены ctx или RemoveTunnel. ready вызывается, когда локальная сторона
+// готова или не удалась; finished — с результатом runTunnel.
+func (c *Client) startTunnel(ctx context.Context, t Tunnel, ready func(error), finished func(error)) error {
+	ctx, cancel := context.WithCancel(ctx)
+	at := &activeTunnel{tunnel: t, cancel: cancel, done: make(chan struct{})}
+	if !c.tunnels.add(t.LocalAddr, at) {
+		cancel()
+		return fmt.Errorf("туннель %s уже запущен", t.LocalAddr)
+	}
+
+	go func() {
+		defer close(at.done)
+		defer c.tunnels.remove(t.LocalAddr, at)
+		defer cancel()
+		finished(c.runTunnel(ctx, t, ready))
+	}()
+	return nil
+}
+
+// AddTunnel запускает туннель t на работающем или ещё не запущенном клиенте
+// и ждёт, пока локальная сторона будет готова. Туннель работает до отмены
+// ctx, RemoveTunnel или Stop.
+func (c *Client) AddTunnel(ctx context.Context, t Tunnel) error {
+	if err := validateTunnels([]Tunnel{t}); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	if c.stopCtx.Err() != nil {
+		c.mu.Unlock()
+		return errClientStopped
+	}
+	c.running.Add(1)
+	c.mu.Unlock()
+
+	ctx, cancel := context.WithCancel(ctx)
+	stop := context.AfterFunc(c.stopCtx, cancel)
+
+	readyCh := make(chan error, 1)
+	var once sync.Once
+	ready := func(err error) { once.Do(func() { readyCh <- err }) }
+	finished := func(err error) {
+		if err != nil {
+			ready(err)
+		}
+		ready(errTunnelStopped)
+		stop()
+		cancel()
+		c.running.Done()
+	}
+	if err := c.startTunnel(ctx, t, ready, finished); err != nil {
+		stop()
+		cancel()
+		c.running.Done()
+		return err
+	}
+
+	if err := <-readyCh; err != nil {
+		return err
+	}
+	log.WithField("local", t.LocalAddr).Info("Туннель добавлен")
+	return nil
+}
+
+// RemoveTunnel останавливает туннель с локальным адресом localAddr: слушатель
+// закрывается и новые подключения не принимаются. Уже установленные
+// соединения продолжают работу до закрытия или остановки клиента и
+// занимают слоты MaxConns туннеля, заново добавленного на тот же адрес.
+func (c *Client) RemoveTunnel(localAddr string) error {
+	at := c.tunnels.get(localAddr)
+	if at == nil {
+		return fmt.Errorf("туннель %s не запущен", localAddr)
+	}
+	at.cancel()
+	<-at.done
+	c.health.remove(localAddr)
+	log.WithField("local", localAddr).Info("Туннель удалён")
+	return nil
+}
+
+// Drain переводит клиента в режим завершения: все слушатели закрываются,
+// новые подключения не принимаются, а активные соединения дорабатывают.
+// Если к отмене ctx они не завершились, оставшиеся закрываются
+// принудительно и возвращается ошибка ctx. Run завершается после Drain.
+func (c *Client) Drain(ctx context.Context) error {
+	c.drains.Add(1)
+	defer c.drains.Done()
+
+	log.Info("Перестаём принимать подключения, ждём завершения активных")
+	for _, at := range c.tunnels.list() {
+		at.cancel()
+		if at.tunnel.mode() == modeDial {
+			// Dial-туннель сам является соединением и завершится вместе с ним
+			continue
+		}
+		select {
+		case <-at.done:
+		case <-ctx.Done():
+		}
+	}
+
+	if !c.sessions.drainContext(ctx) {
+		return ctx.Err()
+	}
+	log.Info("Все соединения завершены")
+	return nil
+}
@@ -0,0 +1,82 @@
+package socket
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// addTunnel добавляет TCP-туннель на addr
+func addTunnel(t *testing.T, c *Client, addr string) {
+	t.Helper()
+	if err := c.AddTunnel(context.Background(), Tunnel{LocalAddr: addr, Handshake: testHandshake}); err != nil {
+		t.Fatalf("AddTunnel %s: %v", addr, err)
+	}
+}
+
+func TestAddRemoveTunnel(t *testing.T) {
+	c := newTestClient(t, Config{})
+	addr := freeAddr(t)
+
+	addTunnel(t, c, addr)
+	conn := dialTunnel(t, addr)
+
+	err := c.AddTunnel(context.Background(), Tunnel{LocalAddr: addr, Handshake: testUsbmuxHandshake})
+	if err == nil || !strings.Contains(err.Error(), "уже запущен") {
+		t.Fatalf("повторный туннель на %s: %v", addr, err)
+	}
+
+	if err := c.RemoveTunnel(addr); err != nil {
+		t.Fatal(err)
+	}
+	// Слушатель закрыт, а установленное соединение продолжает работать
+	if extra, err := net.Dial("tcp", addr); err == nil {
+		extra.Close()
+		t.Fatal("удалённый туннель принимает подключения")
+	}
+	roundTrip(t, conn, "pong")
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatalf("адрес удалённого туннеля не освобождён: %v", err)
+	}
+	listener.Close()
+
+	// Туннель можно добавить заново на тот же адрес
+	addTunnel(t, c, addr)
+	dialTunnel(t, addr)
+
+	if err := c.RemoveTunnel(freeAddr(t)); err == nil {
+		t.Error("удалён незапущенный туннель")
+	}
+}
+
+func TestReAddTunnelKeepsLimit(t *testing.T) {
+	c := newTestClient(t, Config{MaxConns: 1, MaxConnsMode: limitReject})
+	addr := freeAddr(t)
+
+	addTunnel(t, c, addr)
+	held := dialTunnel(t, addr)
+	if err := c.RemoveTunnel(addr); err != nil {
+		t.Fatal(err)
+	}
+	addTunnel(t, c, addr)
+
+	// Соединение удалённого туннеля по-прежнему занимает единственный слот
+	extra, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer extra.Close()
+	extra.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := extra.Read(make([]byte, 1)); !errors.Is(err, io.EOF) {
+		t.Fatalf("после повторного добавления принято соединение сверх лимита: %v", err)
+	}
+
+	held.Close()
+	waitActive(t, c, addr, 0)
+	dialTunnel(t, addr)
+}
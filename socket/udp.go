@@ -0,0 +1,356 @@
+package socket
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Параметры UDP-туннеля
+const (
+	udpMappingTTL  = time.Minute // время жизни сопоставления без датаграмм, если IdleTimeout не задан
+	udpMaxDatagram = 65535
+	udpQueueLen    = 128  // датаграмм клиента, ждущих отправки на сервер
+	udpMaxMappings = 1024 // одновременных сопоставлений туннеля
+)
+
+// udpRelay пересылает датаграммы UDP-туннеля. Каждому адресу клиента
+// соответствует своё соединение с сервером; датаграммы передаются в нём
+// кадрами "длина (2 байта, big endian) || данные". Подключение к серверу и
+// отправка ведутся в горутине сопоставления, так что медленный сервер не
+// задерживает чтение порта: пока очередь сопоставления полна, датаграммы
+// его клиента отбрасываются. Сопоставление закрывается, если за ttl не было
+// датаграмм ни в одну сторону.
+//
+// Датаграммы клиентов не из AllowCIDRs отбрасываются. Каждое сопоставление
+// занимает слот лимита соединений туннеля; если слотов нет или сопоставлений
+// уже maxMappings, датаграммы нового клиента отбрасываются.
+type udpRelay struct {
+	client      *Client
+	tunnel      Tunnel
+	pc          net.PacketConn
+	ttl         time.Duration
+	limiter     *connLimiter
+	maxMappings int
+
+	mu       sync.Mutex
+	mappings map[string]*udpMapping
+}
+
+// udpMapping — соединение с сервером для одного адреса клиента
+type udpMapping struct {
+	relay    *udpRelay
+	id       string
+	logger   *log.Entry
+	addr     net.Addr
+	queue    chan []byte        // кадры для сервера
+	done     chan struct{}      // закрывается в close
+	cancel   context.CancelFunc // прерывает подключение к серверу
+	started  time.Time
+	lastSeen atomic.Int64 // UnixNano последней датаграммы
+	bytesIn  atomic.Int64
+	bytesOut atomic.Int64
+	once     sync.Once
+
+	mu   sync.Mutex
+	conn net.Conn // nil, пока соединение с сервером не установлено
+}
+
+// handleUDPListener слушает UDP-адрес и пересылает датаграммы на сервер
+func (c *Client) handleUDPListener(ctx context.Context, t Tunnel, ep endpoint, ready func(error)) error {
+	pc, err := net.ListenPacket(ep.network, ep.addr)
+	if err != nil {
+		return listenError(ep.addr, "UDP-порт", err)
+	}
+	defer pc.Close()
+	log.WithField("address", ep.addr).Info("Создан и слушается UDP-порт")
+	ready(nil)
+
+	state := c.health.stateFor(t.LocalAddr)
+	state.setBound(true)
+	defer state.setBound(false)
+
+	stop := context.AfterFunc(ctx, func() { pc.Close() })
+	defer stop()
+
+	ttl := udpMappingTTL
+	if c.cfg.IdleTimeout > 0 {
+		ttl = c.cfg.IdleTimeout
+	}
+	relay := &udpRelay{
+		client:      c,
+		tunnel:      t,
+		pc:          pc,
+		ttl:         ttl,
+		limiter:     c.tunnelLimiter(t),
+		maxMappings: udpMaxMappings,
+		mappings:    map[string]*udpMapping{},
+	}
+	defer relay.closeAll()
+	go relay.expire(ctx)
+
+	buf := make([]byte, udpMaxDatagram)
+	for {
+		state.waiting()
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				log.WithField("listener", "UDP-порт").Info("Слушатель остановлен")
+				return nil
+			}
+			if temporaryAcceptError(err) {
+				continue
+			}
+			log.WithError(err).WithField("address", ep.addr).Error("Ошибка чтения UDP-порта")
+			return err
+		}
+		state.accepted()
+		relay.forward(ctx, addr, buf[:n])
+	}
+}
+
+// forward ставит датаграмму клиента addr в очередь на сервер, при
+// необходимости создавая для него сопоставление. Если очередь полна или
+// сопоставление создать нельзя, датаграмма отбрасывается.
+func (r *udpRelay) forward(ctx context.Context, addr net.Addr, data []byte) {
+	m := r.mapping(ctx, addr)
+	if m == nil {
+		return
+	}
+	frame := make([]byte, 2+len(data))
+	binary.BigEndian.PutUint16(frame, uint16(len(data)))
+	copy(frame[2:], data)
+	select {
+	case m.queue <- frame:
+	default:
+		m.logger.Debug("Очередь UDP-клиента заполнена, датаграмма отброшена")
+	}
+}
+
+// mapping возвращает сопоставление для addr или создаёт новое и запускает
+// его горутину. Возвращает nil, если клиент не входит в AllowCIDRs или
+// достигнут лимит сопоставлений. Отказы логируются на уровне Debug: адрес
+// отправителя датаграммы легко подделать, и каждая из них не должна
+// оставлять предупреждение.
+func (r *udpRelay) mapping(ctx context.Context, addr net.Addr) *udpMapping {
+	key := addr.String()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if m := r.mappings[key]; m != nil {
+		return m
+	}
+
+	c, t := r.client, r.tunnel
+	fields := log.Fields{"local": t.LocalAddr, "client": key}
+	if !allowedAddr(addr, c.cfg.AllowCIDRs) {
+		log.WithFields(fields).Debug("Клиент не входит в разрешённые подсети, датаграмма отброшена")
+		return nil
+	}
+	if len(r.mappings) >= r.maxMappings {
+		log.WithFields(fields).Debug("Достигнут предел UDP-сопоставлений, датаграмма отброшена")
+		return nil
+	}
+	if !r.limiter.tryAcquire() {
+		log.WithFields(fields).Debug("Достигнут лимит соединений, датаграмма отброшена")
+		return nil
+	}
+
+	id, logger := c.newConnLogger()
+	logger = logger.WithFields(fields)
+	if connLogs.allow() {
+		logger.Info("Новый UDP-клиент")
+	}
+	c.events.emit(Event{Type: ConnectionOpened, Tunnel: t, ConnID: id})
+
+	m := &udpMapping{
+		relay:   r,
+		id:      id,
+		logger:  logger,
+		addr:    addr,
+		queue:   make(chan []byte, udpQueueLen),
+		done:    make(chan struct{}),
+		started: time.Now(),
+	}
+	ctx, m.cancel = context.WithCancel(ctx)
+	m.touch()
+	r.mappings[key] = m
+	go m.run(ctx)
+	return m
+}
+
+// run подключается к серверу и отправляет ему датаграммы из очереди до
+// закрытия сопоставления или ошибки соединения
+func (m *udpMapping) run(ctx context.Context) {
+	defer m.close()
+	c, t := m.relay.client, m.relay.tunnel
+	conn, err := c.openServerConn(ctx, m.logger, nil, t)
+	if err != nil {
+		m.logger.WithError(err).Error("Не удалось подключиться к серверу")
+		c.events.emit(Event{Type: DialFailed, Tunnel: t, ConnID: m.id, Err: err})
+		return
+	}
+	if c.cfg.Compress {
+		conn = newCompressedConn(conn)
+	}
+	if !m.setConn(conn) {
+		conn.Close()
+		return
+	}
+	c.events.emit(Event{Type: HandshakeSent, Tunnel: t, ConnID: m.id})
+	go m.readServer(conn)
+
+	for {
+		select {
+		case <-m.done:
+			return
+		case frame := <-m.queue:
+			if _, err := conn.Write(frame); err != nil {
+				m.logger.WithError(err).Warn("Ошибка отправки датаграммы на сервер")
+				return
+			}
+			m.touch()
+			m.bytesOut.Add(int64(len(frame) - 2))
+		}
+	}
+}
+
+// setConn запоминает соединение с сервером; false — сопоставление уже закрыто
+func (m *udpMapping) setConn(conn net.Conn) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	select {
+	case <-m.done:
+		return false
+	default:
+	}
+	m.conn = conn
+	activeConnections.WithLabelValues(m.relay.tunnel.LocalAddr).Inc()
+	m.relay.client.stats.countersFor(m.relay.tunnel.LocalAddr).active.Add(1)
+	return true
+}
+
+// readServer пересылает датаграммы сервера клиенту до ошибки соединения
+func (m *udpMapping) readServer(conn net.Conn) {
+	defer m.close()
+	header := make([]byte, 2)
+	buf := make([]byte, udpMaxDatagram)
+	for {
+		if _, err := io.ReadFull(conn, header); err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				m.logger.WithError(err).Warn("Ошибка чтения датаграммы от сервера")
+			}
+			return
+		}
+		data := buf[:binary.BigEndian.Uint16(header)]
+		if _, err := io.ReadFull(conn, data); err != nil {
+			m.logger.WithError(err).Warn("Ошибка чтения датаграммы от сервера")
+			return
+		}
+		if _, err := m.relay.pc.WriteTo(data, m.addr); err != nil {
+			m.logger.WithError(err).Warn("Ошибка отправки датаграммы клиенту")
+			return
+		}
+		m.touch()
+		m.bytesIn.Add(int64(len(data)))
+	}
+}
+
+func (m *udpMapping) touch() {
+	m.lastSeen.Store(time.Now().UnixNano())
+}
+
+func (m *udpMapping) idle() time.Duration {
+	return time.Since(time.Unix(0, m.lastSeen.Load()))
+}
+
+// close закрывает соединение с сервером и удаляет сопоставление
+func (m *udpMapping) close() {
+	m.once.Do(func() {
+		r, c := m.relay, m.relay.client
+		r.mu.Lock()
+		if r.mappings[m.addr.String()] == m {
+			delete(r.mappings, m.addr.String())
+		}
+		r.mu.Unlock()
+		m.cancel()
+
+		m.mu.Lock()
+		close(m.done)
+		conn := m.conn
+		m.mu.Unlock()
+		r.limiter.release()
+		if conn == nil {
+			// Соединение с сервером так и не установлено
+			return
+		}
+		conn.Close()
+
+		local := r.tunnel.LocalAddr
+		bytesIn, bytesOut := m.bytesIn.Load(), m.bytesOut.Load()
+		duration := time.Since(m.started)
+		activeConnections.WithLabelValues(local).Dec()
+		c.stats.countersFor(local).active.Add(-1)
+		c.stats.record(local, bytesIn, bytesOut)
+		connectionsTotal.WithLabelValues(local).Inc()
+		bytesTotal.WithLabelValues(local, "in").Add(float64(bytesIn))
+		bytesTotal.WithLabelValues(local, "out").Add(float64(bytesOut))
+		connectionDuration.WithLabelValues(local).Observe(duration.Seconds())
+		if connLogs.allow() {
+			m.logger.WithFields(log.Fields{
+				"bytes_in":  bytesIn,
+				"bytes_out": bytesOut,
+			}).Info("UDP-клиент отключён")
+		}
+		c.events.emit(Event{
+			Type:     ConnectionClosed,
+			Tunnel:   r.tunnel,
+			ConnID:   m.id,
+			BytesIn:  bytesIn,
+			BytesOut: bytesOut,
+			Duration: duration,
+		})
+	})
+}
+
+// expire закрывает сопоставления, простоявшие дольше ttl, до отмены ctx
+func (r *udpRelay) expire(ctx context.Context) {
+	ticker := time.NewTicker(max(r.ttl/2, time.Second))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		for _, m := range r.list() {
+			if m.idle() > r.ttl {
+				m.logger.WithField("idle", r.ttl).Debug("Закрываем неактивное UDP-сопоставление")
+				m.close()
+			}
+		}
+	}
+}
+
+func (r *udpRelay) list() []*udpMapping {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	list := make([]*udpMapping, 0, len(r.mappings))
+	for _, m := range r.mappings {
+		list = append(list, m)
+	}
+	return list
+}
+
+// closeAll закрывает все сопоставления при остановке туннеля
+func (r *udpRelay) closeAll() {
+	for _, m := range r.list() {
+		m.close()
+	}
+}
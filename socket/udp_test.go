@@ -0,0 +1,195 @@
+package socket
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+	"usbmuxd-client/fakeserver"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// serveUDP запускает UDP-туннель на свободном порту 127.0.0.1
+// и возвращает его адрес
+func serveUDP(t *testing.T, c *Client) string {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := pc.LocalAddr().String()
+	pc.Close()
+
+	tun := Tunnel{LocalAddr: addr, Network: networkUDP, Handshake: testHandshake}
+	ctx, cancel := context.WithCancel(context.Background())
+	ready := make(chan error, 1)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if err := c.handleUDPListener(ctx, tun, endpoint{network: "udp", addr: addr}, func(err error) { ready <- err }); err != nil {
+			ready <- err
+		}
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	if err := <-ready; err != nil {
+		t.Fatal(err)
+	}
+	return addr
+}
+
+func TestUDPEcho(t *testing.T) {
+	c := newTestClient(t, Config{})
+	addr := serveUDP(t, c)
+
+	// Два клиента с разных портов: каждый получает ответ только на свои датаграммы
+	var clients []net.Conn
+	for range 2 {
+		conn, err := net.Dial("udp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		clients = append(clients, conn)
+	}
+	for round := range 3 {
+		for i, conn := range clients {
+			msg := []byte{byte('a' + i), byte('0' + round)}
+			if _, err := conn.Write(msg); err != nil {
+				t.Fatal(err)
+			}
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			buf := make([]byte, udpMaxDatagram)
+			n, err := conn.Read(buf)
+			if err != nil {
+				t.Fatalf("клиент %d: %v", i, err)
+			}
+			if string(buf[:n]) != string(msg) {
+				t.Errorf("клиент %d получил %q, ожидалось %q", i, buf[:n], msg)
+			}
+		}
+	}
+	if got := c.stats.lookup(addr).active.Load(); got != 2 {
+		t.Errorf("активных сопоставлений %d, ожидалось 2", got)
+	}
+}
+
+// udpClient открывает UDP-сокет клиента, подключённый к addr
+func udpClient(t *testing.T, addr string) net.Conn {
+	t.Helper()
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// udpExchange отправляет msg и возвращает ответ; false — ответа нет за wait
+func udpExchange(t *testing.T, conn net.Conn, msg string, wait time.Duration) (string, bool) {
+	t.Helper()
+	if _, err := conn.Write([]byte(msg)); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(wait))
+	buf := make([]byte, udpMaxDatagram)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return "", false
+	}
+	return string(buf[:n]), true
+}
+
+func TestUDPAllowCIDRs(t *testing.T) {
+	srv := fakeserver.New("")
+	defer srv.Close()
+	c := newTestClient(t, Config{Dialer: srv, AllowCIDRs: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}})
+	addr := serveUDP(t, c)
+
+	if got, ok := udpExchange(t, udpClient(t, addr), "ping", 300*time.Millisecond); ok {
+		t.Fatalf("клиент не из разрешённых подсетей получил ответ %q", got)
+	}
+	if got := srv.Handshakes(); len(got) != 0 {
+		t.Errorf("для запрещённого клиента открыто соединение с сервером: %q", got)
+	}
+}
+
+func TestUDPMaxConns(t *testing.T) {
+	srv := fakeserver.New("")
+	defer srv.Close()
+	c := newTestClient(t, Config{Dialer: srv, MaxConns: 1})
+	addr := serveUDP(t, c)
+
+	first := udpClient(t, addr)
+	if got, ok := udpExchange(t, first, "ping", 5*time.Second); !ok || got != "ping" {
+		t.Fatalf("первый клиент получил %q", got)
+	}
+	// Второй клиент сверх лимита: датаграмма отброшена, сервер не вызывается
+	if got, ok := udpExchange(t, udpClient(t, addr), "pong", 300*time.Millisecond); ok {
+		t.Fatalf("клиент сверх лимита получил ответ %q", got)
+	}
+	if got := len(srv.Handshakes()); got != 1 {
+		t.Errorf("открыто %d соединений с сервером, ожидалось 1", got)
+	}
+	if got := counterValue(t, connLimitRejected.WithLabelValues(addr)); got != 1 {
+		t.Errorf("usbmuxd_conn_limit_rejected_total = %v, ожидалось 1", got)
+	}
+	if got := gaugeValue(t, activeConnections.WithLabelValues(addr)); got != 1 {
+		t.Errorf("usbmuxd_active_connections = %v, ожидалось 1", got)
+	}
+}
+
+func TestUDPMaxMappings(t *testing.T) {
+	c := newTestClient(t, Config{})
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	tun := Tunnel{LocalAddr: pc.LocalAddr().String(), Network: networkUDP, Handshake: testHandshake}
+	relay := &udpRelay{client: c, tunnel: tun, pc: pc, ttl: time.Minute, maxMappings: 2, mappings: map[string]*udpMapping{}}
+
+	// Датаграммы трёх клиентов пересылаются напрямую, минуя чтение порта
+	var clients []net.PacketConn
+	for range 3 {
+		client, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+		clients = append(clients, client)
+		relay.forward(context.Background(), client.LocalAddr(), []byte("ping"))
+	}
+	if got := len(relay.list()); got != 2 {
+		t.Fatalf("создано %d сопоставлений, предел 2", got)
+	}
+	buf := make([]byte, udpMaxDatagram)
+	for i, client := range clients {
+		client.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+		_, _, err := client.ReadFrom(buf)
+		if served := err == nil; served != (i < 2) {
+			t.Errorf("клиент %d: ответ получен = %v", i, served)
+		}
+	}
+
+	// Закрытые сопоставления учитываются в тех же метриках, что и TCP-соединения
+	relay.closeAll()
+	if got := gaugeValue(t, activeConnections.WithLabelValues(tun.LocalAddr)); got != 0 {
+		t.Errorf("usbmuxd_active_connections = %v, ожидалось 0", got)
+	}
+	if got := counterValue(t, connectionsTotal.WithLabelValues(tun.LocalAddr)); got != 2 {
+		t.Errorf("usbmuxd_connections_total = %v, ожидалось 2", got)
+	}
+	var m dto.Metric
+	if err := connectionDuration.WithLabelValues(tun.LocalAddr).(prometheus.Histogram).Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	if got := m.GetHistogram().GetSampleCount(); got != 2 {
+		t.Errorf("в usbmuxd_connection_duration_seconds %d наблюдений, ожидалось 2", got)
+	}
+}
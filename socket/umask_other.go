@@ -0,0 +1,10 @@
+//go:build !unix
+
+package socket
+
+import "os"
+
+// withUmask на платформах без umask просто выполняет fn
+func withUmask(_ os.FileMode, fn func() error) error {
+	return fn()
+}
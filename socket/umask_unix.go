@@ -0,0 +1,23 @@
+//go:build unix
+
+package socket
+
+import (
+	"os"
+	"sync"
+	"syscall"
+)
+
+// umaskMu не даёт двум слушателям одновременно менять umask процесса
+var umaskMu sync.Mutex
+
+// withUmask выполняет fn под umask, при которой новый файл получает права
+// не шире mode, и восстанавливает прежнюю. Umask общая для процесса: файлы,
+// которые другие горутины создают в этот момент, тоже её получают.
+func withUmask(mode os.FileMode, fn func() error) error {
+	umaskMu.Lock()
+	defer umaskMu.Unlock()
+	old := syscall.Umask(int(0777 &^ mode.Perm()))
+	defer syscall.Umask(old)
+	return fn()
+}
@@ -0,0 +1,117 @@
+package socket
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestUnixSocketMode(t *testing.T) {
+	c := newTestClient(t, Config{SocketMode: 0660, SocketDirMode: 0750})
+	dir := filepath.Join(t.TempDir(), "run")
+	socketPath := filepath.Join(dir, "usbmuxd")
+
+	listener, err := c.listenUnix(socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	info, err := os.Stat(socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		t.Errorf("%s не сокет: %s", socketPath, info.Mode())
+	}
+	if got := info.Mode().Perm(); got != 0660 {
+		t.Errorf("права сокета %o, ожидалось 660", got)
+	}
+	info, err = os.Stat(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := info.Mode().Perm(); got != 0750 {
+		t.Errorf("права директории %o, ожидалось 750", got)
+	}
+}
+
+func TestUnixSocketModeDefault(t *testing.T) {
+	c := newTestClient(t, Config{})
+	socketPath := filepath.Join(t.TempDir(), "usbmuxd")
+
+	listener, err := c.listenUnix(socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	info, err := os.Stat(socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := info.Mode().Perm(); got != defaultSocketMode {
+		t.Errorf("права сокета %o, ожидалось %o", got, defaultSocketMode)
+	}
+}
+
+func TestUnixSocketStale(t *testing.T) {
+	c := newTestClient(t, Config{})
+	socketPath := filepath.Join(t.TempDir(), "usbmuxd")
+
+	// Файл сокета остался от процесса, который завершился без уборки
+	old, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old.(*net.UnixListener).SetUnlinkOnClose(false)
+	old.Close()
+
+	listener, err := c.listenUnix(socketPath)
+	if err != nil {
+		t.Fatalf("устаревший сокет не заменён: %v", err)
+	}
+	defer listener.Close()
+	conn, err := net.Dial("unix", socketPath)
+	if err != nil {
+		t.Fatalf("подключение к новому сокету: %v", err)
+	}
+	conn.Close()
+}
+
+func TestUnixSocketLive(t *testing.T) {
+	c := newTestClient(t, Config{})
+	socketPath := filepath.Join(t.TempDir(), "usbmuxd")
+
+	// Сокет обслуживает другой работающий экземпляр
+	live, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer live.Close()
+	go func() {
+		for {
+			conn, err := live.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	if listener, err := c.listenUnix(socketPath); !errors.Is(err, syscall.EADDRINUSE) {
+		if listener != nil {
+			listener.Close()
+		}
+		t.Fatalf("listenUnix вернул %v, ожидался занятый адрес", err)
+	}
+	// Чужой сокет не удалён и по-прежнему принимает подключения
+	conn, err := net.Dial("unix", socketPath)
+	if err != nil {
+		t.Fatalf("сокет работающего экземпляра перехвачен: %v", err)
+	}
+	conn.Close()
+}
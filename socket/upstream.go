@@ -0,0 +1,188 @@
+package socket
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Параметры паузы между раундами подключения к серверам
+const (
+	retryInitialDelay = 200 * time.Millisecond
+	retryMaxDelay     = 5 * time.Second
+)
+
+// upstream — адрес одного сервера. Для серверов, заданных адресом вида
+// "схема://...", заданы также схема (ws, wss или quic) и, для WebSocket,
+// путь запроса; иначе соединение — обычный TCP.
+type upstream struct {
+	scheme string
+	host   string
+	port   string
+	path   string
+}
+
+func (u upstream) String() string {
+	if u.scheme != "" {
+		return u.scheme + "://" + net.JoinHostPort(u.host, u.port) + u.path
+	}
+	return net.JoinHostPort(u.host, u.port)
+}
+
+// upstreamsFor возвращает серверы туннеля t: собственные, если они заданы,
+// иначе общие
+func (c *Client) upstreamsFor(t Tunnel) []upstream {
+	if t.ServerAddr == "" && t.ServerPort == "" {
+		return c.upstreams
+	}
+	hosts := c.cfg.Servers
+	if t.ServerAddr != "" {
+		hosts = strings.Split(t.ServerAddr, ",")
+	}
+	port := c.cfg.ServerPort
+	if t.ServerPort != "" {
+		port = t.ServerPort
+	}
+	return parseUpstreams(hosts, port)
+}
+
+// parseUpstreams разбирает список серверов. Элемент может содержать
+// собственный порт ("host:port", "[::1]:port"); иначе используется defaultPort.
+// Элементы вида "ws://...", "wss://..." и "quic://..." разбираются
+// parseURLUpstream; некорректные из них пропускаются (Validate сообщает
+// о них заранее).
+func parseUpstreams(hosts []string, defaultPort string) []upstream {
+	var result []upstream
+	for _, h := range hosts {
+		h = strings.TrimSpace(h)
+		if h == "" {
+			continue
+		}
+		if strings.Contains(h, "://") {
+			if u, err := parseURLUpstream(h); err == nil {
+				result = append(result, u)
+			}
+			continue
+		}
+		if host, port, err := net.SplitHostPort(h); err == nil {
+			result = append(result, upstream{host: host, port: port})
+			continue
+		}
+		result = append(result, upstream{host: h, port: defaultPort})
+	}
+	return result
+}
+
+// Схемы серверов, заданных адресом вида "схема://..."
+const (
+	schemeWS   = "ws"
+	schemeWSS  = "wss"
+	schemeQUIC = "quic"
+)
+
+// parseURLUpstream разбирает сервер вида "ws://host[:port]/path",
+// "wss://host[:port]/path" или "quic://host:port". Для ws и wss без порта
+// используется 80 или 443; у quic порт обязателен.
+func parseURLUpstream(s string) (upstream, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return upstream{}, err
+	}
+	var defaultPort string
+	switch u.Scheme {
+	case schemeWS:
+		defaultPort = "80"
+	case schemeWSS:
+		defaultPort = "443"
+	case schemeQUIC:
+	default:
+		return upstream{}, fmt.Errorf("неизвестная схема %q: поддерживаются ws, wss и quic", u.Scheme)
+	}
+	if u.Hostname() == "" {
+		return upstream{}, fmt.Errorf("в адресе %q не указан хост", s)
+	}
+	port := u.Port()
+	if port == "" {
+		port = defaultPort
+	}
+	if !validPort(port) {
+		return upstream{}, fmt.Errorf("в адресе %q нужен порт от 1 до 65535", s)
+	}
+	result := upstream{scheme: u.Scheme, host: u.Hostname(), port: port}
+	if u.Scheme != schemeQUIC {
+		result.path = u.RequestURI()
+	}
+	return result, nil
+}
+
+// connectToServer подключается к одному из серверов и отправляет handshake.
+// В каждом раунде серверы перебираются по очереди без пауз; пауза с
+// экспоненциальным ростом (200мс, 400мс, ... не более 5с) и случайным
+// разбросом делается только после того, как весь раунд завершился неудачей.
+// Так при частичном отказе здоровый узел находится сразу, а клиенты,
+// потерявшие сервер одновременно, не переподключаются хором. Раунды
+// повторяются DialRounds раз и, если задан DialHold, дальше, пока он не
+// истечёт: локальное подключение ждёт возвращения сервера. Ждать так могут
+// не больше MaxHeld подключений разом, остальные завершаются ошибкой после
+// DialRounds. Начальный сервер меняется по кругу между вызовами. Ожидание
+// прерывается отменой ctx. Handshake с неизвестным сервисом не отправляется.
+func (c *Client) connectToServer(ctx context.Context, logger *log.Entry, local net.Conn, t Tunnel) (net.Conn, error) {
+	handshake := t.Handshake
+	if err := validateHandshake(handshake); err != nil {
+		return nil, err
+	}
+	upstreams := c.upstreamsFor(t)
+	start := int(c.nextUpstream.Add(1)-1) % len(upstreams)
+	var holdUntil time.Time
+	if c.cfg.DialHold > 0 {
+		holdUntil = time.Now().Add(c.cfg.DialHold)
+	}
+	delay := retryInitialDelay
+	var lastErr error
+	for round := 0; round < c.cfg.DialRounds || time.Now().Before(holdUntil); round++ {
+		if round == c.cfg.DialRounds {
+			// Раунды исчерпаны, подключение переходит к ожиданию сервера
+			if c.held.Add(1) > int64(c.cfg.MaxHeld) {
+				c.held.Add(-1)
+				logger.WithField("max_held", c.cfg.MaxHeld).Warn("Слишком много подключений ждут сервера, подключение закрывается")
+				return nil, lastErr
+			}
+			defer c.held.Add(-1)
+		}
+		if round > 0 {
+			pause := jitter(delay)
+			if !holdUntil.IsZero() && round >= c.cfg.DialRounds {
+				pause = min(pause, time.Until(holdUntil))
+			}
+			logger.WithError(lastErr).WithFields(log.Fields{
+				"round": round + 1,
+				"delay": pause,
+			}).Debug("Все серверы недоступны, повторяем")
+
+			if !sleepContext(ctx, pause) {
+				return nil, ctx.Err()
+			}
+			delay = min(delay*2, retryMaxDelay)
+		}
+		for i := range upstreams {
+			u := upstreams[(start+i)%len(upstreams)]
+			conn, err := c.connectToUpstream(ctx, logger, u, local, handshake)
+			if err == nil {
+				return conn, nil
+			}
+			lastErr = err
+		}
+	}
+	return nil, lastErr
+}
+
+// jitter возвращает случайную паузу от d/2 до d
+func jitter(d time.Duration) time.Duration {
+	return d/2 + rand.N(d/2+1)
+}
@@ -0,0 +1,252 @@
+package socket
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+	"usbmuxd-client/fakeserver"
+)
+
+// refusingServer запускает TCP-сервер, который закрывает первые refuse
+// подключений, не подтвердив handshake, а следующие подтверждает строкой
+// "OK" и возвращает данные обратно. Возвращает адрес и счётчик подключений.
+func refusingServer(t *testing.T, refuse int32) (string, *atomic.Int32) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	attempts := new(atomic.Int32)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			if attempts.Add(1) <= refuse {
+				conn.Close()
+				continue
+			}
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				if _, err := r.ReadString('\n'); err != nil {
+					return
+				}
+				conn.Write([]byte("OK\n"))
+				io.Copy(conn, r)
+			}()
+		}
+	}()
+	return listener.Addr().String(), attempts
+}
+
+func TestConnectToServerRetries(t *testing.T) {
+	addr, attempts := refusingServer(t, 2)
+	c := newTestClient(t, Config{Servers: []string{addr}, Dialer: &net.Dialer{}, HandshakeAck: "OK"})
+
+	_, logger := c.newConnLogger()
+	conn, err := c.connectToServer(context.Background(), logger, nil, Tunnel{Handshake: testHandshake})
+	if err != nil {
+		t.Fatalf("подключение после двух отказов: %v", err)
+	}
+	defer conn.Close()
+	if got := attempts.Load(); got != 3 {
+		t.Errorf("сделано %d попыток, ожидалось 3", got)
+	}
+	roundTrip(t, conn, "ping")
+}
+
+func TestConnectToServerGivesUp(t *testing.T) {
+	addr, attempts := refusingServer(t, 3)
+	c := newTestClient(t, Config{Servers: []string{addr}, Dialer: &net.Dialer{}, HandshakeAck: "OK"})
+
+	_, logger := c.newConnLogger()
+	_, err := c.connectToServer(context.Background(), logger, nil, Tunnel{Handshake: testHandshake})
+	if err == nil {
+		t.Fatal("подключение удалось, хотя сервер отказал во всех раундах")
+	}
+	if got := attempts.Load(); got != defaultDialRounds {
+		t.Errorf("сделано %d попыток, ожидалось %d", got, defaultDialRounds)
+	}
+}
+
+func TestConnectToServerBackoffCancel(t *testing.T) {
+	addr, _ := refusingServer(t, 1<<30)
+	c := newTestClient(t, Config{Servers: []string{addr}, Dialer: &net.Dialer{}, HandshakeAck: "OK", DialRounds: 100})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	_, logger := c.newConnLogger()
+	start := time.Now()
+	_, err := c.connectToServer(ctx, logger, nil, Tunnel{Handshake: testHandshake})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("ошибка %v, ожидалась отмена контекста", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("отмена прервала повторы только через %s", elapsed)
+	}
+}
+
+func TestConnectToServerFailover(t *testing.T) {
+	// Первый сервер не отвечает: порт закрыт
+	dead, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadAddr := dead.Addr().String()
+	dead.Close()
+	live, attempts := refusingServer(t, 0)
+
+	c := newTestClient(t, Config{Servers: []string{deadAddr, live}, Dialer: &net.Dialer{}, HandshakeAck: "OK"})
+	for range 4 {
+		_, logger := c.newConnLogger()
+		conn, err := c.connectToServer(context.Background(), logger, nil, Tunnel{Handshake: testHandshake})
+		if err != nil {
+			t.Fatalf("подключение при одном живом сервере: %v", err)
+		}
+		roundTrip(t, conn, "ping")
+		conn.Close()
+	}
+	if got := attempts.Load(); got != 4 {
+		t.Errorf("живой сервер получил %d подключений, ожидалось 4", got)
+	}
+	// Начальный сервер меняется по кругу: половина вызовов начинает с мёртвого
+	if got := serverDialErrors.WithLabelValues(deadAddr); counterValue(t, got) != 2 {
+		t.Errorf("к мёртвому серверу было %v подключений, ожидалось 2", counterValue(t, got))
+	}
+}
+
+// routingDialer направляет подключение на сервер в памяти по адресу
+type routingDialer map[string]*fakeserver.Server
+
+func (d routingDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	srv, ok := d[addr]
+	if !ok {
+		return nil, fmt.Errorf("нет сервера %s", addr)
+	}
+	return srv.DialContext(ctx, network, addr)
+}
+
+func TestTunnelServerOverride(t *testing.T) {
+	dialer := routingDialer{}
+	for _, addr := range []string{"fake:1", "relay-a:27015", "relay-b:443"} {
+		srv := fakeserver.New("")
+		t.Cleanup(func() { srv.Close() })
+		dialer[addr] = srv
+	}
+	c := newTestClient(t, Config{Dialer: dialer, ServerPort: "27015"})
+
+	tunnels := []Tunnel{
+		{Handshake: testUsbmuxHandshake, ServerAddr: "relay-a"},
+		{Handshake: testHandshake, ServerAddr: "relay-b", ServerPort: "443"},
+		{Handshake: "00008110000A1C2E0C38801E wda"},
+	}
+	for _, tun := range tunnels {
+		_, logger := c.newConnLogger()
+		conn, err := c.connectToServer(context.Background(), logger, nil, tun)
+		if err != nil {
+			t.Fatalf("%s: %v", tun.Handshake, err)
+		}
+		roundTrip(t, conn, "ping")
+		conn.Close()
+	}
+
+	want := map[string]string{
+		"relay-a:27015": tunnels[0].Handshake,
+		"relay-b:443":   tunnels[1].Handshake,
+		"fake:1":        tunnels[2].Handshake,
+	}
+	for addr, handshake := range want {
+		if got := dialer[addr].Handshakes(); len(got) != 1 || got[0] != handshake {
+			t.Errorf("сервер %s получил %q, ожидался %q", addr, got, handshake)
+		}
+	}
+}
+
+func TestDialHold(t *testing.T) {
+	// Сервер отказывает дольше единственного раунда, но возвращается до конца DialHold
+	addr, attempts := refusingServer(t, 3)
+	c := newTestClient(t, Config{Servers: []string{addr}, Dialer: &net.Dialer{}, HandshakeAck: "OK", DialRounds: 1, DialHold: 5 * time.Second})
+
+	_, logger := c.newConnLogger()
+	conn, err := c.connectToServer(context.Background(), logger, nil, Tunnel{Handshake: testHandshake})
+	if err != nil {
+		t.Fatalf("подключение в пределах DialHold: %v", err)
+	}
+	defer conn.Close()
+	roundTrip(t, conn, "ping")
+	if got := attempts.Load(); got != 4 {
+		t.Errorf("сделано %d попыток, ожидалось 4", got)
+	}
+	if got := c.held.Load(); got != 0 {
+		t.Errorf("ждущих подключений %d после успеха", got)
+	}
+}
+
+func TestDialHoldExpires(t *testing.T) {
+	const hold = 300 * time.Millisecond
+	addr, _ := refusingServer(t, 1<<30)
+	c := newTestClient(t, Config{Servers: []string{addr}, Dialer: &net.Dialer{}, HandshakeAck: "OK", DialRounds: 1, DialHold: hold})
+
+	_, logger := c.newConnLogger()
+	start := time.Now()
+	if _, err := c.connectToServer(context.Background(), logger, nil, Tunnel{Handshake: testHandshake}); err == nil {
+		t.Fatal("подключение удалось, хотя сервер отказывал до конца DialHold")
+	}
+	if elapsed := time.Since(start); elapsed < hold || elapsed > hold+time.Second {
+		t.Errorf("ожидание сервера длилось %s, DialHold %s", elapsed, hold)
+	}
+}
+
+func TestMaxHeld(t *testing.T) {
+	addr, attempts := refusingServer(t, 1<<30)
+	c := newTestClient(t, Config{Servers: []string{addr}, Dialer: &net.Dialer{}, HandshakeAck: "OK", DialRounds: 1, DialHold: time.Minute, MaxHeld: 1})
+
+	// Первое подключение ждёт сервера в DialHold
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	held := make(chan error, 1)
+	go func() {
+		_, logger := c.newConnLogger()
+		_, err := c.connectToServer(ctx, logger, nil, Tunnel{Handshake: testHandshake})
+		held <- err
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for c.held.Load() != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("подключение не перешло к ожиданию сервера")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Второму места нет: ошибка сразу после DialRounds
+	before := attempts.Load()
+	_, logger := c.newConnLogger()
+	start := time.Now()
+	if _, err := c.connectToServer(context.Background(), logger, nil, Tunnel{Handshake: testHandshake}); err == nil {
+		t.Fatal("подключение сверх MaxHeld удалось при отказывающем сервере")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("подключение сверх MaxHeld ждало %s", elapsed)
+	}
+	if got := attempts.Load() - before; got < 1 {
+		t.Errorf("подключение сверх MaxHeld не сделало ни одной попытки")
+	}
+
+	cancel()
+	if err := <-held; !errors.Is(err, context.Canceled) {
+		t.Errorf("ждущее подключение после отмены: %v", err)
+	}
+	if got := c.held.Load(); got != 0 {
+		t.Errorf("ждущих подключений %d после отмены", got)
+	}
+}
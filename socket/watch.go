@@ -0,0 +1,213 @@
+package socket
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"usbmuxd-client/muxproto"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// DeviceEventType — тип события устройства
+type DeviceEventType int
+
+const (
+	DeviceAttached DeviceEventType = iota + 1
+	DeviceDetached
+)
+
+func (t DeviceEventType) String() string {
+	switch t {
+	case DeviceAttached:
+		return "attached"
+	case DeviceDetached:
+		return "detached"
+	}
+	return "unknown"
+}
+
+// DeviceEvent — подключение или отключение устройства на удалённом хосте.
+// Для DeviceDetached в Device заполнен только DeviceID.
+type DeviceEvent struct {
+	Type   DeviceEventType
+	Device Device
+}
+
+// WatchDevices подписывается на уведомления usbmuxd через клиента по умолчанию
+func WatchDevices(ctx context.Context) (<-chan DeviceEvent, error) {
+	c, err := defaultClient()
+	if err != nil {
+		return nil, err
+	}
+	return c.WatchDevices(ctx)
+}
+
+// WatchDevices подписывается на уведомления usbmuxd (Listen) и отправляет
+// события в канал. При обрыве соединения подписка восстанавливается
+// с нарастающей паузой; устройства, отключившиеся за время обрыва, приходят
+// событием DeviceDetached, а уже известные подключённые не повторяются.
+// Канал закрывается при отмене ctx.
+func (c *Client) WatchDevices(ctx context.Context) (<-chan DeviceEvent, error) {
+	conn, stop, err := c.subscribe(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	events := make(chan DeviceEvent)
+	w := &deviceWatch{known: map[int]Device{}, events: events}
+	go func() {
+		defer close(events)
+		for {
+			err := w.read(ctx, conn)
+			stop()
+			conn.Close()
+			if ctx.Err() != nil {
+				return
+			}
+			log.WithError(err).Warn("Поток уведомлений usbmuxd прерван, подписываемся заново")
+
+			if conn, stop, err = c.resubscribe(ctx); err != nil {
+				return
+			}
+			log.Info("Подписка на уведомления usbmuxd восстановлена")
+			w.reconcile(ctx, c)
+		}
+	}()
+	return events, nil
+}
+
+// subscribe открывает канал к usbmuxd и подписывается на уведомления
+func (c *Client) subscribe(ctx context.Context) (net.Conn, func() bool, error) {
+	conn, stop, err := c.dialUsbmux(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := listen(conn); err != nil {
+		stop()
+		conn.Close()
+		return nil, nil, contextError(ctx, err)
+	}
+	return conn, stop, nil
+}
+
+// resubscribe повторяет subscribe с нарастающей паузой до успеха или отмены ctx
+func (c *Client) resubscribe(ctx context.Context) (net.Conn, func() bool, error) {
+	delay := retryInitialDelay
+	for {
+		if !sleepContext(ctx, jitter(delay)) {
+			return nil, nil, ctx.Err()
+		}
+		conn, stop, err := c.subscribe(ctx)
+		if err == nil {
+			return conn, stop, nil
+		}
+		if ctx.Err() != nil {
+			return nil, nil, ctx.Err()
+		}
+		log.WithError(err).WithField("delay", delay).Debug("Не удалось подписаться на уведомления usbmuxd")
+		delay = min(delay*2, retryMaxDelay)
+	}
+}
+
+// deviceWatch — состояние подписки: подключённые устройства, о которых уже
+// сообщено, чтобы после переподписки не повторять события
+type deviceWatch struct {
+	known  map[int]Device
+	events chan<- DeviceEvent
+}
+
+// read передаёт события из conn до ошибки чтения или отмены ctx
+func (w *deviceWatch) read(ctx context.Context, conn net.Conn) error {
+	for {
+		pkt, err := muxproto.ReadPacket(conn)
+		if err != nil {
+			return err
+		}
+		event, ok := deviceEvent(pkt.Payload)
+		if !ok {
+			continue
+		}
+		if !w.handle(ctx, event) {
+			return ctx.Err()
+		}
+	}
+}
+
+// handle обновляет список устройств и отправляет событие, если оно новое.
+// Возвращает false, если ctx отменён.
+func (w *deviceWatch) handle(ctx context.Context, event DeviceEvent) bool {
+	id := event.Device.DeviceID
+	switch event.Type {
+	case DeviceAttached:
+		if known, ok := w.known[id]; ok && known == event.Device {
+			return true
+		}
+		w.known[id] = event.Device
+	case DeviceDetached:
+		if _, ok := w.known[id]; !ok {
+			return true
+		}
+		delete(w.known, id)
+	}
+	select {
+	case w.events <- event:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// reconcile сообщает об отключении устройств, пропавших за время обрыва.
+// Подключённые за это время придут уведомлениями Attached новой подписки.
+func (w *deviceWatch) reconcile(ctx context.Context, c *Client) {
+	if len(w.known) == 0 {
+		return
+	}
+	devices, err := c.ListDevices(ctx)
+	if err != nil {
+		log.WithError(err).Warn("Не удалось сверить список устройств после переподписки")
+		return
+	}
+	present := make(map[int]bool, len(devices))
+	for _, d := range devices {
+		present[d.DeviceID] = true
+	}
+	for id := range w.known {
+		if !present[id] {
+			w.handle(ctx, DeviceEvent{Type: DeviceDetached, Device: Device{DeviceID: id}})
+		}
+	}
+}
+
+// listen отправляет запрос Listen и проверяет ответ Result
+func listen(conn io.ReadWriter) error {
+	if err := muxproto.WritePacket(conn, 1, muxproto.NewRequest("Listen", nil)); err != nil {
+		return fmt.Errorf("отправка Listen: %w", err)
+	}
+	pkt, err := muxproto.ReadPacket(conn)
+	if err != nil {
+		return fmt.Errorf("чтение ответа Listen: %w", err)
+	}
+	if number, ok := muxproto.ResultNumber(pkt.Payload); !ok || number != 0 {
+		return fmt.Errorf("usbmuxd отклонил Listen: %v", pkt.Payload)
+	}
+	return nil
+}
+
+// deviceEvent преобразует уведомление usbmuxd в событие
+func deviceEvent(payload map[string]any) (DeviceEvent, bool) {
+	switch muxproto.MessageType(payload) {
+	case muxproto.MessageAttached:
+		d, err := muxproto.ParseDevice(payload)
+		if err != nil {
+			log.WithError(err).Warn("Некорректное уведомление Attached")
+			return DeviceEvent{}, false
+		}
+		return DeviceEvent{Type: DeviceAttached, Device: d}, true
+	case muxproto.MessageDetached:
+		return DeviceEvent{Type: DeviceDetached, Device: Device{DeviceID: muxproto.DeviceID(payload)}}, true
+	}
+	return DeviceEvent{}, false
+}
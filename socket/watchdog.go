@@ -0,0 +1,178 @@
+package socket
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// TunnelHealth — снимок состояния цикла приёма соединений туннеля
+type TunnelHealth struct {
+	LocalAddr  string    `json:"localAddr"`
+	Bound      bool      `json:"bound"`
+	LastAccept time.Time `json:"lastAccept"`
+	Stalled    bool      `json:"stalled"`
+}
+
+// acceptState отслеживает цикл приёма соединений одного туннеля по его
+// пульсу: цикл отмечает возврат в ожидание подключения (waiting) и выход
+// из него (accepted, beat). Цикл, который не ждёт подключения и не
+// отмечался дольше порога, застрял — тем временем новые подключения
+// копятся в очереди слушателя.
+type acceptState struct {
+	mu         sync.Mutex
+	bound      bool
+	lastAccept time.Time
+	lastBeat   time.Time // последний пульс цикла
+	idle       bool      // цикл ждёт нового подключения или свободного слота
+	stalled    bool
+}
+
+// healthRegistry — состояния циклов приёма туннелей клиента по локальному адресу
+type healthRegistry struct {
+	mu     sync.Mutex
+	states map[string]*acceptState
+}
+
+// stateFor возвращает состояние туннеля по его локальному адресу
+func (r *healthRegistry) stateFor(localAddr string) *acceptState {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.states == nil {
+		r.states = map[string]*acceptState{}
+	}
+	st, ok := r.states[localAddr]
+	if !ok {
+		st = &acceptState{}
+		r.states[localAddr] = st
+	}
+	return st
+}
+
+// bound сообщает, привязан ли слушатель туннеля
+func (r *healthRegistry) bound(localAddr string) bool {
+	r.mu.Lock()
+	st := r.states[localAddr]
+	r.mu.Unlock()
+	if st == nil {
+		return false
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.bound
+}
+
+func (s *acceptState) setBound(bound bool) {
+	s.mu.Lock()
+	s.bound = bound
+	s.idle = true
+	s.stalled = s.stalled && bound
+	s.mu.Unlock()
+}
+
+// accepted отмечает принятое соединение: цикл занят до следующего waiting
+func (s *acceptState) accepted() {
+	now := time.Now()
+	s.mu.Lock()
+	s.lastAccept = now
+	s.lastBeat = now
+	s.idle = false
+	s.mu.Unlock()
+}
+
+// beat отмечает выход цикла из ожидания без нового соединения
+// (например, после ошибки Accept): цикл занят до следующего waiting
+func (s *acceptState) beat() {
+	s.mu.Lock()
+	s.lastBeat = time.Now()
+	s.idle = false
+	s.mu.Unlock()
+}
+
+// waiting отмечает возврат цикла в ожидание подключения
+func (s *acceptState) waiting() {
+	s.mu.Lock()
+	s.lastBeat = time.Now()
+	s.idle = true
+	s.mu.Unlock()
+}
+
+// remove забывает состояние удалённого туннеля, чтобы он не оставался в
+// отчёте о состоянии
+func (r *healthRegistry) remove(localAddr string) {
+	r.mu.Lock()
+	delete(r.states, localAddr)
+	r.mu.Unlock()
+}
+
+// Health возвращает состояние всех туннелей клиента, отсортированное по адресу
+func (c *Client) Health() []TunnelHealth {
+	r := &c.health
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	result := make([]TunnelHealth, 0, len(r.states))
+	for addr, st := range r.states {
+		st.mu.Lock()
+		result = append(result, TunnelHealth{
+			LocalAddr:  addr,
+			Bound:      st.bound,
+			LastAccept: st.lastAccept,
+			Stalled:    st.stalled,
+		})
+		st.mu.Unlock()
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].LocalAddr < result[j].LocalAddr })
+	return result
+}
+
+// Health возвращает состояние туннелей клиента по умолчанию
+func Health() []TunnelHealth {
+	c, err := defaultClient()
+	if err != nil {
+		return nil
+	}
+	return c.Health()
+}
+
+// minWatchdogTimeout — наименьший порог зависания: проверка идёт с периодом
+// в половину порога, и слишком малый порог превращает её в холостой цикл
+const minWatchdogTimeout = 100 * time.Millisecond
+
+// watch периодически проверяет, не застрял ли цикл приёма какого-либо
+// туннеля дольше timeout: слушатель привязан, цикл не ждёт подключения, а
+// его последний пульс старше порога. Подключение к серверу и рукопожатие
+// SOCKS5 идут в горутине соединения, так что их повторы и ожидание сервера
+// зависанием не считаются; ожидание слота лимита или пула — тоже.
+func (r *healthRegistry) watch(ctx context.Context, timeout time.Duration) {
+	ticker := time.NewTicker(max(timeout, minWatchdogTimeout) / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		r.mu.Lock()
+		for addr, st := range r.states {
+			st.mu.Lock()
+			stalled := st.bound && !st.idle && time.Since(st.lastBeat) > timeout
+			if stalled && !st.stalled {
+				log.WithFields(log.Fields{
+					"local":     addr,
+					"last_beat": st.lastBeat,
+				}).Warn("Цикл приёма соединений туннеля завис")
+			} else if !stalled && st.stalled {
+				log.WithField("local", addr).Info("Цикл приёма соединений туннеля восстановился")
+			}
+			st.stalled = stalled
+			st.mu.Unlock()
+		}
+		r.mu.Unlock()
+	}
+}
@@ -0,0 +1,55 @@
+package socket
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// dialWebSocket открывает WebSocket-соединение поверх уже установленного
+// TCP-соединения conn. Для wss сначала выполняется TLS-рукопожатие: с
+// настройками USBMUXD_TLS_*, если они заданы, иначе с проверкой сертификата
+// по системным корневым сертификатам. Данные передаются бинарными кадрами,
+// так что handshake и поток байтов идут внутри WebSocket без изменений.
+func (c *Client) dialWebSocket(ctx context.Context, conn net.Conn, u upstream) (net.Conn, error) {
+	if u.scheme == schemeWSS {
+		tlsCfg := c.cfg.TLS
+		if tlsCfg == nil {
+			tlsCfg = &tls.Config{MinVersion: tls.VersionTLS12}
+		}
+		var err error
+		if conn, err = wrapTLS(ctx, conn, tlsCfg, u.host); err != nil {
+			return nil, err
+		}
+	}
+
+	origin := "http://" + net.JoinHostPort(u.host, u.port)
+	if u.scheme == schemeWSS {
+		origin = "https://" + net.JoinHostPort(u.host, u.port)
+	}
+	wsCfg, err := websocket.NewConfig(u.String(), origin)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	// websocket.NewClient не принимает контекст: срок подключения
+	// переносится на соединение и снимается после рукопожатия
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	ws, err := websocket.NewClient(wsCfg, conn)
+	stop()
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("WebSocket-рукопожатие с %s: %w", u, err)
+	}
+	conn.SetDeadline(time.Time{})
+	ws.PayloadType = websocket.BinaryFrame
+	return ws, nil
+}
@@ -0,0 +1,282 @@
+// Package tunnelmux передаёт несколько логических потоков поверх одного
+// соединения с сервером.
+//
+// Формат кадра (все числа — big endian):
+//
+//	смещение  размер  поле
+//	0         4       длина payload
+//	4         4       идентификатор потока
+//	8         1       тип кадра
+//	9         длина   payload
+//
+// Типы кадров:
+//
+//	0 (data)   — данные потока, payload не длиннее MaxPayload
+//	1 (open)   — открытие потока, payload пуст
+//	2 (close)  — отправитель закрыл поток и больше не читает и не пишет
+//	3 (window) — отправитель прочитал данные потока: payload — 4 байта,
+//	             на сколько байт собеседник может отправить больше
+//
+// Потоки, открытые клиентом, имеют нечётные идентификаторы, сервером — чётные.
+// Кадры для неизвестного потока отбрасываются.
+//
+// Управление потоком — по окну на каждый поток: после открытия каждая
+// сторона может отправить в поток не больше Window байт, не подтверждённых
+// кадром window. Получатель подтверждает данные по мере их чтения, так что
+// непрочитанные данные одного потока занимают не больше Window байт памяти,
+// а поток, который никто не читает, останавливает только своего отправителя,
+// не задерживая остальные потоки соединения. Сторона, превысившая окно,
+// нарушает протокол: соединение закрывается.
+package tunnelmux
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+)
+
+// Параметры протокола
+const (
+	HeaderSize = 9
+	MaxPayload = 32 * 1024
+	Window     = 8 * MaxPayload // начальное окно потока в байтах
+)
+
+// Типы кадров
+const (
+	frameData   byte = 0
+	frameOpen   byte = 1
+	frameClose  byte = 2
+	frameWindow byte = 3
+)
+
+// acceptBacklog — число открытых собеседником потоков, ждущих Accept
+const acceptBacklog = 16
+
+// ErrSessionClosed — соединение, поверх которого работают потоки, закрыто
+var ErrSessionClosed = errors.New("мультиплексированное соединение закрыто")
+
+// Session — набор потоков поверх одного соединения
+type Session struct {
+	conn    net.Conn
+	writeMu sync.Mutex
+
+	mu      sync.Mutex
+	streams map[uint32]*Stream
+	nextID  uint32
+	err     error
+
+	accept    chan *Stream
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// Client создаёт сессию на стороне клиента
+func Client(conn net.Conn) *Session {
+	return newSession(conn, 1)
+}
+
+// Server создаёт сессию на стороне сервера
+func Server(conn net.Conn) *Session {
+	return newSession(conn, 2)
+}
+
+func newSession(conn net.Conn, firstID uint32) *Session {
+	s := &Session{
+		conn:    conn,
+		streams: map[uint32]*Stream{},
+		nextID:  firstID,
+		accept:  make(chan *Stream, acceptBacklog),
+		done:    make(chan struct{}),
+	}
+	go s.readLoop()
+	return s
+}
+
+// Open открывает новый поток
+func (s *Session) Open() (*Stream, error) {
+	s.mu.Lock()
+	if s.err != nil {
+		s.mu.Unlock()
+		return nil, s.err
+	}
+	id := s.nextID
+	s.nextID += 2
+	st := newStream(s, id)
+	s.streams[id] = st
+	s.mu.Unlock()
+
+	if err := s.writeFrame(id, frameOpen, nil); err != nil {
+		s.remove(id)
+		return nil, err
+	}
+	return st, nil
+}
+
+// Accept ждёт потока, открытого собеседником
+func (s *Session) Accept() (*Stream, error) {
+	select {
+	case st := <-s.accept:
+		return st, nil
+	case <-s.done:
+		return nil, s.Err()
+	}
+}
+
+// Close закрывает соединение и все потоки
+func (s *Session) Close() error {
+	s.shutdown(ErrSessionClosed)
+	return nil
+}
+
+// Done закрывается, когда сессия завершена
+func (s *Session) Done() <-chan struct{} {
+	return s.done
+}
+
+// Err возвращает причину завершения сессии или nil, если она работает
+func (s *Session) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+// NumStreams возвращает число открытых потоков
+func (s *Session) NumStreams() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.streams)
+}
+
+// shutdown завершает сессию с ошибкой err и закрывает соединение.
+// Потоки получают конец данных, когда readLoop обнаружит закрытие.
+func (s *Session) shutdown(err error) {
+	s.closeOnce.Do(func() {
+		s.mu.Lock()
+		s.err = err
+		s.mu.Unlock()
+
+		s.conn.Close()
+		close(s.done)
+	})
+}
+
+// finishStreams сообщает всем оставшимся потокам об окончании данных.
+// Вызывается readLoop после завершения сессии: новые потоки уже не открываются.
+func (s *Session) finishStreams() {
+	s.mu.Lock()
+	streams := s.streams
+	s.streams = map[uint32]*Stream{}
+	s.mu.Unlock()
+
+	for _, st := range streams {
+		st.remoteClose()
+	}
+}
+
+func (s *Session) remove(id uint32) {
+	s.mu.Lock()
+	delete(s.streams, id)
+	s.mu.Unlock()
+}
+
+func (s *Session) lookup(id uint32) *Stream {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.streams[id]
+}
+
+// writeFrame отправляет один кадр; кадры разных потоков не перемешиваются
+func (s *Session) writeFrame(id uint32, typ byte, payload []byte) error {
+	if len(payload) > MaxPayload {
+		return fmt.Errorf("payload %d байт больше допустимых %d", len(payload), MaxPayload)
+	}
+	buf := make([]byte, HeaderSize+len(payload))
+	binary.BigEndian.PutUint32(buf[0:], uint32(len(payload)))
+	binary.BigEndian.PutUint32(buf[4:], id)
+	buf[8] = typ
+	copy(buf[HeaderSize:], payload)
+
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	if err := s.Err(); err != nil {
+		return err
+	}
+	if _, err := s.conn.Write(buf); err != nil {
+		s.shutdown(err)
+		return err
+	}
+	return nil
+}
+
+// readLoop читает кадры и раскладывает их по потокам до ошибки соединения
+func (s *Session) readLoop() {
+	defer s.finishStreams()
+	header := make([]byte, HeaderSize)
+	for {
+		if _, err := io.ReadFull(s.conn, header); err != nil {
+			s.shutdown(err)
+			return
+		}
+		length := binary.BigEndian.Uint32(header[0:])
+		id := binary.BigEndian.Uint32(header[4:])
+		typ := header[8]
+		if length > MaxPayload {
+			s.shutdown(fmt.Errorf("кадр потока %d: длина %d больше допустимых %d", id, length, MaxPayload))
+			return
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(s.conn, payload); err != nil {
+			s.shutdown(err)
+			return
+		}
+
+		switch typ {
+		case frameData:
+			if st := s.lookup(id); st != nil && len(payload) > 0 && !st.deliver(payload) {
+				s.shutdown(fmt.Errorf("поток %d: собеседник превысил окно в %d байт", id, Window))
+				return
+			}
+		case frameWindow:
+			if length != 4 {
+				s.shutdown(fmt.Errorf("кадр window потока %d: длина %d вместо 4", id, length))
+				return
+			}
+			if st := s.lookup(id); st != nil {
+				st.grow(int(binary.BigEndian.Uint32(payload)))
+			}
+		case frameOpen:
+			s.openRemote(id)
+		case frameClose:
+			if st := s.lookup(id); st != nil {
+				s.remove(id)
+				st.remoteClose()
+			}
+		default:
+			s.shutdown(fmt.Errorf("неизвестный тип кадра %d", typ))
+			return
+		}
+	}
+}
+
+// openRemote регистрирует поток, открытый собеседником. Если очередь
+// Accept заполнена, поток сразу закрывается.
+func (s *Session) openRemote(id uint32) {
+	s.mu.Lock()
+	if _, exists := s.streams[id]; exists {
+		s.mu.Unlock()
+		return
+	}
+	st := newStream(s, id)
+	s.streams[id] = st
+	s.mu.Unlock()
+
+	select {
+	case s.accept <- st:
+	default:
+		st.Close()
+	}
+}
@@ -0,0 +1,147 @@
+package tunnelmux
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// pair создаёт клиентскую и серверную сессии поверх net.Pipe
+func pair(t *testing.T) (client, server *Session) {
+	t.Helper()
+	a, b := net.Pipe()
+	client, server = Client(a), Server(b)
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client, server
+}
+
+// writeRawFrame отправляет кадр в обход Session
+func writeRawFrame(t *testing.T, conn net.Conn, id uint32, typ byte, payload []byte) {
+	t.Helper()
+	buf := make([]byte, HeaderSize+len(payload))
+	binary.BigEndian.PutUint32(buf[0:], uint32(len(payload)))
+	binary.BigEndian.PutUint32(buf[4:], id)
+	buf[8] = typ
+	copy(buf[HeaderSize:], payload)
+	conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write(buf); err != nil {
+		t.Fatalf("запись кадра: %v", err)
+	}
+}
+
+// waitDone ждёт завершения сессии
+func waitDone(t *testing.T, s *Session) {
+	t.Helper()
+	select {
+	case <-s.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("сессия не завершилась")
+	}
+}
+
+func TestInterleavedStreams(t *testing.T) {
+	client, server := pair(t)
+
+	// Сервер возвращает данные каждого потока обратно
+	go func() {
+		for {
+			st, err := server.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer st.Close()
+				io.Copy(st, st)
+			}()
+		}
+	}()
+
+	// Каждый поток передаёт больше окна, чтобы кадры window тоже перемешивались
+	const size = 4 * Window
+	var wg sync.WaitGroup
+	for _, fill := range []byte{'a', 'b'} {
+		st, err := client.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer st.Close()
+		st.SetDeadline(time.Now().Add(10 * time.Second))
+
+		want := bytes.Repeat([]byte{fill}, size)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			go st.Write(want)
+			got := make([]byte, size)
+			if _, err := io.ReadFull(st, got); err != nil {
+				t.Errorf("поток %d: %v", st.ID(), err)
+				return
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("поток %d: получены данные другого потока", st.ID())
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestWindowOverflow(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	server := Server(b)
+	defer server.Close()
+
+	writeRawFrame(t, a, 1, frameOpen, nil)
+	st, err := server.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+
+	// Поток никто не читает: данные сверх окна нарушают протокол
+	chunk := make([]byte, MaxPayload)
+	for range Window / MaxPayload {
+		writeRawFrame(t, a, 1, frameData, chunk)
+	}
+	writeRawFrame(t, a, 1, frameData, []byte{0})
+
+	waitDone(t, server)
+	if err := server.Err(); err == nil || !strings.Contains(err.Error(), "превысил окно") {
+		t.Errorf("сессия завершена с ошибкой %v, ожидалось превышение окна", err)
+	}
+}
+
+func TestSessionCloseEOF(t *testing.T) {
+	client, server := pair(t)
+
+	local, err := client.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	remote, err := server.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client.Close()
+	waitDone(t, server)
+
+	for name, st := range map[string]*Stream{"клиент": local, "сервер": remote} {
+		st.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := st.Read(make([]byte, 1)); !errors.Is(err, io.EOF) {
+			t.Errorf("%s: чтение после закрытия сессии вернуло %v, ожидался EOF", name, err)
+		}
+	}
+	if _, err := client.Open(); !errors.Is(err, ErrSessionClosed) {
+		t.Errorf("Open после Close вернул %v, ожидался ErrSessionClosed", err)
+	}
+}
@@ -0,0 +1,287 @@
+package tunnelmux
+
+import (
+	"encoding/binary"
+	"io"
+	"math"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Stream — логический поток внутри сессии; реализует net.Conn
+type Stream struct {
+	id   uint32
+	sess *Session
+
+	// Приём: кадры данных, ещё не отданные Read
+	recvMu   sync.Mutex
+	recvBuf  [][]byte
+	recvLen  int           // непрочитанных байт, включая pending
+	recvEOF  bool          // собеседник закрыл поток или сессия завершилась
+	unacked  int           // прочитано, но ещё не подтверждено кадром window
+	recvWake chan struct{} // сигнал читателю о новых данных
+	pending  []byte        // непрочитанный остаток текущего кадра
+
+	// Отправка: сколько байт ещё можно отправить собеседнику
+	sendMu   sync.Mutex
+	sendWin  int
+	sendWake chan struct{} // сигнал писателю о расширении окна
+
+	closed     chan struct{} // закрывается локальным Close
+	closeOnce  sync.Once
+	remoteOnce sync.Once
+
+	readDeadline  deadline
+	writeDeadline deadline
+}
+
+func newStream(sess *Session, id uint32) *Stream {
+	return &Stream{
+		id:       id,
+		sess:     sess,
+		recvWake: make(chan struct{}, 1),
+		sendWin:  Window,
+		sendWake: make(chan struct{}, 1),
+		closed:   make(chan struct{}),
+	}
+}
+
+// wake будит ожидающего на канале ch, не блокируясь
+func wake(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// ID возвращает идентификатор потока
+func (st *Stream) ID() uint32 {
+	return st.id
+}
+
+// deliver передаёт кадр данных читателю, не блокируясь. false — собеседник
+// превысил окно. Вызывается только из readLoop.
+func (st *Stream) deliver(payload []byte) bool {
+	st.recvMu.Lock()
+	defer st.recvMu.Unlock()
+	if st.recvLen+len(payload) > Window {
+		return false
+	}
+	st.recvBuf = append(st.recvBuf, payload)
+	st.recvLen += len(payload)
+	wake(st.recvWake)
+	return true
+}
+
+// grow расширяет окно отправки на n байт по кадру window собеседника
+func (st *Stream) grow(n int) {
+	st.sendMu.Lock()
+	st.sendWin = min(st.sendWin+n, math.MaxInt32)
+	st.sendMu.Unlock()
+	wake(st.sendWake)
+}
+
+// remoteClose отмечает, что собеседник закрыл поток или сессия завершилась.
+// Вызывается только из readLoop, после последнего deliver.
+func (st *Stream) remoteClose() {
+	st.remoteOnce.Do(func() {
+		st.recvMu.Lock()
+		st.recvEOF = true
+		st.recvMu.Unlock()
+		wake(st.recvWake)
+		wake(st.sendWake)
+	})
+}
+
+func (st *Stream) isRemoteClosed() bool {
+	st.recvMu.Lock()
+	defer st.recvMu.Unlock()
+	return st.recvEOF
+}
+
+func (st *Stream) Read(p []byte) (int, error) {
+	for len(st.pending) == 0 {
+		select {
+		case <-st.closed:
+			return 0, net.ErrClosed
+		default:
+		}
+		st.recvMu.Lock()
+		if len(st.recvBuf) > 0 {
+			st.pending = st.recvBuf[0]
+			st.recvBuf = st.recvBuf[1:]
+			st.recvMu.Unlock()
+			break
+		}
+		eof := st.recvEOF
+		st.recvMu.Unlock()
+		if eof {
+			return 0, io.EOF
+		}
+
+		select {
+		case <-st.recvWake:
+		case <-st.closed:
+			return 0, net.ErrClosed
+		case <-st.readDeadline.wait():
+			return 0, os.ErrDeadlineExceeded
+		}
+	}
+	n := copy(p, st.pending)
+	st.pending = st.pending[n:]
+	st.consumed(n)
+	return n, nil
+}
+
+// consumed освобождает n прочитанных байт окна и, когда их набралось на
+// половину окна, подтверждает их собеседнику
+func (st *Stream) consumed(n int) {
+	st.recvMu.Lock()
+	st.recvLen -= n
+	st.unacked += n
+	ack := 0
+	if st.unacked >= Window/2 && !st.recvEOF {
+		ack, st.unacked = st.unacked, 0
+	}
+	st.recvMu.Unlock()
+	if ack > 0 {
+		payload := make([]byte, 4)
+		binary.BigEndian.PutUint32(payload, uint32(ack))
+		st.sess.writeFrame(st.id, frameWindow, payload)
+	}
+}
+
+// reserve ждёт, пока окно отправки откроется, и занимает в нём до want байт
+func (st *Stream) reserve(want int) (int, error) {
+	for {
+		if st.isRemoteClosed() {
+			return 0, io.ErrClosedPipe
+		}
+		st.sendMu.Lock()
+		if st.sendWin > 0 {
+			n := min(want, st.sendWin)
+			st.sendWin -= n
+			st.sendMu.Unlock()
+			return n, nil
+		}
+		st.sendMu.Unlock()
+
+		select {
+		case <-st.sendWake:
+		case <-st.closed:
+			return 0, net.ErrClosed
+		case <-st.sess.done:
+			return 0, st.sess.Err()
+		case <-st.writeDeadline.wait():
+			return 0, os.ErrDeadlineExceeded
+		}
+	}
+}
+
+func (st *Stream) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		select {
+		case <-st.closed:
+			return written, net.ErrClosed
+		case <-st.writeDeadline.wait():
+			return written, os.ErrDeadlineExceeded
+		default:
+		}
+		n, err := st.reserve(min(len(p), MaxPayload))
+		if err != nil {
+			return written, err
+		}
+		chunk := p[:n]
+		if err := st.sess.writeFrame(st.id, frameData, chunk); err != nil {
+			return written, err
+		}
+		written += len(chunk)
+		p = p[len(chunk):]
+	}
+	return written, nil
+}
+
+// Close закрывает поток и сообщает об этом собеседнику
+func (st *Stream) Close() error {
+	st.closeOnce.Do(func() {
+		close(st.closed)
+		st.sess.remove(st.id)
+		if !st.isRemoteClosed() {
+			st.sess.writeFrame(st.id, frameClose, nil)
+		}
+	})
+	return nil
+}
+
+func (st *Stream) LocalAddr() net.Addr  { return st.sess.conn.LocalAddr() }
+func (st *Stream) RemoteAddr() net.Addr { return st.sess.conn.RemoteAddr() }
+
+func (st *Stream) SetDeadline(t time.Time) error {
+	st.readDeadline.set(t)
+	st.writeDeadline.set(t)
+	return nil
+}
+
+func (st *Stream) SetReadDeadline(t time.Time) error {
+	st.readDeadline.set(t)
+	return nil
+}
+
+func (st *Stream) SetWriteDeadline(t time.Time) error {
+	st.writeDeadline.set(t)
+	return nil
+}
+
+// deadline — срок операции; канал wait закрывается при его наступлении
+type deadline struct {
+	mu    sync.Mutex
+	timer *time.Timer
+	ch    chan struct{}
+}
+
+func (d *deadline) set(t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.timer != nil {
+		d.timer.Stop()
+		d.timer = nil
+	}
+	if d.ch == nil || isClosed(d.ch) {
+		d.ch = make(chan struct{})
+	}
+	if t.IsZero() {
+		return
+	}
+	ch := d.ch
+	if dur := time.Until(t); dur > 0 {
+		d.timer = time.AfterFunc(dur, func() {
+			d.mu.Lock()
+			if d.ch == ch && !isClosed(ch) {
+				close(ch)
+			}
+			d.mu.Unlock()
+		})
+		return
+	}
+	close(ch)
+}
+
+// wait возвращает канал текущего срока; nil-канал никогда не закрывается
+func (d *deadline) wait() <-chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.ch
+}
+
+func isClosed(ch chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}